@@ -0,0 +1,378 @@
+package arrowx
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/decimal256"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+	parquetpb "github.com/streamingfast/substreams-sink-files/v2/pb/parquet"
+	"github.com/streamingfast/substreams-sink-files/v2/protox"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// decimal256Precision is the precision of the decimals holding UINT256 and INT256 columns,
+// the maximum precision of Arrow's 256 bits decimals like Parquet's DECIMAL(76, 0).
+const decimal256Precision = 76
+
+// Table is the Arrow schema derived from a Protobuf message descriptor, it appends messages
+// of this descriptor as rows to record builders.
+//
+// Fields marked with the `(parquet.ignored)` option are skipped like they are for Parquet.
+// Protobuf types are mapped as follows:
+//   - scalars map to the Arrow type of the same width and signedness, string to utf8 and
+//     bytes to binary
+//   - enums map to a dictionary of int32 indices and utf8 values, the dictionary holding
+//     the names of all the enum values in their declaration order
+//   - google.protobuf.Timestamp maps to timestamp[ns, tz=UTC]
+//   - string fields with the `(parquet.column)` UINT256 or INT256 type map to decimal256(76, 0)
+//   - messages map to structs, repeated fields to lists and map fields to maps
+//
+// Fields with presence, like message fields and 'optional' ones, are nullable. Recursive
+// messages have no Arrow representation and are rejected.
+type Table struct {
+	schema  *arrow.Schema
+	columns []fieldAppender
+	// dictionaries are the values of the dictionary types of enums
+	dictionaries map[*arrow.DictionaryType]*array.String
+}
+
+// fieldAppender appends the value of a field of the message to the field's builder.
+type fieldAppender func(builder array.Builder, message protoreflect.Message) error
+
+// valueAppender appends a single value to a builder, elements for repeated fields and keys
+// or values for map fields.
+type valueAppender func(builder array.Builder, value protoreflect.Value) error
+
+// TableFromMessageDescriptor returns the Arrow table of the message descriptor.
+func TableFromMessageDescriptor(descriptor protoreflect.MessageDescriptor) (*Table, error) {
+	builder := &schemaBuilder{dictionaries: map[*arrow.DictionaryType]*array.String{}}
+
+	fields, appenders, err := builder.messageFields(descriptor, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Table{
+		schema:       arrow.NewSchema(fields, nil),
+		columns:      appenders,
+		dictionaries: builder.dictionaries,
+	}, nil
+}
+
+// Schema returns the Arrow schema of the table.
+func (t *Table) Schema() *arrow.Schema {
+	return t.schema
+}
+
+// NewRecordBuilder returns a record builder of the table's schema whose enum dictionaries
+// hold all the values of their enum, so that the records built have the same dictionaries,
+// as the Arrow IPC file format requires, even if they hold different enum values.
+func (t *Table) NewRecordBuilder(allocator memory.Allocator) (*array.RecordBuilder, error) {
+	builder := array.NewRecordBuilder(allocator, t.schema)
+	for i := range t.schema.NumFields() {
+		if err := t.initDictionaries(builder.Field(i)); err != nil {
+			builder.Release()
+			return nil, fmt.Errorf("column %q: %w", t.schema.Field(i).Name, err)
+		}
+	}
+
+	return builder, nil
+}
+
+func (t *Table) initDictionaries(builder array.Builder) error {
+	switch builder := builder.(type) {
+	case *array.BinaryDictionaryBuilder:
+		return builder.InsertStringDictValues(t.dictionaries[builder.Type().(*arrow.DictionaryType)])
+	case *array.ListBuilder:
+		return t.initDictionaries(builder.ValueBuilder())
+	case *array.MapBuilder:
+		return t.initDictionaries(builder.ItemBuilder())
+	case *array.StructBuilder:
+		for i := range builder.NumField() {
+			if err := t.initDictionaries(builder.FieldBuilder(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Append appends the message as a row of the record builder, which must have been created
+// by NewRecordBuilder. On error, the builder is left with a partially appended row.
+func (t *Table) Append(builder *array.RecordBuilder, message protoreflect.Message) error {
+	for i, column := range t.columns {
+		if err := column(builder.Field(i), message); err != nil {
+			return fmt.Errorf("column %q: %w", t.schema.Field(i).Name, err)
+		}
+	}
+
+	return nil
+}
+
+// schemaBuilder builds the Arrow fields of a message along with the appending of their
+// values, keeping the values of the enum dictionaries met.
+type schemaBuilder struct {
+	dictionaries map[*arrow.DictionaryType]*array.String
+}
+
+// messageFields returns the Arrow fields of the message, seen being the messages enclosing
+// it used to detect recursion.
+func (s *schemaBuilder) messageFields(descriptor protoreflect.MessageDescriptor, seen []protoreflect.FullName) (out []arrow.Field, appenders []fieldAppender, err error) {
+	for _, name := range seen {
+		if name == descriptor.FullName() {
+			return nil, nil, fmt.Errorf("recursive message %q cannot be represented in Arrow", descriptor.FullName())
+		}
+	}
+	seen = append(seen, descriptor.FullName())
+
+	fields := descriptor.Fields()
+	for i := range fields.Len() {
+		field := fields.Get(i)
+		if parquetx.IsFieldIgnored(field) {
+			continue
+		}
+
+		arrowField, appender, err := s.messageField(field, seen)
+		if err != nil {
+			return nil, nil, fmt.Errorf("field %q: %w", field.FullName(), err)
+		}
+
+		out = append(out, arrowField)
+		appenders = append(appenders, appender)
+	}
+
+	return out, appenders, nil
+}
+
+func (s *schemaBuilder) messageField(field protoreflect.FieldDescriptor, seen []protoreflect.FullName) (out arrow.Field, appender fieldAppender, err error) {
+	out = arrow.Field{Name: string(field.Name())}
+
+	if field.IsMap() {
+		keyType, appendKey, err := s.valueType(field.MapKey(), seen)
+		if err != nil {
+			return out, nil, fmt.Errorf("map key: %w", err)
+		}
+
+		itemType, appendItem, err := s.valueType(field.MapValue(), seen)
+		if err != nil {
+			return out, nil, fmt.Errorf("map value: %w", err)
+		}
+
+		out.Type = arrow.MapOf(keyType, itemType)
+		return out, func(builder array.Builder, message protoreflect.Message) (err error) {
+			mapBuilder := builder.(*array.MapBuilder)
+			mapBuilder.Append(true)
+
+			message.Get(field).Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				if err = appendKey(mapBuilder.KeyBuilder(), key.Value()); err != nil {
+					return false
+				}
+				if err = appendItem(mapBuilder.ItemBuilder(), value); err != nil {
+					err = fmt.Errorf("key %q: %w", key.String(), err)
+					return false
+				}
+				return true
+			})
+
+			return err
+		}, nil
+	}
+
+	elementType, appendValue, err := s.valueType(field, seen)
+	if err != nil {
+		return out, nil, err
+	}
+
+	switch {
+	case field.IsList():
+		out.Type = arrow.ListOfNonNullable(elementType)
+		return out, func(builder array.Builder, message protoreflect.Message) error {
+			listBuilder := builder.(*array.ListBuilder)
+			listBuilder.Append(true)
+
+			list := message.Get(field).List()
+			for i := range list.Len() {
+				if err := appendValue(listBuilder.ValueBuilder(), list.Get(i)); err != nil {
+					return fmt.Errorf("index %d: %w", i, err)
+				}
+			}
+
+			return nil
+		}, nil
+
+	case field.HasPresence():
+		out.Type = elementType
+		out.Nullable = true
+		return out, func(builder array.Builder, message protoreflect.Message) error {
+			if !message.Has(field) {
+				builder.AppendNull()
+				return nil
+			}
+
+			return appendValue(builder, message.Get(field))
+		}, nil
+	}
+
+	out.Type = elementType
+	return out, func(builder array.Builder, message protoreflect.Message) error {
+		return appendValue(builder, message.Get(field))
+	}, nil
+}
+
+// valueType returns the Arrow type of a single value of the field along with how its
+// values are appended.
+func (s *schemaBuilder) valueType(field protoreflect.FieldDescriptor, seen []protoreflect.FullName) (arrow.DataType, valueAppender, error) {
+	if columnType, ok := parquetx.GetFieldColumnType(field); ok {
+		return columnValueType(field, columnType)
+	}
+
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return arrow.FixedWidthTypes.Boolean, func(b array.Builder, v protoreflect.Value) error {
+			b.(*array.BooleanBuilder).Append(v.Bool())
+			return nil
+		}, nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return arrow.PrimitiveTypes.Int32, func(b array.Builder, v protoreflect.Value) error {
+			b.(*array.Int32Builder).Append(int32(v.Int()))
+			return nil
+		}, nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return arrow.PrimitiveTypes.Int64, func(b array.Builder, v protoreflect.Value) error {
+			b.(*array.Int64Builder).Append(v.Int())
+			return nil
+		}, nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return arrow.PrimitiveTypes.Uint32, func(b array.Builder, v protoreflect.Value) error {
+			b.(*array.Uint32Builder).Append(uint32(v.Uint()))
+			return nil
+		}, nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return arrow.PrimitiveTypes.Uint64, func(b array.Builder, v protoreflect.Value) error {
+			b.(*array.Uint64Builder).Append(v.Uint())
+			return nil
+		}, nil
+	case protoreflect.FloatKind:
+		return arrow.PrimitiveTypes.Float32, func(b array.Builder, v protoreflect.Value) error {
+			b.(*array.Float32Builder).Append(float32(v.Float()))
+			return nil
+		}, nil
+	case protoreflect.DoubleKind:
+		return arrow.PrimitiveTypes.Float64, func(b array.Builder, v protoreflect.Value) error {
+			b.(*array.Float64Builder).Append(v.Float())
+			return nil
+		}, nil
+	case protoreflect.StringKind:
+		return arrow.BinaryTypes.String, func(b array.Builder, v protoreflect.Value) error {
+			b.(*array.StringBuilder).Append(v.String())
+			return nil
+		}, nil
+	case protoreflect.BytesKind:
+		return arrow.BinaryTypes.Binary, func(b array.Builder, v protoreflect.Value) error {
+			b.(*array.BinaryBuilder).Append(v.Bytes())
+			return nil
+		}, nil
+
+	case protoreflect.EnumKind:
+		enum := field.Enum()
+		dictionaryType := &arrow.DictionaryType{IndexType: arrow.PrimitiveTypes.Int32, ValueType: arrow.BinaryTypes.String}
+
+		values := array.NewStringBuilder(memory.DefaultAllocator)
+		defer values.Release()
+		for i := range enum.Values().Len() {
+			values.Append(protox.EnumValueToString(enum.Values().Get(i)))
+		}
+		s.dictionaries[dictionaryType] = values.NewStringArray()
+
+		return dictionaryType, func(b array.Builder, v protoreflect.Value) error {
+			value := enum.Values().ByNumber(v.Enum())
+			if value == nil {
+				return fmt.Errorf("enum value %d is not a valid enumeration value for field '%s', known enum values are [%s]", v.Enum(), field.Name(), protox.EnumKnownValuesDebugString(enum))
+			}
+
+			return b.(*array.BinaryDictionaryBuilder).AppendString(protox.EnumValueToString(value))
+		}, nil
+
+	case protoreflect.MessageKind:
+		if protox.IsWellKnownTimestampField(field) {
+			return &arrow.TimestampType{Unit: arrow.Nanosecond, TimeZone: "UTC"}, func(b array.Builder, v protoreflect.Value) error {
+				b.(*array.TimestampBuilder).Append(arrow.Timestamp(protox.DynamicAsTimestampTime(v.Message()).UnixNano()))
+				return nil
+			}, nil
+		}
+
+		if protox.IsWellKnownGoogleField(field) {
+			return nil, nil, fmt.Errorf("well-known google type %s is not supported yet", field.Message().FullName())
+		}
+
+		fields, appenders, err := s.messageFields(field.Message(), seen)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return arrow.StructOf(fields...), func(b array.Builder, v protoreflect.Value) error {
+			structBuilder := b.(*array.StructBuilder)
+			structBuilder.Append(true)
+
+			for i, appender := range appenders {
+				if err := appender(structBuilder.FieldBuilder(i), v.Message()); err != nil {
+					return fmt.Errorf("field %q: %w", fields[i].Name, err)
+				}
+			}
+
+			return nil
+		}, nil
+	}
+
+	return nil, nil, fmt.Errorf("kind %s is not supported yet", field.Kind())
+}
+
+// columnValueType returns the Arrow type of fields with a `(parquet.column)` type, both
+// UINT256 and INT256 being decimal256(76, 0) values parsed from decimal or '0x' prefixed
+// hexadecimal strings.
+func columnValueType(field protoreflect.FieldDescriptor, columnType parquetpb.ColumnType) (arrow.DataType, valueAppender, error) {
+	if field.Kind() != protoreflect.StringKind {
+		return nil, nil, fmt.Errorf("unsupported conversion from field kind %s to column value of type %s", field.Kind(), columnType)
+	}
+
+	switch columnType {
+	case parquetpb.ColumnType_INT256, parquetpb.ColumnType_UINT256:
+		signed := columnType == parquetpb.ColumnType_INT256
+
+		return &arrow.Decimal256Type{Precision: decimal256Precision, Scale: 0}, func(b array.Builder, v protoreflect.Value) error {
+			number, err := parseDecimal256(v.String(), signed)
+			if err != nil {
+				return err
+			}
+
+			b.(*array.Decimal256Builder).Append(number)
+			return nil
+		}, nil
+	}
+
+	return nil, nil, fmt.Errorf("column type %s is not supported yet", columnType)
+}
+
+func parseDecimal256(in string, signed bool) (out decimal256.Num, err error) {
+	number, ok := new(big.Int).SetString(in, 0)
+	if !ok {
+		return out, fmt.Errorf("converting string %q to big.Int", in)
+	}
+
+	if !signed && (number.Sign() < 0 || strings.HasPrefix(in, "+")) {
+		return out, fmt.Errorf("converting string %q to uint256: not an unsigned number", in)
+	}
+
+	out = decimal256.FromBigInt(number)
+	if !out.FitsInPrecision(decimal256Precision) {
+		return out, fmt.Errorf("converting string %q to decimal256: number has more than %d digits", in, decimal256Precision)
+	}
+
+	return out, nil
+}
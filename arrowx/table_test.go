@@ -0,0 +1,215 @@
+package arrowx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestTableFromMessageDescriptor(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   protoreflect.MessageDescriptor
+		fields []string
+	}{
+		{
+			"all types",
+			(&pbtesting.Row{}).ProtoReflect().Descriptor(),
+			[]string{
+				"typeString: utf8", "typeInt32: int32", "typeInt64: int64", "typeUint32: uint32", "typeUint64: uint64",
+				"typeSint32: int32", "typeSint64: int64", "typeFixed32: uint32", "typeFixed64: uint64", "typeSfixed32: int32",
+				"typeSfixed64: int64", "typeFloat: float32", "typeDouble: float64", "typeBool: bool", "typeBytes: binary",
+				"typeTimestamp: timestamp[ns, tz=UTC], nullable",
+			},
+		},
+		{
+			"optional field",
+			(&pbtesting.RowColumnSandwichedOptional{}).ProtoReflect().Descriptor(),
+			[]string{"prefix: utf8", "value: utf8, nullable", "suffix: utf8"},
+		},
+		{
+			"enum field",
+			(&pbtesting.RowColumEnumInside{}).ProtoReflect().Descriptor(),
+			[]string{"value: dictionary<values=utf8, indices=int32, ordered=false>"},
+		},
+		{
+			"column type",
+			(&pbtesting.RowColumnTypeInt256{}).ProtoReflect().Descriptor(),
+			[]string{"positive: decimal256(76, 0)", "negative: decimal256(76, 0)"},
+		},
+		{
+			"nested message",
+			(&pbtesting.RowColumnNestedMessage{}).ProtoReflect().Descriptor(),
+			[]string{"nested: struct<value: utf8>, nullable"},
+		},
+		{
+			"repeated nested message",
+			(&pbtesting.RowColumnRepeatedNestedMessage{}).ProtoReflect().Descriptor(),
+			[]string{"nested: list<item: struct<value: utf8>>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := TableFromMessageDescriptor(tt.args)
+			require.NoError(t, err)
+
+			var fields []string
+			for _, field := range table.Schema().Fields() {
+				description := field.Name + ": " + field.Type.String()
+				if field.Nullable {
+					description += ", nullable"
+				}
+				fields = append(fields, description)
+			}
+
+			assert.Equal(t, tt.fields, fields)
+		})
+	}
+}
+
+func TestTableFromMessageDescriptor_Recursive(t *testing.T) {
+	_, err := TableFromMessageDescriptor(recursiveMessageDescriptor(t))
+	assert.EqualError(t, err, `field "test.Node.child": recursive message "test.Node" cannot be represented in Arrow`)
+}
+
+func TestTable_Append(t *testing.T) {
+	t.Run("all types", func(t *testing.T) {
+		timestamp := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+		record := appendRows(t, (&pbtesting.Row{}).ProtoReflect().Descriptor(),
+			&pbtesting.Row{TypeString: "abc", TypeInt32: -1, TypeUint64: 2, TypeFloat: 1.5, TypeBool: true, TypeBytes: []byte{0x01}, TypeTimestamp: timestamppb.New(timestamp)},
+			&pbtesting.Row{TypeString: "def"},
+		)
+
+		assert.Equal(t, int64(2), record.NumRows())
+		assert.Equal(t, "abc", column[*array.String](t, record, "typeString").Value(0))
+		assert.Equal(t, int32(-1), column[*array.Int32](t, record, "typeInt32").Value(0))
+		assert.Equal(t, uint64(2), column[*array.Uint64](t, record, "typeUint64").Value(0))
+		assert.Equal(t, float32(1.5), column[*array.Float32](t, record, "typeFloat").Value(0))
+		assert.True(t, column[*array.Boolean](t, record, "typeBool").Value(0))
+		assert.Equal(t, []byte{0x01}, column[*array.Binary](t, record, "typeBytes").Value(0))
+
+		timestamps := column[*array.Timestamp](t, record, "typeTimestamp")
+		assert.Equal(t, arrow.Timestamp(timestamp.UnixNano()), timestamps.Value(0))
+		assert.True(t, timestamps.IsNull(1))
+	})
+
+	t.Run("enum", func(t *testing.T) {
+		record := appendRows(t, (&pbtesting.RowColumEnumInside{}).ProtoReflect().Descriptor(),
+			&pbtesting.RowColumEnumInside{Value: pbtesting.RowColumEnumInside_SECOND},
+		)
+
+		values := column[*array.Dictionary](t, record, "value")
+		assert.Equal(t, "SECOND", values.ValueStr(0))
+		assert.Equal(t, `["UNKNOWN" "FIRST" "SECOND"]`, values.Dictionary().String())
+	})
+
+	t.Run("int256", func(t *testing.T) {
+		record := appendRows(t, (&pbtesting.RowColumnTypeInt256{}).ProtoReflect().Descriptor(),
+			&pbtesting.RowColumnTypeInt256{Positive: "0xff", Negative: "-12345678901234567890123456789"},
+		)
+
+		assert.Equal(t, "255", column[*array.Decimal256](t, record, "positive").ValueStr(0))
+		assert.Equal(t, "-12345678901234567890123456789", column[*array.Decimal256](t, record, "negative").ValueStr(0))
+	})
+
+	t.Run("uint256 negative", func(t *testing.T) {
+		table, err := TableFromMessageDescriptor((&pbtesting.RowColumnTypeUint256{}).ProtoReflect().Descriptor())
+		require.NoError(t, err)
+
+		builder, err := table.NewRecordBuilder(memory.NewGoAllocator())
+		require.NoError(t, err)
+		defer builder.Release()
+
+		err = table.Append(builder, (&pbtesting.RowColumnTypeUint256{Amount: "-1"}).ProtoReflect())
+		assert.EqualError(t, err, `column "amount": converting string "-1" to uint256: not an unsigned number`)
+	})
+
+	t.Run("repeated nested message", func(t *testing.T) {
+		record := appendRows(t, (&pbtesting.RowColumnRepeatedNestedMessage{}).ProtoReflect().Descriptor(),
+			&pbtesting.RowColumnRepeatedNestedMessage{Nested: []*pbtesting.Nested{{Value: "a"}, {Value: "b"}}},
+		)
+
+		list := column[*array.List](t, record, "nested")
+		assert.Equal(t, `[{"value":"a"},{"value":"b"}]`, list.ValueStr(0))
+	})
+}
+
+func appendRows(t *testing.T, descriptor protoreflect.MessageDescriptor, messages ...proto.Message) arrow.Record {
+	t.Helper()
+
+	table, err := TableFromMessageDescriptor(descriptor)
+	require.NoError(t, err)
+
+	builder, err := table.NewRecordBuilder(memory.NewGoAllocator())
+	require.NoError(t, err)
+	defer builder.Release()
+
+	for _, message := range messages {
+		require.NoError(t, table.Append(builder, message.ProtoReflect()))
+	}
+
+	return builder.NewRecord()
+}
+
+func column[T arrow.Array](t *testing.T, record arrow.Record, name string) T {
+	t.Helper()
+
+	indices := record.Schema().FieldIndices(name)
+	require.Len(t, indices, 1)
+
+	return record.Column(indices[0]).(T)
+}
+
+// recursiveMessageDescriptor returns the descriptor of a message referring to itself:
+//
+//	message Node {
+//	  string id = 1;
+//	  Node child = 2;
+//	  repeated Node children = 3;
+//	  map<string, int64> labels = 4;
+//	}
+func recursiveMessageDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	message := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("node.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Node"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("id"), JsonName: proto.String("id"), Number: proto.Int32(1), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+				{Name: proto.String("child"), JsonName: proto.String("child"), Number: proto.Int32(2), Label: optional, Type: message, TypeName: proto.String(".test.Node")},
+				{Name: proto.String("children"), JsonName: proto.String("children"), Number: proto.Int32(3), Label: repeated, Type: message, TypeName: proto.String(".test.Node")},
+				{Name: proto.String("labels"), JsonName: proto.String("labels"), Number: proto.Int32(4), Label: repeated, Type: message, TypeName: proto.String(".test.Node.LabelsEntry")},
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("LabelsEntry"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("key"), JsonName: proto.String("key"), Number: proto.Int32(1), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+					{Name: proto.String("value"), JsonName: proto.String("value"), Number: proto.Int32(2), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()},
+				},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}},
+		}},
+	}, nil)
+	require.NoError(t, err)
+
+	return file.Messages().ByName("Node")
+}
@@ -0,0 +1,370 @@
+package avrox
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/hamba/avro/v2"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+	parquetpb "github.com/streamingfast/substreams-sink-files/v2/pb/parquet"
+	"github.com/streamingfast/substreams-sink-files/v2/protox"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Record is the Avro record schema derived from a Protobuf message descriptor, it encodes
+// messages of this descriptor as Avro binary data.
+//
+// Fields marked with the `(parquet.ignored)` option are skipped like they are for Parquet.
+// Protobuf types are mapped as follows:
+//   - bool, int32, int64, float, double, string and bytes map to their Avro counterpart
+//   - uint32 maps to long, uint64 maps to bytes with the decimal(20, 0) logical type
+//   - string fields with a `(parquet.column)` type UINT256 or INT256 map to bytes with the
+//     decimal(76, 0) logical type, values being parsed from decimal or '0x' prefixed
+//     hexadecimal strings
+//   - enums map to an Avro enum of their value names
+//   - google.protobuf.Timestamp maps to long with the timestamp-micros logical type
+//   - messages map to records, repeated fields to arrays and maps to Avro maps whose
+//     keys are the text representation of the Protobuf keys
+//
+// Fields with presence, like message fields and 'optional' ones, are a union of null and
+// their type defaulting to null.
+type Record struct {
+	schema  *avro.RecordSchema
+	message *messageType
+}
+
+// messageType is how a message is converted to the generic value of its Avro record.
+type messageType struct {
+	fields []*fieldType
+}
+
+type fieldType struct {
+	descriptor protoreflect.FieldDescriptor
+	// nullBranch is the name of the non null type of the field's union, empty when the
+	// field has no presence
+	nullBranch string
+	// value converts a single value of the field, elements for repeated fields and
+	// values for map fields
+	value func(protoreflect.Value) (any, error)
+}
+
+// RecordFromMessageDescriptor returns the Avro record of the message descriptor.
+func RecordFromMessageDescriptor(descriptor protoreflect.MessageDescriptor) (*Record, error) {
+	builder := &recordBuilder{
+		messages: map[protoreflect.FullName]*messageType{},
+		enums:    map[protoreflect.FullName]bool{},
+	}
+
+	definition, message, err := builder.message(descriptor)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := json.Marshal(definition)
+	if err != nil {
+		return nil, fmt.Errorf("marshal schema: %w", err)
+	}
+
+	// Each record gets its own cache, tables are independent schemas that may define the
+	// same names
+	schema, err := avro.ParseBytesWithCache(content, "", &avro.SchemaCache{})
+	if err != nil {
+		return nil, fmt.Errorf("parse schema: %w", err)
+	}
+
+	return &Record{schema: schema.(*avro.RecordSchema), message: message}, nil
+}
+
+// Schema returns the Avro schema of the record.
+func (r *Record) Schema() *avro.RecordSchema {
+	return r.schema
+}
+
+// Marshal returns the Avro binary encoding of the message.
+func (r *Record) Marshal(message protoreflect.Message) ([]byte, error) {
+	value, err := r.message.record(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return avro.Marshal(r.schema, value)
+}
+
+func (m *messageType) record(message protoreflect.Message) (map[string]any, error) {
+	out := make(map[string]any, len(m.fields))
+	for _, field := range m.fields {
+		value, err := field.fieldValue(message)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", field.descriptor.Name(), err)
+		}
+
+		out[string(field.descriptor.Name())] = value
+	}
+
+	return out, nil
+}
+
+func (f *fieldType) fieldValue(message protoreflect.Message) (any, error) {
+	value := message.Get(f.descriptor)
+
+	switch {
+	case f.descriptor.IsMap():
+		entries := value.Map()
+		out := make(map[string]any, entries.Len())
+
+		var err error
+		entries.Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+			var entry any
+			if entry, err = f.value(value); err != nil {
+				err = fmt.Errorf("key %q: %w", key.String(), err)
+				return false
+			}
+
+			out[key.String()] = entry
+			return true
+		})
+
+		return out, err
+
+	case f.descriptor.IsList():
+		list := value.List()
+		out := make([]any, list.Len())
+		for i := range list.Len() {
+			element, err := f.value(list.Get(i))
+			if err != nil {
+				return nil, fmt.Errorf("index %d: %w", i, err)
+			}
+
+			out[i] = element
+		}
+
+		return out, nil
+
+	case f.nullBranch != "":
+		if !message.Has(f.descriptor) {
+			return nil, nil
+		}
+
+		out, err := f.value(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]any{f.nullBranch: out}, nil
+	}
+
+	return f.value(value)
+}
+
+// recordBuilder builds the JSON definition of a record schema along with the conversion
+// of its messages. Named types are defined the first time they are met and referred to
+// by name afterward, which is how recursive messages are supported.
+type recordBuilder struct {
+	messages map[protoreflect.FullName]*messageType
+	enums    map[protoreflect.FullName]bool
+}
+
+func (b *recordBuilder) message(descriptor protoreflect.MessageDescriptor) (definition any, message *messageType, err error) {
+	if message, found := b.messages[descriptor.FullName()]; found {
+		return string(descriptor.FullName()), message, nil
+	}
+
+	message = &messageType{}
+	b.messages[descriptor.FullName()] = message
+
+	fields := descriptor.Fields()
+	fieldDefinitions := make([]any, 0, fields.Len())
+	for i := range fields.Len() {
+		field := fields.Get(i)
+		if parquetx.IsFieldIgnored(field) {
+			continue
+		}
+
+		fieldDefinition, fieldType, err := b.field(field)
+		if err != nil {
+			return nil, nil, fmt.Errorf("field %q: %w", field.FullName(), err)
+		}
+
+		fieldDefinitions = append(fieldDefinitions, fieldDefinition)
+		message.fields = append(message.fields, fieldType)
+	}
+
+	return namedDefinition("record", descriptor, "fields", fieldDefinitions), message, nil
+}
+
+func (b *recordBuilder) field(field protoreflect.FieldDescriptor) (definition map[string]any, out *fieldType, err error) {
+	out = &fieldType{descriptor: field}
+	definition = map[string]any{"name": string(field.Name())}
+
+	valueField := field
+	if field.IsMap() {
+		valueField = field.MapValue()
+	}
+
+	typeDefinition, typeName, value, err := b.value(valueField)
+	if err != nil {
+		return nil, nil, err
+	}
+	out.value = value
+
+	switch {
+	case field.IsMap():
+		definition["type"] = map[string]any{"type": "map", "values": typeDefinition}
+	case field.IsList():
+		definition["type"] = map[string]any{"type": "array", "items": typeDefinition}
+	case field.HasPresence():
+		out.nullBranch = typeName
+		definition["type"] = []any{"null", typeDefinition}
+		definition["default"] = nil
+	default:
+		definition["type"] = typeDefinition
+	}
+
+	return definition, out, nil
+}
+
+// value returns the definition of the type of a single value of the field along with its
+// name, as used to select a branch of a union, and the conversion of its values.
+func (b *recordBuilder) value(field protoreflect.FieldDescriptor) (definition any, name string, convert func(protoreflect.Value) (any, error), err error) {
+	if columnType, ok := parquetx.GetFieldColumnType(field); ok {
+		return columnValue(field, columnType)
+	}
+
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return "boolean", "boolean", func(v protoreflect.Value) (any, error) { return v.Bool(), nil }, nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return "int", "int", func(v protoreflect.Value) (any, error) { return int32(v.Int()), nil }, nil
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return "long", "long", func(v protoreflect.Value) (any, error) { return v.Int(), nil }, nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return "long", "long", func(v protoreflect.Value) (any, error) { return int64(v.Uint()), nil }, nil
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return decimalDefinition(uint64Precision), decimalBranch, func(v protoreflect.Value) (any, error) {
+			return new(big.Rat).SetInt(new(big.Int).SetUint64(v.Uint())), nil
+		}, nil
+	case protoreflect.FloatKind:
+		return "float", "float", func(v protoreflect.Value) (any, error) { return float32(v.Float()), nil }, nil
+	case protoreflect.DoubleKind:
+		return "double", "double", func(v protoreflect.Value) (any, error) { return v.Float(), nil }, nil
+	case protoreflect.StringKind:
+		return "string", "string", func(v protoreflect.Value) (any, error) { return v.String(), nil }, nil
+	case protoreflect.BytesKind:
+		return "bytes", "bytes", func(v protoreflect.Value) (any, error) { return v.Bytes(), nil }, nil
+
+	case protoreflect.EnumKind:
+		enum := field.Enum()
+		convert := func(v protoreflect.Value) (any, error) {
+			value := enum.Values().ByNumber(v.Enum())
+			if value == nil {
+				return nil, fmt.Errorf("enum value %d is not a valid enumeration value for field '%s', known enum values are [%s]", v.Enum(), field.Name(), protox.EnumKnownValuesDebugString(enum))
+			}
+			return protox.EnumValueToString(value), nil
+		}
+
+		if b.enums[enum.FullName()] {
+			return string(enum.FullName()), string(enum.FullName()), convert, nil
+		}
+		b.enums[enum.FullName()] = true
+
+		values := enum.Values()
+		symbols := make([]string, values.Len())
+		for i := range values.Len() {
+			symbols[i] = protox.EnumValueToString(values.Get(i))
+		}
+
+		return namedDefinition("enum", enum, "symbols", symbols), string(enum.FullName()), convert, nil
+
+	case protoreflect.MessageKind:
+		if protox.IsWellKnownTimestampField(field) {
+			return map[string]any{"type": "long", "logicalType": "timestamp-micros"}, "long.timestamp-micros", func(v protoreflect.Value) (any, error) {
+				return protox.DynamicAsTimestampTime(v.Message()), nil
+			}, nil
+		}
+
+		if protox.IsWellKnownGoogleField(field) {
+			return nil, "", nil, fmt.Errorf("well-known google type %s is not supported yet", field.Message().FullName())
+		}
+
+		definition, message, err := b.message(field.Message())
+		if err != nil {
+			return nil, "", nil, err
+		}
+
+		return definition, string(field.Message().FullName()), func(v protoreflect.Value) (any, error) {
+			return message.record(v.Message())
+		}, nil
+	}
+
+	return nil, "", nil, fmt.Errorf("kind %s is not supported yet", field.Kind())
+}
+
+const (
+	// uint64Precision is the number of digits of the largest uint64 value
+	uint64Precision = 20
+	// int256Precision is the largest precision of 256 bits numbers, like Arrow's decimal256
+	int256Precision = 76
+	// decimalBranch is the name of the decimal type in unions
+	decimalBranch = "bytes.decimal"
+)
+
+// columnValue returns the type of fields with a `(parquet.column)` type, both UINT256 and
+// INT256 being decimal(76, 0) values parsed from decimal or '0x' prefixed hexadecimal
+// strings.
+func columnValue(field protoreflect.FieldDescriptor, columnType parquetpb.ColumnType) (definition any, name string, convert func(protoreflect.Value) (any, error), err error) {
+	if field.Kind() != protoreflect.StringKind {
+		return nil, "", nil, fmt.Errorf("unsupported conversion from field kind %s to column value of type %s", field.Kind(), columnType)
+	}
+
+	switch columnType {
+	case parquetpb.ColumnType_INT256, parquetpb.ColumnType_UINT256:
+		signed := columnType == parquetpb.ColumnType_INT256
+
+		return decimalDefinition(int256Precision), decimalBranch, func(v protoreflect.Value) (any, error) {
+			number, err := parseInt256(v.String(), signed)
+			if err != nil {
+				return nil, err
+			}
+
+			return new(big.Rat).SetInt(number), nil
+		}, nil
+	}
+
+	return nil, "", nil, fmt.Errorf("unsupported column type %s", columnType)
+}
+
+func parseInt256(in string, signed bool) (*big.Int, error) {
+	number, ok := new(big.Int).SetString(in, 0)
+	if !ok {
+		return nil, fmt.Errorf("converting string %q to big.Int", in)
+	}
+
+	if !signed && (number.Sign() < 0 || strings.HasPrefix(in, "+")) {
+		return nil, fmt.Errorf("converting string %q to uint256: not an unsigned number", in)
+	}
+
+	if len(new(big.Int).Abs(number).String()) > int256Precision {
+		return nil, fmt.Errorf("converting string %q to decimal: number has more than %d digits", in, int256Precision)
+	}
+
+	return number, nil
+}
+
+// decimalDefinition returns the definition of integers of the given number of digits.
+func decimalDefinition(precision int) map[string]any {
+	return map[string]any{"type": "bytes", "logicalType": "decimal", "precision": precision, "scale": 0}
+}
+
+// namedDefinition returns the definition of a named Avro type, its namespace being the
+// parent of the Protobuf full name, the package or the enclosing message. The namespace
+// is always set, even if empty, so it's not inherited from the enclosing record.
+func namedDefinition(typ string, descriptor protoreflect.Descriptor, key string, value any) map[string]any {
+	return map[string]any{
+		"type":      typ,
+		"name":      string(descriptor.Name()),
+		"namespace": string(descriptor.FullName().Parent()),
+		key:         value,
+	}
+}
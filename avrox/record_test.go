@@ -0,0 +1,231 @@
+package avrox
+
+import (
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestRecordFromMessageDescriptor(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   protoreflect.MessageDescriptor
+		schema string
+	}{
+		{
+			"all types",
+			(&pbtesting.Row{}).ProtoReflect().Descriptor(),
+			`{"name":"sf.substreams.sink.files.testing.Row","type":"record","fields":[` +
+				`{"name":"typeString","type":"string"},{"name":"typeInt32","type":"int"},{"name":"typeInt64","type":"long"},` +
+				`{"name":"typeUint32","type":"long"},{"name":"typeUint64","type":{"type":"bytes","logicalType":"decimal","precision":20}},{"name":"typeSint32","type":"int"},` +
+				`{"name":"typeSint64","type":"long"},{"name":"typeFixed32","type":"long"},{"name":"typeFixed64","type":{"type":"bytes","logicalType":"decimal","precision":20}},` +
+				`{"name":"typeSfixed32","type":"int"},{"name":"typeSfixed64","type":"long"},{"name":"typeFloat","type":"float"},` +
+				`{"name":"typeDouble","type":"double"},{"name":"typeBool","type":"boolean"},{"name":"typeBytes","type":"bytes"},` +
+				`{"name":"typeTimestamp","type":["null",{"type":"long","logicalType":"timestamp-micros"}]}]}`,
+		},
+		{
+			"int256 column",
+			(&pbtesting.RowColumnTypeInt256{}).ProtoReflect().Descriptor(),
+			`{"name":"sf.substreams.sink.files.testing.RowColumnTypeInt256","type":"record","fields":[` +
+				`{"name":"positive","type":{"type":"bytes","logicalType":"decimal","precision":76}},` +
+				`{"name":"negative","type":{"type":"bytes","logicalType":"decimal","precision":76}}]}`,
+		},
+		{
+			"optional field",
+			(&pbtesting.RowColumnSandwichedOptional{}).ProtoReflect().Descriptor(),
+			`{"name":"sf.substreams.sink.files.testing.RowColumnSandwichedOptional","type":"record","fields":[` +
+				`{"name":"prefix","type":"string"},{"name":"value","type":["null","string"]},{"name":"suffix","type":"string"}]}`,
+		},
+		{
+			"enum field",
+			(&pbtesting.RowColumEnumInside{}).ProtoReflect().Descriptor(),
+			`{"name":"sf.substreams.sink.files.testing.RowColumEnumInside","type":"record","fields":[` +
+				`{"name":"value","type":{"name":"sf.substreams.sink.files.testing.RowColumEnumInside.Value","type":"enum","symbols":["UNKNOWN","FIRST","SECOND"]}}]}`,
+		},
+		{
+			"repeated nested message",
+			(&pbtesting.RowColumnRepeatedNestedMessage{}).ProtoReflect().Descriptor(),
+			`{"name":"sf.substreams.sink.files.testing.RowColumnRepeatedNestedMessage","type":"record","fields":[` +
+				`{"name":"nested","type":{"type":"array","items":{"name":"sf.substreams.sink.files.testing.Nested","type":"record","fields":[{"name":"value","type":"string"}]}}}]}`,
+		},
+		{
+			"recursive message",
+			recursiveMessageDescriptor(t),
+			`{"name":"test.Node","type":"record","fields":[` +
+				`{"name":"id","type":"string"},{"name":"child","type":["null","test.Node"]},` +
+				`{"name":"children","type":{"type":"array","items":"test.Node"}},{"name":"labels","type":{"type":"map","values":"long"}}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, err := RecordFromMessageDescriptor(tt.args)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.schema, record.Schema().String())
+		})
+	}
+}
+
+func TestRecord_Marshal(t *testing.T) {
+	t.Run("all types", func(t *testing.T) {
+		record, err := RecordFromMessageDescriptor((&pbtesting.Row{}).ProtoReflect().Descriptor())
+		require.NoError(t, err)
+
+		timestamp := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+		values := decode(t, record, &pbtesting.Row{
+			TypeString:    "abc",
+			TypeInt32:     -1,
+			TypeUint32:    4294967295,
+			TypeUint64:    18,
+			TypeFloat:     1.5,
+			TypeBytes:     []byte{0x01},
+			TypeTimestamp: timestamppb.New(timestamp),
+		})
+
+		assert.Equal(t, "abc", values["typeString"])
+		assert.Equal(t, -1, values["typeInt32"])
+		assert.Equal(t, int64(4294967295), values["typeUint32"])
+		assert.Equal(t, big.NewRat(18, 1), values["typeUint64"])
+		assert.Equal(t, float32(1.5), values["typeFloat"])
+		assert.Equal(t, []byte{0x01}, values["typeBytes"])
+		assert.Equal(t, timestamp, values["typeTimestamp"])
+
+		values = decode(t, record, &pbtesting.Row{})
+		assert.Nil(t, values["typeTimestamp"])
+	})
+
+	t.Run("uint64 max", func(t *testing.T) {
+		record, err := RecordFromMessageDescriptor((&pbtesting.Row{}).ProtoReflect().Descriptor())
+		require.NoError(t, err)
+
+		values := decode(t, record, &pbtesting.Row{TypeUint64: math.MaxUint64, TypeFixed64: 1 << 63})
+		assert.Equal(t, "18446744073709551615", values["typeUint64"].(*big.Rat).RatString())
+		assert.Equal(t, "9223372036854775808", values["typeFixed64"].(*big.Rat).RatString())
+	})
+
+	t.Run("int256", func(t *testing.T) {
+		record, err := RecordFromMessageDescriptor((&pbtesting.RowColumnTypeInt256{}).ProtoReflect().Descriptor())
+		require.NoError(t, err)
+
+		values := decode(t, record, &pbtesting.RowColumnTypeInt256{Positive: "0xff", Negative: "-12345678901234567890123456789"})
+		assert.Equal(t, "255", values["positive"].(*big.Rat).RatString())
+		assert.Equal(t, "-12345678901234567890123456789", values["negative"].(*big.Rat).RatString())
+
+		_, err = record.Marshal((&pbtesting.RowColumnTypeInt256{Positive: "1" + strings.Repeat("0", 76)}).ProtoReflect())
+		assert.EqualError(t, err, `field "positive": converting string "1`+strings.Repeat("0", 76)+`" to decimal: number has more than 76 digits`)
+	})
+
+	t.Run("uint256 negative", func(t *testing.T) {
+		record, err := RecordFromMessageDescriptor((&pbtesting.RowColumnTypeUint256{}).ProtoReflect().Descriptor())
+		require.NoError(t, err)
+
+		_, err = record.Marshal((&pbtesting.RowColumnTypeUint256{Amount: "-1"}).ProtoReflect())
+		assert.EqualError(t, err, `field "amount": converting string "-1" to uint256: not an unsigned number`)
+	})
+
+	t.Run("enum", func(t *testing.T) {
+		record, err := RecordFromMessageDescriptor((&pbtesting.RowColumEnumInside{}).ProtoReflect().Descriptor())
+		require.NoError(t, err)
+
+		values := decode(t, record, &pbtesting.RowColumEnumInside{Value: pbtesting.RowColumEnumInside_SECOND})
+		assert.Equal(t, "SECOND", values["value"])
+
+		_, err = record.Marshal((&pbtesting.RowColumEnumInside{Value: 5}).ProtoReflect())
+		assert.EqualError(t, err, `field "value": enum value 5 is not a valid enumeration value for field 'value', known enum values are [UNKNOWN (0), FIRST (1), SECOND (2)]`)
+	})
+
+	t.Run("recursive message", func(t *testing.T) {
+		descriptor := recursiveMessageDescriptor(t)
+		record, err := RecordFromMessageDescriptor(descriptor)
+		require.NoError(t, err)
+
+		node := func(id string) *dynamicpb.Message {
+			message := dynamicpb.NewMessage(descriptor)
+			message.Set(descriptor.Fields().ByName("id"), protoreflect.ValueOfString(id))
+			return message
+		}
+
+		root := node("root")
+		root.Set(descriptor.Fields().ByName("child"), protoreflect.ValueOfMessage(node("child")))
+		children := root.Mutable(descriptor.Fields().ByName("children")).List()
+		children.Append(protoreflect.ValueOfMessage(node("first")))
+		labels := root.Mutable(descriptor.Fields().ByName("labels")).Map()
+		labels.Set(protoreflect.MapKey(protoreflect.ValueOfString("a")), protoreflect.ValueOfInt64(1))
+
+		values := decode(t, record, root)
+		assert.Equal(t, map[string]any{
+			"id":       "root",
+			"child":    map[string]any{"test.Node": map[string]any{"id": "child", "child": nil, "children": []any(nil), "labels": map[string]any{}}},
+			"children": []any{map[string]any{"id": "first", "child": nil, "children": []any(nil), "labels": map[string]any{}}},
+			"labels":   map[string]any{"a": int64(1)},
+		}, values)
+	})
+}
+
+func decode(t *testing.T, record *Record, message proto.Message) map[string]any {
+	t.Helper()
+
+	data, err := record.Marshal(message.ProtoReflect())
+	require.NoError(t, err)
+
+	var out map[string]any
+	require.NoError(t, avro.Unmarshal(record.Schema(), data, &out))
+
+	return out
+}
+
+// recursiveMessageDescriptor returns the descriptor of a message referring to itself:
+//
+//	message Node {
+//	  string id = 1;
+//	  Node child = 2;
+//	  repeated Node children = 3;
+//	  map<string, int64> labels = 4;
+//	}
+func recursiveMessageDescriptor(t *testing.T) protoreflect.MessageDescriptor {
+	t.Helper()
+
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	message := descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("node.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Node"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("id"), JsonName: proto.String("id"), Number: proto.Int32(1), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+				{Name: proto.String("child"), JsonName: proto.String("child"), Number: proto.Int32(2), Label: optional, Type: message, TypeName: proto.String(".test.Node")},
+				{Name: proto.String("children"), JsonName: proto.String("children"), Number: proto.Int32(3), Label: repeated, Type: message, TypeName: proto.String(".test.Node")},
+				{Name: proto.String("labels"), JsonName: proto.String("labels"), Number: proto.Int32(4), Label: repeated, Type: message, TypeName: proto.String(".test.Node.LabelsEntry")},
+			},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("LabelsEntry"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{Name: proto.String("key"), JsonName: proto.String("key"), Number: proto.Int32(1), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+					{Name: proto.String("value"), JsonName: proto.String("value"), Number: proto.Int32(2), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()},
+				},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}},
+		}},
+	}, nil)
+	require.NoError(t, err)
+
+	return file.Messages().ByName("Node")
+}
@@ -6,11 +6,11 @@ import (
 	"time"
 
 	"github.com/streamingfast/bstream"
-	"github.com/streamingfast/dhammer"
 	"github.com/streamingfast/dstore"
 	"github.com/streamingfast/shutter"
 	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
 	"github.com/streamingfast/substreams-sink-files/v2/state"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
 	sink "github.com/streamingfast/substreams/sink"
 	"go.uber.org/zap"
 )
@@ -19,13 +19,52 @@ type Bundler struct {
 	*shutter.Shutter
 
 	blockCount     uint64
+	timeWindowSize time.Duration
+	maxFileSize    uint64
+	maxFileRows    uint64
 	stats          *boundaryStats
 	boundaryWriter writer.Writer
 	outputStore    dstore.Store
 	stateStore     state.Store
+
+	// activeBoundary is the block range of the active boundary, for time window boundaries
+	// its end block is unknown until the window is closed.
 	activeBoundary *bstream.Range
-	uploadQueue    *dhammer.Nailer
+	activeWindow   *timeWindow
+	activeBlocks   activeBlocks
+	uploadQueue    *uploadQueue
 	zlogger        *zap.Logger
+
+	uploadConcurrency int
+	uploadQueueSize   int
+	uploadRetries     uint64
+	uploadBackoff     time.Duration
+
+	manifest        *manifestConfig
+	atomicPublisher *atomicPublisher
+	pathTemplate    *PathTemplate
+	checkpointer    *checkpointer
+	reconciler      *reconciler
+	heads           *headFlusher
+	hooks           *hookRunner
+	tableCommitters []TableCommitter
+	replicas        []Replica
+	replicaJournal  dstore.Store
+	replicators     []*replicator
+	status          statusTracker
+
+	emptyBoundaryPolicy EmptyBoundaryPolicy
+
+	// lastBlockTime is the time of the last block received through Roll
+	lastBlockTime time.Time
+}
+
+// activeBlocks tracks the blocks seen in the active boundary.
+type activeBlocks struct {
+	first     bstream.BlockRef
+	firstTime time.Time
+	last      bstream.BlockRef
+	cursor    *sink.Cursor
 }
 
 func New(
@@ -34,6 +73,7 @@ func New(
 	stateStore state.Store,
 	outputStore dstore.Store,
 	zlogger *zap.Logger,
+	opts ...Option,
 ) (*Bundler, error) {
 
 	b := &Bundler{
@@ -44,9 +84,34 @@ func New(
 		blockCount:     size,
 		stats:          newStats(),
 		zlogger:        zlogger,
+
+		uploadConcurrency: DefaultUploadConcurrency,
+		uploadQueueSize:   DefaultUploadQueueSize,
+		uploadRetries:     DefaultUploadRetries,
+		uploadBackoff:     DefaultUploadBackoff,
+
+		emptyBoundaryPolicy: EmptyBoundaryWrite,
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.reconciler != nil && b.reconciler.policy != ReconcileOff && b.emptyBoundaryPolicy == EmptyBoundarySkip {
+		return nil, fmt.Errorf("reconcile cannot be used with the %q empty boundary policy, skipped boundaries leave no file and would be reported as gaps, use %q instead", EmptyBoundarySkip, EmptyBoundaryMarker)
 	}
 
-	b.uploadQueue = dhammer.NewNailer(5, b.uploadBoundary, dhammer.NailerLogger(zlogger))
+	b.uploadQueue = newUploadQueue(b.uploadConcurrency, b.uploadQueueSize, b.uploadRetries, b.uploadBackoff, zlogger)
+	var rewriters []ReplicaRewriter
+	for _, committer := range b.tableCommitters {
+		if rewriter, ok := committer.(ReplicaRewriter); ok {
+			rewriters = append(rewriters, rewriter)
+		}
+	}
+
+	for _, replica := range b.replicas {
+		b.replicators = append(b.replicators, newReplicator(outputStore, b.replicaJournal, replica, rewriters, b.uploadRetries, b.uploadBackoff, zlogger))
+	}
 
 	return b, nil
 }
@@ -57,37 +122,146 @@ func (b *Bundler) Launch(ctx context.Context) {
 		b.Close()
 	})
 
-	b.uploadQueue.Start(ctx)
-	go func() {
-		for v := range b.uploadQueue.Out {
-			bf := v.(*boundaryFile)
+	b.uploadQueue.OnTerminating(func(err error) {
+		if err != nil {
+			b.Shutdown(fmt.Errorf("upload queue failed: %w", err))
+		}
+	})
 
-			if err := bf.state.Save(); err != nil {
-				b.Shutdown(fmt.Errorf("unable to save state: %w", err))
-				return
-			}
+	upload := func(ctx context.Context, bf *boundaryFile) error {
+		err := b.uploadBoundary(ctx, bf)
+		b.status.uploaded(err)
+
+		return err
+	}
+
+	for _, replicator := range b.replicators {
+		replicator.start(ctx)
+	}
+
+	b.status.launched()
+	b.uploadQueue.start(ctx, upload, func(bf *boundaryFile) error {
+		// Head files do not move the state forward
+		if bf.state == nil {
+			return nil
+		}
+
+		if err := bf.state.Save(); err != nil {
+			return fmt.Errorf("unable to save state: %w", err)
+		}
+
+		b.status.committed(bf)
+		return nil
+	})
+}
+
+// Recover finishes or cleans up the work left over by a previous run that did
+// not terminate cleanly, it must be called before Launch.
+func (b *Bundler) Recover(ctx context.Context) error {
+	// With a lease, the previous holder may have saved the state after it was first read
+	if err := b.stateStore.Reload(ctx); err != nil {
+		return fmt.Errorf("reload state: %w", err)
+	}
+
+	if b.atomicPublisher != nil {
+		if err := b.atomicPublisher.recover(ctx); err != nil {
+			return fmt.Errorf("recover staged boundaries: %w", err)
+		}
+	}
+
+	if b.heads != nil {
+		if err := b.heads.recover(ctx, b.outputStore); err != nil {
+			return fmt.Errorf("recover head files: %w", err)
 		}
-		if b.uploadQueue.Err() != nil {
-			b.Shutdown(fmt.Errorf("upload queue failed: %w", b.uploadQueue.Err()))
+	}
+
+	for _, replicator := range b.replicators {
+		if err := replicator.recover(ctx); err != nil {
+			return fmt.Errorf("recover copies to %s: %w", replicator.destination, err)
+		}
+	}
+
+	if b.reconciler != nil {
+		if err := b.reconciler.reconcile(ctx); err != nil {
+			return fmt.Errorf("reconcile output store: %w", err)
+		}
+	}
+
+	if b.checkpointer != nil {
+		cursor, err := b.stateStore.ReadCursor()
+		if err != nil {
+			return fmt.Errorf("read cursor: %w", err)
+		}
+
+		if err := b.checkpointer.recover(cursor); err != nil {
+			return fmt.Errorf("recover checkpoint: %w", err)
 		}
-	}()
+	}
+
+	return nil
 }
 
+// Close waits until all boundaries queued are uploaded and their state saved, unless
+// the upload queue failed.
 func (b *Bundler) Close() {
-	b.zlogger.Info("closing upload queue")
-	b.uploadQueue.Close()
-	b.zlogger.Info("waiting till queue is drained")
-	b.uploadQueue.WaitUntilEmpty(context.Background())
+	b.zlogger.Info("closing upload queue, waiting till queue is drained")
+	b.uploadQueue.close()
+	b.uploadQueue.Shutdown(nil)
+
+	for _, replicator := range b.replicators {
+		replicator.close()
+	}
 	b.zlogger.Info("boundary uploaded completed")
 }
 
+// GetCursor returns the cursor to resume from, the cursor of the checkpoint restored
+// by Recover if any, otherwise the one of the state.
 func (b *Bundler) GetCursor() (*sink.Cursor, error) {
+	if b.checkpointer != nil && b.checkpointer.restored != nil {
+		return sink.NewCursor(b.checkpointer.restored.Cursor)
+	}
+
 	return b.stateStore.ReadCursor()
 }
 
-func (b *Bundler) Roll(ctx context.Context, blockNum uint64) error {
+// Roll closes the active boundary if the block received is not part of it and starts
+// the boundary containing the block.
+func (b *Bundler) Roll(ctx context.Context, clock *pbsubstreams.Clock) (err error) {
+	if b.timeWindowSize > 0 {
+		err = b.rollTimeWindow(ctx, clock)
+	} else {
+		err = b.rollBlockRange(ctx, clock)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := b.flushHeadIfDue(ctx, clock.Number); err != nil {
+		return fmt.Errorf("flush head: %w", err)
+	}
+
+	blockTime := clock.Timestamp.AsTime()
+	ProcessedBlockCount.Inc()
+	HeadBlockNumber.SetUint64(clock.Number)
+	HeadBlockTimeDrift.SetBlockTime(blockTime)
+
+	if b.activeBlocks.firstTime.IsZero() {
+		b.activeBlocks.firstTime = blockTime
+	}
+	b.lastBlockTime = blockTime
+
+	if err := b.checkpoint(); err != nil {
+		return fmt.Errorf("checkpoint active boundary: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Bundler) rollBlockRange(ctx context.Context, clock *pbsubstreams.Clock) error {
+	blockNum := clock.Number
 	if b.activeBoundary.Contains(blockNum) {
-		return nil
+		return b.splitIfFull(ctx, blockNum)
 	}
 
 	boundaries := boundariesToSkip(b.activeBoundary, blockNum, b.blockCount)
@@ -102,21 +276,166 @@ func (b *Bundler) Roll(ctx context.Context, blockNum uint64) error {
 		return fmt.Errorf("stop active boundary: %w", err)
 	}
 
-	for _, boundary := range boundaries {
-		if err := b.Start(boundary.StartBlock()); err != nil {
-			return fmt.Errorf("start skipping boundary: %w", err)
-		}
+	if err := b.closeEmptyBoundaries(ctx, boundaries, false); err != nil {
+		return err
+	}
+
+	if err := b.start(b.newBoundary(blockNum), nil); err != nil {
+		return fmt.Errorf("start skipping boundary: %w", err)
+	}
+	return nil
+}
+
+// splitIfFull closes the active boundary early if the data accumulated so far reached
+// the configured maximum file size or rows. The active boundary is split in two at
+// blockNum, the remaining part becoming the new active boundary, so files produced
+// stay ordered and never overlap.
+func (b *Bundler) splitIfFull(ctx context.Context, blockNum uint64) error {
+	if b.maxFileSize == 0 && b.maxFileRows == 0 {
+		return nil
+	}
+
+	// A boundary always contains at least one block
+	if b.activeBlocks.last == nil || blockNum == b.activeBoundary.StartBlock() {
+		return nil
+	}
+
+	stats := b.boundaryWriter.Stats()
+	sizeReached := b.maxFileSize > 0 && uint64(stats.Size) >= b.maxFileSize
+	rowsReached := b.maxFileRows > 0 && uint64(stats.Rows) >= b.maxFileRows
+	if !sizeReached && !rowsReached {
+		return nil
+	}
+
+	b.zlogger.Info("active boundary is full, splitting it",
+		zap.Stringer("active_boundary", b.activeBoundary),
+		zap.Int64("size", stats.Size),
+		zap.Int64("rows", stats.Rows),
+		zap.Uint64("block_num", blockNum),
+	)
+
+	remaining := bstream.NewOpenRange(blockNum)
+	if endBlock := b.activeBoundary.EndBlock(); endBlock != nil {
+		remaining = bstream.NewRangeExcludingEnd(blockNum, *endBlock)
+	}
+	window := b.activeWindow
+
+	b.activeBoundary = bstream.NewRangeExcludingEnd(b.activeBoundary.StartBlock(), blockNum)
+	if err := b.stop(ctx); err != nil {
+		return fmt.Errorf("stop full boundary: %w", err)
+	}
+
+	if err := b.start(remaining, window); err != nil {
+		return fmt.Errorf("start remaining boundary: %w", err)
+	}
+
+	return nil
+}
+
+// rollTimeWindow is the Roll counterpart of time window boundaries. Contrary to block
+// boundaries, windows without any block are not produced since there is no block range
+// to name them with.
+func (b *Bundler) rollTimeWindow(ctx context.Context, clock *pbsubstreams.Clock) error {
+	blockTime := clock.Timestamp.AsTime()
+	if b.activeWindow != nil && b.activeWindow.contains(blockTime) {
+		return b.splitIfFull(ctx, clock.Number)
+	}
+
+	var window *timeWindow
+	if b.activeWindow == nil {
+		window = b.resumedWindow(clock.Number, blockTime)
+	} else {
+		b.zlogger.Info("block time is not in active time window",
+			zap.Stringer("active_window", b.activeWindow),
+			zap.Time("block_time", blockTime),
+			zap.Uint64("block_num", clock.Number),
+		)
+
+		// The window ends right before the block starting the next one
+		b.activeBoundary = bstream.NewRangeExcludingEnd(b.activeBoundary.StartBlock(), clock.Number)
 		if err := b.stop(ctx); err != nil {
-			return fmt.Errorf("stop skipping boundary: %w", err)
+			return fmt.Errorf("stop active time window: %w", err)
 		}
 	}
 
-	if err := b.Start(blockNum); err != nil {
-		return fmt.Errorf("start skipping boundary: %w", err)
+	if window == nil {
+		window = newTimeWindow(blockTime, b.timeWindowSize)
+	}
+
+	if err := b.start(bstream.NewOpenRange(clock.Number), window); err != nil {
+		return fmt.Errorf("start time window: %w", err)
 	}
+
 	return nil
 }
 
+// resumedWindow returns the time window of the boundary saved in the state when the first
+// block of the run belongs to it, so a restart continues the window that was being written,
+// even if the window size changed in between, instead of deriving a new one overlapping it.
+func (b *Bundler) resumedWindow(blockNum uint64, blockTime time.Time) *timeWindow {
+	saved := b.stateStore.ActiveBoundary()
+	if saved.WindowStart.IsZero() || saved.WindowEnd.IsZero() || blockNum < saved.StartBlockNumber {
+		return nil
+	}
+
+	window := &timeWindow{start: saved.WindowStart.UTC(), end: saved.WindowEnd.UTC()}
+	if !window.contains(blockTime) {
+		return nil
+	}
+
+	return window
+}
+
+// Finish is called once the stream reached its stop block, it closes the active boundary
+// along with the empty boundaries that follow it up to the stop block and marks the state
+// as completed.
+//
+// When the active boundary ends after the stop block, which is always the case of time
+// window boundaries, it's closed as a partial boundary covering the blocks from its start
+// up to the stop block, named after this range. The next run extending the block range
+// continues right after it, see Start.
+func (b *Bundler) Finish(ctx context.Context, stopBlock uint64) error {
+	if b.activeBoundary == nil || b.activeBoundary.StartBlock() >= stopBlock {
+		b.zlogger.Info("stop block reached without an active boundary, nothing to write",
+			zap.Stringer("active_boundary", b.activeBoundary),
+			zap.Uint64("stop_block", stopBlock),
+		)
+		return nil
+	}
+
+	if b.activeBoundary.EndBlock() == nil || *b.activeBoundary.EndBlock() > stopBlock {
+		b.zlogger.Info("stop block reached within active boundary, closing it as a partial boundary",
+			zap.Stringer("active_boundary", b.activeBoundary),
+			zap.Uint64("stop_block", stopBlock),
+		)
+
+		b.activeBoundary = bstream.NewRangeExcludingEnd(b.activeBoundary.StartBlock(), stopBlock)
+		b.stateStore.MarkCompleted()
+		if err := b.stop(ctx); err != nil {
+			return fmt.Errorf("stop partial boundary: %w", err)
+		}
+
+		return nil
+	}
+
+	boundaries := boundariesToSkip(b.activeBoundary, stopBlock, b.blockCount)
+	b.zlogger.Info("stop block reached, closing last boundaries",
+		zap.Stringer("active_boundary", b.activeBoundary),
+		zap.Int("boundaries_to_skip", len(boundaries)),
+		zap.Uint64("stop_block", stopBlock),
+	)
+
+	if len(boundaries) == 0 {
+		b.stateStore.MarkCompleted()
+	}
+
+	if err := b.stop(ctx); err != nil {
+		return fmt.Errorf("stop active boundary: %w", err)
+	}
+
+	return b.closeEmptyBoundaries(ctx, boundaries, true)
+}
+
 func (b *Bundler) TrackBlockProcessDuration(elapsed time.Duration) {
 	b.stats.addProcessingDataDur(elapsed)
 }
@@ -125,33 +444,251 @@ func (b *Bundler) Writer() writer.Writer {
 	return b.boundaryWriter
 }
 
+// SetCursor records the cursor of the last block fully written to the active
+// boundary, marking the end of this block's data in the boundary writer.
 func (b *Bundler) SetCursor(cursor *sink.Cursor) {
+	b.boundaryWriter.EndBlock(cursor.Block().Num())
 	b.stateStore.SetCursor(cursor)
+
+	if b.activeBlocks.first == nil {
+		b.activeBlocks.first = cursor.Block()
+	}
+	b.activeBlocks.last = cursor.Block()
+	b.activeBlocks.cursor = cursor
+
+	b.status.blockProcessed(cursor, b.stateStore.StartedAt(), b.stateStore.RestartedAt())
+}
+
+// Revert discards all data of the active boundary written for blocks after
+// the last valid block of the cursor and rewinds the state to this cursor.
+//
+// Boundaries that were already closed are queued for upload and cannot be
+// reverted anymore, an error is returned if the undo goes beyond the active
+// boundary. Head files being parts of the active boundary, they are reverted
+// too, see revertHeads.
+func (b *Bundler) Revert(ctx context.Context, lastValidCursor *sink.Cursor) error {
+	lastValidBlockNum := lastValidCursor.Block().Num()
+
+	if b.activeBoundary == nil {
+		return fmt.Errorf("no active boundary to revert")
+	}
+
+	if lastValidBlockNum+1 < b.activeBoundary.StartBlock() {
+		// Head files are parts of the active boundary, reverting them is supported
+		if !b.heads.active() || lastValidBlockNum+1 < b.heads.startBlock {
+			return fmt.Errorf("last valid block #%d is before active boundary %s, data of prior boundaries has already been flushed and cannot be reverted", lastValidBlockNum, b.activeBoundary)
+		}
+
+		if err := b.revertHeads(ctx, lastValidBlockNum); err != nil {
+			return fmt.Errorf("revert head files: %w", err)
+		}
+	}
+
+	b.zlogger.Info("reverting active boundary",
+		zap.Stringer("boundary", b.activeBoundary),
+		zap.Stringer("last_valid_block", lastValidCursor.Block()),
+	)
+
+	// The checkpoint is discarded before the writer truncates the data it refers to, so a
+	// crash in between never restores it
+	if b.checkpointer != nil {
+		if err := b.checkpointer.revert(lastValidBlockNum); err != nil {
+			return fmt.Errorf("revert checkpoint: %w", err)
+		}
+	}
+
+	if err := b.boundaryWriter.Revert(lastValidBlockNum); err != nil {
+		return fmt.Errorf("revert writer: %w", err)
+	}
+
+	b.stateStore.SetCursor(lastValidCursor)
+
+	if b.activeBlocks.first != nil && lastValidBlockNum < b.activeBlocks.first.Num() {
+		b.activeBlocks.first = nil
+		b.activeBlocks.firstTime = time.Time{}
+		b.activeBlocks.last = nil
+	} else if b.activeBlocks.first != nil {
+		b.activeBlocks.last = lastValidCursor.Block()
+	}
+	b.activeBlocks.cursor = lastValidCursor
+
+	return nil
 }
 
+// Start starts the boundary containing the given block. With time window boundaries,
+// this is a no-op as the block's timestamp is required to determine the window, it's
+// started by Roll when the first block is received.
+//
+// When boundaries can be split because of their size, the boundary is started at the
+// given block instead of the start of its block range since a previous run may have
+// already written the part of it prior this block.
+//
+// When the previous run completed with a partial boundary, because its stop block was not
+// aligned on the block count, the boundary is started right after the partial one so the
+// blocks it contains are not written twice.
+//
+// When a checkpoint was restored by Recover, the checkpointed boundary is resumed instead.
 func (b *Bundler) Start(blockNum uint64) error {
-	boundaryRange := b.newBoundary(blockNum)
+	if b.checkpointer != nil && b.checkpointer.restored != nil {
+		checkpoint := b.checkpointer.restored
+		b.checkpointer.restored = nil
+
+		return b.restoreCheckpoint(checkpoint)
+	}
+
+	if b.timeWindowSize > 0 {
+		return nil
+	}
+
+	boundary := b.newBoundary(blockNum)
+	if partialEnd, found := b.partialBoundaryEnd(boundary); found {
+		b.zlogger.Info("previous run ended with a partial boundary, continuing after it", zap.Uint64("partial_end_block", partialEnd))
+		boundary = bstream.NewRangeExcludingEnd(partialEnd, *boundary.EndBlock())
+	} else if (b.maxFileSize > 0 || b.maxFileRows > 0) && blockNum > boundary.StartBlock() {
+		boundary = bstream.NewRangeExcludingEnd(blockNum, *boundary.EndBlock())
+	}
+
+	return b.start(boundary, nil)
+}
+
+// partialBoundaryEnd returns the end block of the partial boundary written by the previous
+// run if the state was completed with one ending within the given boundary.
+func (b *Bundler) partialBoundaryEnd(boundary *bstream.Range) (uint64, bool) {
+	if !b.stateStore.IsCompleted() {
+		return 0, false
+	}
+
+	endBlock := b.stateStore.ActiveBoundary().EndBlockNumber
+	if endBlock <= boundary.StartBlock() || endBlock >= *boundary.EndBlock() {
+		return 0, false
+	}
+
+	return endBlock, true
+}
+
+func (b *Bundler) start(boundaryRange *bstream.Range, window *timeWindow) error {
 	b.activeBoundary = boundaryRange
+	b.activeWindow = window
+	b.activeBlocks.first = nil
+	b.activeBlocks.firstTime = time.Time{}
+	b.activeBlocks.last = nil
+
+	if b.heads != nil && !b.heads.active() {
+		b.heads.lastAt = time.Now()
+	}
+
+	if b.checkpointer != nil {
+		cursor, err := b.stateStore.ReadCursor()
+		if err != nil {
+			return fmt.Errorf("read cursor: %w", err)
+		}
 
-	b.zlogger.Info("starting new file boundary", zap.Stringer("boundary", boundaryRange))
+		b.checkpointer.previousCursor = cursor.String()
+		b.checkpointer.lastAt = time.Now()
+	}
+
+	b.zlogger.Info("starting new file boundary", zap.Stringer("boundary", boundaryRange), zap.Stringer("window", window))
 	if err := b.boundaryWriter.StartBoundary(boundaryRange); err != nil {
 		return fmt.Errorf("start file: %w", err)
 	}
 
 	b.stats.startBoundary(boundaryRange)
 	b.zlogger.Info("boundary started", zap.Stringer("boundary", boundaryRange))
-	b.stateStore.NewBoundary(boundaryRange)
+	b.stateStore.NewBoundary(b.activeStateBoundary())
+	b.status.boundaryStarted(b.activeStateBoundary())
 	return nil
 }
 
+func (b *Bundler) activeStateBoundary() state.ActiveBoundary {
+	out := state.NewActiveBoundary(b.activeBoundary)
+	if b.activeWindow != nil {
+		out.WindowStart = b.activeWindow.start
+		out.WindowEnd = b.activeWindow.end
+	}
+
+	return out
+}
+
+// activeName is the name of the active boundary, the prefix of every file produced
+// for it, see boundaryName.
+func (b *Bundler) activeName() string {
+	if b.activeWindow != nil {
+		return b.activeWindow.String() + "_" + boundaryName(b.activeBoundary)
+	}
+
+	return boundaryName(b.activeBoundary)
+}
+
+// activeTime is the time of the active boundary used to render path templates, it's
+// the start of the time window for time window boundaries, otherwise the time of the
+// boundary's first block or, if it has none, the time of the last block received.
+func (b *Bundler) activeTime() time.Time {
+	if b.activeWindow != nil {
+		return b.activeWindow.start
+	}
+
+	if !b.activeBlocks.firstTime.IsZero() {
+		return b.activeBlocks.firstTime
+	}
+
+	return b.lastBlockTime
+}
+
+func (b *Bundler) activeFileNamer(name string) writer.FileNamer {
+	if b.pathTemplate != nil {
+		return b.pathTemplate.fileNamer(name, b.activeBoundary, b.activeTime())
+	}
+
+	return writer.BaseNameFileNamer(name)
+}
+
 func (b *Bundler) stop(ctx context.Context) error {
 	b.zlogger.Info("stopping file boundary")
 
-	file, err := b.boundaryWriter.CloseBoundary(ctx)
-	if err != nil {
-		return fmt.Errorf("closing file: %w", err)
+	// When head files were written, the last part of the boundary is written as a head
+	// file too and the boundary's files are compacted from them once uploaded
+	var heads []*boundaryFile
+	if b.heads.active() {
+		head, err := b.closeHead(ctx)
+		if err != nil {
+			return err
+		}
+		b.heads.parts = append(b.heads.parts, &headPart{file: head})
+
+		startBlock, firstBlock, firstTime := b.heads.startBlock, b.heads.firstBlock, b.heads.firstTime
+		if heads, err = b.heads.reset(); err != nil {
+			return err
+		}
+
+		b.activeBoundary = bstream.NewRangeExcludingEnd(startBlock, *b.activeBoundary.EndBlock())
+		b.activeBlocks.first = firstBlock
+		b.activeBlocks.firstTime = firstTime
 	}
 
+	name := b.activeName()
+	namer := b.activeFileNamer(name)
+
+	var file writer.Uploadeable
+	var empty bool
+	if heads == nil {
+		var err error
+		empty = b.activeIsEmpty()
+		file, err = b.boundaryWriter.CloseBoundary(ctx, namer)
+		if err != nil {
+			return fmt.Errorf("closing file: %w", err)
+		}
+
+		if empty {
+			if err := discardFile(file); err != nil {
+				return fmt.Errorf("discard empty file: %w", err)
+			}
+			file = nil
+		}
+	}
+
+	// The end block of time windows is only known now, so we record it prior saving
+	b.stateStore.NewBoundary(b.activeStateBoundary())
+
 	state, err := b.stateStore.GetState()
 	if err != nil {
 		return fmt.Errorf("failed to encode state: %w", err)
@@ -160,15 +697,34 @@ func (b *Bundler) stop(ctx context.Context) error {
 	b.zlogger.Info("queuing boundary upload",
 		zap.Stringer("boundary", b.activeBoundary),
 	)
-	b.uploadQueue.In <- &boundaryFile{
-		name:  b.activeBoundary.String(),
-		file:  file,
-		state: state,
+	err = b.uploadQueue.push(&boundaryFile{
+		name:       name,
+		boundary:   b.activeBoundary,
+		window:     b.activeWindow,
+		firstBlock: b.activeBlocks.first,
+		lastBlock:  b.activeBlocks.last,
+		cursor:     b.activeBlocks.cursor.String(),
+		file:       file,
+		namer:      namer,
+		empty:      empty,
+		heads:      heads,
+		state:      state,
+	})
+	if err != nil {
+		return fmt.Errorf("queue boundary upload: %w", err)
 	}
 
 	b.activeBoundary = nil
+	b.activeWindow = nil
+
+	if b.checkpointer != nil {
+		if err := b.checkpointer.discard(); err != nil {
+			return err
+		}
+	}
 
 	b.stats.endBoundary()
+	b.stats.record()
 	b.zlogger.Info("bundler stats", b.stats.Log()...)
 	return nil
 }
@@ -189,27 +745,190 @@ func boundariesToSkip(lastBoundary *bstream.Range, blockNum uint64, size uint64)
 	return out
 }
 
+// boundaryName is the canonical name of a boundary, the '<start>-<end>' prefix of
+// every file produced for it.
+func boundaryName(boundary *bstream.Range) string {
+	return fmt.Sprintf("%010d-%010d", boundary.StartBlock(), *boundary.EndBlock())
+}
+
 func computeEndBlock(startBlockNum, size uint64) uint64 {
 	return (startBlockNum + size) - (startBlockNum+size)%size
 }
 
 type boundaryFile struct {
-	name  string
-	file  writer.Uploadeable
+	name       string
+	boundary   *bstream.Range
+	window     *timeWindow
+	firstBlock bstream.BlockRef
+	lastBlock  bstream.BlockRef
+	cursor     string
+	file       writer.Uploadeable
+	namer      writer.FileNamer
+	// empty is true when the boundary holds no data and is handled according to the
+	// empty boundary policy, file is nil in this case
+	empty bool
 	state state.Saveable
+
+	// head is true for head files, which do not save the state, see headFlusher
+	head bool
+	// uploaded is closed once the head file is uploaded, files being the ones written
+	uploaded chan struct{}
+	files    []writer.UploadedFile
+	// heads are the head files the boundary is compacted from, file is nil in this case
+	heads []*boundaryFile
+
+	// published are the files of the boundary once uploaded and headFiles the head files
+	// it was compacted from, so that retrying the upload after a later step failed resumes
+	// from this step instead of uploading the boundary again
+	published    []writer.UploadedFile
+	headFiles    []writer.UploadedFile
+	headsRemoved bool
 }
 
-func (b *Bundler) uploadBoundary(ctx context.Context, v interface{}) (interface{}, error) {
-	bf := v.(*boundaryFile)
+// discardFile removes the local data of the file, if any, once it's not needed anymore.
+func discardFile(file writer.Uploadeable) error {
+	if discardable, ok := file.(interface{ Discard() error }); ok {
+		return discardable.Discard()
+	}
 
-	outputPath, err := bf.file.Upload(ctx, b.outputStore)
+	return nil
+}
+
+func (b *Bundler) uploadBoundary(ctx context.Context, bf *boundaryFile) error {
+	if bf.empty {
+		return b.uploadEmptyBoundary(ctx, bf)
+	}
+
+	if bf.head {
+		return b.uploadHead(ctx, bf)
+	}
+
+	if bf.published == nil {
+		if err := b.publishBoundary(ctx, bf); err != nil {
+			return err
+		}
+	}
+	files := bf.published
+
+	replicated := make([]string, 0, len(files)+2)
+	for _, file := range files {
+		replicated = append(replicated, file.Filename)
+	}
+
+	if b.manifest != nil {
+		manifestFilename, err := b.manifest.write(ctx, b.outputStore, bf, files)
+		if err != nil {
+			return fmt.Errorf("unable to write manifest: %w", err)
+		}
+
+		b.zlogger.Info("boundary manifest written", zap.String("boundary", bf.name), zap.String("manifest_path", b.outputStore.ObjectPath(manifestFilename)))
+		replicated = append(replicated, manifestFilename)
+	}
+
+	for _, committer := range b.tableCommitters {
+		filenames, err := committer.Commit(ctx, b.outputStore, bf.name, files)
+		if err != nil {
+			return fmt.Errorf("unable to commit %s tables: %w", committer.Name(), err)
+		}
+
+		b.zlogger.Info("boundary committed to tables", zap.String("boundary", bf.name), zap.String("table_format", committer.Name()), zap.Strings("log_paths", filenames))
+		replicated = append(replicated, filenames...)
+	}
+
+	if b.atomicPublisher != nil {
+		replicated = append(replicated, CommitMarkerFilename(bf.name))
+	}
+
+	// Files are replicated prior removing head files so that a failure is retried on restart
+	if err := b.replicate(ctx, bf.name, replicated); err != nil {
+		return err
+	}
+
+	if len(bf.headFiles) > 0 && !bf.headsRemoved {
+		if err := b.heads.remove(ctx, bf.headFiles); err != nil {
+			return fmt.Errorf("unable to remove compacted heads: %w", err)
+		}
+
+		bf.headsRemoved = true
+		b.zlogger.Info("head files compacted", zap.String("boundary", bf.name), zap.Int("head_count", len(bf.heads)))
+	}
+
+	if b.hooks != nil {
+		event := &HookEvent{
+			Boundary: bf.name,
+			Manifest: newManifest(bf, files, b.hooks.moduleName, b.hooks.moduleHash),
+			URLs:     outputURLs(b.outputStore, files),
+		}
+
+		if err := b.hooks.run(ctx, event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishBoundary uploads the files of the boundary, compacting its head files if any, and
+// records them in bf.published. The local data of the boundary is removed once uploaded.
+func (b *Bundler) publishBoundary(ctx context.Context, bf *boundaryFile) error {
+	file := bf.file
+	var headFiles []writer.UploadedFile
+	if len(bf.heads) > 0 {
+		var err error
+		if headFiles, err = b.heads.wait(ctx, bf.heads, b.uploadQueue.Terminating()); err != nil {
+			return err
+		}
+
+		for _, head := range bf.heads {
+			if err := discardFile(head.file); err != nil {
+				return fmt.Errorf("discard uploaded head: %w", err)
+			}
+		}
+
+		file = b.boundaryWriter.Compact(b.heads.store, headFiles, bf.namer)
+	}
+
+	start := time.Now()
+	var files []writer.UploadedFile
+	var err error
+	if b.atomicPublisher != nil {
+		files, err = b.atomicPublisher.publish(ctx, bf.name, file)
+	} else {
+		files, err = file.Upload(ctx, b.outputStore)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("unable to upload: %w", err)
+		return fmt.Errorf("unable to upload: %w", err)
 	}
+	UploadDuration.ObserveSince(start)
+	recordWrittenFiles(files)
+
 	b.zlogger.Info("boundary uploaded",
 		zap.String("boundary", bf.name),
-		zap.String("output_path", outputPath),
+		zap.Strings("output_paths", outputPaths(b.outputStore, files)),
 	)
 
-	return bf, nil
+	bf.published = files
+	bf.headFiles = headFiles
+
+	if err := discardFile(file); err != nil {
+		return fmt.Errorf("discard uploaded file: %w", err)
+	}
+
+	return nil
+}
+
+func outputURLs(store dstore.Store, files []writer.UploadedFile) []string {
+	out := make([]string, len(files))
+	for i, file := range files {
+		out[i] = store.ObjectURL(file.Filename)
+	}
+	return out
+}
+
+func outputPaths(store dstore.Store, files []writer.UploadedFile) []string {
+	out := make([]string, len(files))
+	for i, file := range files {
+		out[i] = store.ObjectPath(file.Filename)
+	}
+	return out
 }
@@ -1,9 +1,27 @@
 package bundler
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
 	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/streamingfast/substreams-sink-files/v2/state"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	sink "github.com/streamingfast/substreams/sink"
 	"github.com/stretchr/testify/assert"
-	"testing"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestBoundary_newBoundary(t *testing.T) {
@@ -79,3 +97,820 @@ func TestBundler_boundariesToSkip(t *testing.T) {
 		})
 	}
 }
+
+func TestBundler_splitIfFull(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []Option
+		blocks      []uint64
+		expectFiles map[string]string
+	}{
+		{
+			"max rows",
+			[]Option{WithMaxFileRows(2)},
+			[]uint64{0, 1, 2, 3, 4, 5, 100},
+			map[string]string{
+				"0000000000-0000000002.jsonl": "0\n1\n",
+				"0000000002-0000000004.jsonl": "2\n3\n",
+				"0000000004-0000000100.jsonl": "4\n5\n",
+			},
+		},
+		{
+			"max size",
+			[]Option{WithMaxFileSize(5)},
+			[]uint64{0, 1, 2, 3, 4, 5, 100},
+			map[string]string{
+				"0000000000-0000000003.jsonl": "0\n1\n2\n",
+				"0000000003-0000000100.jsonl": "3\n4\n5\n",
+			},
+		},
+		{
+			"time window",
+			[]Option{WithMaxFileRows(2), WithTimeWindow(time.Hour)},
+			[]uint64{0, 1, 2, 3, 4, 5, 3600},
+			map[string]string{
+				"19700101T000000Z-19700101T010000Z_0000000000-0000000002.jsonl": "0\n1\n",
+				"19700101T000000Z-19700101T010000Z_0000000002-0000000004.jsonl": "2\n3\n",
+				"19700101T000000Z-19700101T010000Z_0000000004-0000003600.jsonl": "4\n5\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			outputDir := t.TempDir()
+
+			outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+			require.NoError(t, err)
+
+			stateStore, err := state.NewFileStateStore(filepath.Join(t.TempDir(), "state.yaml"))
+			require.NoError(t, err)
+
+			boundaryWriter := writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop())
+			b, err := New(100, boundaryWriter, stateStore, outputStore, zap.NewNop(), test.opts...)
+			require.NoError(t, err)
+
+			b.Launch(ctx)
+			require.NoError(t, b.Start(0))
+
+			for _, blockNum := range test.blocks {
+				// Block timestamp is the block number in seconds
+				require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+				_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+				require.NoError(t, err)
+
+				b.SetCursor(testCursor(blockNum))
+			}
+			b.Shutdown(nil)
+			<-b.Terminated()
+			require.NoError(t, b.Err())
+
+			actualFiles := readOutputFiles(t, outputDir, len(test.expectFiles))
+			assert.Equal(t, test.expectFiles, actualFiles)
+		})
+	}
+}
+
+func TestBundler_Header(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []Option
+		blocks      []uint64
+		expectFiles map[string]string
+	}{
+		{
+			"split and empty files",
+			[]Option{WithMaxFileRows(2)},
+			[]uint64{0, 1, 2, 3, 4, 250},
+			map[string]string{
+				"0000000000-0000000002.jsonl": "block\n0\n1\n",
+				"0000000002-0000000004.jsonl": "block\n2\n3\n",
+				"0000000004-0000000100.jsonl": "block\n4\n",
+				"0000000100-0000000200.jsonl": "block\n",
+				"0000000200-0000000300.jsonl": "block\n250\n",
+			},
+		},
+		{
+			"compacted head files",
+			[]Option{WithMaxBoundaryAge(time.Nanosecond, filepath.Join(t.TempDir(), "head"))},
+			[]uint64{0, 10, 20, 250},
+			map[string]string{
+				"0000000000-0000000100.jsonl": "block\n0\n10\n20\n",
+				"0000000100-0000000200.jsonl": "block\n",
+				"0000000200-0000000300.jsonl": "block\n250\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			outputDir := t.TempDir()
+
+			outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+			require.NoError(t, err)
+
+			stateStore, err := state.NewFileStateStore(filepath.Join(t.TempDir(), "state.yaml"))
+			require.NoError(t, err)
+
+			// The header is written at the start of every file without being counted as a row
+			boundaryWriter := writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop(), writer.BufferedHeader([]byte("block\n")))
+			b, err := New(100, boundaryWriter, stateStore, outputStore, zap.NewNop(), test.opts...)
+			require.NoError(t, err)
+
+			b.Launch(ctx)
+			require.NoError(t, b.Start(0))
+
+			for _, blockNum := range test.blocks {
+				require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+				_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+				require.NoError(t, err)
+
+				b.SetCursor(testCursor(blockNum))
+			}
+			require.NoError(t, b.Finish(ctx, 300))
+
+			b.Shutdown(nil)
+			<-b.Terminated()
+			require.NoError(t, b.Err())
+
+			assert.Equal(t, test.expectFiles, readOutputFiles(t, outputDir, len(test.expectFiles)))
+		})
+	}
+}
+
+func TestBundler_Finish(t *testing.T) {
+	tests := []struct {
+		name            string
+		blocks          []uint64
+		stopBlock       uint64
+		expectFiles     map[string]string
+		expectCompleted bool
+	}{
+		{
+			"stop block at boundary end",
+			[]uint64{100, 150, 199},
+			200,
+			map[string]string{"0000000100-0000000200.jsonl": "100\n150\n199\n"},
+			true,
+		},
+		{
+			"empty boundaries up to stop block",
+			[]uint64{100, 150},
+			400,
+			map[string]string{
+				"0000000100-0000000200.jsonl": "100\n150\n",
+				"0000000200-0000000300.jsonl": "",
+				"0000000300-0000000400.jsonl": "",
+			},
+			true,
+		},
+		{
+			"stop block within active boundary",
+			[]uint64{100, 150},
+			180,
+			map[string]string{"0000000100-0000000180.jsonl": "100\n150\n"},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			outputDir := t.TempDir()
+
+			outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+			require.NoError(t, err)
+
+			stateStore, err := state.NewFileStateStore(filepath.Join(t.TempDir(), "state.yaml"))
+			require.NoError(t, err)
+
+			boundaryWriter := writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop())
+			b, err := New(100, boundaryWriter, stateStore, outputStore, zap.NewNop())
+			require.NoError(t, err)
+
+			b.Launch(ctx)
+			require.NoError(t, b.Start(test.blocks[0]))
+
+			for _, blockNum := range test.blocks {
+				require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+				_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+				require.NoError(t, err)
+
+				b.SetCursor(testCursor(blockNum))
+			}
+
+			require.NoError(t, b.Finish(ctx, test.stopBlock))
+			assert.Equal(t, test.expectCompleted, stateStore.IsCompleted())
+
+			b.Shutdown(nil)
+			<-b.Terminated()
+			require.NoError(t, b.Err())
+
+			assert.Equal(t, test.expectFiles, readOutputFiles(t, outputDir, len(test.expectFiles)))
+		})
+	}
+}
+
+func TestBundler_FinishPartialThenExtend(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+	statePath := filepath.Join(t.TempDir(), "state.yaml")
+
+	outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+	require.NoError(t, err)
+
+	run := func(startBlock uint64, blocks []uint64, stopBlock uint64) {
+		stateStore, err := state.NewFileStateStore(statePath)
+		require.NoError(t, err)
+
+		b, err := New(100, writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop())
+		require.NoError(t, err)
+
+		b.Launch(ctx)
+		require.NoError(t, b.Start(startBlock))
+
+		for _, blockNum := range blocks {
+			require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+			_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+			require.NoError(t, err)
+
+			b.SetCursor(testCursor(blockNum))
+		}
+
+		require.NoError(t, b.Finish(ctx, stopBlock))
+
+		b.Shutdown(nil)
+		<-b.Terminated()
+		require.NoError(t, b.Err())
+	}
+
+	run(100, []uint64{100, 150, 170}, 180)
+	assert.Equal(t, map[string]string{
+		"0000000100-0000000180.jsonl": "100\n150\n170\n",
+	}, readOutputFiles(t, outputDir, 1))
+
+	// The cursor is at block 170, the next run continues after the partial boundary
+	run(171, []uint64{180, 190, 250}, 300)
+	assert.Equal(t, map[string]string{
+		"0000000100-0000000180.jsonl": "100\n150\n170\n",
+		"0000000180-0000000200.jsonl": "180\n190\n",
+		"0000000200-0000000300.jsonl": "250\n",
+	}, readOutputFiles(t, outputDir, 3))
+}
+
+func TestBundler_TimeWindowResume(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+	statePath := filepath.Join(t.TempDir(), "state.yaml")
+
+	outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+	require.NoError(t, err)
+
+	run := func(windowSize time.Duration, blocks []uint64, stopBlock uint64) {
+		stateStore, err := state.NewFileStateStore(statePath)
+		require.NoError(t, err)
+
+		b, err := New(100, writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop(), WithTimeWindow(windowSize))
+		require.NoError(t, err)
+
+		b.Launch(ctx)
+		require.NoError(t, b.Start(blocks[0]))
+
+		for _, blockNum := range blocks {
+			// Block timestamp is the block number in seconds
+			require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+			_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+			require.NoError(t, err)
+
+			b.SetCursor(testCursor(blockNum))
+		}
+
+		require.NoError(t, b.Finish(ctx, stopBlock))
+
+		b.Shutdown(nil)
+		<-b.Terminated()
+		require.NoError(t, b.Err())
+	}
+
+	run(2*time.Hour, []uint64{0, 10}, 20)
+	assert.Equal(t, map[string]string{
+		"19700101T000000Z-19700101T020000Z_0000000000-0000000020.jsonl": "0\n10\n",
+	}, readOutputFiles(t, outputDir, 1))
+
+	// The window saved in the state is continued even though the window size changed
+	run(time.Hour, []uint64{20, 3700, 7300}, 7400)
+	assert.Equal(t, map[string]string{
+		"19700101T000000Z-19700101T020000Z_0000000000-0000000020.jsonl": "0\n10\n",
+		"19700101T000000Z-19700101T020000Z_0000000020-0000007300.jsonl": "20\n3700\n",
+		"19700101T020000Z-19700101T030000Z_0000007300-0000007400.jsonl": "7300\n",
+	}, readOutputFiles(t, outputDir, 3))
+}
+
+func TestBundler_MaxBoundaryAge(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+
+	outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+	require.NoError(t, err)
+
+	stateStore, err := state.NewFileStateStore(filepath.Join(t.TempDir(), "state.yaml"))
+	require.NoError(t, err)
+
+	// Every block after the first one of a boundary flushes a head file
+	boundaryWriter := writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop())
+	b, err := New(100, boundaryWriter, stateStore, outputStore, zap.NewNop(), WithMaxBoundaryAge(time.Nanosecond, t.TempDir()))
+	require.NoError(t, err)
+
+	b.Launch(ctx)
+	require.NoError(t, b.Start(100))
+
+	for _, blockNum := range []uint64{100, 110, 120, 250} {
+		require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+		_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+		require.NoError(t, err)
+
+		b.SetCursor(testCursor(blockNum))
+	}
+
+	require.NoError(t, b.Finish(ctx, 300))
+
+	b.Shutdown(nil)
+	<-b.Terminated()
+	require.NoError(t, b.Err())
+
+	assert.Equal(t, map[string]string{
+		"0000000100-0000000200.jsonl": "100\n110\n120\n",
+		"0000000200-0000000300.jsonl": "250\n",
+	}, readOutputFiles(t, outputDir, 2))
+
+	heads, err := os.ReadDir(filepath.Join(outputDir, HeadPrefix))
+	if !os.IsNotExist(err) {
+		require.NoError(t, err)
+		assert.Empty(t, heads)
+	}
+}
+
+func TestBundler_Status(t *testing.T) {
+	ctx := context.Background()
+
+	outputStore, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+	require.NoError(t, err)
+
+	stateStore, err := state.NewFileStateStore(filepath.Join(t.TempDir(), "state.yaml"))
+	require.NoError(t, err)
+
+	b, err := New(100, writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop())
+	require.NoError(t, err)
+
+	b.Launch(ctx)
+	require.NoError(t, b.Start(0))
+
+	for _, blockNum := range []uint64{10, 150} {
+		require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+		b.SetCursor(testCursor(blockNum))
+	}
+
+	require.Eventually(t, func() bool {
+		status := b.Status()
+		return status.LastCommittedBoundary != nil && status.PendingUploads == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	status := b.Status()
+	assert.Equal(t, "0000000000-0000000100", status.LastCommittedBoundary.Name)
+	assert.Equal(t, testCursor(10).String(), status.LastCommittedBoundary.Cursor)
+	assert.Equal(t, state.ActiveBoundary{StartBlockNumber: 100, EndBlockNumber: 200}, status.ActiveBoundary.ActiveBoundary)
+	assert.Equal(t, uint64(150), status.Block.Number)
+	assert.False(t, status.Terminated)
+	assert.False(t, status.StartedAt.IsZero())
+
+	b.Shutdown(nil)
+	<-b.Terminated()
+	assert.True(t, b.Status().Terminated)
+}
+
+func TestBundler_MaxBoundaryAgeRevert(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+
+	outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+	require.NoError(t, err)
+
+	stateStore, err := state.NewFileStateStore(filepath.Join(t.TempDir(), "state.yaml"))
+	require.NoError(t, err)
+
+	boundaryWriter := writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop())
+	b, err := New(100, boundaryWriter, stateStore, outputStore, zap.NewNop(), WithMaxBoundaryAge(time.Nanosecond, t.TempDir()))
+	require.NoError(t, err)
+
+	b.Launch(ctx)
+	require.NoError(t, b.Start(100))
+
+	roll := func(blockNum uint64, data string) {
+		require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+		_, err := b.Writer().Write([]byte(data))
+		require.NoError(t, err)
+
+		b.SetCursor(testCursor(blockNum))
+	}
+
+	headFiles := func() (out []string) {
+		entries, err := os.ReadDir(filepath.Join(outputDir, HeadPrefix))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		require.NoError(t, err)
+		for _, entry := range entries {
+			out = append(out, entry.Name())
+		}
+		return out
+	}
+
+	// Head files [100, 110) and [110, 120) are flushed, block 120 being in the active part
+	roll(100, "100\n")
+	roll(110, "110\n")
+	roll(120, "120\n")
+	require.Eventually(t, func() bool { return len(headFiles()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// Block 110 is kept while the head file holding it is deleted as it holds forked block 120
+	require.NoError(t, b.Revert(ctx, testCursor(110)))
+	assert.Equal(t, []string{"0000000100-0000000110.jsonl"}, headFiles())
+
+	roll(115, "115\n")
+	roll(250, "250\n")
+	require.NoError(t, b.Finish(ctx, 300))
+
+	b.Shutdown(nil)
+	<-b.Terminated()
+	require.NoError(t, b.Err())
+
+	assert.Equal(t, map[string]string{
+		"0000000100-0000000200.jsonl": "100\n110\n115\n",
+		"0000000200-0000000300.jsonl": "250\n",
+	}, readOutputFiles(t, outputDir, 2))
+	assert.Empty(t, headFiles())
+}
+
+func TestBundler_EmptyBoundaryPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      EmptyBoundaryPolicy
+		blocks      []uint64
+		data        map[uint64]string
+		stopBlock   uint64
+		expectFiles map[string]string
+	}{
+		{
+			"write",
+			EmptyBoundaryWrite,
+			[]uint64{100, 150, 450, 520},
+			map[uint64]string{100: "100\n", 450: "450\n"},
+			700,
+			map[string]string{
+				"0000000100-0000000200.jsonl": "100\n",
+				"0000000200-0000000300.jsonl": "",
+				"0000000300-0000000400.jsonl": "",
+				"0000000400-0000000500.jsonl": "450\n",
+				"0000000500-0000000600.jsonl": "",
+				"0000000600-0000000700.jsonl": "",
+			},
+		},
+		{
+			"skip",
+			EmptyBoundarySkip,
+			[]uint64{100, 150, 450, 520},
+			map[uint64]string{100: "100\n", 450: "450\n"},
+			700,
+			map[string]string{
+				"0000000100-0000000200.jsonl": "100\n",
+				"0000000400-0000000500.jsonl": "450\n",
+			},
+		},
+		{
+			"marker",
+			EmptyBoundaryMarker,
+			[]uint64{100, 150, 450, 520},
+			map[uint64]string{100: "100\n", 450: "450\n"},
+			700,
+			map[string]string{
+				"0000000100-0000000200.jsonl": "100\n",
+				"0000000200-0000000400.empty": "",
+				"0000000400-0000000500.jsonl": "450\n",
+				"0000000500-0000000600.empty": "",
+				"0000000600-0000000700.empty": "",
+			},
+		},
+		{
+			"marker on long gap",
+			EmptyBoundaryMarker,
+			[]uint64{100, 1000050},
+			map[uint64]string{100: "100\n", 1000050: "1000050\n"},
+			1000100,
+			map[string]string{
+				"0000000100-0000000200.jsonl": "100\n",
+				"0000000200-0001000000.empty": "",
+				"0001000000-0001000100.jsonl": "1000050\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			outputDir := t.TempDir()
+
+			outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+			require.NoError(t, err)
+
+			statePath := filepath.Join(t.TempDir(), "state.yaml")
+			stateStore, err := state.NewFileStateStore(statePath)
+			require.NoError(t, err)
+
+			boundaryWriter := writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop())
+			b, err := New(100, boundaryWriter, stateStore, outputStore, zap.NewNop(), WithEmptyBoundaryPolicy(test.policy))
+			require.NoError(t, err)
+
+			b.Launch(ctx)
+			require.NoError(t, b.Start(test.blocks[0]))
+
+			for _, blockNum := range test.blocks {
+				require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+				_, err := b.Writer().Write([]byte(test.data[blockNum]))
+				require.NoError(t, err)
+
+				b.SetCursor(testCursor(blockNum))
+			}
+
+			require.NoError(t, b.Finish(ctx, test.stopBlock))
+
+			b.Shutdown(nil)
+			<-b.Terminated()
+			require.NoError(t, b.Err())
+
+			assert.Equal(t, test.expectFiles, readOutputFiles(t, outputDir, len(test.expectFiles)))
+
+			saved, err := state.NewFileStateStore(statePath)
+			require.NoError(t, err)
+			assert.True(t, saved.IsCompleted())
+
+			cursor, err := saved.ReadCursor()
+			require.NoError(t, err)
+			assert.Equal(t, test.blocks[len(test.blocks)-1], cursor.Block().Num())
+		})
+	}
+}
+
+func TestBundler_Checkpoint(t *testing.T) {
+	tests := []struct {
+		name         string
+		savedCursor  *sink.Cursor
+		expectCursor uint64
+		resumeBlocks []uint64
+		expectFiles  map[string]string
+	}{
+		{
+			"resume from checkpoint",
+			nil,
+			150,
+			[]uint64{170},
+			map[string]string{"0000000100-0000000200.jsonl": "100\n150\n170\n"},
+		},
+		{
+			"checkpoint discarded when state moved",
+			testCursor(99),
+			99,
+			[]uint64{100, 170},
+			map[string]string{"0000000100-0000000200.jsonl": "100\n170\n"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			outputDir := t.TempDir()
+			workingDir := t.TempDir()
+			checkpointDir := filepath.Join(t.TempDir(), "checkpoint")
+			statePath := filepath.Join(t.TempDir(), "state.yaml")
+
+			outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+			require.NoError(t, err)
+
+			rollBlocks := func(b *Bundler, blocks []uint64) {
+				for _, blockNum := range blocks {
+					require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+					_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+					require.NoError(t, err)
+
+					b.SetCursor(testCursor(blockNum))
+				}
+			}
+
+			// The first bundler "crashes" after block 160, the checkpoint taken when
+			// rolling to it contains blocks up to 150
+			stateStore, err := state.NewFileStateStore(statePath)
+			require.NoError(t, err)
+
+			crashed, err := New(100, writer.NewBufferedIO(1024, workingDir, writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop(), WithCheckpoint(0, checkpointDir))
+			require.NoError(t, err)
+			require.NoError(t, crashed.Start(100))
+			rollBlocks(crashed, []uint64{100, 150, 160})
+
+			if test.savedCursor != nil {
+				stateStore.SetCursor(test.savedCursor)
+				saveable, err := stateStore.GetState()
+				require.NoError(t, err)
+				require.NoError(t, saveable.Save())
+			}
+
+			stateStore, err = state.NewFileStateStore(statePath)
+			require.NoError(t, err)
+
+			b, err := New(100, writer.NewBufferedIO(1024, workingDir, writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop(), WithCheckpoint(0, checkpointDir))
+			require.NoError(t, err)
+			require.NoError(t, b.Recover(ctx))
+
+			cursor, err := b.GetCursor()
+			require.NoError(t, err)
+			assert.Equal(t, test.expectCursor, cursor.Block().Num())
+
+			b.Launch(ctx)
+			require.NoError(t, b.Start(cursor.Block().Num()+1))
+			rollBlocks(b, test.resumeBlocks)
+			require.NoError(t, b.Finish(ctx, 200))
+
+			b.Shutdown(nil)
+			<-b.Terminated()
+			require.NoError(t, b.Err())
+
+			assert.Equal(t, test.expectFiles, readOutputFiles(t, outputDir, len(test.expectFiles)))
+			assert.NoDirExists(t, checkpointDir)
+		})
+	}
+}
+
+func TestBundler_CheckpointRevert(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+	workingDir := t.TempDir()
+	checkpointDir := filepath.Join(t.TempDir(), "checkpoint")
+	statePath := filepath.Join(t.TempDir(), "state.yaml")
+
+	outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+	require.NoError(t, err)
+
+	rollBlocks := func(b *Bundler, blocks []uint64) {
+		for _, blockNum := range blocks {
+			require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+			_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+			require.NoError(t, err)
+
+			b.SetCursor(testCursor(blockNum))
+		}
+	}
+
+	stateStore, err := state.NewFileStateStore(statePath)
+	require.NoError(t, err)
+	stateStore.SetCursor(testCursor(99))
+	saveable, err := stateStore.GetState()
+	require.NoError(t, err)
+	require.NoError(t, saveable.Save())
+
+	// The first bundler "crashes" right after reverting to block 100, below the checkpoint
+	// taken when rolling to block 160 which contains blocks up to 150
+	crashed, err := New(100, writer.NewBufferedIO(1024, workingDir, writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop(), WithCheckpoint(0, checkpointDir))
+	require.NoError(t, err)
+	require.NoError(t, crashed.Start(100))
+	rollBlocks(crashed, []uint64{100, 150, 160})
+	require.NoError(t, crashed.Revert(ctx, testCursor(100)))
+
+	stateStore, err = state.NewFileStateStore(statePath)
+	require.NoError(t, err)
+
+	b, err := New(100, writer.NewBufferedIO(1024, workingDir, writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop(), WithCheckpoint(0, checkpointDir))
+	require.NoError(t, err)
+	require.NoError(t, b.Recover(ctx))
+
+	cursor, err := b.GetCursor()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(99), cursor.Block().Num())
+
+	// The checkpoint was discarded, the boundary is processed again from its start
+	b.Launch(ctx)
+	require.NoError(t, b.Start(100))
+	rollBlocks(b, []uint64{100, 150, 160})
+	require.NoError(t, b.Revert(ctx, testCursor(100)))
+	rollBlocks(b, []uint64{151, 170})
+	require.NoError(t, b.Finish(ctx, 200))
+
+	b.Shutdown(nil)
+	<-b.Terminated()
+	require.NoError(t, b.Err())
+
+	assert.Equal(t, map[string]string{"0000000100-0000000200.jsonl": "100\n151\n170\n"}, readOutputFiles(t, outputDir, 1))
+}
+
+func TestBundler_RetryAfterUpload(t *testing.T) {
+	ctx := context.Background()
+	workingDir := t.TempDir()
+
+	// The manifest write fails once, after the boundary's file was uploaded
+	lock := sync.Mutex{}
+	manifestFailed := false
+	outputStore := dstore.NewMockStore(nil)
+	outputStore.WriteObjectFunc = func(_ context.Context, base string, f io.Reader) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if strings.HasSuffix(base, ".manifest.json") && !manifestFailed {
+			manifestFailed = true
+			return errors.New("transient failure")
+		}
+
+		content, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+
+		outputStore.Files[base] = content
+		return nil
+	}
+
+	stateStore, err := state.NewFileStateStore(filepath.Join(t.TempDir(), "state.yaml"))
+	require.NoError(t, err)
+
+	// A tiny buffer so that the boundary is uploaded from its working file
+	b, err := New(100, writer.NewBufferedIO(4, workingDir, writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop(), WithManifest("map_events", "abcdef"), WithUploadRetry(2, time.Millisecond))
+	require.NoError(t, err)
+
+	b.Launch(ctx)
+	require.NoError(t, b.Start(100))
+
+	for _, blockNum := range []uint64{100, 150} {
+		require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+		_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+		require.NoError(t, err)
+
+		b.SetCursor(testCursor(blockNum))
+	}
+	require.NoError(t, b.Finish(ctx, 200))
+
+	b.Shutdown(nil)
+	<-b.Terminated()
+	require.NoError(t, b.Err())
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	assert.True(t, manifestFailed)
+	assert.Equal(t, "100\n150\n", string(outputStore.Files["0000000100-0000000200.jsonl"]))
+	assert.Contains(t, outputStore.Files, "0000000100-0000000200.manifest.json")
+
+	entries, err := os.ReadDir(workingDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "working file is removed once uploaded")
+}
+
+// readOutputFiles returns the content of the files written to the output directory
+// once it contains the expected amount of files, closing the bundler does not wait
+// for in-flight uploads to complete.
+func readOutputFiles(t *testing.T, outputDir string, expectedCount int) map[string]string {
+	t.Helper()
+
+	actualFiles := map[string]string{}
+	require.Eventually(t, func() bool {
+		entries, err := os.ReadDir(outputDir)
+		require.NoError(t, err)
+
+		actualFiles = map[string]string{}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+				continue
+			}
+
+			content, err := os.ReadFile(filepath.Join(outputDir, entry.Name()))
+			require.NoError(t, err)
+			actualFiles[entry.Name()] = string(content)
+		}
+
+		return len(actualFiles) == expectedCount
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return actualFiles
+}
+
+func testCursor(blockNum uint64) *sink.Cursor {
+	block := bstream.NewBlockRef(fmt.Sprintf("%08x", blockNum), blockNum)
+	return &sink.Cursor{Cursor: &bstream.Cursor{Step: bstream.StepNewIrreversible, Block: block, LIB: block, HeadBlock: block}}
+}
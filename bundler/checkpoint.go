@@ -0,0 +1,278 @@
+package bundler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	sink "github.com/streamingfast/substreams/sink"
+	"go.uber.org/zap"
+)
+
+const checkpointFilename = "checkpoint.json"
+
+// checkpointer periodically saves the active boundary to a local directory so that,
+// after a crash, the sink resumes from the last checkpoint instead of re-processing
+// the boundary from its start block.
+//
+// Each checkpoint writes the boundary writer's data in a new sub-directory then
+// atomically replaces 'checkpoint.json' to point to it, so a crash while checkpointing
+// leaves the previous checkpoint intact.
+//
+// A checkpoint is only valid if all boundaries prior the checkpointed one were uploaded,
+// this is the case when the cursor saved in the state is the one the state had when
+// the checkpointed boundary started.
+type checkpointer struct {
+	interval time.Duration
+	dir      string
+	zlogger  *zap.Logger
+
+	// lastAt is the time of the last checkpoint or the start of the active boundary
+	lastAt time.Time
+	// previousCursor is the state's cursor when the active boundary started
+	previousCursor string
+	// restored is the checkpoint loaded by recover, consumed when the bundler starts
+	restored *boundaryCheckpoint
+	// saved is the checkpoint of the active boundary, nil if it has none
+	saved *boundaryCheckpoint
+}
+
+type boundaryCheckpoint struct {
+	// DataDir is the sub-directory, relative to the checkpoint directory, holding the
+	// boundary writer's data
+	DataDir     string     `json:"data_dir"`
+	StartBlock  uint64     `json:"start_block"`
+	EndBlock    *uint64    `json:"end_block,omitempty"`
+	WindowStart *time.Time `json:"window_start,omitempty"`
+	WindowEnd   *time.Time `json:"window_end,omitempty"`
+
+	FirstBlock     *ManifestBlock `json:"first_block"`
+	FirstBlockTime time.Time      `json:"first_block_time"`
+	LastBlock      *ManifestBlock `json:"last_block"`
+	// Cursor is the cursor of the last block written to the checkpoint
+	Cursor string `json:"cursor"`
+	// PreviousCursor is the state's cursor when the boundary started
+	PreviousCursor string `json:"previous_cursor"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c *boundaryCheckpoint) boundary() *bstream.Range {
+	if c.EndBlock == nil {
+		return bstream.NewOpenRange(c.StartBlock)
+	}
+
+	return bstream.NewRangeExcludingEnd(c.StartBlock, *c.EndBlock)
+}
+
+func (c *boundaryCheckpoint) window() *timeWindow {
+	if c.WindowStart == nil || c.WindowEnd == nil {
+		return nil
+	}
+
+	return &timeWindow{start: c.WindowStart.UTC(), end: c.WindowEnd.UTC()}
+}
+
+func newCheckpointer(interval time.Duration, dir string, zlogger *zap.Logger) *checkpointer {
+	return &checkpointer{
+		interval: interval,
+		dir:      dir,
+		zlogger:  zlogger,
+	}
+}
+
+// recover loads the checkpoint left by a previous run, it's discarded if the cursor
+// saved in the state is not the one recorded when the checkpointed boundary started.
+func (c *checkpointer) recover(savedCursor *sink.Cursor) error {
+	content, err := os.ReadFile(filepath.Join(c.dir, checkpointFilename))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return fmt.Errorf("read checkpoint: %w", err)
+	}
+
+	checkpoint := &boundaryCheckpoint{}
+	if err := json.Unmarshal(content, checkpoint); err != nil {
+		return fmt.Errorf("unmarshal checkpoint: %w", err)
+	}
+
+	if checkpoint.PreviousCursor != savedCursor.String() {
+		c.zlogger.Info("discarding checkpoint, boundaries prior the checkpointed one were not all written",
+			zap.Stringer("checkpoint_boundary", checkpoint.boundary()),
+			zap.Stringer("saved_cursor_block", savedCursor.Block()),
+		)
+
+		return c.discard()
+	}
+
+	c.zlogger.Info("resuming from checkpoint",
+		zap.Stringer("boundary", checkpoint.boundary()),
+		zap.Uint64("last_block", checkpoint.LastBlock.Number),
+		zap.Time("created_at", checkpoint.CreatedAt),
+	)
+
+	c.restored = checkpoint
+	return nil
+}
+
+// due returns true if the interval elapsed since the last checkpoint.
+func (c *checkpointer) due() bool {
+	return time.Since(c.lastAt) >= c.interval
+}
+
+// dataDir returns the sub-directory where the data of the checkpoint of the given
+// block is saved.
+func (c *checkpointer) dataDir(blockNum uint64) string {
+	return fmt.Sprintf("%010d", blockNum)
+}
+
+// save writes the checkpoint file then removes the data of older checkpoints.
+func (c *checkpointer) save(checkpoint *boundaryCheckpoint) error {
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("marshal checkpoint: %w", err)
+	}
+
+	path := filepath.Join(c.dir, checkpointFilename)
+	if err := os.WriteFile(path+".tmp", content, 0644); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("rename checkpoint: %w", err)
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("list checkpoints: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != checkpoint.DataDir {
+			if err := os.RemoveAll(filepath.Join(c.dir, entry.Name())); err != nil {
+				return fmt.Errorf("remove old checkpoint: %w", err)
+			}
+		}
+	}
+
+	c.saved = checkpoint
+	c.lastAt = time.Now()
+	return nil
+}
+
+// discard removes the checkpoint, called once the checkpointed boundary is closed.
+func (c *checkpointer) discard() error {
+	if err := os.RemoveAll(c.dir); err != nil {
+		return fmt.Errorf("remove checkpoint: %w", err)
+	}
+
+	c.saved = nil
+	return nil
+}
+
+// revert discards the checkpoint if it contains blocks after the last valid block, the
+// data the writer keeps for it being about to be truncated. The next checkpoint is due
+// right away so the boundary doesn't stay without one.
+func (c *checkpointer) revert(lastValidBlockNum uint64) error {
+	if c.saved == nil || c.saved.LastBlock.Number <= lastValidBlockNum {
+		return nil
+	}
+
+	c.zlogger.Info("discarding checkpoint containing reverted blocks",
+		zap.Uint64("checkpoint_last_block", c.saved.LastBlock.Number),
+		zap.Uint64("last_valid_block", lastValidBlockNum),
+	)
+
+	if err := c.discard(); err != nil {
+		return err
+	}
+
+	c.lastAt = time.Time{}
+	return nil
+}
+
+// checkpoint saves the active boundary if the checkpoint interval elapsed since the
+// last one, boundaries without any block yet are never checkpointed.
+func (b *Bundler) checkpoint() error {
+	if b.checkpointer == nil || b.activeBoundary == nil || b.activeBlocks.last == nil || !b.checkpointer.due() {
+		return nil
+	}
+
+	dataDir := b.checkpointer.dataDir(b.activeBlocks.last.Num())
+	path := filepath.Join(b.checkpointer.dir, dataDir)
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("remove checkpoint data directory: %w", err)
+	}
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("create checkpoint data directory: %w", err)
+	}
+
+	if err := b.boundaryWriter.Checkpoint(path); err != nil {
+		return fmt.Errorf("checkpoint writer: %w", err)
+	}
+
+	checkpoint := &boundaryCheckpoint{
+		DataDir:        dataDir,
+		StartBlock:     b.activeBoundary.StartBlock(),
+		EndBlock:       b.activeBoundary.EndBlock(),
+		FirstBlock:     newManifestBlock(b.activeBlocks.first),
+		FirstBlockTime: b.activeBlocks.firstTime,
+		LastBlock:      newManifestBlock(b.activeBlocks.last),
+		Cursor:         b.activeBlocks.cursor.String(),
+		PreviousCursor: b.checkpointer.previousCursor,
+		CreatedAt:      time.Now().UTC(),
+	}
+
+	if b.activeWindow != nil {
+		checkpoint.WindowStart = &b.activeWindow.start
+		checkpoint.WindowEnd = &b.activeWindow.end
+	}
+
+	if err := b.checkpointer.save(checkpoint); err != nil {
+		return err
+	}
+
+	b.zlogger.Debug("active boundary checkpointed", zap.Stringer("boundary", b.activeBoundary), zap.Stringer("last_block", b.activeBlocks.last))
+	return nil
+}
+
+// restoreCheckpoint makes the checkpointed boundary the active one.
+func (b *Bundler) restoreCheckpoint(checkpoint *boundaryCheckpoint) error {
+	cursor, err := sink.NewCursor(checkpoint.Cursor)
+	if err != nil {
+		return fmt.Errorf("invalid checkpoint cursor: %w", err)
+	}
+
+	boundary := checkpoint.boundary()
+	if err := b.boundaryWriter.RestoreCheckpoint(filepath.Join(b.checkpointer.dir, checkpoint.DataDir), boundary); err != nil {
+		return fmt.Errorf("restore writer: %w", err)
+	}
+
+	b.activeBoundary = boundary
+	b.activeWindow = checkpoint.window()
+	b.activeBlocks = activeBlocks{
+		first:     bstream.NewBlockRef(checkpoint.FirstBlock.ID, checkpoint.FirstBlock.Number),
+		firstTime: checkpoint.FirstBlockTime,
+		last:      bstream.NewBlockRef(checkpoint.LastBlock.ID, checkpoint.LastBlock.Number),
+		cursor:    cursor,
+	}
+
+	b.stats.startBoundary(boundary)
+	b.stateStore.NewBoundary(b.activeStateBoundary())
+	b.stateStore.SetCursor(cursor)
+
+	b.checkpointer.previousCursor = checkpoint.PreviousCursor
+	b.checkpointer.saved = checkpoint
+	b.checkpointer.lastAt = time.Now()
+
+	b.zlogger.Info("boundary restored from checkpoint", zap.Stringer("boundary", boundary), zap.Stringer("last_block", b.activeBlocks.last))
+	return nil
+}
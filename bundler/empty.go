@@ -0,0 +1,123 @@
+package bundler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/substreams-sink-files/v2/state"
+	"go.uber.org/zap"
+)
+
+// EmptyBoundaryPolicy is what to do with boundaries that contain no data at all.
+type EmptyBoundaryPolicy string
+
+const (
+	// EmptyBoundaryWrite writes empty boundaries like any other, producing empty files
+	EmptyBoundaryWrite EmptyBoundaryPolicy = "write"
+	// EmptyBoundarySkip writes nothing for empty boundaries, only the state is saved
+	EmptyBoundarySkip EmptyBoundaryPolicy = "skip"
+	// EmptyBoundaryMarker writes a '<start>-<end>.empty' object instead of the boundary's files
+	EmptyBoundaryMarker EmptyBoundaryPolicy = "marker"
+)
+
+// ParseEmptyBoundaryPolicy parses the policy, accepted values are 'write', 'skip' and 'marker'.
+func ParseEmptyBoundaryPolicy(in string) (EmptyBoundaryPolicy, error) {
+	switch policy := EmptyBoundaryPolicy(strings.ToLower(in)); policy {
+	case EmptyBoundaryWrite, EmptyBoundarySkip, EmptyBoundaryMarker:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("invalid empty boundary policy %q, accepted values are 'write', 'skip' and 'marker'", in)
+}
+
+// EmptyMarkerFilename returns the name of the marker written for the given boundary name
+// when it holds no data.
+func EmptyMarkerFilename(boundaryName string) string {
+	return boundaryName + ".empty"
+}
+
+// activeIsEmpty returns true if nothing was written to the active boundary and it must
+// not be written as is according to the empty boundary policy.
+func (b *Bundler) activeIsEmpty() bool {
+	if b.emptyBoundaryPolicy == EmptyBoundaryWrite {
+		return false
+	}
+
+	stats := b.boundaryWriter.Stats()
+	return stats.Rows == 0 && stats.Size == 0
+}
+
+// closeEmptyBoundaries closes the boundaries between the active boundary and the next
+// block, which hold no block at all. With the 'write' policy, each one is written as an
+// empty boundary. Otherwise, they are collapsed into a single boundary covering the whole
+// gap so that a jump of millions of blocks queues a single state save instead of
+// thousands of no-op uploads. When completed is true, the state is marked completed
+// along with the last boundary.
+func (b *Bundler) closeEmptyBoundaries(ctx context.Context, boundaries []*bstream.Range, completed bool) error {
+	if len(boundaries) == 0 {
+		return nil
+	}
+
+	if b.emptyBoundaryPolicy == EmptyBoundaryWrite {
+		for i, boundary := range boundaries {
+			if err := b.start(boundary, nil); err != nil {
+				return fmt.Errorf("start skipping boundary: %w", err)
+			}
+
+			if completed && i == len(boundaries)-1 {
+				b.stateStore.MarkCompleted()
+			}
+
+			if err := b.stop(ctx); err != nil {
+				return fmt.Errorf("stop skipping boundary: %w", err)
+			}
+		}
+
+		return nil
+	}
+
+	gap := bstream.NewRangeExcludingEnd(boundaries[0].StartBlock(), *boundaries[len(boundaries)-1].EndBlock())
+	if completed {
+		b.stateStore.MarkCompleted()
+	}
+
+	b.stateStore.NewBoundary(state.NewActiveBoundary(gap))
+	state, err := b.stateStore.GetState()
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	b.zlogger.Info("queuing empty boundaries", zap.Stringer("gap", gap), zap.Int("boundary_count", len(boundaries)))
+	err = b.uploadQueue.push(&boundaryFile{
+		name:     boundaryName(gap),
+		boundary: gap,
+		cursor:   b.activeBlocks.cursor.String(),
+		empty:    true,
+		state:    state,
+	})
+	if err != nil {
+		return fmt.Errorf("queue empty boundaries: %w", err)
+	}
+
+	return nil
+}
+
+// uploadEmptyBoundary writes what the empty boundary policy requires for a boundary
+// holding no data, nothing for 'skip' and the '.empty' marker for 'marker'.
+func (b *Bundler) uploadEmptyBoundary(ctx context.Context, bf *boundaryFile) error {
+	if b.emptyBoundaryPolicy != EmptyBoundaryMarker {
+		b.zlogger.Info("empty boundary skipped", zap.String("boundary", bf.name))
+		return nil
+	}
+
+	filename := EmptyMarkerFilename(bf.name)
+	if err := b.outputStore.WriteObject(ctx, filename, bytes.NewReader(nil)); err != nil {
+		return fmt.Errorf("write empty marker: %w", err)
+	}
+
+	b.zlogger.Info("empty boundary marker written", zap.String("boundary", bf.name), zap.String("marker_path", b.outputStore.ObjectPath(filename)))
+	return b.replicate(ctx, bf.name, []string{filename})
+}
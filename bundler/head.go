@@ -0,0 +1,364 @@
+package bundler
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	sink "github.com/streamingfast/substreams/sink"
+	"go.uber.org/zap"
+)
+
+// HeadPrefix is the folder of the output store where head files are written, they hold
+// the data of boundaries that are not complete yet.
+const HeadPrefix = "_head"
+
+// headFlusher bounds the latency of the data written when following the chain head. Once
+// the active boundary is older than maxAge, the data accumulated so far is closed as a
+// head file covering only the blocks seen so far and written under `_head/`, the boundary
+// continuing with the next block.
+//
+// Once the boundary completes, its last part is written as a head file too and the head
+// files are compacted in the background into the canonical boundary files, head files
+// being deleted once the canonical ones are written.
+//
+// Head files do not move the state forward, a restart re-processes the boundary from its
+// start, so head files left over by a previous run are deleted when recovering.
+//
+// Before a part is closed as a head file, the writer's data is checkpointed in dir so
+// that a revert crossing head files can make the part holding the first reverted block
+// the active boundary again, the head files containing reverted blocks being deleted.
+type headFlusher struct {
+	maxAge  time.Duration
+	dir     string
+	store   dstore.Store
+	zlogger *zap.Logger
+
+	// lastAt is the time of the last head file or the start of the active boundary
+	lastAt time.Time
+
+	// startBlock, firstBlock and firstTime are the ones of the boundary written in head
+	// files, the active boundary being only its last part
+	startBlock uint64
+	firstBlock bstream.BlockRef
+	firstTime  time.Time
+	// parts are the head files of the active boundary, in block order
+	parts []*headPart
+}
+
+// headPart is a part of the active boundary written as a head file.
+type headPart struct {
+	file *boundaryFile
+	// boundary is the block range the part was started with, the head file's one ending
+	// at the block that flushed it
+	boundary  *bstream.Range
+	firstTime time.Time
+	// checkpointDir holds the writer's data of the part, it's empty for the last part
+	// written when the boundary completes
+	checkpointDir string
+}
+
+func newHeadFlusher(maxAge time.Duration, dir string, outputStore dstore.Store, zlogger *zap.Logger) *headFlusher {
+	return &headFlusher{
+		maxAge:  maxAge,
+		dir:     dir,
+		store:   newPrefixedStore(outputStore, HeadPrefix),
+		zlogger: zlogger,
+	}
+}
+
+// active returns true if head files were written for the active boundary.
+func (h *headFlusher) active() bool {
+	return h != nil && len(h.parts) > 0
+}
+
+// due returns true if the maximum age elapsed since the last head file.
+func (h *headFlusher) due() bool {
+	return time.Since(h.lastAt) >= h.maxAge
+}
+
+// checkpointDir returns the directory where the writer's data of the part starting at
+// the given block is checkpointed.
+func (h *headFlusher) checkpointDir(startBlock uint64) string {
+	return filepath.Join(h.dir, fmt.Sprintf("%010d", startBlock))
+}
+
+// reset returns the head files of the active boundary and forgets them, the checkpoints
+// of their parts are removed as the boundary cannot be reverted anymore.
+func (h *headFlusher) reset() ([]*boundaryFile, error) {
+	files := make([]*boundaryFile, len(h.parts))
+	for i, part := range h.parts {
+		files[i] = part.file
+	}
+
+	if err := h.removeCheckpoints(h.parts); err != nil {
+		return nil, err
+	}
+
+	h.parts = nil
+	h.firstBlock = nil
+	h.firstTime = time.Time{}
+
+	return files, nil
+}
+
+func (h *headFlusher) removeCheckpoints(parts []*headPart) error {
+	for _, part := range parts {
+		if part.checkpointDir == "" {
+			continue
+		}
+
+		if err := os.RemoveAll(part.checkpointDir); err != nil {
+			return fmt.Errorf("remove head checkpoint: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// wait blocks until all head files are uploaded and returns the files written for them.
+func (h *headFlusher) wait(ctx context.Context, heads []*boundaryFile, terminating <-chan struct{}) ([]writer.UploadedFile, error) {
+	var out []writer.UploadedFile
+	for _, head := range heads {
+		select {
+		case <-head.uploaded:
+			out = append(out, head.files...)
+		case <-terminating:
+			return nil, fmt.Errorf("upload queue terminated while waiting for head %s", head.name)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return out, nil
+}
+
+// remove deletes the given head files, called once they were compacted.
+func (h *headFlusher) remove(ctx context.Context, files []writer.UploadedFile) error {
+	for _, file := range files {
+		if err := h.store.DeleteObject(ctx, file.Filename); err != nil {
+			return fmt.Errorf("delete head file %q: %w", file.Filename, err)
+		}
+	}
+
+	return nil
+}
+
+// recover deletes the head files and checkpoints left over by a previous run, their
+// boundary is going to be processed again from its start.
+func (h *headFlusher) recover(ctx context.Context, outputStore dstore.Store) error {
+	if err := os.RemoveAll(h.dir); err != nil {
+		return fmt.Errorf("remove head checkpoints: %w", err)
+	}
+
+	var filenames []string
+	err := outputStore.Walk(ctx, HeadPrefix+"/", func(filename string) error {
+		if strings.HasPrefix(filename, HeadPrefix+"/") {
+			filenames = append(filenames, filename)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk head files: %w", err)
+	}
+
+	for _, filename := range filenames {
+		h.zlogger.Info("deleting head file left over by a previous run", zap.String("filename", filename))
+		if err := outputStore.DeleteObject(ctx, filename); err != nil {
+			return fmt.Errorf("delete head file %q: %w", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// flushHeadIfDue closes the data of the active boundary accumulated so far as a head file
+// once the maximum boundary age elapsed, the active boundary then continues at blockNum.
+func (b *Bundler) flushHeadIfDue(ctx context.Context, blockNum uint64) error {
+	if b.heads == nil || b.activeBoundary == nil || b.activeBlocks.last == nil || blockNum <= b.activeBoundary.StartBlock() || !b.heads.due() {
+		return nil
+	}
+
+	if !b.heads.active() {
+		b.heads.startBlock = b.activeBoundary.StartBlock()
+		b.heads.firstBlock = b.activeBlocks.first
+		b.heads.firstTime = b.activeBlocks.firstTime
+	}
+
+	remaining := bstream.NewOpenRange(blockNum)
+	if endBlock := b.activeBoundary.EndBlock(); endBlock != nil {
+		remaining = bstream.NewRangeExcludingEnd(blockNum, *endBlock)
+	}
+	window := b.activeWindow
+
+	b.zlogger.Info("maximum boundary age reached, flushing head file",
+		zap.Stringer("active_boundary", b.activeBoundary),
+		zap.Duration("max_age", b.heads.maxAge),
+		zap.Uint64("block_num", blockNum),
+	)
+
+	part := &headPart{
+		boundary:      b.activeBoundary,
+		firstTime:     b.activeBlocks.firstTime,
+		checkpointDir: b.heads.checkpointDir(b.activeBoundary.StartBlock()),
+	}
+
+	if err := os.RemoveAll(part.checkpointDir); err != nil {
+		return fmt.Errorf("remove head checkpoint: %w", err)
+	}
+
+	if err := os.MkdirAll(part.checkpointDir, 0755); err != nil {
+		return fmt.Errorf("create head checkpoint directory: %w", err)
+	}
+
+	if err := b.boundaryWriter.Checkpoint(part.checkpointDir); err != nil {
+		return fmt.Errorf("checkpoint head: %w", err)
+	}
+
+	b.activeBoundary = bstream.NewRangeExcludingEnd(b.activeBoundary.StartBlock(), blockNum)
+	head, err := b.closeHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	part.file = head
+	b.heads.parts = append(b.heads.parts, part)
+
+	if err := b.start(remaining, window); err != nil {
+		return fmt.Errorf("start remaining boundary: %w", err)
+	}
+
+	b.heads.lastAt = time.Now()
+	return nil
+}
+
+// closeHead closes the active boundary as a head file and queues its upload.
+func (b *Bundler) closeHead(ctx context.Context) (*boundaryFile, error) {
+	name := b.activeName()
+	file, err := b.boundaryWriter.CloseBoundary(ctx, b.activeFileNamer(name))
+	if err != nil {
+		return nil, fmt.Errorf("closing head file: %w", err)
+	}
+
+	head := &boundaryFile{
+		name:       name,
+		boundary:   b.activeBoundary,
+		window:     b.activeWindow,
+		firstBlock: b.activeBlocks.first,
+		lastBlock:  b.activeBlocks.last,
+		cursor:     b.activeBlocks.cursor.String(),
+		file:       file,
+		head:       true,
+		uploaded:   make(chan struct{}),
+	}
+
+	b.zlogger.Info("queuing head upload", zap.Stringer("boundary", b.activeBoundary))
+	if err := b.uploadQueue.push(head); err != nil {
+		return nil, fmt.Errorf("queue head upload: %w", err)
+	}
+
+	return head, nil
+}
+
+// uploadHead uploads a head file under HeadPrefix, it's not published atomically as
+// head files are temporary. The local data of the head file is kept as the checkpoint
+// of its part may refer to it, it's discarded once compacted or reverted.
+func (b *Bundler) uploadHead(ctx context.Context, bf *boundaryFile) error {
+	files, err := bf.file.Upload(ctx, b.heads.store)
+	if err != nil {
+		return fmt.Errorf("unable to upload head: %w", err)
+	}
+
+	b.zlogger.Info("head uploaded", zap.String("boundary", bf.name), zap.Strings("output_paths", outputPaths(b.heads.store, files)))
+
+	bf.files = files
+	close(bf.uploaded)
+	return nil
+}
+
+// revertHeads makes the part holding the first reverted block the active boundary again,
+// restoring the writer's data from the checkpoint taken when it was flushed. The head
+// files of this part and of the ones after it contain reverted blocks, they are deleted
+// and the valid blocks are written again by the next head file, due right away.
+func (b *Bundler) revertHeads(ctx context.Context, lastValidBlockNum uint64) error {
+	index := 0
+	for *b.heads.parts[index].file.boundary.EndBlock() <= lastValidBlockNum+1 {
+		index++
+	}
+
+	reverted := b.heads.parts[index:]
+	heads := make([]*boundaryFile, len(reverted))
+	for i, part := range reverted {
+		heads[i] = part.file
+	}
+
+	// Uploads are awaited so that no deleted head file is written afterward
+	files, err := b.heads.wait(ctx, heads, b.uploadQueue.Terminating())
+	if err != nil {
+		return err
+	}
+
+	if err := b.heads.remove(ctx, files); err != nil {
+		return err
+	}
+
+	// All blocks of the active boundary are reverted, its data is dropped
+	file, err := b.boundaryWriter.CloseBoundary(ctx, b.activeFileNamer(b.activeName()))
+	if err != nil {
+		return fmt.Errorf("close active boundary: %w", err)
+	}
+
+	if err := discardFile(file); err != nil {
+		return fmt.Errorf("discard active boundary: %w", err)
+	}
+
+	// The first part's local data is the one restored by the writer
+	for _, part := range reverted[1:] {
+		if err := discardFile(part.file.file); err != nil {
+			return fmt.Errorf("discard reverted head: %w", err)
+		}
+	}
+
+	part := reverted[0]
+	cursor, err := sink.NewCursor(part.file.cursor)
+	if err != nil {
+		return fmt.Errorf("invalid head cursor: %w", err)
+	}
+
+	if err := b.boundaryWriter.RestoreCheckpoint(part.checkpointDir, part.boundary); err != nil {
+		return fmt.Errorf("restore head: %w", err)
+	}
+
+	if err := b.heads.removeCheckpoints(reverted); err != nil {
+		return err
+	}
+
+	b.zlogger.Info("head files reverted",
+		zap.Stringer("restored_boundary", part.boundary),
+		zap.Int("head_count", len(reverted)),
+		zap.Uint64("last_valid_block", lastValidBlockNum),
+	)
+
+	b.heads.parts = b.heads.parts[:index]
+	b.heads.lastAt = time.Time{}
+
+	b.activeBoundary = part.boundary
+	b.activeWindow = part.file.window
+	b.activeBlocks = activeBlocks{
+		first:     part.file.firstBlock,
+		firstTime: part.firstTime,
+		last:      part.file.lastBlock,
+		cursor:    cursor,
+	}
+
+	b.stateStore.NewBoundary(b.activeStateBoundary())
+	b.status.boundaryStarted(b.activeStateBoundary())
+	return nil
+}
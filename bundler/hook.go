@@ -0,0 +1,195 @@
+package bundler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"go.uber.org/zap"
+)
+
+// HookFailurePolicy is what to do when a post-upload hook fails.
+type HookFailurePolicy string
+
+const (
+	// HookBlock retries the hook until it succeeds, the boundary is not committed and the
+	// following ones wait meanwhile
+	HookBlock HookFailurePolicy = "block"
+	// HookRetry retries the hook a limited number of times, then stops the sink without
+	// committing the boundary so that it's processed again on restart
+	HookRetry HookFailurePolicy = "retry"
+	// HookLog retries the hook a limited number of times, then logs the failure and
+	// commits the boundary anyway
+	HookLog HookFailurePolicy = "log"
+)
+
+// ParseHookFailurePolicy parses the policy, accepted values are 'block', 'retry' and 'log'.
+func ParseHookFailurePolicy(in string) (HookFailurePolicy, error) {
+	switch policy := HookFailurePolicy(strings.ToLower(in)); policy {
+	case HookBlock, HookRetry, HookLog:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("invalid hook failure policy %q, accepted values are 'block', 'retry' and 'log'", in)
+}
+
+// HookEvent is the JSON description of an uploaded boundary received by post-upload
+// hooks, it's the boundary's Manifest along with its name and the URL of its files.
+type HookEvent struct {
+	Boundary string `json:"boundary"`
+	*Manifest
+	URLs []string `json:"urls"`
+}
+
+// Hook is triggered once all files of a boundary are uploaded.
+type Hook interface {
+	// Name identifies the hook in logs
+	Name() string
+	Run(ctx context.Context, event []byte) error
+}
+
+// ExecHook runs a command through `sh -c`, the event being written to its standard input,
+// the hook fails if the command exits with a non-zero status.
+type ExecHook struct {
+	command string
+	zlogger *zap.Logger
+}
+
+func NewExecHook(command string, zlogger *zap.Logger) *ExecHook {
+	return &ExecHook{command: command, zlogger: zlogger}
+}
+
+func (h *ExecHook) Name() string {
+	return "exec " + h.command
+}
+
+func (h *ExecHook) Run(ctx context.Context, event []byte) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.command)
+	cmd.Stdin = bytes.NewReader(event)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("run command: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	if len(output) > 0 {
+		h.zlogger.Debug("hook command output", zap.String("command", h.command), zap.String("output", string(output)))
+	}
+
+	return nil
+}
+
+// WebhookHook POSTs the event as JSON to an URL, the hook fails on any response status
+// other than 2xx.
+type WebhookHook struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookHook(url string) *WebhookHook {
+	return &WebhookHook{url: url, client: http.DefaultClient}
+}
+
+func (h *WebhookHook) Name() string {
+	return "webhook " + h.url
+}
+
+func (h *WebhookHook) Run(ctx context.Context, event []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(event))
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := h.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// hookRunner triggers the post-upload hooks of a boundary and applies the failure policy.
+// Each attempt of a hook is bounded by the timeout, failed attempts being retried with an
+// exponential backoff.
+type hookRunner struct {
+	hooks          []Hook
+	policy         HookFailurePolicy
+	retries        uint64
+	timeout        time.Duration
+	initialBackoff time.Duration
+	moduleName     string
+	moduleHash     string
+	zlogger        *zap.Logger
+}
+
+// run triggers the hooks in order, an error is returned only if the policy requires the
+// boundary not to be committed. Such errors are permanent, the boundary's files being
+// already uploaded they must not be uploaded again.
+func (r *hookRunner) run(ctx context.Context, event *HookEvent) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return backoff.Permanent(fmt.Errorf("marshal hook event: %w", err))
+	}
+
+	for _, hook := range r.hooks {
+		if err := r.runHook(ctx, hook, event.Boundary, content); err != nil {
+			if r.policy == HookLog {
+				r.zlogger.Error("post-upload hook failed, ignoring", zap.String("hook", hook.Name()), zap.String("boundary", event.Boundary), zap.Error(err))
+				continue
+			}
+
+			return backoff.Permanent(fmt.Errorf("post-upload hook %q: %w", hook.Name(), err))
+		}
+	}
+
+	return nil
+}
+
+func (r *hookRunner) runHook(ctx context.Context, hook Hook, boundary string, content []byte) error {
+	policy := backoff.NewExponentialBackOff()
+	policy.InitialInterval = r.initialBackoff
+	policy.MaxInterval = maxUploadBackoff
+	policy.MaxElapsedTime = 0
+
+	var retryPolicy backoff.BackOff = policy
+	if r.policy != HookBlock {
+		retryPolicy = backoff.WithMaxRetries(policy, r.retries)
+	}
+
+	attempt := 0
+	return backoff.RetryNotify(func() error {
+		attempt++
+
+		attemptCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+
+		err := hook.Run(attemptCtx, content)
+		if err != nil && ctx.Err() != nil {
+			return backoff.Permanent(err)
+		}
+
+		return err
+	}, backoff.WithContext(retryPolicy, ctx), func(err error, next time.Duration) {
+		r.zlogger.Warn("post-upload hook failed, retrying",
+			zap.String("hook", hook.Name()),
+			zap.String("boundary", boundary),
+			zap.Int("attempt", attempt),
+			zap.Duration("retry_in", next),
+			zap.Error(err),
+		)
+	})
+}
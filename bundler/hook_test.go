@@ -0,0 +1,143 @@
+package bundler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/streamingfast/substreams-sink-files/v2/state"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestHookRunner_policies(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       HookFailurePolicy
+		failures     int32
+		expectErr    string
+		expectCalled int32
+	}{
+		{"success", HookRetry, 0, "", 1},
+		{"retried", HookRetry, 2, "", 3},
+		{"retries exhausted", HookRetry, 5, "unexpected status 500 Internal Server Error: failure", 4},
+		{"retries exhausted logged", HookLog, 5, "", 4},
+		{"blocked until success", HookBlock, 5, "", 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var called atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if called.Add(1) <= test.failures {
+					http.Error(w, "failure", http.StatusInternalServerError)
+					return
+				}
+			}))
+			defer server.Close()
+
+			runner := &hookRunner{
+				hooks:          []Hook{NewWebhookHook(server.URL)},
+				policy:         test.policy,
+				retries:        3,
+				timeout:        time.Second,
+				initialBackoff: time.Millisecond,
+				zlogger:        zap.NewNop(),
+			}
+
+			err := runner.run(context.Background(), &HookEvent{Boundary: "0000000000-0000000100", Manifest: &Manifest{}})
+			if test.expectErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, test.expectCalled, called.Load())
+		})
+	}
+}
+
+func TestBundler_PostUploadHooks(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+	eventsDir := t.TempDir()
+
+	outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+	require.NoError(t, err)
+
+	stateStore, err := state.NewFileStateStore(filepath.Join(t.TempDir(), "state.yaml"))
+	require.NoError(t, err)
+
+	var webhookEvents atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Contains(t, string(body), `"module_hash":"abc"`)
+
+		webhookEvents.Add(1)
+	}))
+	defer server.Close()
+
+	hooks := []Hook{
+		NewExecHook(fmt.Sprintf("cat > %s/$(date +%%s%%N).json", eventsDir), zap.NewNop()),
+		NewWebhookHook(server.URL),
+	}
+
+	boundaryWriter := writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop())
+	b, err := New(100, boundaryWriter, stateStore, outputStore, zap.NewNop(), WithPostUploadHooks("test", "abc", HookRetry, 0, time.Second, hooks...))
+	require.NoError(t, err)
+
+	b.Launch(ctx)
+	require.NoError(t, b.Start(0))
+
+	for _, blockNum := range []uint64{10, 150} {
+		require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+		_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+		require.NoError(t, err)
+
+		b.SetCursor(testCursor(blockNum))
+	}
+
+	require.NoError(t, b.Finish(ctx, 200))
+	b.Shutdown(nil)
+	<-b.Terminated()
+	require.NoError(t, b.Err())
+
+	assert.Equal(t, int32(2), webhookEvents.Load())
+
+	entries, err := os.ReadDir(eventsDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	var boundaries []string
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(eventsDir, entry.Name()))
+		require.NoError(t, err)
+
+		event := &HookEvent{}
+		require.NoError(t, json.Unmarshal(content, event))
+		require.Len(t, event.Files, 1)
+		assert.Equal(t, "test", event.ModuleName)
+		assert.Equal(t, []string{outputStore.ObjectURL(event.Files[0].Filename)}, event.URLs)
+
+		boundaries = append(boundaries, event.Boundary)
+	}
+
+	assert.ElementsMatch(t, []string{"0000000000-0000000100", "0000000100-0000000200"}, boundaries)
+}
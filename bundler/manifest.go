@@ -0,0 +1,100 @@
+package bundler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+)
+
+type manifestConfig struct {
+	moduleName string
+	moduleHash string
+}
+
+// Manifest is the machine-readable description of a boundary written next to the
+// boundary's files, downstream consumers can use it to discover and validate new
+// data without listing and opening every output file.
+type Manifest struct {
+	// StartBlock is the inclusive start block of the boundary
+	StartBlock uint64 `json:"start_block"`
+	// EndBlock is the exclusive end block of the boundary
+	EndBlock uint64 `json:"end_block"`
+	// WindowStart and WindowEnd are the time window covered by the boundary, only set
+	// when boundaries are time windows
+	WindowStart *time.Time `json:"window_start,omitempty"`
+	WindowEnd   *time.Time `json:"window_end,omitempty"`
+	// FirstBlock is the first block processed in the boundary, nil if no block was seen
+	FirstBlock *ManifestBlock `json:"first_block,omitempty"`
+	// LastBlock is the last block processed in the boundary, nil if no block was seen
+	LastBlock *ManifestBlock `json:"last_block,omitempty"`
+	// Cursor is the cursor of the last block processed when the boundary was closed
+	Cursor string `json:"cursor"`
+
+	ModuleName string `json:"module_name"`
+	ModuleHash string `json:"module_hash"`
+
+	Files     []writer.UploadedFile `json:"files"`
+	CreatedAt time.Time             `json:"created_at"`
+}
+
+type ManifestBlock struct {
+	ID     string `json:"id"`
+	Number uint64 `json:"number"`
+}
+
+func newManifestBlock(ref bstream.BlockRef) *ManifestBlock {
+	if ref == nil {
+		return nil
+	}
+
+	return &ManifestBlock{ID: ref.ID(), Number: ref.Num()}
+}
+
+// ManifestFilename returns the name of the manifest file of the given boundary name.
+func ManifestFilename(boundaryName string) string {
+	return boundaryName + ".manifest.json"
+}
+
+// newManifest describes the boundary whose files were uploaded.
+func newManifest(bf *boundaryFile, files []writer.UploadedFile, moduleName, moduleHash string) *Manifest {
+	manifest := &Manifest{
+		StartBlock: bf.boundary.StartBlock(),
+		EndBlock:   *bf.boundary.EndBlock(),
+		FirstBlock: newManifestBlock(bf.firstBlock),
+		LastBlock:  newManifestBlock(bf.lastBlock),
+		Cursor:     bf.cursor,
+		ModuleName: moduleName,
+		ModuleHash: moduleHash,
+		Files:      files,
+		CreatedAt:  time.Now().UTC(),
+	}
+
+	if bf.window != nil {
+		manifest.WindowStart = &bf.window.start
+		manifest.WindowEnd = &bf.window.end
+	}
+
+	return manifest
+}
+
+func (c *manifestConfig) write(ctx context.Context, store dstore.Store, bf *boundaryFile, files []writer.UploadedFile) (string, error) {
+	manifest := newManifest(bf, files, c.moduleName, c.moduleHash)
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	filename := ManifestFilename(bf.name)
+	if err := store.WriteObject(ctx, filename, bytes.NewReader(content)); err != nil {
+		return "", fmt.Errorf("write manifest: %w", err)
+	}
+
+	return filename, nil
+}
@@ -0,0 +1,44 @@
+package bundler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest_write(t *testing.T) {
+	store := dstore.NewMockStore(nil)
+	config := &manifestConfig{moduleName: "map_events", moduleHash: "abcdef"}
+
+	files := []writer.UploadedFile{
+		{Filename: "transfers/0000000100-0000000200.parquet", Table: "transfers", Size: 1024, Rows: 10, SHA256: "00ff"},
+	}
+
+	filename, err := config.write(context.Background(), store, &boundaryFile{
+		name:       "0000000100-0000000200",
+		boundary:   bstream.NewRangeExcludingEnd(100, 200),
+		firstBlock: bstream.NewBlockRef("0a", 101),
+		lastBlock:  bstream.NewBlockRef("0b", 199),
+		cursor:     "cursor",
+	}, files)
+	require.NoError(t, err)
+	assert.Equal(t, "0000000100-0000000200.manifest.json", filename)
+
+	manifest := &Manifest{}
+	require.NoError(t, json.Unmarshal(store.Files[filename], manifest))
+
+	assert.Equal(t, uint64(100), manifest.StartBlock)
+	assert.Equal(t, uint64(200), manifest.EndBlock)
+	assert.Equal(t, &ManifestBlock{ID: "0a", Number: 101}, manifest.FirstBlock)
+	assert.Equal(t, &ManifestBlock{ID: "0b", Number: 199}, manifest.LastBlock)
+	assert.Equal(t, "cursor", manifest.Cursor)
+	assert.Equal(t, "map_events", manifest.ModuleName)
+	assert.Equal(t, "abcdef", manifest.ModuleHash)
+	assert.Equal(t, files, manifest.Files)
+}
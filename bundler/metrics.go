@@ -0,0 +1,57 @@
+package bundler
+
+import (
+	"path"
+	"strings"
+
+	"github.com/streamingfast/dmetrics"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+)
+
+// Metrics of the bundler, they are registered along with the ones of the writers when
+// the Prometheus metrics server is started.
+var Metrics = dmetrics.NewSet()
+
+var HeadBlockNumber = Metrics.NewHeadBlockNumber("substreams_sink_files")
+var HeadBlockTimeDrift = Metrics.NewHeadTimeDrift("substreams_sink_files")
+
+var ProcessedBlockCount = Metrics.NewCounter("substreams_sink_files_processed_blocks", "The number of blocks processed by the bundler")
+var BoundaryCount = Metrics.NewCounter("substreams_sink_files_boundaries", "The number of boundaries closed by the bundler, head files excluded")
+var BoundaryProcessDuration = Metrics.NewGauge("substreams_sink_files_boundary_process_duration", "The time, in seconds, taken by the last boundary from its start to its close")
+var BoundaryDataProcessDuration = Metrics.NewGauge("substreams_sink_files_boundary_data_process_duration", "The time, in seconds, spent encoding the data of the last boundary")
+
+var RowsWritten = Metrics.NewCounterVec("substreams_sink_files_rows_written", []string{"table"}, "The number of rows written to the output store per table, lines for line based outputs")
+var BytesWritten = Metrics.NewCounterVec("substreams_sink_files_bytes_written", []string{"file_type"}, "The number of bytes written to the output store per file type")
+
+var UploadDuration = Metrics.NewHistogram("substreams_sink_files_upload_duration", "The time, in seconds, taken to upload all files of a boundary, retries excluded")
+var UploadQueueDepth = Metrics.NewGauge("substreams_sink_files_upload_queue_depth", "The number of closed boundaries waiting for an upload slot")
+var UploadFailureCount = Metrics.NewCounter("substreams_sink_files_upload_failures", "The number of upload attempts that failed, whether they are retried or not")
+var UploadRetryCount = Metrics.NewCounter("substreams_sink_files_upload_retries", "The number of upload attempts retried after a failure")
+
+var ReplicaPendingBoundaries = Metrics.NewGaugeVec("substreams_sink_files_replica_pending_boundaries", []string{"destination"}, "The number of boundaries waiting to be copied to an optional replica")
+var ReplicaFailureCount = Metrics.NewCounterVec("substreams_sink_files_replica_failures", []string{"destination"}, "The number of copies to a replica that failed, whether they are retried or not")
+var ReplicaBytesWritten = Metrics.NewCounterVec("substreams_sink_files_replica_bytes_written", []string{"destination"}, "The number of bytes copied to a replica")
+
+// RegisterMetrics registers the metrics of the bundler and of the writers.
+func RegisterMetrics() {
+	dmetrics.Register(Metrics, writer.Metrics)
+}
+
+// recordWrittenFiles accounts the rows and bytes of files written to the output store.
+func recordWrittenFiles(files []writer.UploadedFile) {
+	for _, file := range files {
+		RowsWritten.AddInt64(file.Rows, file.Table)
+		BytesWritten.AddInt64(file.Size, fileType(file.Filename))
+	}
+}
+
+// fileType returns the extension of the filename, everything after the first dot of its
+// base name so that compound extensions are kept whole.
+func fileType(filename string) string {
+	base := path.Base(filename)
+	if i := strings.Index(base, "."); i >= 0 {
+		return base[i+1:]
+	}
+
+	return ""
+}
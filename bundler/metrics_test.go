@@ -0,0 +1,25 @@
+package bundler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_fileType(t *testing.T) {
+	tests := []struct {
+		filename   string
+		expectType string
+	}{
+		{"0000000000-0000000100.jsonl", "jsonl"},
+		{"swaps/0000000000-0000000100.parquet", "parquet"},
+		{"swaps/date=2024-03-05/0000000000-0000000100.parquet", "parquet"},
+		{"20240305T130000Z-20240305T140000Z_0000000000-0000000100.jsonl.zst", "jsonl.zst"},
+		{"0000000000-0000000100", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			assert.Equal(t, test.expectType, fileType(test.filename))
+		})
+	}
+}
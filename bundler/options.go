@@ -0,0 +1,170 @@
+package bundler
+
+import (
+	"time"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+)
+
+// Option configures optional behaviors of the Bundler.
+type Option func(b *Bundler)
+
+// WithManifest enables writing a '<start>-<end>.manifest.json' file to the output store
+// once all files of a boundary have been uploaded. The module name and hash are
+// recorded in each manifest to identify which module produced the data.
+func WithManifest(moduleName, moduleHash string) Option {
+	return func(b *Bundler) {
+		b.manifest = &manifestConfig{
+			moduleName: moduleName,
+			moduleHash: moduleHash,
+		}
+	}
+}
+
+// WithAtomicPublish enables the two-phase commit of boundaries, see atomicPublisher
+// for details about the protocol.
+func WithAtomicPublish() Option {
+	return func(b *Bundler) {
+		b.atomicPublisher = newAtomicPublisher(b.outputStore, b.zlogger)
+	}
+}
+
+// WithTimeWindow makes boundaries time windows of the given size based on the block's
+// clock timestamp instead of a fixed amount of blocks. Files are named after the time
+// window they cover followed by the actual block range they contain.
+func WithTimeWindow(size time.Duration) Option {
+	return func(b *Bundler) {
+		b.timeWindowSize = size
+	}
+}
+
+// WithMaxFileSize closes the active boundary early once the data accumulated for it
+// reaches the given amount of bytes, the rest of the boundary's block range is written
+// to the next file. For Parquet, the size is the estimated uncompressed size of the rows.
+func WithMaxFileSize(size uint64) Option {
+	return func(b *Bundler) {
+		b.maxFileSize = size
+	}
+}
+
+// WithMaxFileRows closes the active boundary early once the rows accumulated for it
+// reach the given count, the rest of the boundary's block range is written to the next
+// file. Rows of all tables are counted for Parquet and lines for line based outputs.
+func WithMaxFileRows(rows uint64) Option {
+	return func(b *Bundler) {
+		b.maxFileRows = rows
+	}
+}
+
+// WithPathTemplate names the files produced for each boundary according to the given
+// template instead of the default '[<table>/]<start>-<end>.<ext>' layout.
+func WithPathTemplate(template *PathTemplate) Option {
+	return func(b *Bundler) {
+		b.pathTemplate = template
+	}
+}
+
+// WithCheckpoint periodically saves the active boundary, every interval at most, in the
+// given local directory so that a restart after a crash resumes the boundary from the
+// last checkpoint instead of re-processing it from its start block.
+func WithCheckpoint(interval time.Duration, dir string) Option {
+	return func(b *Bundler) {
+		b.checkpointer = newCheckpointer(interval, dir, b.zlogger)
+	}
+}
+
+// WithReconcile compares, when recovering, the boundaries of the given block range found
+// in the output store with the cursor of the state and applies the policy if they are not
+// consistent, see reconciler for details.
+func WithReconcile(policy ReconcilePolicy, blockRange *bstream.Range) Option {
+	return func(b *Bundler) {
+		b.reconciler = newReconciler(policy, blockRange, b.outputStore, b.stateStore, b.zlogger)
+	}
+}
+
+// WithMaxBoundaryAge writes the data of the active boundary accumulated so far as a head
+// file once the boundary is older than the given age, head files are compacted into the
+// boundary's files once it completes, see headFlusher. The data of each head file is
+// checkpointed in dir until its boundary completes so that it can be reverted.
+func WithMaxBoundaryAge(age time.Duration, dir string) Option {
+	return func(b *Bundler) {
+		b.heads = newHeadFlusher(age, dir, b.outputStore, b.zlogger)
+	}
+}
+
+// WithPostUploadHooks triggers the hooks, in order, once all files of a boundary are
+// uploaded. Failed hooks are retried up to retries times, each attempt being bounded by
+// timeout, and the policy decides what happens once retries are exhausted, see
+// HookFailurePolicy. The module name and hash are recorded in the event sent to hooks.
+func WithPostUploadHooks(moduleName, moduleHash string, policy HookFailurePolicy, retries uint64, timeout time.Duration, hooks ...Hook) Option {
+	return func(b *Bundler) {
+		b.hooks = &hookRunner{
+			hooks:          hooks,
+			policy:         policy,
+			retries:        retries,
+			timeout:        timeout,
+			initialBackoff: DefaultUploadBackoff,
+			moduleName:     moduleName,
+			moduleHash:     moduleHash,
+			zlogger:        b.zlogger,
+		}
+	}
+}
+
+// WithReplicas copies every file written to the output store to the given replicas, each
+// copy being retried up to the upload retries. A boundary is committed only once copied
+// to all required replicas, optional ones being copied to in the background, see
+// replicator. Files are copied from the output store, it must be readable. The copies
+// pending for optional replicas are saved to journal, the output store opened so that it
+// overwrites objects, to be resumed on restart.
+func WithReplicas(journal dstore.Store, replicas ...Replica) Option {
+	return func(b *Bundler) {
+		b.replicaJournal = journal
+		b.replicas = append(b.replicas, replicas...)
+	}
+}
+
+// WithTableCommitters records the files of every boundary uploaded in the metadata of
+// table formats, the commit of each committer being part of the boundary's upload, see
+// TableCommitter.
+func WithTableCommitters(committers ...TableCommitter) Option {
+	return func(b *Bundler) {
+		b.tableCommitters = append(b.tableCommitters, committers...)
+	}
+}
+
+// WithEmptyBoundaryPolicy sets what to do with boundaries holding no data, defaults to
+// EmptyBoundaryWrite which writes them as empty files.
+func WithEmptyBoundaryPolicy(policy EmptyBoundaryPolicy) Option {
+	return func(b *Bundler) {
+		b.emptyBoundaryPolicy = policy
+	}
+}
+
+// WithUploadConcurrency sets the number of boundaries uploaded in parallel, defaults
+// to DefaultUploadConcurrency.
+func WithUploadConcurrency(concurrency int) Option {
+	return func(b *Bundler) {
+		b.uploadConcurrency = concurrency
+	}
+}
+
+// WithUploadQueueSize sets the number of closed boundaries that can wait for an upload
+// slot, once reached block processing is blocked until uploads catch up. Defaults to
+// DefaultUploadQueueSize.
+func WithUploadQueueSize(size int) Option {
+	return func(b *Bundler) {
+		b.uploadQueueSize = size
+	}
+}
+
+// WithUploadRetry sets how many times a failed upload is retried and the initial delay
+// between attempts, which grows exponentially with jitter. Defaults to DefaultUploadRetries
+// and DefaultUploadBackoff.
+func WithUploadRetry(retries uint64, initialBackoff time.Duration) Option {
+	return func(b *Bundler) {
+		b.uploadRetries = retries
+		b.uploadBackoff = initialBackoff
+	}
+}
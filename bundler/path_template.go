@@ -0,0 +1,108 @@
+package bundler
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+)
+
+var pathTemplateVariableRegex = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// PathTemplateVariables lists the variables accepted in a path template.
+var PathTemplateVariables = []string{"table", "network", "module", "name", "start", "end", "block_date", "block_hour", "ext"}
+
+// PathTemplate renders the path, relative to the output store, of the files
+// produced for a boundary, for example '{table}/chain={network}/date={block_date}/{start}-{end}.parquet'
+// produces Hive-style partitioned outputs.
+//
+// Variables are written between braces:
+//   - {table} is the table the file holds rows of, it's empty for line based outputs
+//   - {network} is the network of the Substreams package
+//   - {module} is the output module's name
+//   - {name} is the boundary name, '<start>-<end>' or '<window>_<start>-<end>' for time windows
+//   - {start} and {end} are the boundary's block range, zero padded to 10 digits
+//   - {block_date} and {block_hour} are the date (2006-01-02) and hour (15) of the boundary
+//     in UTC, see Bundler for how the time of a boundary is determined
+//   - {ext} is the extension of the file's type, 'parquet' or 'jsonl' for example
+//
+// Empty path segments, like the '{table}/' segment of line based outputs, are removed.
+type PathTemplate struct {
+	template string
+	network  string
+	module   string
+}
+
+// NewPathTemplate parses the template, it must identify the boundary uniquely so it
+// must contain either {name} or both {start} and {end}.
+func NewPathTemplate(template string, network string, module string) (*PathTemplate, error) {
+	t := &PathTemplate{template: template, network: network, module: module}
+
+	for _, match := range pathTemplateVariableRegex.FindAllStringSubmatch(template, -1) {
+		if !isPathTemplateVariable(match[1]) {
+			return nil, fmt.Errorf("unknown variable {%s} in path template %q, accepted variables are {%s}", match[1], template, strings.Join(PathTemplateVariables, "}, {"))
+		}
+	}
+
+	if !t.HasVariable("name") && !(t.HasVariable("start") && t.HasVariable("end")) {
+		return nil, fmt.Errorf("path template %q must contain {name} or both {start} and {end} so that each boundary has its own files", template)
+	}
+
+	return t, nil
+}
+
+// HasVariable returns true if the template uses the given variable.
+func (t *PathTemplate) HasVariable(name string) bool {
+	return strings.Contains(t.template, "{"+name+"}")
+}
+
+func (t *PathTemplate) String() string {
+	return t.template
+}
+
+// fileNamer returns the FileNamer of the boundary of the given name and range, blockTime
+// is the time the {block_date} and {block_hour} variables are computed from.
+func (t *PathTemplate) fileNamer(name string, boundary *bstream.Range, blockTime time.Time) writer.FileNamer {
+	blockTime = blockTime.UTC()
+
+	return writer.FileNamerFunc(func(table string, fileType writer.FileType) string {
+		values := map[string]string{
+			"table":      table,
+			"network":    t.network,
+			"module":     t.module,
+			"name":       name,
+			"start":      fmt.Sprintf("%010d", boundary.StartBlock()),
+			"end":        fmt.Sprintf("%010d", *boundary.EndBlock()),
+			"block_date": blockTime.Format("2006-01-02"),
+			"block_hour": blockTime.Format("15"),
+			"ext":        string(fileType),
+		}
+
+		rendered := pathTemplateVariableRegex.ReplaceAllStringFunc(t.template, func(variable string) string {
+			return values[strings.Trim(variable, "{}")]
+		})
+
+		segments := strings.Split(rendered, "/")
+		kept := segments[:0]
+		for _, segment := range segments {
+			if segment != "" {
+				kept = append(kept, segment)
+			}
+		}
+
+		return strings.Join(kept, "/")
+	})
+}
+
+func isPathTemplateVariable(name string) bool {
+	for _, variable := range PathTemplateVariables {
+		if variable == name {
+			return true
+		}
+	}
+
+	return false
+}
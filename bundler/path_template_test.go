@@ -0,0 +1,60 @@
+package bundler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPathTemplate(t *testing.T) {
+	tests := []struct {
+		template    string
+		expectError bool
+	}{
+		{"{table}/chain={network}/date={block_date}/{start}-{end}.parquet", false},
+		{"{module}/{name}.{ext}", false},
+		{"{table}/{start}.parquet", true},
+		{"{table}/{unknown}/{name}.parquet", true},
+	}
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			_, err := NewPathTemplate(test.template, "mainnet", "map_events")
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestPathTemplate_fileNamer(t *testing.T) {
+	boundary := bstream.NewRangeExcludingEnd(100, 200)
+	blockTime := time.Date(2024, 3, 5, 13, 42, 7, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		template string
+		table    string
+		fileType writer.FileType
+		expect   string
+	}{
+		{"hive parquet", "{table}/chain={network}/date={block_date}/{start}-{end}.parquet", "transfers", writer.FileTypeParquet, "transfers/chain=mainnet/date=2024-03-05/0000000100-0000000200.parquet"},
+		{"hive jsonl drops empty table", "{table}/chain={network}/date={block_date}/hour={block_hour}/{name}.{ext}", "", writer.FileTypeJSONL, "chain=mainnet/date=2024-03-05/hour=13/0000000100-0000000200.jsonl"},
+		{"module", "{module}/{name}.{ext}", "", writer.FileTypeJSONL, "map_events/0000000100-0000000200.jsonl"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template, err := NewPathTemplate(test.template, "mainnet", "map_events")
+			require.NoError(t, err)
+
+			namer := template.fileNamer(boundaryName(boundary), boundary, blockTime)
+			assert.Equal(t, test.expect, namer.Filename(test.table, test.fileType))
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package bundler
+
+import (
+	"context"
+	"io"
+	"path"
+
+	"github.com/streamingfast/dstore"
+)
+
+// prefixedStore wraps a dstore.Store so that every object written or read through it
+// lives under the given prefix of the wrapped store. Contrary to `dstore.Store.SubStore`,
+// objects written are visible from the wrapped store, which is required to later copy
+// them elsewhere in the same store.
+//
+// Only object level operations are prefixed, listing operations are not and should be
+// performed on the wrapped store directly.
+type prefixedStore struct {
+	dstore.Store
+
+	prefix string
+}
+
+func newPrefixedStore(store dstore.Store, prefix string) *prefixedStore {
+	return &prefixedStore{Store: store, prefix: prefix}
+}
+
+func (s *prefixedStore) name(base string) string {
+	return path.Join(s.prefix, base)
+}
+
+func (s *prefixedStore) WriteObject(ctx context.Context, base string, f io.Reader) error {
+	return s.Store.WriteObject(ctx, s.name(base), f)
+}
+
+func (s *prefixedStore) PushLocalFile(ctx context.Context, localFile, toBaseName string) error {
+	return s.Store.PushLocalFile(ctx, localFile, s.name(toBaseName))
+}
+
+func (s *prefixedStore) OpenObject(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.Store.OpenObject(ctx, s.name(name))
+}
+
+func (s *prefixedStore) FileExists(ctx context.Context, base string) (bool, error) {
+	return s.Store.FileExists(ctx, s.name(base))
+}
+
+func (s *prefixedStore) DeleteObject(ctx context.Context, base string) error {
+	return s.Store.DeleteObject(ctx, s.name(base))
+}
+
+func (s *prefixedStore) CopyObject(ctx context.Context, src, dest string) error {
+	return s.Store.CopyObject(ctx, s.name(src), s.name(dest))
+}
+
+func (s *prefixedStore) ObjectPath(base string) string {
+	return s.Store.ObjectPath(s.name(base))
+}
+
+func (s *prefixedStore) ObjectURL(base string) string {
+	return s.Store.ObjectURL(s.name(base))
+}
@@ -0,0 +1,200 @@
+package bundler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"go.uber.org/zap"
+)
+
+const (
+	// StagingPrefix is the folder of the output store under which the files of a boundary
+	// are uploaded before being promoted to their final name when using atomic publishing.
+	StagingPrefix = "_staging"
+	// CommitsPrefix is the folder of the output store where commit markers are written
+	// once all files of a boundary were promoted to their final name.
+	CommitsPrefix = "_commits"
+
+	stagedMarkerFilename = "_STAGED"
+)
+
+// CommitMarker is the content of the marker written in `_commits/<start>-<end>.json` once
+// a boundary is fully published. It's also used as the `_STAGED` marker which records
+// that all files of a boundary have been uploaded to the staging area.
+type CommitMarker struct {
+	Boundary    string                `json:"boundary"`
+	Files       []writer.UploadedFile `json:"files"`
+	CommittedAt time.Time             `json:"committed_at,omitempty"`
+}
+
+// CommitMarkerFilename returns the name of the commit marker of the given boundary name.
+func CommitMarkerFilename(boundaryName string) string {
+	return path.Join(CommitsPrefix, boundaryName+".json")
+}
+
+// atomicPublisher performs a two-phase commit of boundaries. All files of a boundary are
+// first uploaded under `_staging/<start>-<end>/` followed by a `_STAGED` marker, then they
+// are copied to their final name, a commit marker is written in `_commits/` and the
+// staging data is removed.
+//
+// Readers that only consider boundaries having a commit marker never see a partially
+// written boundary. On restart, fully staged boundaries are promoted while partially
+// staged ones are deleted, they are going to be produced again by the sinker.
+type atomicPublisher struct {
+	store   dstore.Store
+	zlogger *zap.Logger
+}
+
+func newAtomicPublisher(store dstore.Store, zlogger *zap.Logger) *atomicPublisher {
+	return &atomicPublisher{store: store, zlogger: zlogger}
+}
+
+func (p *atomicPublisher) stagingDir(boundaryName string) string {
+	return path.Join(StagingPrefix, boundaryName)
+}
+
+func (p *atomicPublisher) publish(ctx context.Context, boundaryName string, file writer.Uploadeable) ([]writer.UploadedFile, error) {
+	stagingDir := p.stagingDir(boundaryName)
+
+	files, err := file.Upload(ctx, newPrefixedStore(p.store, stagingDir))
+	if err != nil {
+		return nil, fmt.Errorf("upload to staging: %w", err)
+	}
+
+	if err := p.writeMarker(ctx, path.Join(stagingDir, stagedMarkerFilename), &CommitMarker{Boundary: boundaryName, Files: files}); err != nil {
+		return nil, fmt.Errorf("write staged marker: %w", err)
+	}
+
+	if err := p.promote(ctx, boundaryName, files); err != nil {
+		return nil, fmt.Errorf("promote: %w", err)
+	}
+
+	return files, nil
+}
+
+func (p *atomicPublisher) promote(ctx context.Context, boundaryName string, files []writer.UploadedFile) error {
+	stagingDir := p.stagingDir(boundaryName)
+
+	for _, file := range files {
+		if err := p.store.CopyObject(ctx, path.Join(stagingDir, file.Filename), file.Filename); err != nil {
+			return fmt.Errorf("copy staged file %q: %w", file.Filename, err)
+		}
+	}
+
+	marker := &CommitMarker{Boundary: boundaryName, Files: files, CommittedAt: time.Now().UTC()}
+	if err := p.writeMarker(ctx, CommitMarkerFilename(boundaryName), marker); err != nil {
+		return fmt.Errorf("write commit marker: %w", err)
+	}
+
+	// The marker is deleted last so that a crash while cleaning up still leads to a
+	// (harmless) promotion of the boundary on restart.
+	for _, file := range files {
+		if err := p.store.DeleteObject(ctx, path.Join(stagingDir, file.Filename)); err != nil {
+			return fmt.Errorf("delete staged file %q: %w", file.Filename, err)
+		}
+	}
+
+	if err := p.store.DeleteObject(ctx, path.Join(stagingDir, stagedMarkerFilename)); err != nil {
+		return fmt.Errorf("delete staged marker: %w", err)
+	}
+
+	p.zlogger.Debug("boundary committed", zap.String("boundary", boundaryName), zap.Int("file_count", len(files)))
+	return nil
+}
+
+// recover finishes or cleans up the staging data left over by a previous run.
+func (p *atomicPublisher) recover(ctx context.Context) error {
+	filesByBoundary := map[string][]string{}
+	err := p.store.Walk(ctx, StagingPrefix+"/", func(filename string) error {
+		boundaryName, _, found := strings.Cut(strings.TrimPrefix(filename, StagingPrefix+"/"), "/")
+		if !found {
+			return nil
+		}
+
+		filesByBoundary[boundaryName] = append(filesByBoundary[boundaryName], filename)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk staging files: %w", err)
+	}
+
+	boundaryNames := make([]string, 0, len(filesByBoundary))
+	for boundaryName := range filesByBoundary {
+		boundaryNames = append(boundaryNames, boundaryName)
+	}
+	sort.Strings(boundaryNames)
+
+	for _, boundaryName := range boundaryNames {
+		markerFilename := path.Join(p.stagingDir(boundaryName), stagedMarkerFilename)
+
+		marker, err := p.readMarker(ctx, markerFilename)
+		if err != nil {
+			return fmt.Errorf("read staged marker of boundary %q: %w", boundaryName, err)
+		}
+
+		if marker != nil {
+			p.zlogger.Info("promoting fully staged boundary left over by a previous run", zap.String("boundary", boundaryName))
+			if err := p.promote(ctx, boundaryName, marker.Files); err != nil {
+				return fmt.Errorf("promote boundary %q: %w", boundaryName, err)
+			}
+			continue
+		}
+
+		p.zlogger.Info("deleting partially staged boundary left over by a previous run", zap.String("boundary", boundaryName), zap.Int("file_count", len(filesByBoundary[boundaryName])))
+		for _, filename := range filesByBoundary[boundaryName] {
+			if err := p.store.DeleteObject(ctx, filename); err != nil {
+				return fmt.Errorf("delete staged file %q: %w", filename, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *atomicPublisher) writeMarker(ctx context.Context, filename string, marker *CommitMarker) error {
+	content, err := json.Marshal(marker)
+	if err != nil {
+		return fmt.Errorf("marshal marker: %w", err)
+	}
+
+	return p.store.WriteObject(ctx, filename, bytes.NewReader(content))
+}
+
+// readMarker returns the marker found at filename or nil if it does not exist
+func (p *atomicPublisher) readMarker(ctx context.Context, filename string) (*CommitMarker, error) {
+	exists, err := p.store.FileExists(ctx, filename)
+	if err != nil {
+		return nil, fmt.Errorf("check marker exists: %w", err)
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	reader, err := p.store.OpenObject(ctx, filename)
+	if err != nil {
+		return nil, fmt.Errorf("open marker: %w", err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read marker: %w", err)
+	}
+
+	marker := &CommitMarker{}
+	if err := json.Unmarshal(content, marker); err != nil {
+		return nil, fmt.Errorf("unmarshal marker: %w", err)
+	}
+
+	return marker, nil
+}
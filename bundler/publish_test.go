@@ -0,0 +1,66 @@
+package bundler
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestAtomicPublisher_publish(t *testing.T) {
+	ctx := context.Background()
+	store := dstore.NewMockStore(nil)
+	publisher := newAtomicPublisher(store, zap.NewNop())
+
+	files, err := publisher.publish(ctx, "0000000000-0000000010", writer.UploadeableFunc(func(ctx context.Context, store dstore.Store) ([]writer.UploadedFile, error) {
+		require.NoError(t, store.WriteObject(ctx, "a/0000000000-0000000010.parquet", bytes.NewReader([]byte("a"))))
+		require.NoError(t, store.WriteObject(ctx, "b/0000000000-0000000010.parquet", bytes.NewReader([]byte("b"))))
+
+		return []writer.UploadedFile{
+			{Filename: "a/0000000000-0000000010.parquet"},
+			{Filename: "b/0000000000-0000000010.parquet"},
+		}, nil
+	}))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	assert.ElementsMatch(t, []string{
+		"a/0000000000-0000000010.parquet",
+		"b/0000000000-0000000010.parquet",
+		"_commits/0000000000-0000000010.json",
+	}, keys(store.Files))
+	assert.Equal(t, []byte("a"), store.Files["a/0000000000-0000000010.parquet"])
+	assert.Equal(t, []byte("b"), store.Files["b/0000000000-0000000010.parquet"])
+}
+
+func TestAtomicPublisher_recover(t *testing.T) {
+	ctx := context.Background()
+	store := dstore.NewMockStore(nil)
+	publisher := newAtomicPublisher(store, zap.NewNop())
+
+	// Fully staged boundary, must be promoted
+	store.SetFile("_staging/0000000000-0000000010/a/0000000000-0000000010.parquet", []byte("a"))
+	store.SetFile("_staging/0000000000-0000000010/_STAGED", []byte(`{"boundary":"0000000000-0000000010","files":[{"filename":"a/0000000000-0000000010.parquet"}]}`))
+
+	// Partially staged boundary, must be deleted
+	store.SetFile("_staging/0000000010-0000000020/a/0000000010-0000000020.parquet", []byte("a"))
+
+	require.NoError(t, publisher.recover(ctx))
+
+	assert.ElementsMatch(t, []string{
+		"a/0000000000-0000000010.parquet",
+		"_commits/0000000000-0000000010.json",
+	}, keys(store.Files))
+}
+
+func keys[V any](in map[string]V) (out []string) {
+	for k := range in {
+		out = append(out, k)
+	}
+	return
+}
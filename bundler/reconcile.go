@@ -0,0 +1,337 @@
+package bundler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/state"
+	sink "github.com/streamingfast/substreams/sink"
+	"go.uber.org/zap"
+)
+
+// ReconcilePolicy is what to do when, at startup, the output store is not consistent
+// with the cursor of the state.
+type ReconcilePolicy string
+
+const (
+	// ReconcileOff does not check the output store at all
+	ReconcileOff ReconcilePolicy = "off"
+	// ReconcileWarn logs the inconsistencies found and starts anyway
+	ReconcileWarn ReconcilePolicy = "warn"
+	// ReconcileFail refuses to start if any inconsistency is found
+	ReconcileFail ReconcilePolicy = "fail"
+	// ReconcileRepair rewinds the state and deletes files so that inconsistent boundaries
+	// are written again
+	ReconcileRepair ReconcilePolicy = "repair"
+)
+
+// ParseReconcilePolicy parses the policy, accepted values are 'off', 'warn', 'fail' and 'repair'.
+func ParseReconcilePolicy(in string) (ReconcilePolicy, error) {
+	switch policy := ReconcilePolicy(strings.ToLower(in)); policy {
+	case ReconcileOff, ReconcileWarn, ReconcileFail, ReconcileRepair:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("invalid reconcile policy %q, accepted values are 'off', 'warn', 'fail' and 'repair'", in)
+}
+
+// boundaryPathRegex finds the '<start>-<end>' block range in the path of the files
+// produced for a boundary, data files, manifests and commit markers alike.
+var boundaryPathRegex = regexp.MustCompile(`(?:^|[/_])(\d{10})-(\d{10})(?:[./]|$)`)
+
+// reconciler compares the boundaries found in the output store with the cursor of the
+// state, it reports:
+//   - gaps, block ranges before the cursor without any file
+//   - orphan files, files whose block range overlaps the one of other files, typically
+//     left over by a run using different boundary settings
+//   - boundaries past the cursor, written by another run or by this one prior a crash
+//     that happened before the state was saved
+//
+// When repairing, the state is rewound to the end of the last boundary before the first
+// gap or orphan file, using the cursor of its manifest, and all files of the boundaries
+// after it are deleted so they get written again.
+type reconciler struct {
+	policy     ReconcilePolicy
+	blockRange *bstream.Range
+	store      dstore.Store
+	stateStore state.Store
+	zlogger    *zap.Logger
+}
+
+// storedBoundary is a block range found in the output store along with its files.
+type storedBoundary struct {
+	boundary *bstream.Range
+	files    []string
+	manifest string
+}
+
+// reconciliation is the result of the comparison of the output store with the cursor.
+type reconciliation struct {
+	gaps       []*bstream.Range
+	orphans    []*storedBoundary
+	pastCursor []*storedBoundary
+
+	// rewindTo is the index, in the boundaries before the cursor, of the first boundary
+	// that must be written again, -1 if the state does not need to be rewound
+	rewindTo int
+}
+
+func (r *reconciliation) consistent() bool {
+	return len(r.gaps) == 0 && len(r.orphans) == 0 && len(r.pastCursor) == 0
+}
+
+func newReconciler(policy ReconcilePolicy, blockRange *bstream.Range, store dstore.Store, stateStore state.Store, zlogger *zap.Logger) *reconciler {
+	return &reconciler{
+		policy:     policy,
+		blockRange: blockRange,
+		store:      store,
+		stateStore: stateStore,
+		zlogger:    zlogger,
+	}
+}
+
+func (r *reconciler) reconcile(ctx context.Context) error {
+	if r.policy == ReconcileOff {
+		return nil
+	}
+
+	cursor, err := r.stateStore.ReadCursor()
+	if err != nil {
+		return fmt.Errorf("read cursor: %w", err)
+	}
+
+	boundaries, err := r.listBoundaries(ctx)
+	if err != nil {
+		return err
+	}
+
+	var beforeCursor []*storedBoundary
+	var pastCursor []*storedBoundary
+	for _, boundary := range boundaries {
+		if cursor.IsBlank() || boundary.boundary.StartBlock() > cursor.Block().Num() {
+			pastCursor = append(pastCursor, boundary)
+			continue
+		}
+
+		beforeCursor = append(beforeCursor, boundary)
+	}
+
+	result := reconcileBoundaries(beforeCursor, r.blockRange.StartBlock(), cursor)
+	result.pastCursor = pastCursor
+
+	if result.consistent() {
+		r.zlogger.Info("output store is consistent with the state", zap.Int("boundary_count", len(boundaries)), zap.Stringer("cursor_block", cursor.Block()))
+		return nil
+	}
+
+	r.zlogger.Warn("output store is not consistent with the state",
+		zap.Stringer("cursor_block", cursor.Block()),
+		zap.Stringers("gaps", result.gaps),
+		zap.Strings("orphan_files", boundaryFiles(result.orphans)),
+		zap.Strings("files_past_cursor", boundaryFiles(result.pastCursor)),
+	)
+
+	switch r.policy {
+	case ReconcileWarn:
+		return nil
+	case ReconcileFail:
+		return fmt.Errorf("output store is not consistent with the state (cursor at block %s): %d gap(s), %d orphan file(s) and %d file(s) past the cursor found, refusing to start",
+			cursor.Block(), len(result.gaps), len(boundaryFiles(result.orphans)), len(boundaryFiles(result.pastCursor)))
+	}
+
+	return r.repair(ctx, beforeCursor, result)
+}
+
+func (r *reconciler) repair(ctx context.Context, beforeCursor []*storedBoundary, result *reconciliation) error {
+	toDelete := result.pastCursor
+
+	if result.rewindTo >= 0 {
+		cursor := sink.NewBlankCursor()
+		if result.rewindTo > 0 {
+			lastValid := beforeCursor[result.rewindTo-1]
+			if lastValid.manifest == "" {
+				return fmt.Errorf("unable to rewind the state to the end of boundary %s, its manifest holding the cursor is missing, it's only written with boundary manifests enabled", lastValid.boundary)
+			}
+
+			manifest, err := readManifest(ctx, r.store, lastValid.manifest)
+			if err != nil {
+				return fmt.Errorf("read manifest of boundary %s: %w", lastValid.boundary, err)
+			}
+
+			if cursor, err = sink.NewCursor(manifest.Cursor); err != nil {
+				return fmt.Errorf("invalid cursor in manifest of boundary %s: %w", lastValid.boundary, err)
+			}
+		}
+
+		r.zlogger.Info("rewinding state", zap.Stringer("cursor_block", cursor.Block()))
+		r.stateStore.SetCursor(cursor)
+
+		saveable, err := r.stateStore.GetState()
+		if err != nil {
+			return fmt.Errorf("get state: %w", err)
+		}
+
+		if err := saveable.Save(); err != nil {
+			return fmt.Errorf("save rewound state: %w", err)
+		}
+
+		toDelete = append(beforeCursor[result.rewindTo:], toDelete...)
+	}
+
+	for _, filename := range boundaryFiles(toDelete) {
+		r.zlogger.Info("deleting file of boundary to write again", zap.String("filename", filename))
+		if err := r.store.DeleteObject(ctx, filename); err != nil {
+			return fmt.Errorf("delete %q: %w", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// listBoundaries returns the boundaries of the block range found in the output store
+// sorted by block range.
+func (r *reconciler) listBoundaries(ctx context.Context) ([]*storedBoundary, error) {
+	byRange := map[string]*storedBoundary{}
+	err := r.store.Walk(ctx, "", func(filename string) error {
+		if strings.HasPrefix(filename, StagingPrefix+"/") || strings.HasPrefix(filename, HeadPrefix+"/") || strings.HasPrefix(filename, ReplicaJournalPrefix+"/") {
+			return nil
+		}
+
+		boundary, ok := parseBoundaryPath(filename)
+		if !ok || !r.inBlockRange(boundary) {
+			return nil
+		}
+
+		key := boundaryName(boundary)
+		if _, found := byRange[key]; !found {
+			byRange[key] = &storedBoundary{boundary: boundary}
+		}
+
+		byRange[key].files = append(byRange[key].files, filename)
+		if strings.HasSuffix(filename, ".manifest.json") {
+			byRange[key].manifest = filename
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk output store: %w", err)
+	}
+
+	out := make([]*storedBoundary, 0, len(byRange))
+	for _, boundary := range byRange {
+		sort.Strings(boundary.files)
+		out = append(out, boundary)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].boundary.StartBlock() != out[j].boundary.StartBlock() {
+			return out[i].boundary.StartBlock() < out[j].boundary.StartBlock()
+		}
+
+		return *out[i].boundary.EndBlock() < *out[j].boundary.EndBlock()
+	})
+
+	return out, nil
+}
+
+// inBlockRange returns true if the boundary contains blocks of the sink's block range,
+// other boundaries belong to other runs, like other segments of a parallel backfill.
+func (r *reconciler) inBlockRange(boundary *bstream.Range) bool {
+	if *boundary.EndBlock() <= r.blockRange.StartBlock() {
+		return false
+	}
+
+	return r.blockRange.EndBlock() == nil || boundary.StartBlock() < *r.blockRange.EndBlock()
+}
+
+// reconcileBoundaries looks for gaps and overlaps in the boundaries found before the
+// cursor, which are sorted by block range. The first boundary may start before the
+// start block as boundaries are aligned on the block count.
+func reconcileBoundaries(boundaries []*storedBoundary, startBlock uint64, cursor *sink.Cursor) *reconciliation {
+	result := &reconciliation{rewindTo: -1}
+	markRewind := func(index int) {
+		if result.rewindTo == -1 {
+			result.rewindTo = index
+		}
+	}
+
+	// next is the end of the boundaries seen so far, nextIndex the boundary ending there
+	next, nextIndex := startBlock, -1
+	for i, boundary := range boundaries {
+		if nextIndex >= 0 && boundary.boundary.StartBlock() < next {
+			// Both boundaries are written again as we cannot tell which one is right
+			if len(result.orphans) == 0 || result.orphans[len(result.orphans)-1] != boundaries[nextIndex] {
+				result.orphans = append(result.orphans, boundaries[nextIndex])
+			}
+			result.orphans = append(result.orphans, boundary)
+			markRewind(nextIndex)
+		} else if boundary.boundary.StartBlock() > next {
+			result.gaps = append(result.gaps, bstream.NewRangeExcludingEnd(next, boundary.boundary.StartBlock()))
+			markRewind(i)
+		}
+
+		if nextIndex == -1 || *boundary.boundary.EndBlock() > next {
+			next, nextIndex = *boundary.boundary.EndBlock(), i
+		}
+	}
+
+	if !cursor.IsBlank() && next <= cursor.Block().Num() {
+		result.gaps = append(result.gaps, bstream.NewRangeExcludingEnd(next, cursor.Block().Num()+1))
+		markRewind(len(boundaries))
+	}
+
+	return result
+}
+
+func parseBoundaryPath(filename string) (*bstream.Range, bool) {
+	matches := boundaryPathRegex.FindAllStringSubmatch(filename, -1)
+	if len(matches) == 0 {
+		return nil, false
+	}
+
+	match := matches[len(matches)-1]
+	start, _ := strconv.ParseUint(match[1], 10, 64)
+	end, _ := strconv.ParseUint(match[2], 10, 64)
+	if end <= start {
+		return nil, false
+	}
+
+	return bstream.NewRangeExcludingEnd(start, end), true
+}
+
+func boundaryFiles(boundaries []*storedBoundary) (out []string) {
+	for _, boundary := range boundaries {
+		out = append(out, boundary.files...)
+	}
+
+	return out
+}
+
+func readManifest(ctx context.Context, store dstore.Store, filename string) (*Manifest, error) {
+	reader, err := store.OpenObject(ctx, filename)
+	if err != nil {
+		return nil, fmt.Errorf("open manifest: %w", err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest: %w", err)
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,205 @@
+package bundler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/streamingfast/substreams-sink-files/v2/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseBoundaryPath(t *testing.T) {
+	tests := []struct {
+		filename string
+		expect   *bstream.Range
+	}{
+		{"0000000100-0000000200.jsonl", bstream.NewRangeExcludingEnd(100, 200)},
+		{"transfers/0000000100-0000000200.parquet", bstream.NewRangeExcludingEnd(100, 200)},
+		{"0000000100-0000000200.manifest.json", bstream.NewRangeExcludingEnd(100, 200)},
+		{"_commits/0000000100-0000000200.json", bstream.NewRangeExcludingEnd(100, 200)},
+		{"20240305T130000Z-20240305T140000Z_0000000100-0000000200.jsonl", bstream.NewRangeExcludingEnd(100, 200)},
+		{"state.0000000000-0000000200.yaml", nil},
+		{"state.yaml", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			boundary, ok := parseBoundaryPath(test.filename)
+			assert.Equal(t, test.expect != nil, ok)
+			assert.Equal(t, test.expect, boundary)
+		})
+	}
+}
+
+func TestReconcileBoundaries(t *testing.T) {
+	stored := func(ranges ...[2]uint64) (out []*storedBoundary) {
+		for _, r := range ranges {
+			out = append(out, &storedBoundary{boundary: bstream.NewRangeExcludingEnd(r[0], r[1])})
+		}
+		return out
+	}
+
+	tests := []struct {
+		name          string
+		boundaries    []*storedBoundary
+		cursorBlock   uint64
+		expectGaps    []*bstream.Range
+		expectOrphans int
+		expectRewind  int
+	}{
+		{"consistent", stored([2]uint64{0, 100}, [2]uint64{100, 200}), 199, nil, 0, -1},
+		{"aligned first boundary", stored([2]uint64{100, 200}), 199, nil, 0, -1},
+		{"gap between boundaries", stored([2]uint64{0, 100}, [2]uint64{200, 300}), 299, []*bstream.Range{bstream.NewRangeExcludingEnd(100, 200)}, 0, 1},
+		{"gap at start", stored([2]uint64{200, 300}), 299, []*bstream.Range{bstream.NewRangeExcludingEnd(123, 200)}, 0, 0},
+		{"gap up to cursor", stored([2]uint64{0, 100}), 250, []*bstream.Range{bstream.NewRangeExcludingEnd(100, 251)}, 0, 1},
+		{"overlapping boundaries", stored([2]uint64{0, 100}, [2]uint64{100, 200}, [2]uint64{100, 150}, [2]uint64{200, 300}), 299, nil, 2, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			startBlock := uint64(123)
+			if test.boundaries[0].boundary.StartBlock() == 0 {
+				startBlock = 0
+			}
+
+			result := reconcileBoundaries(test.boundaries, startBlock, testCursor(test.cursorBlock))
+			assert.Equal(t, test.expectGaps, result.gaps)
+			assert.Len(t, result.orphans, test.expectOrphans)
+			assert.Equal(t, test.expectRewind, result.rewindTo)
+		})
+	}
+}
+
+func TestReconciler_reconcile(t *testing.T) {
+	manifestWithCursor := func(blockNum uint64) string {
+		return `{"cursor":"` + testCursor(blockNum).String() + `"}`
+	}
+
+	tests := []struct {
+		name         string
+		policy       ReconcilePolicy
+		files        map[string]string
+		cursorBlock  uint64
+		expectError  bool
+		expectFiles  []string
+		expectCursor uint64
+	}{
+		{
+			"warn keeps everything",
+			ReconcileWarn,
+			map[string]string{"0000000000-0000000100.jsonl": "", "0000000100-0000000200.jsonl": ""},
+			99,
+			false,
+			[]string{"0000000000-0000000100.jsonl", "0000000100-0000000200.jsonl"},
+			99,
+		},
+		{
+			"fail on boundary past cursor",
+			ReconcileFail,
+			map[string]string{"0000000000-0000000100.jsonl": "", "0000000100-0000000200.jsonl": ""},
+			99,
+			true,
+			[]string{"0000000000-0000000100.jsonl", "0000000100-0000000200.jsonl"},
+			99,
+		},
+		{
+			"repair deletes boundary past cursor",
+			ReconcileRepair,
+			map[string]string{"0000000000-0000000100.jsonl": "", "0000000100-0000000200.jsonl": "", "0000000100-0000000200.manifest.json": manifestWithCursor(199)},
+			99,
+			false,
+			[]string{"0000000000-0000000100.jsonl"},
+			99,
+		},
+		{
+			"repair rewinds before gap",
+			ReconcileRepair,
+			map[string]string{
+				"0000000000-0000000100.jsonl":         "",
+				"0000000000-0000000100.manifest.json": manifestWithCursor(99),
+				"0000000200-0000000300.jsonl":         "",
+			},
+			299,
+			false,
+			[]string{"0000000000-0000000100.jsonl", "0000000000-0000000100.manifest.json"},
+			99,
+		},
+		{
+			"repair without manifest",
+			ReconcileRepair,
+			map[string]string{"0000000000-0000000100.jsonl": "", "0000000200-0000000300.jsonl": ""},
+			299,
+			true,
+			[]string{"0000000000-0000000100.jsonl", "0000000200-0000000300.jsonl"},
+			299,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			outputDir := t.TempDir()
+			for filename, content := range test.files {
+				require.NoError(t, os.WriteFile(filepath.Join(outputDir, filename), []byte(content), 0644))
+			}
+
+			outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+			require.NoError(t, err)
+
+			statePath := filepath.Join(t.TempDir(), "state.yaml")
+			stateStore, err := state.NewFileStateStore(statePath)
+			require.NoError(t, err)
+			stateStore.SetCursor(testCursor(test.cursorBlock))
+
+			err = newReconciler(test.policy, bstream.NewOpenRange(0), outputStore, stateStore, zap.NewNop()).reconcile(ctx)
+			if test.expectError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			var actualFiles []string
+			require.NoError(t, outputStore.Walk(ctx, "", func(filename string) error {
+				actualFiles = append(actualFiles, filename)
+				return nil
+			}))
+			assert.ElementsMatch(t, test.expectFiles, actualFiles)
+
+			cursor, err := stateStore.ReadCursor()
+			require.NoError(t, err)
+			assert.Equal(t, test.expectCursor, cursor.Block().Num())
+		})
+	}
+}
+
+func TestReconciler_emptyBoundaries(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+	for _, filename := range []string{"0000000100-0000000200.jsonl", "0000000200-0000000400.empty", "0000000400-0000000500.jsonl", "0000000500-0000000700.empty"} {
+		require.NoError(t, os.WriteFile(filepath.Join(outputDir, filename), nil, 0644))
+	}
+
+	outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+	require.NoError(t, err)
+
+	statePath := filepath.Join(t.TempDir(), "state.yaml")
+	stateStore, err := state.NewFileStateStore(statePath)
+	require.NoError(t, err)
+	stateStore.SetCursor(testCursor(699))
+
+	boundaryWriter := writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop())
+	blockRange := bstream.NewRangeExcludingEnd(100, 700)
+
+	// Skipped boundaries leave no file and would be reported as gaps
+	_, err = New(100, boundaryWriter, stateStore, outputStore, zap.NewNop(), WithEmptyBoundaryPolicy(EmptyBoundarySkip), WithReconcile(ReconcileFail, blockRange))
+	require.Error(t, err)
+
+	b, err := New(100, boundaryWriter, stateStore, outputStore, zap.NewNop(), WithEmptyBoundaryPolicy(EmptyBoundaryMarker), WithReconcile(ReconcileFail, blockRange))
+	require.NoError(t, err)
+	require.NoError(t, b.reconciler.reconcile(ctx))
+}
@@ -0,0 +1,366 @@
+package bundler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/streamingfast/dstore"
+	"go.uber.org/zap"
+)
+
+// OptionalReplicaPrefix marks, in a destination specification, a replica that is allowed
+// to lag behind the output store, see ParseDestination.
+const OptionalReplicaPrefix = "optional:"
+
+// ReplicaJournalPrefix is the folder of the output store where the copies pending for
+// each optional replica are saved so that they are resumed on restart.
+const ReplicaJournalPrefix = "_replicas"
+
+// Replica is a destination receiving a copy of every file written to the output store.
+type Replica struct {
+	Store dstore.Store
+	// Required replicas must receive the files of a boundary before it's committed,
+	// optional ones are copied to in the background and can lag behind
+	Required bool
+}
+
+// ParseDestination splits a destination specification in its URL and whether it's
+// required, destinations prefixed with OptionalReplicaPrefix are optional.
+func ParseDestination(in string) (url string, required bool) {
+	if url, found := strings.CutPrefix(in, OptionalReplicaPrefix); found {
+		return url, false
+	}
+
+	return in, true
+}
+
+// replication is the copy of the files of a boundary from the output store to a replica.
+type replication struct {
+	Boundary  string   `json:"boundary"`
+	Filenames []string `json:"filenames"`
+}
+
+// replicaJournal is the content of the journal of an optional replica.
+type replicaJournal struct {
+	Destination string         `json:"destination"`
+	Pending     []*replication `json:"pending"`
+}
+
+// replicator copies the files written to the output store to a replica, each copy being
+// retried with an exponential backoff.
+//
+// Copies to required replicas are done by the upload of the boundary, so the state is
+// saved only once they succeeded. Copies to optional replicas are queued and done in
+// order by a background worker retrying forever, the sink never waiting for them. The
+// copies pending are saved in a journal, an object of the output store under
+// ReplicaJournalPrefix written through a store overwriting objects, each time a copy is
+// queued or done so that the ones still pending when the sink stops are resumed on
+// restart.
+//
+// Files go through the rewriters of the table committers when copied, so that the
+// metadata of tables copied refers to the replica's files.
+type replicator struct {
+	source          dstore.Store
+	journal         dstore.Store
+	journalFilename string
+	replica         Replica
+	rewriters       []ReplicaRewriter
+	destination     string
+	retries         uint64
+	initialBackoff  time.Duration
+	zlogger         *zap.Logger
+
+	lock    sync.Mutex
+	pending []*replication
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newReplicator(source dstore.Store, journal dstore.Store, replica Replica, rewriters []ReplicaRewriter, retries uint64, initialBackoff time.Duration, zlogger *zap.Logger) *replicator {
+	destination := replica.Store.BaseURL().Redacted()
+
+	return &replicator{
+		source:          source,
+		journal:         journal,
+		journalFilename: replicaJournalFilename(destination),
+		replica:         replica,
+		rewriters:       rewriters,
+		destination:     destination,
+		retries:         retries,
+		initialBackoff:  initialBackoff,
+		zlogger:         zlogger.With(zap.String("destination", destination)),
+		wake:            make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+// replicaJournalFilename returns the name of the journal of the given destination, named
+// after the hash of its URL.
+func replicaJournalFilename(destination string) string {
+	hash := sha256.Sum256([]byte(destination))
+	return path.Join(ReplicaJournalPrefix, hex.EncodeToString(hash[:8])+".json")
+}
+
+// recover loads the copies left pending by a previous run from the journal, it must be
+// called before start.
+func (r *replicator) recover(ctx context.Context) error {
+	if r.replica.Required {
+		return nil
+	}
+
+	exists, err := r.journal.FileExists(ctx, r.journalFilename)
+	if err != nil {
+		return fmt.Errorf("check journal exists: %w", err)
+	}
+
+	if !exists {
+		return nil
+	}
+
+	reader, err := r.journal.OpenObject(ctx, r.journalFilename)
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	defer reader.Close()
+
+	journal := &replicaJournal{}
+	if err := json.NewDecoder(reader).Decode(journal); err != nil {
+		return fmt.Errorf("decode journal %q: %w", r.journalFilename, err)
+	}
+
+	if len(journal.Pending) > 0 {
+		r.zlogger.Info("resuming copies left pending by the previous run", zap.Int("boundary_count", len(journal.Pending)))
+	}
+
+	r.lock.Lock()
+	r.pending = append(journal.Pending, r.pending...)
+	ReplicaPendingBoundaries.SetInt(len(r.pending), r.destination)
+	r.lock.Unlock()
+
+	return nil
+}
+
+// saveJournal writes the copies pending to the journal, the lock must be held.
+func (r *replicator) saveJournal(ctx context.Context) error {
+	content, err := json.Marshal(&replicaJournal{Destination: r.destination, Pending: r.pending})
+	if err != nil {
+		return fmt.Errorf("marshal journal: %w", err)
+	}
+
+	if err := r.journal.WriteObject(ctx, r.journalFilename, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("write journal %q: %w", r.journalFilename, err)
+	}
+
+	return nil
+}
+
+// replicate copies the files of the boundary to the replica if it's required, or queues
+// the copy if it's optional. Errors are permanent, the boundary's files being already in
+// the output store they must not be uploaded again.
+func (r *replicator) replicate(ctx context.Context, boundary string, filenames []string) error {
+	if len(filenames) == 0 {
+		return nil
+	}
+
+	if !r.replica.Required {
+		return r.push(ctx, &replication{Boundary: boundary, Filenames: filenames})
+	}
+
+	policy := r.backoff()
+	if err := r.copyWithRetry(ctx, backoff.WithMaxRetries(policy, r.retries), boundary, filenames); err != nil {
+		return backoff.Permanent(fmt.Errorf("replicate to %s: %w", r.destination, err))
+	}
+
+	r.zlogger.Info("boundary replicated", zap.String("boundary", boundary), zap.Int("file_count", len(filenames)))
+	return nil
+}
+
+// push queues the copy once saved in the journal.
+func (r *replicator) push(ctx context.Context, pending *replication) error {
+	r.lock.Lock()
+	r.pending = append(r.pending, pending)
+	if err := r.saveJournal(ctx); err != nil {
+		r.pending = r.pending[:len(r.pending)-1]
+		r.lock.Unlock()
+		return fmt.Errorf("queue copy to %s: %w", r.destination, err)
+	}
+	ReplicaPendingBoundaries.SetInt(len(r.pending), r.destination)
+	r.lock.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// start launches the background worker of optional replicas, it stops once ctx is done
+// or the replicator is closed.
+func (r *replicator) start(ctx context.Context) {
+	go func() {
+		defer close(r.done)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-r.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		for {
+			next := r.next()
+			if next == nil {
+				select {
+				case <-r.wake:
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if err := r.copyWithRetry(ctx, r.backoff(), next.Boundary, next.Filenames); err != nil {
+				return
+			}
+
+			r.zlogger.Info("boundary replicated", zap.String("boundary", next.Boundary), zap.Int("file_count", len(next.Filenames)))
+			r.lock.Lock()
+			r.pending = r.pending[1:]
+			// The copy is done again on restart if the journal is not saved, copies are idempotent
+			if err := r.saveJournal(ctx); err != nil {
+				r.zlogger.Warn("unable to save replica journal", zap.Error(err))
+			}
+			ReplicaPendingBoundaries.SetInt(len(r.pending), r.destination)
+			r.lock.Unlock()
+		}
+	}()
+}
+
+// next returns the oldest copy pending, nil if there is none.
+func (r *replicator) next() *replication {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	return r.pending[0]
+}
+
+// close stops the background worker, waiting for it to stop, and logs the copies left
+// pending, they are resumed on restart.
+func (r *replicator) close() {
+	close(r.stop)
+	<-r.done
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.pending) > 0 {
+		r.zlogger.Info("boundaries not replicated to optional destination yet, copies are resumed on restart", zap.Int("boundary_count", len(r.pending)), zap.String("journal", r.journalFilename))
+	}
+}
+
+func (r *replicator) backoff() *backoff.ExponentialBackOff {
+	policy := backoff.NewExponentialBackOff()
+	policy.InitialInterval = r.initialBackoff
+	policy.MaxInterval = maxUploadBackoff
+	policy.MaxElapsedTime = 0
+
+	return policy
+}
+
+func (r *replicator) copyWithRetry(ctx context.Context, policy backoff.BackOff, boundary string, filenames []string) error {
+	attempt := 0
+	return backoff.RetryNotify(func() error {
+		attempt++
+
+		for _, filename := range filenames {
+			if err := r.copy(ctx, filename); err != nil {
+				ReplicaFailureCount.Inc(r.destination)
+				if ctx.Err() != nil {
+					return backoff.Permanent(err)
+				}
+
+				return err
+			}
+		}
+
+		return nil
+	}, backoff.WithContext(policy, ctx), func(err error, next time.Duration) {
+		r.zlogger.Warn("boundary replication failed, retrying",
+			zap.String("boundary", boundary),
+			zap.Int("attempt", attempt),
+			zap.Duration("retry_in", next),
+			zap.Error(err),
+		)
+	})
+}
+
+// copy writes the file of the output store to the replica under the same name. Files
+// deleted from the output store since the copy was queued, for example by
+// --startup-reconcile=repair, are skipped.
+func (r *replicator) copy(ctx context.Context, filename string) error {
+	reader, err := r.source.OpenObject(ctx, filename)
+	if err != nil {
+		if errors.Is(err, dstore.ErrNotFound) {
+			r.zlogger.Warn("file to replicate not found in the output store, skipping", zap.String("filename", filename))
+			return nil
+		}
+
+		return fmt.Errorf("open %q: %w", filename, err)
+	}
+	defer reader.Close()
+
+	var content io.Reader = reader
+	for _, rewriter := range r.rewriters {
+		if content, err = rewriter.RewriteForReplica(ctx, r.source, r.replica.Store, filename, content); err != nil {
+			return fmt.Errorf("rewrite %q: %w", filename, err)
+		}
+	}
+
+	var size int64
+	counter := writeCounterFunc(func(n int) { size += int64(n) })
+	if err := r.replica.Store.WriteObject(ctx, filename, io.TeeReader(content, counter)); err != nil {
+		return fmt.Errorf("write %q: %w", filename, err)
+	}
+
+	ReplicaBytesWritten.AddInt64(size, r.destination)
+	return nil
+}
+
+type writeCounterFunc func(n int)
+
+func (f writeCounterFunc) Write(p []byte) (int, error) {
+	f(len(p))
+	return len(p), nil
+}
+
+// replicate copies the given files of the boundary, already in the output store, to
+// every replica, in order, copies to optional replicas being only queued.
+func (b *Bundler) replicate(ctx context.Context, boundary string, filenames []string) error {
+	for _, replicator := range b.replicators {
+		if err := replicator.replicate(ctx, boundary, filenames); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package bundler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/streamingfast/substreams-sink-files/v2/state"
+	pbsubstreams "github.com/streamingfast/substreams/pb/sf/substreams/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestParseDestination(t *testing.T) {
+	url, required := ParseDestination("gs://bucket/output")
+	assert.Equal(t, "gs://bucket/output", url)
+	assert.True(t, required)
+
+	url, required = ParseDestination("optional:file:///mnt/output")
+	assert.Equal(t, "file:///mnt/output", url)
+	assert.False(t, required)
+}
+
+func TestBundler_Replicas(t *testing.T) {
+	newStore := func(t *testing.T, dir string) dstore.Store {
+		store, err := dstore.NewStore("file://"+dir, "", "", true)
+		require.NoError(t, err)
+		return store
+	}
+
+	tests := []struct {
+		name           string
+		requiredBroken bool
+		expectErr      string
+		expectRequired map[string]string
+		expectOptional map[string]string
+	}{
+		{
+			name: "replicated",
+			expectRequired: map[string]string{
+				"0000000000-0000000100.jsonl": "10\n",
+				"0000000100-0000000200.jsonl": "150\n",
+			},
+			expectOptional: map[string]string{
+				"0000000000-0000000100.jsonl": "10\n",
+				"0000000100-0000000200.jsonl": "150\n",
+			},
+		},
+		{
+			name:           "required replica failing",
+			requiredBroken: true,
+			expectErr:      "replicate to file://",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			requiredDir := t.TempDir()
+			optionalDir := t.TempDir()
+			requiredStore := newStore(t, requiredDir)
+
+			// A store whose root became a regular file cannot be written to
+			if test.requiredBroken {
+				require.NoError(t, os.Remove(requiredDir))
+				require.NoError(t, os.WriteFile(requiredDir, nil, 0644))
+			}
+
+			stateFile := filepath.Join(t.TempDir(), "state.yaml")
+			stateStore, err := state.NewFileStateStore(stateFile)
+			require.NoError(t, err)
+
+			boundaryWriter := writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop())
+			outputStore := newStore(t, t.TempDir())
+			b, err := New(100, boundaryWriter, stateStore, outputStore, zap.NewNop(),
+				WithUploadRetry(1, time.Millisecond),
+				WithReplicas(outputStore,
+					Replica{Store: requiredStore, Required: true},
+					Replica{Store: newStore(t, optionalDir), Required: false},
+				),
+			)
+			require.NoError(t, err)
+
+			b.Launch(ctx)
+			require.NoError(t, b.Start(0))
+
+			// A single boundary when failing so that no upload is still writing to the output
+			// store once the bundler terminated
+			blocks, endBlock := []uint64{10, 150}, uint64(200)
+			if test.requiredBroken {
+				blocks, endBlock = []uint64{10}, 100
+			}
+
+			for _, blockNum := range blocks {
+				require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+				_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+				require.NoError(t, err)
+
+				b.SetCursor(testCursor(blockNum))
+			}
+
+			require.NoError(t, b.Finish(ctx, endBlock))
+
+			if test.expectErr != "" {
+				<-b.Terminated()
+				require.Error(t, b.Err())
+				assert.Contains(t, b.Err().Error(), test.expectErr)
+				assert.NoFileExists(t, stateFile)
+				return
+			}
+
+			// Optional replicas are not waited for on shutdown
+			assert.Equal(t, test.expectOptional, readOutputFiles(t, optionalDir, len(test.expectOptional)))
+
+			b.Shutdown(nil)
+			<-b.Terminated()
+			require.NoError(t, b.Err())
+
+			assert.Equal(t, test.expectRequired, readOutputFiles(t, requiredDir, len(test.expectRequired)))
+		})
+	}
+}
+
+func TestBundler_ReplicaJournal(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+	optionalDir := t.TempDir()
+	statePath := filepath.Join(t.TempDir(), "state.yaml")
+
+	outputStore, err := dstore.NewStore("file://"+outputDir, "", "", true)
+	require.NoError(t, err)
+	optionalStore, err := dstore.NewStore("file://"+optionalDir, "", "", true)
+	require.NoError(t, err)
+
+	newBundler := func(t *testing.T) *Bundler {
+		stateStore, err := state.NewFileStateStore(statePath)
+		require.NoError(t, err)
+
+		b, err := New(100, writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop(),
+			WithUploadRetry(1, time.Millisecond),
+			WithReplicas(outputStore, Replica{Store: optionalStore, Required: false}),
+		)
+		require.NoError(t, err)
+		require.NoError(t, b.Recover(ctx))
+
+		return b
+	}
+
+	// The optional replica cannot be written to during the first run, its copies are left
+	// pending on shutdown
+	require.NoError(t, os.Remove(optionalDir))
+	require.NoError(t, os.WriteFile(optionalDir, nil, 0644))
+
+	b := newBundler(t)
+	b.Launch(ctx)
+	require.NoError(t, b.Start(0))
+	for _, blockNum := range []uint64{10, 150} {
+		require.NoError(t, b.Roll(ctx, &pbsubstreams.Clock{Number: blockNum, Timestamp: timestamppb.New(time.Unix(int64(blockNum), 0))}))
+
+		_, err := fmt.Fprintf(b.Writer(), "%d\n", blockNum)
+		require.NoError(t, err)
+
+		b.SetCursor(testCursor(blockNum))
+	}
+	require.NoError(t, b.Finish(ctx, 200))
+
+	b.Shutdown(nil)
+	<-b.Terminated()
+	require.NoError(t, b.Err())
+
+	journalPath := filepath.Join(outputDir, replicaJournalFilename(optionalStore.BaseURL().Redacted()))
+	content, err := os.ReadFile(journalPath)
+	require.NoError(t, err)
+	journal := &replicaJournal{}
+	require.NoError(t, json.Unmarshal(content, journal))
+	require.Len(t, journal.Pending, 2)
+	assert.Equal(t, "0000000000-0000000100", journal.Pending[0].Boundary)
+	assert.Equal(t, "0000000100-0000000200", journal.Pending[1].Boundary)
+
+	// The copies are resumed by the next run once the replica is back
+	require.NoError(t, os.Remove(optionalDir))
+	require.NoError(t, os.Mkdir(optionalDir, 0755))
+
+	b = newBundler(t)
+	b.Launch(ctx)
+
+	assert.Equal(t, map[string]string{
+		"0000000000-0000000100.jsonl": "10\n",
+		"0000000100-0000000200.jsonl": "150\n",
+	}, readOutputFiles(t, optionalDir, 2))
+
+	b.Shutdown(nil)
+	<-b.Terminated()
+	require.NoError(t, b.Err())
+
+	content, err = os.ReadFile(journalPath)
+	require.NoError(t, err)
+	journal = &replicaJournal{}
+	require.NoError(t, json.Unmarshal(content, journal))
+	assert.Empty(t, journal.Pending)
+}
+
+func TestReplicator_rewriters(t *testing.T) {
+	ctx := context.Background()
+	source := dstore.NewMockStore(nil)
+	source.SetFile("0000000000-0000000100.jsonl", []byte("10\n"))
+	source.SetFile("_metadata/table.json", []byte(`{"location":"source"}`))
+	replica := dstore.NewMockStore(nil)
+
+	rewriter := replicaRewriterFunc(func(ctx context.Context, source dstore.Store, replica dstore.Store, filename string, content io.Reader) (io.Reader, error) {
+		if filename != "_metadata/table.json" {
+			return content, nil
+		}
+
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(bytes.ReplaceAll(data, []byte("source"), []byte("replica"))), nil
+	})
+
+	r := newReplicator(source, source, Replica{Store: replica, Required: true}, []ReplicaRewriter{rewriter}, 0, time.Millisecond, zap.NewNop())
+	require.NoError(t, r.replicate(ctx, "0000000000-0000000100", []string{"0000000000-0000000100.jsonl", "_metadata/table.json"}))
+
+	assert.Equal(t, map[string][]byte{
+		"0000000000-0000000100.jsonl": []byte("10\n"),
+		"_metadata/table.json":        []byte(`{"location":"replica"}`),
+	}, replica.Files)
+}
+
+type replicaRewriterFunc func(ctx context.Context, source dstore.Store, replica dstore.Store, filename string, content io.Reader) (io.Reader, error)
+
+func (f replicaRewriterFunc) RewriteForReplica(ctx context.Context, source dstore.Store, replica dstore.Store, filename string, content io.Reader) (io.Reader, error) {
+	return f(ctx, source, replica, filename, content)
+}
@@ -52,6 +52,13 @@ func (s *boundaryStats) endBoundary() {
 	s.avgDataProcessDuration.AddDuration(s.procesingDataTime)
 }
 
+// record publishes the durations of the boundary just ended to the Prometheus metrics.
+func (s *boundaryStats) record() {
+	BoundaryCount.Inc()
+	BoundaryProcessDuration.SetFloat64(s.boundaryProcessTime.Seconds())
+	BoundaryDataProcessDuration.SetFloat64(s.procesingDataTime.Seconds())
+}
+
 func (s *boundaryStats) addProcessingDataDur(dur time.Duration) {
 	s.procesingDataTime += dur
 }
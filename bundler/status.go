@@ -0,0 +1,140 @@
+package bundler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streamingfast/substreams-sink-files/v2/state"
+	sink "github.com/streamingfast/substreams/sink"
+)
+
+// Status is a snapshot of the progress of the bundler, safe to be served while it runs.
+type Status struct {
+	ActiveBoundary        *BoundaryStatus `json:"active_boundary,omitempty"`
+	LastCommittedBoundary *BoundaryStatus `json:"last_committed_boundary,omitempty"`
+
+	// Cursor and Block are the ones of the last block processed, they are saved in the
+	// state once the boundary containing the block is committed.
+	Cursor      string           `json:"cursor"`
+	Block       state.BlockState `json:"block"`
+	LastBlockAt time.Time        `json:"last_block_at,omitempty"`
+
+	StartedAt   time.Time `json:"started_at,omitempty"`
+	RestartedAt time.Time `json:"restarted_at,omitempty"`
+	LaunchedAt  time.Time `json:"launched_at,omitempty"`
+
+	// PendingUploads is the number of closed boundaries, head files included, not
+	// committed yet.
+	PendingUploads int64 `json:"pending_uploads"`
+	// UploadError is the error of the last upload attempt, cleared once an upload succeeds.
+	UploadError   string    `json:"upload_error,omitempty"`
+	UploadErrorAt time.Time `json:"upload_error_at,omitempty"`
+
+	// Terminated is true once the bundler stopped, Error being the reason if it failed.
+	Terminated bool   `json:"terminated"`
+	Error      string `json:"error,omitempty"`
+}
+
+// BoundaryStatus describes a boundary in Status.
+type BoundaryStatus struct {
+	Name string `json:"name,omitempty"`
+	state.ActiveBoundary
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// statusTracker holds the Status of the bundler, it's updated from the goroutine
+// processing blocks and from the upload queue while being read by the status server.
+type statusTracker struct {
+	mu     sync.Mutex
+	status Status
+}
+
+func (s *statusTracker) launched() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.LaunchedAt = time.Now()
+}
+
+func (s *statusTracker) boundaryStarted(boundary state.ActiveBoundary) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.ActiveBoundary = &BoundaryStatus{ActiveBoundary: boundary}
+}
+
+func (s *statusTracker) blockProcessed(cursor *sink.Cursor, startedAt, restartedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.Cursor = cursor.String()
+	s.status.Block = state.BlockState{ID: cursor.Block().ID(), Number: cursor.Block().Num()}
+	s.status.LastBlockAt = time.Now()
+	s.status.StartedAt = startedAt
+	s.status.RestartedAt = restartedAt
+}
+
+func (s *statusTracker) uploaded(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.status.UploadError = err.Error()
+		s.status.UploadErrorAt = time.Now()
+		return
+	}
+
+	s.status.UploadError = ""
+	s.status.UploadErrorAt = time.Time{}
+}
+
+func (s *statusTracker) committed(bf *boundaryFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	boundary := state.ActiveBoundary{StartBlockNumber: bf.boundary.StartBlock()}
+	if endBlock := bf.boundary.EndBlock(); endBlock != nil {
+		boundary.EndBlockNumber = *endBlock
+	}
+	if bf.window != nil {
+		boundary.WindowStart = bf.window.start
+		boundary.WindowEnd = bf.window.end
+	}
+
+	s.status.LastCommittedBoundary = &BoundaryStatus{Name: bf.name, ActiveBoundary: boundary, Cursor: bf.cursor}
+}
+
+func (s *statusTracker) snapshot() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := s.status
+	if out.ActiveBoundary != nil {
+		active := *out.ActiveBoundary
+		out.ActiveBoundary = &active
+	}
+	if out.LastCommittedBoundary != nil {
+		committed := *out.LastCommittedBoundary
+		out.LastCommittedBoundary = &committed
+	}
+
+	return out
+}
+
+// Status returns a snapshot of the progress of the bundler, it's safe to call it
+// concurrently with block processing.
+func (b *Bundler) Status() Status {
+	out := b.status.snapshot()
+	out.PendingUploads = b.uploadQueue.pendingCount()
+
+	select {
+	case <-b.Terminated():
+		out.Terminated = true
+		if err := b.Err(); err != nil {
+			out.Error = err.Error()
+		}
+	default:
+	}
+
+	return out
+}
@@ -0,0 +1,77 @@
+package bundler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+)
+
+// TableCommitter records the files of uploaded boundaries in the metadata of a table
+// format, like a Delta Lake transaction log, so that query engines get a consistent view
+// of the tables without listing the output store.
+//
+// Commit is called once all files of a boundary are uploaded, prior the boundary's state
+// is saved. Boundaries are uploaded concurrently, so commits can happen concurrently and
+// out of order. The upload of a boundary, commit included, is retried on failure and a
+// boundary whose state was not saved is processed again on restart, Commit must then be
+// idempotent.
+type TableCommitter interface {
+	// Name identifies the table format in logs
+	Name() string
+	// Commit records the files of the boundary, it returns the name of the files it wrote
+	// to the store so that they are replicated along with the boundary's files.
+	Commit(ctx context.Context, store dstore.Store, boundary string, files []writer.UploadedFile) ([]string, error)
+}
+
+// ReplicaRewriter is implemented by table committers whose metadata refers to files by
+// their URL in the output store. The files copied to a replica go through it so that the
+// metadata copied refers to the replica's files, it returns the content of other files as
+// is.
+type ReplicaRewriter interface {
+	RewriteForReplica(ctx context.Context, source dstore.Store, replica dstore.Store, filename string, content io.Reader) (io.Reader, error)
+}
+
+// SplitTablePath splits the name of a table's file in the directory of the table, the
+// part of the path up to the folder named after the table, and the path of the file
+// relative to it.
+func SplitTablePath(file writer.UploadedFile) (dir string, relative string, err error) {
+	segments := strings.Split(file.Filename, "/")
+
+	index := slices.Index(segments[:len(segments)-1], file.Table)
+	if index == -1 {
+		return "", "", fmt.Errorf("file %q is not in a folder named after its table %q", file.Filename, file.Table)
+	}
+
+	return path.Join(segments[:index+1]...), path.Join(segments[index+1:]...), nil
+}
+
+// PartitionValues returns the Hive-style partitions of the file's path relative to its
+// table, which are its `key=value` folders, in order.
+func PartitionValues(relative string) (columns []string, values map[string]string, err error) {
+	values = map[string]string{}
+
+	segments := strings.Split(relative, "/")
+	for _, segment := range segments[:len(segments)-1] {
+		key, value, found := strings.Cut(segment, "=")
+		if !found {
+			continue
+		}
+
+		unescaped, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("partition value of %q: %w", key, err)
+		}
+
+		columns = append(columns, key)
+		values[key] = unescaped
+	}
+
+	return columns, values, nil
+}
@@ -0,0 +1,37 @@
+package bundler
+
+import (
+	"testing"
+
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitTablePath(t *testing.T) {
+	dir, relative, err := SplitTablePath(writer.UploadedFile{
+		Filename: "events/transfers/chain=mainnet/date=2024-01-01/0000000000-0000000100.parquet",
+		Table:    "transfers",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "events/transfers", dir)
+	assert.Equal(t, "chain=mainnet/date=2024-01-01/0000000000-0000000100.parquet", relative)
+
+	_, _, err = SplitTablePath(writer.UploadedFile{Filename: "0000000000-0000000100/transfers", Table: "transfers"})
+	require.ErrorContains(t, err, "is not in a folder named after its table")
+}
+
+func TestPartitionValues(t *testing.T) {
+	columns, values, err := PartitionValues("chain=mainnet/blocks/date=2024%2F01/0000000000-0000000100.parquet")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chain", "date"}, columns)
+	assert.Equal(t, map[string]string{"chain": "mainnet", "date": "2024/01"}, values)
+
+	columns, values, err = PartitionValues("0000000000-0000000100.parquet")
+	require.NoError(t, err)
+	assert.Empty(t, columns)
+	assert.Empty(t, values)
+
+	_, _, err = PartitionValues("date=%zz/0000000000-0000000100.parquet")
+	require.ErrorContains(t, err, `partition value of "date"`)
+}
@@ -0,0 +1,55 @@
+package bundler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const timeWindowLayout = "20060102T150405Z"
+
+// timeWindow is the time range [start, end) covered by a time based boundary.
+type timeWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// newTimeWindow returns the window of the given size containing blockTime, windows
+// are aligned on UTC so that '24h' windows start at midnight UTC.
+func newTimeWindow(blockTime time.Time, size time.Duration) *timeWindow {
+	start := blockTime.UTC().Truncate(size)
+	return &timeWindow{start: start, end: start.Add(size)}
+}
+
+// contains returns true if a block with the given time belongs to the window. Only
+// the end of the window is checked so that a block having a timestamp lower than its
+// parent, which happens on some chains, does not close the window.
+func (w *timeWindow) contains(blockTime time.Time) bool {
+	return blockTime.Before(w.end)
+}
+
+func (w *timeWindow) String() string {
+	return w.start.Format(timeWindowLayout) + "-" + w.end.Format(timeWindowLayout)
+}
+
+// ParseFileBoundary parses the time window size of time based boundaries, accepted
+// values are 'hourly', 'daily' or any Go duration like '15m' or '6h'.
+func ParseFileBoundary(in string) (time.Duration, error) {
+	switch strings.ToLower(in) {
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	}
+
+	size, err := time.ParseDuration(in)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file boundary %q, accepted values are 'hourly', 'daily' or a duration like '1h': %w", in, err)
+	}
+
+	if size < time.Second {
+		return 0, fmt.Errorf("invalid file boundary %q, must be at least 1s", in)
+	}
+
+	return size, nil
+}
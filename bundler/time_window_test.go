@@ -0,0 +1,109 @@
+package bundler
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/substreams-sink-files/v2/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeWindow_newTimeWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		blockTime  time.Time
+		size       time.Duration
+		expectName string
+	}{
+		{"hourly", time.Date(2024, 3, 5, 13, 42, 7, 0, time.UTC), time.Hour, "20240305T130000Z-20240305T140000Z"},
+		{"hourly on boundary", time.Date(2024, 3, 5, 13, 0, 0, 0, time.UTC), time.Hour, "20240305T130000Z-20240305T140000Z"},
+		{"daily", time.Date(2024, 3, 5, 23, 59, 59, 0, time.UTC), 24 * time.Hour, "20240305T000000Z-20240306T000000Z"},
+		{"daily non UTC", time.Date(2024, 3, 5, 20, 0, 0, 0, time.FixedZone("EST", -5*3600)), 24 * time.Hour, "20240306T000000Z-20240307T000000Z"},
+		{"15m", time.Date(2024, 3, 5, 13, 42, 7, 0, time.UTC), 15 * time.Minute, "20240305T133000Z-20240305T134500Z"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expectName, newTimeWindow(test.blockTime, test.size).String())
+		})
+	}
+}
+
+func TestTimeWindow_contains(t *testing.T) {
+	window := newTimeWindow(time.Date(2024, 3, 5, 13, 42, 7, 0, time.UTC), time.Hour)
+
+	assert.True(t, window.contains(time.Date(2024, 3, 5, 13, 0, 0, 0, time.UTC)))
+	assert.True(t, window.contains(time.Date(2024, 3, 5, 13, 59, 59, 0, time.UTC)))
+	assert.True(t, window.contains(time.Date(2024, 3, 5, 12, 59, 59, 0, time.UTC)), "block time going backward stays in window")
+	assert.False(t, window.contains(time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC)))
+}
+
+func TestBundler_resumedWindow(t *testing.T) {
+	saved := state.ActiveBoundary{
+		StartBlockNumber: 100,
+		WindowStart:      time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC),
+		WindowEnd:        time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		name         string
+		saved        state.ActiveBoundary
+		blockNum     uint64
+		blockTime    time.Time
+		expectWindow string
+	}{
+		{"within saved window", saved, 150, time.Date(2024, 3, 5, 13, 42, 7, 0, time.UTC), "20240305T120000Z-20240305T140000Z"},
+		{"after saved window", saved, 150, time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC), ""},
+		{"before saved boundary", saved, 99, time.Date(2024, 3, 5, 13, 42, 7, 0, time.UTC), ""},
+		{"no saved window", state.ActiveBoundary{StartBlockNumber: 100, EndBlockNumber: 200}, 150, time.Date(2024, 3, 5, 13, 42, 7, 0, time.UTC), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stateStore, err := state.NewFileStateStore(filepath.Join(t.TempDir(), "state.yaml"))
+			require.NoError(t, err)
+			stateStore.NewBoundary(test.saved)
+
+			// The window size of the run differs from the saved one
+			b := &Bundler{stateStore: stateStore, timeWindowSize: time.Hour}
+
+			window := b.resumedWindow(test.blockNum, test.blockTime)
+			if test.expectWindow == "" {
+				assert.Nil(t, window)
+				return
+			}
+
+			require.NotNil(t, window)
+			assert.Equal(t, test.expectWindow, window.String())
+		})
+	}
+}
+
+func TestParseFileBoundary(t *testing.T) {
+	tests := []struct {
+		in          string
+		expect      time.Duration
+		expectError bool
+	}{
+		{"hourly", time.Hour, false},
+		{"daily", 24 * time.Hour, false},
+		{"Daily", 24 * time.Hour, false},
+		{"1h", time.Hour, false},
+		{"15m", 15 * time.Minute, false},
+		{"0s", 0, true},
+		{"-1h", 0, true},
+		{"weekly", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			actual, err := ParseFileBoundary(test.in)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expect, actual)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package bundler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/streamingfast/shutter"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultUploadConcurrency = 5
+	DefaultUploadQueueSize   = 10
+	DefaultUploadRetries     = 5
+	DefaultUploadBackoff     = time.Second
+
+	maxUploadBackoff = 30 * time.Second
+)
+
+// errUploadQueueClosed is returned when pushing to an upload queue that is closing.
+var errUploadQueueClosed = errors.New("upload queue closed")
+
+// uploadQueue uploads boundaries concurrently while reporting them in the order they
+// were pushed, so that the state is always saved in order.
+//
+// The queue is bounded, pushing blocks once `size` boundaries are waiting for an upload
+// slot, which slows down block processing when uploads fall behind instead of holding
+// an ever growing amount of boundaries in memory.
+//
+// Failed uploads are retried with an exponential backoff with jitter, the queue
+// terminates with an error once the retries of a boundary are exhausted.
+type uploadQueue struct {
+	*shutter.Shutter
+
+	concurrency    int
+	retries        uint64
+	initialBackoff time.Duration
+	upload         func(ctx context.Context, bf *boundaryFile) error
+	onUploaded     func(bf *boundaryFile) error
+	zlogger        *zap.Logger
+
+	queue   chan *pendingUpload
+	pending atomic.Int64
+	closing chan struct{}
+	done    chan struct{}
+}
+
+type pendingUpload struct {
+	file *boundaryFile
+	err  chan error
+}
+
+func newUploadQueue(concurrency int, size int, retries uint64, initialBackoff time.Duration, zlogger *zap.Logger) *uploadQueue {
+	return &uploadQueue{
+		Shutter:        shutter.New(),
+		concurrency:    max(concurrency, 1),
+		retries:        retries,
+		initialBackoff: initialBackoff,
+		zlogger:        zlogger,
+		queue:          make(chan *pendingUpload, max(size, 1)),
+		closing:        make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+}
+
+// start launches the upload workers, onUploaded is called for every boundary uploaded,
+// in the order they were pushed.
+func (q *uploadQueue) start(ctx context.Context, upload func(ctx context.Context, bf *boundaryFile) error, onUploaded func(bf *boundaryFile) error) {
+	q.upload = upload
+	q.onUploaded = onUploaded
+
+	work := make(chan *pendingUpload)
+	ordered := make(chan *pendingUpload, q.concurrency)
+
+	for i := 0; i < q.concurrency; i++ {
+		go func() {
+			for pending := range work {
+				pending.err <- q.uploadWithRetry(ctx, pending.file)
+			}
+		}()
+	}
+
+	go q.dispatch(work, ordered)
+	go func() {
+		err := q.sequence(ordered)
+
+		// Closed prior shutting down since terminating may wait for the queue to be done
+		close(q.done)
+		if err != nil {
+			q.Shutdown(err)
+		}
+	}()
+}
+
+// push queues the boundary for upload, blocking while the queue is full.
+func (q *uploadQueue) push(bf *boundaryFile) error {
+	pending := &pendingUpload{file: bf, err: make(chan error, 1)}
+
+	select {
+	case q.queue <- pending:
+		q.pending.Add(1)
+		UploadQueueDepth.SetUint64(uint64(len(q.queue)))
+		return nil
+	default:
+	}
+
+	q.zlogger.Info("upload queue is full, waiting for uploads to catch up", zap.String("boundary", bf.name), zap.Int("queue_size", cap(q.queue)))
+	select {
+	case q.queue <- pending:
+		q.pending.Add(1)
+		UploadQueueDepth.SetUint64(uint64(len(q.queue)))
+		return nil
+	case <-q.closing:
+		return errUploadQueueClosed
+	case <-q.Terminating():
+		return fmt.Errorf("upload queue terminated: %w", q.Err())
+	}
+}
+
+// pendingCount returns the number of boundaries pushed that are not reported as
+// uploaded yet.
+func (q *uploadQueue) pendingCount() int64 {
+	return q.pending.Load()
+}
+
+// close stops accepting new boundaries and waits until the boundaries already queued
+// are uploaded, or until the queue terminates because of an upload failure.
+func (q *uploadQueue) close() {
+	select {
+	case <-q.closing:
+	default:
+		close(q.closing)
+	}
+
+	<-q.done
+}
+
+func (q *uploadQueue) dispatch(work chan<- *pendingUpload, ordered chan<- *pendingUpload) {
+	defer close(work)
+	defer close(ordered)
+
+	send := func(pending *pendingUpload) bool {
+		UploadQueueDepth.SetUint64(uint64(len(q.queue)))
+
+		select {
+		case ordered <- pending:
+		case <-q.Terminating():
+			return false
+		}
+
+		select {
+		case work <- pending:
+		case <-q.Terminating():
+			return false
+		}
+
+		return true
+	}
+
+	for {
+		select {
+		case pending := <-q.queue:
+			if !send(pending) {
+				return
+			}
+
+		case <-q.closing:
+			for {
+				select {
+				case pending := <-q.queue:
+					if !send(pending) {
+						return
+					}
+				default:
+					return
+				}
+			}
+
+		case <-q.Terminating():
+			return
+		}
+	}
+}
+
+func (q *uploadQueue) sequence(ordered <-chan *pendingUpload) error {
+	for pending := range ordered {
+		var err error
+		select {
+		case err = <-pending.err:
+		case <-q.Terminating():
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("upload boundary %s: %w", pending.file.name, err)
+		}
+
+		if err := q.onUploaded(pending.file); err != nil {
+			return err
+		}
+		q.pending.Add(-1)
+	}
+
+	return nil
+}
+
+func (q *uploadQueue) uploadWithRetry(ctx context.Context, bf *boundaryFile) error {
+	policy := backoff.NewExponentialBackOff()
+	policy.InitialInterval = q.initialBackoff
+	policy.MaxInterval = maxUploadBackoff
+	policy.MaxElapsedTime = 0
+
+	attempt := 0
+	return backoff.RetryNotify(func() error {
+		attempt++
+
+		err := q.upload(ctx, bf)
+		if err != nil {
+			UploadFailureCount.Inc()
+		}
+
+		if err != nil && ctx.Err() != nil {
+			return backoff.Permanent(err)
+		}
+
+		return err
+	}, backoff.WithContext(backoff.WithMaxRetries(policy, q.retries), ctx), func(err error, next time.Duration) {
+		UploadRetryCount.Inc()
+		q.zlogger.Warn("boundary upload failed, retrying",
+			zap.String("boundary", bf.name),
+			zap.Int("attempt", attempt),
+			zap.Duration("retry_in", next),
+			zap.Error(err),
+		)
+	})
+}
@@ -0,0 +1,150 @@
+package bundler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestUploadQueue(t *testing.T) {
+	tests := []struct {
+		name          string
+		retries       uint64
+		failures      map[string]int
+		expectErr     string
+		expectUpdated []string
+	}{
+		{
+			name:          "uploaded in order",
+			retries:       0,
+			expectUpdated: []string{"b0", "b1", "b2", "b3", "b4", "b5"},
+		},
+		{
+			name:          "transient failures retried",
+			retries:       3,
+			failures:      map[string]int{"b1": 2, "b4": 3},
+			expectUpdated: []string{"b0", "b1", "b2", "b3", "b4", "b5"},
+		},
+		{
+			name:          "retries exhausted",
+			retries:       2,
+			failures:      map[string]int{"b2": 3},
+			expectErr:     "upload boundary b2: transient failure of b2",
+			expectUpdated: []string{"b0", "b1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var lock sync.Mutex
+			attempts := map[string]int{}
+
+			upload := func(ctx context.Context, bf *boundaryFile) error {
+				lock.Lock()
+				attempts[bf.name]++
+				attempt := attempts[bf.name]
+				lock.Unlock()
+
+				// Later boundaries finish first to ensure ordering does not rely on upload completion
+				var index int
+				fmt.Sscanf(bf.name, "b%d", &index)
+				time.Sleep(time.Duration(6-index) * 2 * time.Millisecond)
+
+				if attempt <= test.failures[bf.name] {
+					return fmt.Errorf("transient failure of %s", bf.name)
+				}
+				return nil
+			}
+
+			var updated []string
+			onUploaded := func(bf *boundaryFile) error {
+				updated = append(updated, bf.name)
+				return nil
+			}
+
+			queue := newUploadQueue(3, 10, test.retries, time.Millisecond, zap.NewNop())
+			queue.start(context.Background(), upload, onUploaded)
+
+			for i := 0; i < 6; i++ {
+				require.NoError(t, queue.push(&boundaryFile{name: fmt.Sprintf("b%d", i)}))
+			}
+			queue.close()
+
+			if test.expectErr != "" {
+				<-queue.Terminated()
+				require.Error(t, queue.Err())
+				assert.Equal(t, test.expectErr, queue.Err().Error())
+			} else {
+				assert.NoError(t, queue.Err())
+			}
+
+			assert.Equal(t, test.expectUpdated, updated)
+		})
+	}
+}
+
+func TestUploadQueue_Backpressure(t *testing.T) {
+	release := make(chan struct{})
+	upload := func(ctx context.Context, bf *boundaryFile) error {
+		<-release
+		return nil
+	}
+
+	var uploaded atomic.Int32
+	queue := newUploadQueue(1, 2, 0, time.Millisecond, zap.NewNop())
+	queue.start(context.Background(), upload, func(bf *boundaryFile) error {
+		uploaded.Add(1)
+		return nil
+	})
+
+	// One boundary is being uploaded, one waits to be sequenced and two fill the queue
+	for i := 0; i < 4; i++ {
+		require.NoError(t, queue.push(&boundaryFile{name: fmt.Sprintf("b%d", i)}))
+	}
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- queue.push(&boundaryFile{name: "b4"})
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push should block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(t, <-pushed)
+
+	queue.close()
+	assert.NoError(t, queue.Err())
+	assert.Equal(t, int32(5), uploaded.Load())
+}
+
+func TestUploadQueue_PushAfterFailure(t *testing.T) {
+	upload := func(ctx context.Context, bf *boundaryFile) error {
+		return errors.New("permanent failure")
+	}
+
+	queue := newUploadQueue(1, 1, 0, time.Millisecond, zap.NewNop())
+	queue.start(context.Background(), upload, func(bf *boundaryFile) error { return nil })
+
+	require.NoError(t, queue.push(&boundaryFile{name: "b0"}))
+	<-queue.Terminated()
+
+	// Queue is no longer drained, pushing eventually fails instead of blocking forever
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		err = queue.push(&boundaryFile{name: fmt.Sprintf("b%d", i+1)})
+	}
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "upload queue terminated")
+}
@@ -0,0 +1,304 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/arrow/util"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/logging"
+	"github.com/streamingfast/substreams-sink-files/v2/arrowx"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var _ Writer = (*ArrowWriter)(nil)
+
+// ArrowWriter implements our internal interface for writing Arrow IPC files, one per table,
+// the tables being found in the output message descriptor with the same rules as the
+// ParquetWriter. Rows of a block are appended to the table's record builder and become a
+// record batch when the block ends, the batches of the active boundary being kept in
+// memory until the boundary is closed.
+type ArrowWriter struct {
+	*tableWriter[*arrowBatches]
+}
+
+func NewArrowWriter(descriptor protoreflect.MessageDescriptor, logger *zap.Logger, tracer logging.Tracer, opts ...TableWriterOption) (*ArrowWriter, error) {
+	options := NewTableWriterOptions(opts)
+
+	tableWriter, err := newTableWriter(FileTypeArrow, descriptor, options, func(table parquetx.TableResult) (tableEncoding[*arrowBatches], error) {
+		arrowTable, err := arrowx.TableFromMessageDescriptor(table.Descriptor)
+		if err != nil {
+			return nil, fmt.Errorf("arrow schema: %w", err)
+		}
+
+		return &arrowEncoding{table: arrowTable, compression: options.ArrowCompression, allocator: memory.DefaultAllocator}, nil
+	}, logger, tracer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ArrowWriter{tableWriter: tableWriter}, nil
+}
+
+// arrowEncoding writes the record batches of a table as an Arrow IPC file with the table's
+// schema.
+type arrowEncoding struct {
+	table       *arrowx.Table
+	compression ArrowCompression
+	allocator   memory.Allocator
+}
+
+func (e *arrowEncoding) newBuffer() (*arrowBatches, error) {
+	builder, err := e.table.NewRecordBuilder(e.allocator)
+	if err != nil {
+		return nil, err
+	}
+
+	return &arrowBatches{table: e.table, builder: builder}, nil
+}
+
+// writeFile writes the record batches of the buffer, they are concatenated in a single
+// batch except for checkpoint files.
+func (e *arrowEncoding) writeFile(w io.Writer, batches *arrowBatches, checkpoint bool) error {
+	compression := ArrowCompressionNone
+	records := batches.records
+	if !checkpoint {
+		compression = e.compression
+
+		record, err := concatRecords(e.table.Schema(), batches.records, e.allocator)
+		if err != nil {
+			return fmt.Errorf("concatenate record batches: %w", err)
+		}
+
+		records = nil
+		if record != nil {
+			records = []arrow.Record{record}
+		}
+	}
+
+	fileWriter, err := e.newFileWriter(w, compression)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := fileWriter.Write(record); err != nil {
+			return fmt.Errorf("write record batch: %w", err)
+		}
+	}
+
+	if err := fileWriter.Close(); err != nil {
+		return fmt.Errorf("close arrow writer: %w", err)
+	}
+
+	return nil
+}
+
+func (e *arrowEncoding) newFileWriter(w io.Writer, compression ArrowCompression) (*ipc.FileWriter, error) {
+	options := append([]ipc.Option{ipc.WithSchema(e.table.Schema()), ipc.WithAllocator(e.allocator)}, compression.ipcOptions()...)
+
+	fileWriter, err := ipc.NewFileWriter(w, options...)
+	if err != nil {
+		return nil, fmt.Errorf("new arrow writer: %w", err)
+	}
+
+	return fileWriter, nil
+}
+
+// concatRecords concatenates the records in a single one, nil when there are no records.
+func concatRecords(schema *arrow.Schema, records []arrow.Record, allocator memory.Allocator) (arrow.Record, error) {
+	switch len(records) {
+	case 0:
+		return nil, nil
+	case 1:
+		return records[0], nil
+	}
+
+	rows := int64(0)
+	for _, record := range records {
+		rows += record.NumRows()
+	}
+
+	columns := make([]arrow.Array, schema.NumFields())
+	for i := range columns {
+		chunks := make([]arrow.Array, len(records))
+		for j, record := range records {
+			chunks[j] = record.Column(i)
+		}
+
+		column, err := array.Concatenate(chunks, allocator)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %w", schema.Field(i).Name, err)
+		}
+
+		columns[i] = column
+	}
+
+	return array.NewRecord(schema, columns, rows), nil
+}
+
+// readCheckpoint reads back the first record batches of the checkpoint IPC file.
+func (e *arrowEncoding) readCheckpoint(file *os.File, count int64) (*arrowBatches, error) {
+	fileReader, err := ipc.NewFileReader(file, ipc.WithAllocator(e.allocator))
+	if err != nil {
+		return nil, fmt.Errorf("new arrow reader: %w", err)
+	}
+	defer fileReader.Close()
+
+	if int64(fileReader.NumRecords()) < count {
+		return nil, fmt.Errorf("expected %d record batches, found %d", count, fileReader.NumRecords())
+	}
+
+	batches, err := e.newBuffer()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range int(count) {
+		record, err := fileReader.RecordAt(i)
+		if err != nil {
+			return nil, fmt.Errorf("read record batch %d: %w", i, err)
+		}
+
+		batches.appendRecord(record)
+	}
+
+	return batches, nil
+}
+
+// compactFiles writes the record batches of the IPC files one after the other in a single
+// file.
+func (e *arrowEncoding) compactFiles(ctx context.Context, w io.Writer, source dstore.Store, files []string) (int64, error) {
+	fileWriter, err := e.newFileWriter(w, e.compression)
+	if err != nil {
+		return 0, err
+	}
+
+	rowCount := int64(0)
+	for _, file := range files {
+		n, err := copyArrowFileRecords(ctx, source, file, fileWriter, e.allocator)
+		if err != nil {
+			return rowCount, fmt.Errorf("copy record batches of %q: %w", file, err)
+		}
+
+		rowCount += n
+	}
+
+	if err := fileWriter.Close(); err != nil {
+		return rowCount, fmt.Errorf("close arrow writer: %w", err)
+	}
+
+	return rowCount, nil
+}
+
+// copyArrowFileRecords writes the record batches of the given IPC file of the source store
+// to the file writer. The IPC file format keeps its footer at the end, so the file is read
+// in memory first.
+func copyArrowFileRecords(ctx context.Context, source dstore.Store, filename string, fileWriter *ipc.FileWriter, allocator memory.Allocator) (int64, error) {
+	reader, err := source.OpenObject(ctx, filename)
+	if err != nil {
+		return 0, fmt.Errorf("open object: %w", err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return 0, fmt.Errorf("read object: %w", err)
+	}
+
+	fileReader, err := ipc.NewFileReader(bytes.NewReader(content), ipc.WithAllocator(allocator))
+	if err != nil {
+		return 0, fmt.Errorf("new arrow reader: %w", err)
+	}
+	defer fileReader.Close()
+
+	n := int64(0)
+	for i := range fileReader.NumRecords() {
+		record, err := fileReader.Record(i)
+		if err != nil {
+			return n, fmt.Errorf("read record batch %d: %w", i, err)
+		}
+
+		if err := fileWriter.Write(record); err != nil {
+			return n, fmt.Errorf("write record batch %d: %w", i, err)
+		}
+		n += record.NumRows()
+	}
+
+	return n, nil
+}
+
+// arrowBatches is the record batches of a table, one per block with rows, along with the
+// record builder of the rows of the current block. Its position is the number of record
+// batches.
+type arrowBatches struct {
+	table   *arrowx.Table
+	records []arrow.Record
+	builder *array.RecordBuilder
+
+	rows int64
+	size int64
+	// pendingRows and pendingSize are for the rows of the builder, pendingSize being their
+	// Protobuf size as the Arrow one is only known once the batch is built
+	pendingRows int64
+	pendingSize int64
+}
+
+func (b *arrowBatches) append(message protoreflect.Message) error {
+	if err := b.table.Append(b.builder, message); err != nil {
+		return err
+	}
+
+	b.pendingRows++
+	b.pendingSize += int64(proto.Size(message.Interface()))
+	return nil
+}
+
+func (b *arrowBatches) appendRecord(record arrow.Record) {
+	b.records = append(b.records, record)
+	b.rows += record.NumRows()
+	b.size += int64(util.TotalRecordSize(record))
+}
+
+// endBlock turns the rows of the builder into a record batch.
+func (b *arrowBatches) endBlock() int64 {
+	record := b.builder.NewRecord()
+	b.pendingRows, b.pendingSize = 0, 0
+
+	if record.NumRows() == 0 {
+		record.Release()
+	} else {
+		b.appendRecord(record)
+	}
+
+	return int64(len(b.records))
+}
+
+// truncate keeps only the first count record batches, dropping the rows of the builder.
+func (b *arrowBatches) truncate(count int64) {
+	b.builder.NewRecord().Release()
+	b.pendingRows, b.pendingSize = 0, 0
+
+	for _, record := range b.records[count:] {
+		b.rows -= record.NumRows()
+		b.size -= int64(util.TotalRecordSize(record))
+		record.Release()
+	}
+
+	b.records = b.records[:count]
+}
+
+// stats returns the size of the record batches' buffers, before they are compressed.
+func (b *arrowBatches) stats() WriterStats {
+	return WriterStats{Size: b.size + b.pendingSize, Rows: b.rows + b.pendingRows}
+}
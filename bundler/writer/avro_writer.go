@@ -0,0 +1,243 @@
+package writer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/ocf"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/logging"
+	"github.com/streamingfast/substreams-sink-files/v2/avrox"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var _ Writer = (*AvroWriter)(nil)
+
+// AvroWriter implements our internal interface for writing Avro object container files,
+// one per table, the tables being found in the output message descriptor with the same
+// rules as the ParquetWriter. Rows of the active boundary are kept in memory in their
+// Avro binary encoding until the boundary is closed.
+type AvroWriter struct {
+	*tableWriter[*avroRows]
+}
+
+func NewAvroWriter(descriptor protoreflect.MessageDescriptor, logger *zap.Logger, tracer logging.Tracer, opts ...TableWriterOption) (*AvroWriter, error) {
+	options := NewTableWriterOptions(opts)
+
+	tableWriter, err := newTableWriter(FileTypeAvro, descriptor, options, func(table parquetx.TableResult) (tableEncoding[*avroRows], error) {
+		record, err := avrox.RecordFromMessageDescriptor(table.Descriptor)
+		if err != nil {
+			return nil, fmt.Errorf("avro schema: %w", err)
+		}
+
+		return &avroEncoding{record: record, codec: options.AvroCodec}, nil
+	}, logger, tracer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AvroWriter{tableWriter: tableWriter}, nil
+}
+
+// avroEncoding writes the rows of a table as an Avro object container file embedding the
+// table's schema.
+type avroEncoding struct {
+	record *avrox.Record
+	codec  AvroCodec
+}
+
+func (e *avroEncoding) newBuffer() (*avroRows, error) {
+	return &avroRows{record: e.record}, nil
+}
+
+func (e *avroEncoding) writeFile(w io.Writer, rows *avroRows, checkpoint bool) error {
+	codec := e.codec
+	if checkpoint {
+		codec = AvroCodecNull
+	}
+
+	encoder, err := e.newEncoder(w, codec)
+	if err != nil {
+		return err
+	}
+
+	for i := range len(rows.ends) {
+		if _, err := encoder.Write(rows.row(i)); err != nil {
+			return fmt.Errorf("write row: %w", err)
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("close avro encoder: %w", err)
+	}
+
+	return nil
+}
+
+func (e *avroEncoding) newEncoder(w io.Writer, codec AvroCodec) (*ocf.Encoder, error) {
+	encoder, err := ocf.NewEncoderWithSchema(e.record.Schema(), w,
+		ocf.WithCodec(codec.ocfCodec()),
+		// Keeps the null defaults of optional fields which the canonical form drops
+		ocf.WithSchemaMarshaler(ocf.FullSchemaMarshaler),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new avro encoder: %w", err)
+	}
+
+	return encoder, nil
+}
+
+// readCheckpoint reads back the first rows of the checkpoint container file, the rows
+// being decoded then encoded again to get their binary encoding.
+func (e *avroEncoding) readCheckpoint(file *os.File, count int64) (*avroRows, error) {
+	decoder, err := ocf.NewDecoder(file)
+	if err != nil {
+		return nil, fmt.Errorf("new avro decoder: %w", err)
+	}
+
+	rows := &avroRows{record: e.record}
+	for rows.count() < count && decoder.HasNext() {
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("decode row: %w", err)
+		}
+
+		row, err := avro.Marshal(e.record.Schema(), value)
+		if err != nil {
+			return nil, fmt.Errorf("encode row: %w", err)
+		}
+
+		rows.appendRow(row)
+	}
+
+	if err := decoder.Error(); err != nil {
+		return nil, fmt.Errorf("read rows: %w", err)
+	}
+
+	if rows.count() != count {
+		return nil, fmt.Errorf("expected %d rows, found %d", count, rows.count())
+	}
+
+	return rows, nil
+}
+
+// compactFiles writes the rows of the container files in a single one.
+func (e *avroEncoding) compactFiles(ctx context.Context, w io.Writer, source dstore.Store, files []string) (int64, error) {
+	encoder, err := e.newEncoder(w, e.codec)
+	if err != nil {
+		return 0, err
+	}
+
+	rowCount := int64(0)
+	for _, file := range files {
+		n, err := copyAvroFileRows(ctx, source, file, encoder)
+		if err != nil {
+			return rowCount, fmt.Errorf("copy rows of %q: %w", file, err)
+		}
+
+		rowCount += n
+	}
+
+	if err := encoder.Close(); err != nil {
+		return rowCount, fmt.Errorf("close avro encoder: %w", err)
+	}
+
+	return rowCount, nil
+}
+
+// copyAvroFileRows writes the rows of the given container file of the source store to
+// the encoder.
+func copyAvroFileRows(ctx context.Context, source dstore.Store, filename string, encoder *ocf.Encoder) (int64, error) {
+	reader, err := source.OpenObject(ctx, filename)
+	if err != nil {
+		return 0, fmt.Errorf("open object: %w", err)
+	}
+	defer reader.Close()
+
+	decoder, err := ocf.NewDecoder(reader)
+	if err != nil {
+		return 0, fmt.Errorf("new avro decoder: %w", err)
+	}
+
+	n := int64(0)
+	for decoder.HasNext() {
+		var row any
+		if err := decoder.Decode(&row); err != nil {
+			return n, fmt.Errorf("decode row: %w", err)
+		}
+
+		if err := encoder.Encode(row); err != nil {
+			return n, fmt.Errorf("encode row: %w", err)
+		}
+		n++
+	}
+
+	if err := decoder.Error(); err != nil {
+		return n, fmt.Errorf("read rows: %w", err)
+	}
+
+	return n, nil
+}
+
+// avroRows is the Avro binary encoding of the rows of a table, one after the other, its
+// position being the number of rows.
+type avroRows struct {
+	record *avrox.Record
+
+	data []byte
+	// ends is the offset in data of the end of each row
+	ends []int
+}
+
+func (r *avroRows) append(message protoreflect.Message) error {
+	row, err := r.record.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	r.appendRow(row)
+	return nil
+}
+
+func (r *avroRows) appendRow(row []byte) {
+	r.data = append(r.data, row...)
+	r.ends = append(r.ends, len(r.data))
+}
+
+func (r *avroRows) count() int64 {
+	return int64(len(r.ends))
+}
+
+func (r *avroRows) row(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = r.ends[i-1]
+	}
+
+	return r.data[start:r.ends[i]]
+}
+
+func (r *avroRows) endBlock() int64 {
+	return r.count()
+}
+
+// truncate keeps only the first count rows.
+func (r *avroRows) truncate(count int64) {
+	if count == 0 {
+		r.data, r.ends = r.data[:0], r.ends[:0]
+		return
+	}
+
+	r.data = r.data[:r.ends[count-1]]
+	r.ends = r.ends[:count]
+}
+
+// stats returns the size of the rows' Avro binary encoding, before blocks are compressed.
+func (r *avroRows) stats() WriterStats {
+	return WriterStats{Size: int64(len(r.data)), Rows: r.count()}
+}
@@ -0,0 +1,39 @@
+package writer
+
+// blockMark records the writer's position (bytes written, rows written, etc.)
+// at the end of a given block.
+type blockMark[T any] struct {
+	BlockNum uint64 `json:"block_num"`
+	Position T      `json:"position"`
+}
+
+// blockMarks is the ordered list of block marks recorded for the active boundary,
+// used to find back where to truncate the data when blocks are undone.
+type blockMarks[T any] []blockMark[T]
+
+func (m blockMarks[T]) add(blockNum uint64, position T) blockMarks[T] {
+	return append(m, blockMark[T]{BlockNum: blockNum, Position: position})
+}
+
+// last returns the position recorded for the last block, found is false if no
+// block was marked yet.
+func (m blockMarks[T]) last() (position T, found bool) {
+	if len(m) == 0 {
+		return position, false
+	}
+
+	return m[len(m)-1].Position, true
+}
+
+// revertTo returns the position recorded for the highest block lower or equal to
+// lastValidBlockNum along with the marks that are still valid. When no such block
+// exists, found is false meaning all data of the active boundary must be discarded.
+func (m blockMarks[T]) revertTo(lastValidBlockNum uint64) (position T, kept blockMarks[T], found bool) {
+	for i := len(m) - 1; i >= 0; i-- {
+		if m[i].BlockNum <= lastValidBlockNum {
+			return m[i].Position, m[:i+1], true
+		}
+	}
+
+	return position, m[:0], false
+}
@@ -10,37 +10,130 @@ import (
 	"path/filepath"
 
 	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
 	"go.uber.org/zap"
 )
 
 var _ Writer = (*BufferedIO)(nil)
+var _ RowWriter = (*BufferedIO)(nil)
 
 type BufferedIO struct {
 	baseWriter
 
 	bufferMazSize uint64
 	workingDir    string
+	compression   Compression
+	irreversible  bool
+	header        []byte
+	// encodedHeader is the header as written at the start of the working file, compressed
+	// in its own frame with a revertable compression. It's empty with lz4, the header
+	// being compressed in the single frame of the file along with the data.
+	encodedHeader []byte
 	activeFile    *bufferedActiveFile
 }
 
+// BufferedIOOption configures optional behaviors of BufferedIO.
+type BufferedIOOption func(s *BufferedIO)
+
+// BufferedCompression compresses the data while it's written, the buffer and the working
+// file holding compressed data. Output files are named with the compression's extension
+// appended to the file type, for example '.jsonl.zst'.
+func BufferedCompression(compression Compression) BufferedIOOption {
+	return func(s *BufferedIO) {
+		s.compression = compression
+	}
+}
+
+// BufferedIrreversible tells the writer that blocks are never reverted, like when only
+// final blocks are received or when reorganizations are absorbed by an undo buffer.
+// Compressed data is then written as a single stream per file, instead of a frame per
+// block, so that the compression ratio is not lost to frames.
+func BufferedIrreversible() BufferedIOOption {
+	return func(s *BufferedIO) {
+		s.irreversible = true
+	}
+}
+
+// BufferedHeader writes the given header at the start of every file, including the files
+// of empty boundaries. It's not counted in the writer's Stats nor in the rows of the file,
+// and is written once in the file compacting head files.
+func BufferedHeader(header []byte) BufferedIOOption {
+	return func(s *BufferedIO) {
+		s.header = header
+	}
+}
+
 func NewBufferedIO(
 	bufferMaxSize uint64,
 	workingDir string,
 	fileType FileType,
 	zlogger *zap.Logger,
+	opts ...BufferedIOOption,
 ) *BufferedIO {
 	if bufferMaxSize == 0 {
 		bufferMaxSize = DefaultBufSize
 	}
 
-	return &BufferedIO{
+	s := &BufferedIO{
 		bufferMazSize: bufferMaxSize,
 		baseWriter:    newBaseWriter(fileType, zlogger),
 		workingDir:    workingDir,
+		compression:   CompressionNone,
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.encodedHeader = s.header
+	if len(s.header) > 0 && s.compression != CompressionNone {
+		s.encodedHeader = nil
+		if s.compression.Revertable() {
+			s.encodedHeader = compressFrame(s.compression, s.header)
+		}
+	}
+
+	return s
+}
+
+// compressFrame returns the data compressed in a single frame.
+func compressFrame(compression Compression, data []byte) []byte {
+	buffer := bytes.NewBuffer(nil)
+	compressor, err := compression.newWriter(buffer)
+	if err != nil {
+		panic(fmt.Errorf("new %s compressor: %w", compression, err))
+	}
+
+	// Writes to memory do not fail
+	compressor.Write(data)
+	compressor.Close()
+
+	return buffer.Bytes()
+}
+
+// framePerBlock returns true if the data of each block is compressed in its own frame, so
+// that Revert can truncate the compressed data at the end of any block.
+func (s *BufferedIO) framePerBlock() bool {
+	return s.compression != CompressionNone && s.compression.Revertable() && !s.irreversible
+}
+
+// revertable returns true if Revert can discard any block, compressed data being only
+// revertable when each block is its own frame.
+func (s *BufferedIO) revertable() bool {
+	return s.compression == CompressionNone || s.framePerBlock()
+}
+
+// outputFileType is the type of the files produced, the compression's extension
+// included.
+func (s *BufferedIO) outputFileType() FileType {
+	return s.compression.FileType(s.fileType)
 }
 
 func (s *BufferedIO) workingFilename(blockRange *bstream.Range) string {
+	if blockRange.EndBlock() == nil {
+		return fmt.Sprintf("%010d.tmp.%s", blockRange.StartBlock(), s.fileType)
+	}
+
 	return fmt.Sprintf("%010d-%010d.tmp.%s", blockRange.StartBlock(), (*blockRange.EndBlock()), s.fileType)
 }
 
@@ -52,17 +145,58 @@ func (s *BufferedIO) StartBoundary(blockRange *bstream.Range) error {
 	lazyFile := LazyOpen(filepath.Join(s.workingDir, s.workingFilename(blockRange)))
 
 	a := &bufferedActiveFile{
-		lazyFile:       lazyFile,
-		writer:         NewIntelligentWriterSize(lazyFile, int(s.bufferMazSize)),
-		blockRange:     blockRange,
-		outputFilename: s.filename(blockRange),
+		lazyFile:   lazyFile,
+		writer:     NewIntelligentWriterSize(lazyFile, int(s.bufferMazSize)),
+		blockRange: blockRange,
 	}
 
 	s.activeFile = a
+	return s.writeHeader()
+}
+
+// writeHeader writes the header at the start of the active file, outside of its size and
+// lines.
+func (s *BufferedIO) writeHeader() error {
+	if len(s.header) == 0 {
+		return nil
+	}
+
+	if len(s.encodedHeader) == 0 {
+		if err := s.activeFile.openFrame(s.compression); err != nil {
+			return err
+		}
+
+		if _, err := s.activeFile.compressor.Write(s.header); err != nil {
+			return fmt.Errorf("write header: %w", err)
+		}
+
+		return nil
+	}
+
+	if _, err := s.activeFile.writer.Write(s.encodedHeader); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+
 	return nil
 }
 
-func (s *BufferedIO) CloseBoundary(ctx context.Context) (Uploadeable, error) {
+// fileSize returns the size of the working file at the given position, the header
+// written at the start of the file included.
+func (s *BufferedIO) fileSize(position bufferedPosition) int64 {
+	if s.compression == CompressionNone {
+		return int64(len(s.encodedHeader)) + position.Size
+	}
+
+	// The position of a file holding only the header is not recorded when no block was
+	// marked yet
+	if position.FileSize == 0 {
+		return int64(len(s.encodedHeader))
+	}
+
+	return position.FileSize
+}
+
+func (s *BufferedIO) CloseBoundary(ctx context.Context, namer FileNamer) (Uploadeable, error) {
 	defer func() {
 		s.activeFile = nil
 	}()
@@ -71,15 +205,28 @@ func (s *BufferedIO) CloseBoundary(ctx context.Context) (Uploadeable, error) {
 		return nil, fmt.Errorf("no active file")
 	}
 
+	outputFilename := namer.Filename("", s.outputFileType())
+
+	if s.activeFile.err != nil {
+		return nil, s.activeFile.err
+	}
+
+	if err := s.activeFile.closeFrame(); err != nil {
+		return nil, err
+	}
+
 	if s.activeFile.writer.AllDataFitInMemory() {
 		s.zlogger.Info("all data from range is in memory, no need to flush")
+		BufferedBoundaryCount.Inc("memory")
 		return &dataFile{
-			reader:         bytes.NewReader(s.activeFile.writer.MemoryData()),
-			outputFilename: s.activeFile.outputFilename,
+			data:           s.activeFile.writer.MemoryData(),
+			outputFilename: outputFilename,
+			rows:           s.activeFile.lines,
 		}, nil
 	}
 
 	s.zlogger.Info("flushing buffered writer")
+	BufferedBoundaryCount.Inc("disk")
 	if err := s.activeFile.writer.Flush(); err != nil {
 		return nil, fmt.Errorf("flushing buffered active writer: %w", err)
 	}
@@ -91,16 +238,231 @@ func (s *BufferedIO) CloseBoundary(ctx context.Context) (Uploadeable, error) {
 	workingPath := s.activeFile.Path()
 	return &localFile{
 		localFilePath:  workingPath,
-		outputFilename: s.activeFile.outputFilename,
+		outputFilename: outputFilename,
+		rows:           s.activeFile.lines,
 	}, nil
 }
 
 func (s *BufferedIO) Write(data []byte) (n int, err error) {
+	return s.write(data, -1)
+}
+
+// WriteRows implements RowWriter, the rows of the data are the given ones instead of its
+// lines.
+func (s *BufferedIO) WriteRows(data []byte, rows int64) (n int, err error) {
+	return s.write(data, rows)
+}
+
+// write writes data to the active file, its lines being counted as rows if rows is
+// negative.
+func (s *BufferedIO) write(data []byte, rows int64) (n int, err error) {
 	if s.activeFile == nil {
 		return 0, fmt.Errorf("failed to write to active file")
 	}
 
-	return s.activeFile.writer.Write(data)
+	if s.activeFile.err != nil {
+		return 0, s.activeFile.err
+	}
+
+	var out io.Writer = s.activeFile.writer
+	if s.compression != CompressionNone {
+		if err := s.activeFile.openFrame(s.compression); err != nil {
+			return 0, err
+		}
+
+		out = s.activeFile.compressor
+	}
+
+	n, err = out.Write(data)
+	s.activeFile.size += int64(n)
+	if rows < 0 {
+		rows = int64(bytes.Count(data[:n], newLine))
+	}
+	s.activeFile.lines += rows
+	return n, err
+}
+
+// EndBlock implements Writer, with a revertable compression the frame holding the block's
+// data is completed so that Revert can truncate the compressed data at the end of any
+// block, unless the writer is irreversible. Failing to complete it fails the next
+// operation on the active file.
+func (s *BufferedIO) EndBlock(blockNum uint64) {
+	if s.activeFile == nil || s.activeFile.err != nil {
+		return
+	}
+
+	if s.framePerBlock() {
+		if err := s.activeFile.closeFrame(); err != nil {
+			s.activeFile.err = err
+			return
+		}
+	}
+
+	s.activeFile.blockMarks = s.activeFile.blockMarks.add(blockNum, bufferedPosition{
+		Size:     s.activeFile.size,
+		Lines:    s.activeFile.lines,
+		FileSize: s.activeFile.writer.Size(),
+	})
+}
+
+func (s *BufferedIO) Stats() WriterStats {
+	if s.activeFile == nil {
+		return WriterStats{}
+	}
+
+	return WriterStats{Size: s.activeFile.size, Rows: s.activeFile.lines}
+}
+
+func (s *BufferedIO) Revert(lastValidBlockNum uint64) error {
+	if s.activeFile == nil {
+		return fmt.Errorf("no active file")
+	}
+
+	if s.activeFile.err != nil {
+		return s.activeFile.err
+	}
+
+	position, kept, _ := s.activeFile.blockMarks.revertTo(lastValidBlockNum)
+	if !s.revertable() && position.Size != s.activeFile.size {
+		return fmt.Errorf("unable to revert %d bytes already compressed with %s", s.activeFile.size-position.Size, s.compression)
+	}
+	s.activeFile.blockMarks = kept
+
+	s.zlogger.Info("reverting buffered writer",
+		zap.Uint64("last_valid_block_num", lastValidBlockNum),
+		zap.Int64("from_size", s.activeFile.size),
+		zap.Int64("to_size", position.Size),
+	)
+
+	if position.Size == s.activeFile.size {
+		return nil
+	}
+
+	// Compressed data is truncated at the end of the frame of the last valid block, the
+	// frame being written, if any, is dropped
+	if s.compression != CompressionNone {
+		s.activeFile.frameOpen = false
+	}
+
+	if err := s.activeFile.writer.Truncate(s.fileSize(position)); err != nil {
+		return fmt.Errorf("truncating active writer: %w", err)
+	}
+	s.activeFile.size = position.Size
+	s.activeFile.lines = position.Lines
+
+	return nil
+}
+
+// Checkpoint flushes all data to the working file and syncs it to disk, the working file's
+// path and size are saved in the checkpoint directory. Once checkpointed, the boundary is
+// uploaded from the working file even if all its data would have fit in memory. With
+// compression, the compressed frame is completed, data written next going to a new frame.
+//
+// The checkpoint refers to the working file's data, it's invalid once Revert truncates the
+// file below the checkpointed size and must be discarded prior doing so.
+func (s *BufferedIO) Checkpoint(dir string) error {
+	if s.activeFile == nil {
+		return fmt.Errorf("no active file")
+	}
+
+	if s.activeFile.err != nil {
+		return s.activeFile.err
+	}
+
+	if err := s.activeFile.closeFrame(); err != nil {
+		return err
+	}
+
+	if err := s.activeFile.writer.Flush(); err != nil {
+		return fmt.Errorf("flushing buffered active writer: %w", err)
+	}
+
+	if err := s.activeFile.lazyFile.Sync(); err != nil {
+		return fmt.Errorf("sync working file: %w", err)
+	}
+
+	position, _ := s.activeFile.blockMarks.last()
+	return writeCheckpointFile(dir, &bufferedCheckpoint{
+		Path:       s.activeFile.Path(),
+		Position:   position,
+		FileSize:   s.activeFile.writer.Size(),
+		BlockMarks: s.activeFile.blockMarks,
+	})
+}
+
+// RestoreCheckpoint reopens the working file saved by Checkpoint, discarding any data
+// written to it after the checkpoint.
+func (s *BufferedIO) RestoreCheckpoint(dir string, blockRange *bstream.Range) error {
+	if s.activeFile != nil {
+		return fmt.Errorf("unable to restore a file while one (backed by %q) is already open", s.activeFile.Path())
+	}
+
+	checkpoint := &bufferedCheckpoint{}
+	if err := readCheckpointFile(dir, checkpoint); err != nil {
+		return err
+	}
+
+	fileSize := s.fileSize(checkpoint.Position)
+	if !s.revertable() {
+		fileSize = checkpoint.FileSize
+	}
+
+	lazyFile, err := LazyReopen(checkpoint.Path, fileSize)
+	if err != nil {
+		return fmt.Errorf("reopen working file: %w", err)
+	}
+
+	writer := NewIntelligentWriterSize(lazyFile, int(s.bufferMazSize))
+	writer.resumeAt(fileSize)
+
+	s.activeFile = &bufferedActiveFile{
+		lazyFile:   lazyFile,
+		writer:     writer,
+		blockRange: blockRange,
+		size:       checkpoint.Position.Size,
+		lines:      checkpoint.Position.Lines,
+		blockMarks: checkpoint.BlockMarks,
+	}
+
+	return nil
+}
+
+// Compact implements Writer, files are concatenated as is, compressed files being made
+// of frames that can be concatenated. The header is kept only from the first file.
+func (s *BufferedIO) Compact(source dstore.Store, files []UploadedFile, namer FileNamer) Uploadeable {
+	return UploadeableFunc(func(ctx context.Context, store dstore.Store) ([]UploadedFile, error) {
+		outputFilename := namer.Filename("", s.outputFileType())
+		reader, writer := io.Pipe()
+
+		var rows int64
+		for _, file := range files {
+			rows += file.Rows
+		}
+
+		go func() {
+			for i, file := range files {
+				var skip []byte
+				if i > 0 {
+					skip = s.encodedHeader
+				}
+
+				if err := copyObjectAfter(ctx, source, file.Filename, skip, writer); err != nil {
+					writer.CloseWithError(fmt.Errorf("copy %q: %w", file.Filename, err))
+					return
+				}
+			}
+
+			writer.Close()
+		}()
+
+		stats := newUploadStats()
+		if err := store.WriteObject(ctx, outputFilename, io.TeeReader(reader, stats)); err != nil {
+			reader.CloseWithError(err)
+			return nil, fmt.Errorf("write compacted object: %w", err)
+		}
+
+		return []UploadedFile{stats.uploadedFile(outputFilename, "", rows)}, nil
+	})
 }
 
 var _ io.WriteCloser = (*LazyFile)(nil)
@@ -122,6 +484,28 @@ func LazyOpen(path string) *LazyFile {
 	}
 }
 
+// LazyReopen opens the existing file at path to continue writing after its first `size`
+// bytes, any data past them is discarded.
+func LazyReopen(path string, size int64) (*LazyFile, error) {
+	f := LazyOpen(path)
+	if size == 0 {
+		return f, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+
+	f.File = file
+	if err := f.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
 func (f *LazyFile) Path() string {
 	return f.path
 }
@@ -143,6 +527,37 @@ func (f *LazyFile) Write(p []byte) (n int, err error) {
 	return f.File.Write(p)
 }
 
+// Truncate changes the size of the file and moves the write offset at the new end
+// of the file so that next writes are appended after the kept data.
+func (f *LazyFile) Truncate(size int64) error {
+	if f.File == nil {
+		if size == 0 {
+			return nil
+		}
+
+		return fmt.Errorf("unable to truncate to %d bytes, file %q was never written to", size, f.path)
+	}
+
+	if err := f.File.Truncate(size); err != nil {
+		return fmt.Errorf("truncate file: %w", err)
+	}
+
+	if _, err := f.File.Seek(size, io.SeekStart); err != nil {
+		return fmt.Errorf("seek file: %w", err)
+	}
+
+	return nil
+}
+
+// Sync commits the file's content to disk, it's a no-op if the file was never written to.
+func (f *LazyFile) Sync() error {
+	if f.File == nil {
+		return nil
+	}
+
+	return f.File.Sync()
+}
+
 func (f *LazyFile) Close() error {
 	if f.File != nil {
 		return f.File.Close()
@@ -164,6 +579,7 @@ type memoryBufferedWriter struct {
 	MemoryBuffer       []byte
 	NextWritesToMemory bool
 	WrittenToWrapped   bool
+	WrittenToWrappedN  int64
 }
 
 func newMemoryBufferedWriter(w io.Writer) *memoryBufferedWriter {
@@ -182,7 +598,9 @@ func (f *memoryBufferedWriter) Write(p []byte) (n int, err error) {
 	}
 
 	f.WrittenToWrapped = true
-	return f.Writer.Write(p)
+	n, err = f.Writer.Write(p)
+	f.WrittenToWrappedN += int64(n)
+	return n, err
 }
 
 func (f *memoryBufferedWriter) Close() error {
@@ -249,6 +667,66 @@ func (w *IntelligentWriter) MemoryData() []byte {
 	return w.underlyingWriter.MemoryBuffer
 }
 
+// Size returns the total amount of bytes written so far, accounting both for the
+// data flushed to the wrapped writer and the data still buffered in memory.
+func (w *IntelligentWriter) Size() int64 {
+	return w.underlyingWriter.WrittenToWrappedN + int64(w.Writer.Buffered())
+}
+
+// Truncate discards all data written after the first `size` bytes. When all data
+// still fits in memory, the buffer is rewritten in place, otherwise everything is
+// flushed and the wrapped writer is truncated, which in this case must implement
+// `Truncate(size int64) error` like LazyFile does.
+func (w *IntelligentWriter) Truncate(size int64) error {
+	current := w.Size()
+	if size > current {
+		return fmt.Errorf("unable to truncate to %d bytes, only %d bytes were written", size, current)
+	}
+
+	if size == current {
+		return nil
+	}
+
+	if w.AllDataFitInMemory() {
+		// MemoryData gives us access to the internal buffer of `bufio.Writer` which is
+		// re-used after the reset, so we must copy the kept data before writing it back.
+		kept := append([]byte(nil), w.MemoryData()[:size]...)
+
+		w.underlyingWriter.NextWritesToMemory = false
+		w.underlyingWriter.MemoryBuffer = nil
+		w.Writer.Reset(w.underlyingWriter)
+
+		if _, err := w.Writer.Write(kept); err != nil {
+			return fmt.Errorf("rewrite kept data: %w", err)
+		}
+
+		return nil
+	}
+
+	truncater, ok := w.underlyingWriter.Writer.(interface{ Truncate(size int64) error })
+	if !ok {
+		return fmt.Errorf("wrapped writer of type %T does not support truncation", w.underlyingWriter.Writer)
+	}
+
+	if err := w.Writer.Flush(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+
+	if err := truncater.Truncate(size); err != nil {
+		return fmt.Errorf("truncate wrapped writer: %w", err)
+	}
+
+	w.underlyingWriter.WrittenToWrappedN = size
+	return nil
+}
+
+// resumeAt configures the writer as if `size` bytes were already written to the wrapped
+// writer, used when writing continues in an existing file.
+func (w *IntelligentWriter) resumeAt(size int64) {
+	w.underlyingWriter.WrittenToWrapped = size > 0
+	w.underlyingWriter.WrittenToWrappedN = size
+}
+
 type IntelligentWriter struct {
 	*bufio.Writer
 
@@ -259,11 +737,73 @@ const (
 	DefaultBufSize = 16 * 1024 * 1024 // 16 MiB
 )
 
+var newLine = []byte{'\n'}
+
 type bufferedActiveFile struct {
-	lazyFile       *LazyFile
-	writer         *IntelligentWriter
-	blockRange     *bstream.Range
-	outputFilename string
+	lazyFile *LazyFile
+	writer   *IntelligentWriter
+	// compressor compresses the data written into writer, it's nil without compression
+	// or until data is written, frameOpen is true while data is written to its frame
+	compressor frameWriter
+	frameOpen  bool
+	// err is the error of completing a frame at the end of a block, see EndBlock
+	err        error
+	blockRange *bstream.Range
+	// size is the amount of bytes written before compression
+	size       int64
+	lines      int64
+	blockMarks blockMarks[bufferedPosition]
+}
+
+// openFrame starts a new compressed frame if none is being written.
+func (f *bufferedActiveFile) openFrame(compression Compression) (err error) {
+	if f.frameOpen {
+		return nil
+	}
+
+	if f.compressor == nil {
+		if f.compressor, err = compression.newWriter(f.writer); err != nil {
+			return fmt.Errorf("new %s compressor: %w", compression, err)
+		}
+	} else {
+		f.compressor.Reset(f.writer)
+	}
+
+	f.frameOpen = true
+	return nil
+}
+
+// closeFrame completes the compressed frame being written, if any.
+func (f *bufferedActiveFile) closeFrame() error {
+	if !f.frameOpen {
+		return nil
+	}
+
+	if err := f.compressor.Close(); err != nil {
+		return fmt.Errorf("close compressor: %w", err)
+	}
+
+	f.frameOpen = false
+	return nil
+}
+
+// bufferedPosition is the position of the active file at the end of a block, Size being
+// the amount of bytes written before compression and FileSize the amount of bytes of the
+// file, which differs from Size when the data is compressed.
+type bufferedPosition struct {
+	Size     int64 `json:"size"`
+	Lines    int64 `json:"lines"`
+	FileSize int64 `json:"file_size,omitempty"`
+}
+
+// bufferedCheckpoint is what BufferedIO saves on checkpoint, the data itself is kept
+// in the working file. FileSize is the size of the working file, data written after the
+// last block being kept when it's compressed in a frame holding previous blocks too.
+type bufferedCheckpoint struct {
+	Path       string                       `json:"path"`
+	Position   bufferedPosition             `json:"position"`
+	FileSize   int64                        `json:"file_size"`
+	BlockMarks blockMarks[bufferedPosition] `json:"block_marks"`
 }
 
 func (f *bufferedActiveFile) Path() string {
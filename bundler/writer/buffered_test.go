@@ -1,12 +1,18 @@
 package writer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"fmt"
+	"io"
 	"io/fs"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
 	"github.com/streamingfast/bstream"
 	"github.com/streamingfast/dstore"
 	"github.com/stretchr/testify/assert"
@@ -49,17 +55,20 @@ func TestNewBufferedIO(t *testing.T) {
 				require.NoError(t, simpler.Write([]byte("{first}")))
 				require.NoError(t, simpler.Write([]byte("{second}")))
 
-				uploadeable, err := writer.CloseBoundary(context.Background())
+				uploadeable, err := writer.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(0, 10)))
 				require.NoError(t, err)
 				writtenFiles := listFiles(workingDir)
 
-				_, err = uploadeable.Upload(context.Background(), output)
+				uploadedFiles, err := uploadeable.Upload(context.Background(), output)
 				require.NoError(t, err)
 
 				assert.Len(t, writtenFiles, 0)
 				assert.Equal(t, map[string][]byte{
 					"0000000000-0000000010.jsonl": []byte(`{first}{second}`),
 				}, output.Files)
+				assert.Equal(t, []UploadedFile{
+					{Filename: "0000000000-0000000010.jsonl", Size: 15, Rows: 0, SHA256: "e9de29c8e924034f184a0ed1061069c77791046971facfc11f7869c8378a7db2"},
+				}, uploadedFiles)
 			},
 		},
 
@@ -73,8 +82,8 @@ func TestNewBufferedIO(t *testing.T) {
 				require.NoError(t, simpler.Write([]byte("{first}")), "write first content")
 				require.NoError(t, simpler.Write([]byte("{second}")), "write second content")
 
-				//require.NoError(t, writer.CloseBoundary(context.Background()), "closing boundary")
-				uploadeable, err := writer.CloseBoundary(context.Background())
+				//require.NoError(t, writer.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(0, 10))), "closing boundary")
+				uploadeable, err := writer.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(0, 10)))
 				require.NoError(t, err)
 
 				writtenFiles := listFiles(workingDir)
@@ -88,6 +97,92 @@ func TestNewBufferedIO(t *testing.T) {
 				}, output.Files)
 			},
 		},
+
+		{
+			"revert all in memory",
+			64,
+			func(t *testing.T, writer *BufferedIO, workingDir string, output *dstore.MockStore) {
+				simpler := newSimplerWritter(t, writer)
+
+				require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(0, 10)))
+				require.NoError(t, simpler.Write([]byte("{first}")))
+				writer.EndBlock(1)
+				require.NoError(t, simpler.Write([]byte("{second}")))
+				writer.EndBlock(2)
+				require.NoError(t, simpler.Write([]byte("{third}")))
+				writer.EndBlock(3)
+
+				require.NoError(t, writer.Revert(1))
+				require.NoError(t, simpler.Write([]byte("{second'}")))
+				writer.EndBlock(2)
+
+				uploadeable, err := writer.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(0, 10)))
+				require.NoError(t, err)
+				writtenFiles := listFiles(workingDir)
+
+				_, err = uploadeable.Upload(context.Background(), output)
+				require.NoError(t, err)
+
+				assert.Len(t, writtenFiles, 0)
+				assert.Equal(t, map[string][]byte{
+					"0000000000-0000000010.jsonl": []byte(`{first}{second'}`),
+				}, output.Files)
+			},
+		},
+
+		{
+			"revert written to file",
+			4,
+			func(t *testing.T, writer *BufferedIO, workingDir string, output *dstore.MockStore) {
+				simpler := newSimplerWritter(t, writer)
+
+				require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(0, 10)))
+				require.NoError(t, simpler.Write([]byte("{first}")))
+				writer.EndBlock(1)
+				require.NoError(t, simpler.Write([]byte("{second}")))
+				writer.EndBlock(2)
+
+				require.NoError(t, writer.Revert(1))
+				require.NoError(t, simpler.Write([]byte("{second'}")))
+				writer.EndBlock(2)
+
+				uploadeable, err := writer.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(0, 10)))
+				require.NoError(t, err)
+
+				_, err = uploadeable.Upload(context.Background(), output)
+				require.NoError(t, err)
+
+				assert.Equal(t, map[string][]byte{
+					"0000000000-0000000010.jsonl": []byte(`{first}{second'}`),
+				}, output.Files)
+			},
+		},
+
+		{
+			"revert whole boundary",
+			64,
+			func(t *testing.T, writer *BufferedIO, workingDir string, output *dstore.MockStore) {
+				simpler := newSimplerWritter(t, writer)
+
+				require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(5, 10)))
+				require.NoError(t, simpler.Write([]byte("{first}")))
+				writer.EndBlock(5)
+
+				require.NoError(t, writer.Revert(4))
+				require.NoError(t, simpler.Write([]byte("{first'}")))
+				writer.EndBlock(5)
+
+				uploadeable, err := writer.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(5, 10)))
+				require.NoError(t, err)
+
+				_, err = uploadeable.Upload(context.Background(), output)
+				require.NoError(t, err)
+
+				assert.Equal(t, map[string][]byte{
+					"0000000005-0000000010.jsonl": []byte(`{first'}`),
+				}, output.Files)
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -124,3 +219,275 @@ func (w *simplerWriter) Write(buf []byte) (err error) {
 
 	return err
 }
+
+var decompress = map[Compression]func(t *testing.T, data []byte) []byte{
+	CompressionNone: func(t *testing.T, data []byte) []byte {
+		return data
+	},
+	CompressionGzip: func(t *testing.T, data []byte) []byte {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		require.NoError(t, err)
+
+		out, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		return out
+	},
+	CompressionZstd: func(t *testing.T, data []byte) []byte {
+		reader, err := zstd.NewReader(bytes.NewReader(data))
+		require.NoError(t, err)
+		defer reader.Close()
+
+		out, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		return out
+	},
+	CompressionLZ4: func(t *testing.T, data []byte) []byte {
+		out, err := io.ReadAll(lz4.NewReader(bytes.NewReader(data)))
+		require.NoError(t, err)
+		return out
+	},
+}
+
+func TestBufferedIO_Compression(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression Compression
+		bufferSize  uint64
+		filename    string
+		inMemory    bool
+		expectData  string
+	}{
+		{"gzip in memory", CompressionGzip, 1024 * 1024, "0000000000-0000000010.jsonl.gz", true, "{first}\n{third}\n"},
+		{"gzip written to file", CompressionGzip, 4, "0000000000-0000000010.jsonl.gz", false, "{first}\n{third}\n"},
+		{"zstd in memory", CompressionZstd, 1024 * 1024, "0000000000-0000000010.jsonl.zst", true, "{first}\n{third}\n"},
+		{"zstd written to file", CompressionZstd, 4, "0000000000-0000000010.jsonl.zst", false, "{first}\n{third}\n"},
+		{"lz4 in memory", CompressionLZ4, 1024 * 1024, "0000000000-0000000010.jsonl.lz4", true, "{first}\n{second}\n{partial}\n{third}\n"},
+		{"lz4 written to file", CompressionLZ4, 4, "0000000000-0000000010.jsonl.lz4", false, "{first}\n{second}\n{partial}\n{third}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workingDir := t.TempDir()
+			output := dstore.NewMockStore(nil)
+			writer := NewBufferedIO(tt.bufferSize, workingDir, FileTypeJSONL, zlog, BufferedCompression(tt.compression))
+			simpler := &simplerWriter{writer: writer, t: t}
+
+			require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(0, 10)))
+			require.NoError(t, simpler.Write([]byte("{first}\n")))
+			writer.EndBlock(1)
+			require.NoError(t, simpler.Write([]byte("{second}\n")))
+			writer.EndBlock(2)
+
+			require.NoError(t, simpler.Write([]byte("{partial}\n")))
+
+			assert.Equal(t, WriterStats{Size: 27, Rows: 3}, writer.Stats())
+			if tt.compression.Revertable() {
+				// Each block is its own frame, reverting drops the frame being written too
+				require.NoError(t, writer.Revert(2), "reverting the frame being written")
+				assert.Equal(t, WriterStats{Size: 17, Rows: 2}, writer.Stats())
+				require.NoError(t, writer.Revert(1), "reverting compressed data")
+				assert.Equal(t, WriterStats{Size: 8, Rows: 1}, writer.Stats())
+			} else {
+				require.Error(t, writer.Revert(1), "reverting compressed data")
+			}
+
+			require.NoError(t, simpler.Write([]byte("{third}\n")))
+			writer.EndBlock(3)
+
+			uploadeable, err := writer.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(0, 10)))
+			require.NoError(t, err)
+
+			_, isDataFile := uploadeable.(*dataFile)
+			assert.Equal(t, tt.inMemory, isDataFile)
+
+			uploadedFiles, err := uploadeable.Upload(context.Background(), output)
+			require.NoError(t, err)
+
+			require.Len(t, uploadedFiles, 1)
+			assert.Equal(t, tt.filename, uploadedFiles[0].Filename)
+			assert.Equal(t, int64(strings.Count(tt.expectData, "\n")), uploadedFiles[0].Rows)
+			assert.Equal(t, tt.expectData, string(decompress[tt.compression](t, output.Files[tt.filename])))
+		})
+	}
+}
+
+func TestBufferedIO_CompressionIrreversible(t *testing.T) {
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			write := func(opts ...BufferedIOOption) (*BufferedIO, []byte) {
+				output := dstore.NewMockStore(nil)
+				writer := NewBufferedIO(1024*1024, t.TempDir(), FileTypeJSONL, zlog, append([]BufferedIOOption{BufferedCompression(compression)}, opts...)...)
+
+				require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(0, 1000)))
+				for block := uint64(0); block < 1000; block++ {
+					_, err := fmt.Fprintf(writer, `{"block":%d,"from":"0xa9d1e08c7793af67e9d92fe308d5697fb81d3e43","amount":"1000"}`+"\n", block)
+					require.NoError(t, err)
+					writer.EndBlock(block)
+				}
+
+				uploadeable, err := writer.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(0, 1000)))
+				require.NoError(t, err)
+				uploaded, err := uploadeable.Upload(context.Background(), output)
+				require.NoError(t, err)
+
+				return writer, output.Files[uploaded[0].Filename]
+			}
+
+			_, revertable := write()
+			writer, irreversible := write(BufferedIrreversible())
+
+			// Without a frame per block, the file is a single stream compressing much better
+			assert.Equal(t, decompress[compression](t, revertable), decompress[compression](t, irreversible))
+			assert.Less(t, len(irreversible)*4, len(revertable))
+
+			require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(0, 10)))
+			_, err := writer.Write([]byte("{first}\n"))
+			require.NoError(t, err)
+			writer.EndBlock(1)
+			_, err = writer.Write([]byte("{second}\n"))
+			require.NoError(t, err)
+			writer.EndBlock(2)
+			assert.ErrorContains(t, writer.Revert(1), "unable to revert 9 bytes already compressed")
+		})
+	}
+}
+
+func TestBufferedIO_CompressionCheckpoint(t *testing.T) {
+	workingDir := t.TempDir()
+	checkpointDir := t.TempDir()
+	output := dstore.NewMockStore(nil)
+
+	writer := NewBufferedIO(1024*1024, workingDir, FileTypeJSONL, zlog, BufferedCompression(CompressionGzip))
+	require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(0, 10)))
+	_, err := writer.Write([]byte("{first}\n"))
+	require.NoError(t, err)
+	writer.EndBlock(1)
+	require.NoError(t, writer.Checkpoint(checkpointDir))
+
+	restored := NewBufferedIO(1024*1024, workingDir, FileTypeJSONL, zlog, BufferedCompression(CompressionGzip))
+	require.NoError(t, restored.RestoreCheckpoint(checkpointDir, bstream.NewInclusiveRange(0, 10)))
+	assert.Equal(t, WriterStats{Size: 8, Rows: 1}, restored.Stats())
+
+	_, err = restored.Write([]byte("{second}\n"))
+	require.NoError(t, err)
+	restored.EndBlock(2)
+
+	uploadeable, err := restored.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(0, 10)))
+	require.NoError(t, err)
+	_, err = uploadeable.Upload(context.Background(), output)
+	require.NoError(t, err)
+
+	reader, err := gzip.NewReader(bytes.NewReader(output.Files["0000000000-0000000010.jsonl.gz"]))
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "{first}\n{second}\n", string(data))
+}
+
+func TestBufferedIO_Header(t *testing.T) {
+	tests := []struct {
+		name        string
+		compression Compression
+		bufferSize  uint64
+	}{
+		{"none in memory", CompressionNone, 1024 * 1024},
+		{"none written to file", CompressionNone, 4},
+		{"gzip in memory", CompressionGzip, 1024 * 1024},
+		{"gzip written to file", CompressionGzip, 4},
+		{"zstd in memory", CompressionZstd, 1024 * 1024},
+		{"zstd written to file", CompressionZstd, 4},
+		{"lz4 in memory", CompressionLZ4, 1024 * 1024},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			output := dstore.NewMockStore(nil)
+			writer := NewBufferedIO(tt.bufferSize, t.TempDir(), FileTypeCSV, zlog, BufferedCompression(tt.compression), BufferedHeader([]byte("a,b\n")))
+
+			upload := func(blockRange *bstream.Range) UploadedFile {
+				uploadeable, err := writer.CloseBoundary(ctx, BlockRangeFileNamer(blockRange))
+				require.NoError(t, err)
+
+				uploadedFiles, err := uploadeable.Upload(ctx, output)
+				require.NoError(t, err)
+				require.Len(t, uploadedFiles, 1)
+
+				return uploadedFiles[0]
+			}
+
+			// The header is not part of the stats, the boundary is seen as empty
+			require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(0, 10)))
+			assert.Equal(t, WriterStats{}, writer.Stats())
+			empty := upload(bstream.NewInclusiveRange(0, 10))
+			assert.Equal(t, int64(0), empty.Rows)
+			assert.Equal(t, "a,b\n", string(decompress[tt.compression](t, output.Files[empty.Filename])))
+
+			require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(10, 20)))
+			_, err := writer.Write([]byte("1,2\n"))
+			require.NoError(t, err)
+			writer.EndBlock(11)
+			if tt.compression.Revertable() {
+				// Reverting all blocks keeps the header
+				require.NoError(t, writer.Revert(10))
+				assert.Equal(t, WriterStats{}, writer.Stats())
+				_, err = writer.Write([]byte("1,2\n"))
+				require.NoError(t, err)
+				writer.EndBlock(11)
+			}
+			_, err = writer.Write([]byte("3,4\n"))
+			require.NoError(t, err)
+			writer.EndBlock(12)
+			assert.Equal(t, WriterStats{Size: 8, Rows: 2}, writer.Stats())
+
+			first := upload(bstream.NewInclusiveRange(10, 20))
+			assert.Equal(t, int64(2), first.Rows)
+			assert.Equal(t, "a,b\n1,2\n3,4\n", string(decompress[tt.compression](t, output.Files[first.Filename])))
+
+			require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(20, 30)))
+			_, err = writer.Write([]byte("5,6\n"))
+			require.NoError(t, err)
+			writer.EndBlock(21)
+			second := upload(bstream.NewInclusiveRange(20, 30))
+			assert.Equal(t, int64(1), second.Rows)
+
+			if tt.compression.Revertable() {
+				// Compacted files hold the header once
+				compacted, err := writer.Compact(output, []UploadedFile{first, second}, BlockRangeFileNamer(bstream.NewInclusiveRange(10, 30))).Upload(ctx, output)
+				require.NoError(t, err)
+				require.Len(t, compacted, 1)
+				assert.Equal(t, int64(3), compacted[0].Rows)
+				assert.Equal(t, "a,b\n1,2\n3,4\n5,6\n", string(decompress[tt.compression](t, output.Files[compacted[0].Filename])))
+			}
+		})
+	}
+}
+
+func TestBufferedIO_HeaderCheckpoint(t *testing.T) {
+	workingDir := t.TempDir()
+	checkpointDir := t.TempDir()
+	output := dstore.NewMockStore(nil)
+
+	writer := NewBufferedIO(4, workingDir, FileTypeCSV, zlog, BufferedHeader([]byte("a,b\n")))
+	require.NoError(t, writer.StartBoundary(bstream.NewInclusiveRange(0, 10)))
+	_, err := writer.Write([]byte("1,2\n"))
+	require.NoError(t, err)
+	writer.EndBlock(1)
+	require.NoError(t, writer.Checkpoint(checkpointDir))
+	_, err = writer.Write([]byte("lost\n"))
+	require.NoError(t, err)
+
+	restored := NewBufferedIO(4, workingDir, FileTypeCSV, zlog, BufferedHeader([]byte("a,b\n")))
+	require.NoError(t, restored.RestoreCheckpoint(checkpointDir, bstream.NewInclusiveRange(0, 10)))
+	assert.Equal(t, WriterStats{Size: 4, Rows: 1}, restored.Stats())
+
+	_, err = restored.Write([]byte("3,4\n"))
+	require.NoError(t, err)
+	restored.EndBlock(2)
+
+	uploadeable, err := restored.CloseBoundary(context.Background(), BlockRangeFileNamer(bstream.NewInclusiveRange(0, 10)))
+	require.NoError(t, err)
+	uploadedFiles, err := uploadeable.Upload(context.Background(), output)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(2), uploadedFiles[0].Rows)
+	assert.Equal(t, "a,b\n1,2\n3,4\n", string(output.Files["0000000000-0000000010.csv"]))
+}
@@ -0,0 +1,38 @@
+package writer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkpointFilename is the file, in the checkpoint directory received by Writer.Checkpoint,
+// where writers save what they need to restore the active boundary.
+const checkpointFilename = "writer.json"
+
+func writeCheckpointFile(dir string, v any) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal checkpoint: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, checkpointFilename), content, 0644); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+func readCheckpointFile(dir string, v any) error {
+	content, err := os.ReadFile(filepath.Join(dir, checkpointFilename))
+	if err != nil {
+		return fmt.Errorf("read checkpoint: %w", err)
+	}
+
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("unmarshal checkpoint: %w", err)
+	}
+
+	return nil
+}
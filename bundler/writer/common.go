@@ -1,9 +1,6 @@
 package writer
 
 import (
-	"fmt"
-
-	"github.com/streamingfast/bstream"
 	"go.uber.org/zap"
 )
 
@@ -11,7 +8,11 @@ type FileType string
 
 const (
 	FileTypeJSONL   FileType = "jsonl"
+	FileTypeCSV     FileType = "csv"
+	FileTypeTSV     FileType = "tsv"
 	FileTypeParquet FileType = "parquet"
+	FileTypeAvro    FileType = "avro"
+	FileTypeArrow   FileType = "arrow"
 )
 
 type baseWriter struct {
@@ -27,10 +28,6 @@ func newBaseWriter(fileType FileType, zlogger *zap.Logger) baseWriter {
 
 }
 
-func (b baseWriter) filename(blockRange *bstream.Range) string {
-	return fmt.Sprintf("%010d-%010d.%s", blockRange.StartBlock(), *blockRange.EndBlock(), b.fileType)
-}
-
 func (b baseWriter) Type() FileType {
 	return b.fileType
 }
@@ -0,0 +1,93 @@
+package writer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression is the compression applied by line based writers to the files they produce.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+	CompressionLZ4  Compression = "lz4"
+)
+
+// ParseCompression parses the compression, accepted values are 'none', 'gzip', 'zstd'
+// and 'lz4'. An empty value is 'none'.
+func ParseCompression(in string) (Compression, error) {
+	if in == "" {
+		return CompressionNone, nil
+	}
+
+	switch compression := Compression(strings.ToLower(in)); compression {
+	case CompressionNone, CompressionGzip, CompressionZstd, CompressionLZ4:
+		return compression, nil
+	}
+
+	return "", fmt.Errorf("invalid compression %q, accepted values are 'none', 'gzip', 'zstd' and 'lz4'", in)
+}
+
+// Extension returns the extension appended to the name of compressed files, empty
+// without compression.
+func (c Compression) Extension() string {
+	switch c {
+	case CompressionGzip:
+		return "gz"
+	case CompressionZstd:
+		return "zst"
+	case CompressionLZ4:
+		return "lz4"
+	}
+
+	return ""
+}
+
+// FileType returns the type of the files of the given type once compressed, for
+// example 'jsonl.zst'.
+func (c Compression) FileType(fileType FileType) FileType {
+	if ext := c.Extension(); ext != "" {
+		return FileType(string(fileType) + "." + ext)
+	}
+
+	return fileType
+}
+
+// Revertable returns true if compressed data can be reverted at the end of any block,
+// the data of each block being compressed in its own frame. It's the case for gzip and
+// zstd whose concatenated frames are read as a single stream by common readers, unlike
+// lz4.
+func (c Compression) Revertable() bool {
+	return c != CompressionLZ4
+}
+
+// frameWriter compresses the data written to it as a single frame, complete once it's
+// closed. Reset starts a new frame written to the given writer.
+type frameWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// newWriter returns a writer compressing the data written to it into w as a single
+// frame, the frame is complete once the returned writer is closed. Frames written one
+// after the other form a valid stream for all compressions, even though lz4 readers
+// usually stop at the end of the first frame.
+func (c Compression) newWriter(w io.Writer) (frameWriter, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionLZ4:
+		return lz4.NewWriter(w), nil
+	}
+
+	return nil, fmt.Errorf("unsupported compression %q", c)
+}
@@ -2,7 +2,9 @@ package writer
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"path"
 
 	"github.com/streamingfast/bstream"
 	"github.com/streamingfast/dstore"
@@ -11,17 +13,115 @@ import (
 type Writer interface {
 	io.Writer
 
+	// StartBoundary starts accumulating data for a new boundary, the range received is
+	// the tentative block range of the boundary, its end block can be unknown (open range)
+	// when boundaries are not bounded by block numbers.
 	StartBoundary(*bstream.Range) error
-	CloseBoundary(ctx context.Context) (Uploadeable, error)
+	// CloseBoundary closes the active boundary returning the Uploadeable that writes its
+	// files to the output store, named according to the received FileNamer.
+	CloseBoundary(ctx context.Context, namer FileNamer) (Uploadeable, error)
 	Type() FileType
+
+	// EndBlock marks the end of the data written for the given block in the
+	// active boundary, it's the position the writer can go back to when
+	// Revert is called.
+	EndBlock(blockNum uint64)
+
+	// Revert discards all data written to the active boundary for blocks
+	// higher than the given last valid block number.
+	Revert(lastValidBlockNum uint64) error
+
+	// Stats returns the amount of data accumulated so far in the active boundary.
+	Stats() WriterStats
+
+	// Checkpoint persists the data of the active boundary, up to the last block marked
+	// by EndBlock, in the given directory so that it survives a crash of the process. A
+	// checkpoint may refer to the data of the active boundary, it's not valid anymore once
+	// Revert discards blocks it contains.
+	Checkpoint(dir string) error
+	// RestoreCheckpoint starts the boundary from the data persisted in the given directory
+	// by Checkpoint, it's called instead of StartBoundary.
+	RestoreCheckpoint(dir string, blockRange *bstream.Range) error
+
+	// Compact returns the Uploadeable merging files previously produced by this writer,
+	// read from the source store, into a single file per table named according to the
+	// received FileNamer. Files are merged in the order received.
+	Compact(source dstore.Store, files []UploadedFile, namer FileNamer) Uploadeable
+}
+
+// RowWriter is implemented by writers counting the lines of the data written as its rows,
+// for encoders whose rows can span multiple lines, like CSV records with quoted newlines.
+type RowWriter interface {
+	// WriteRows writes data holding the given number of rows
+	WriteRows(data []byte, rows int64) (n int, err error)
+}
+
+// WriterStats is the amount of data accumulated in the active boundary of a Writer.
+type WriterStats struct {
+	// Size is the amount of bytes accumulated, for Parquet it's an estimation of the
+	// uncompressed size of the rows since files are only encoded when uploaded.
+	Size int64
+	// Rows is the amount of rows accumulated, for line based outputs it's the number
+	// of lines.
+	Rows int64
+}
+
+// FileNamer decides the name in the output store of the files produced for a boundary.
+type FileNamer interface {
+	// Filename returns the name of the boundary's file holding rows of the given table,
+	// table is empty for writers that do not split rows in tables.
+	Filename(table string, fileType FileType) string
+}
+
+type FileNamerFunc func(table string, fileType FileType) string
+
+func (f FileNamerFunc) Filename(table string, fileType FileType) string {
+	return f(table, fileType)
+}
+
+// BaseNameFileNamer names files '[<table>/]<baseName>.<fileType>', where the table folder
+// is present only for writers splitting rows in tables.
+func BaseNameFileNamer(baseName string) FileNamer {
+	return FileNamerFunc(func(table string, fileType FileType) string {
+		filename := baseName + "." + string(fileType)
+		if table != "" {
+			return path.Join(table, filename)
+		}
+
+		return filename
+	})
+}
+
+// BlockRangeFileNamer names files '[<table>/]<start>-<end>.<fileType>' from the block range
+// received, it's the default naming of boundary files.
+func BlockRangeFileNamer(blockRange *bstream.Range) FileNamer {
+	return BaseNameFileNamer(fmt.Sprintf("%010d-%010d", blockRange.StartBlock(), *blockRange.EndBlock()))
 }
 
 type Uploadeable interface {
-	Upload(ctx context.Context, store dstore.Store) (string, error)
+	Upload(ctx context.Context, store dstore.Store) ([]UploadedFile, error)
 }
 
-type UploadeableFunc func(ctx context.Context, store dstore.Store) (string, error)
+type UploadeableFunc func(ctx context.Context, store dstore.Store) ([]UploadedFile, error)
 
-func (f UploadeableFunc) Upload(ctx context.Context, store dstore.Store) (string, error) {
+func (f UploadeableFunc) Upload(ctx context.Context, store dstore.Store) ([]UploadedFile, error) {
 	return f(ctx, store)
 }
+
+// UploadedFile describes a file that was written to the output store.
+type UploadedFile struct {
+	// Filename is the name of the file relative to the output store
+	Filename string `json:"filename"`
+	// Table is the table the file holds rows of, empty for line based outputs
+	Table string `json:"table,omitempty"`
+	// Size is the amount of bytes written to the output store
+	Size int64 `json:"size"`
+	// Rows is the number of rows the file contains, for line based outputs it's
+	// the number of lines in the file
+	Rows int64 `json:"rows"`
+	// SHA256 is the hex encoded SHA-256 checksum of the file's content
+	SHA256 string `json:"sha256"`
+	// Columns are the statistics of the file's columns, only known for Parquet files. They
+	// are kept in memory for table formats and not serialized.
+	Columns []ColumnStats `json:"-"`
+}
@@ -0,0 +1,10 @@
+package writer
+
+import (
+	"github.com/streamingfast/dmetrics"
+)
+
+// Metrics of the writers, registered by bundler.RegisterMetrics.
+var Metrics = dmetrics.NewSet()
+
+var BufferedBoundaryCount = Metrics.NewCounterVec("substreams_sink_files_buffered_boundaries", []string{"storage"}, "The number of boundaries closed by line based writers per storage, 'memory' when all data fit in the buffer and 'disk' when it spilled to the working directory")
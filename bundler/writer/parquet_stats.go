@@ -0,0 +1,123 @@
+package writer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// ColumnStats are the statistics of a leaf column of a Parquet file, table formats like
+// Delta Lake record them along with the file so that query engines can skip files.
+type ColumnStats struct {
+	// Path is the path of the column in the file's schema
+	Path []string
+	// Node is the leaf node of the column in the file's schema
+	Node parquet.Node
+	// Repeated is true if the column or one of its parents is repeated, the column then
+	// holds the values of all the rows' lists
+	Repeated bool
+	// Values is the number of values of the column, nulls included
+	Values int64
+	// Nulls is the number of null values of the column
+	Nulls int64
+	// Min and Max are the bounds of the column's non-null values, they are null values
+	// when the column holds none
+	Min parquet.Value
+	Max parquet.Value
+}
+
+// HasBounds returns true if Min and Max are set.
+func (s *ColumnStats) HasBounds() bool {
+	return !s.Min.IsNull() && !s.Max.IsNull()
+}
+
+// merge adds the values of the page to the statistics.
+func (s *ColumnStats) merge(values, nulls int64, min, max parquet.Value, hasBounds bool) {
+	s.Values += values
+	s.Nulls += nulls
+
+	if !hasBounds {
+		return
+	}
+
+	columnType := s.Node.Type()
+	if s.Min.IsNull() || columnType.Compare(min, s.Min) < 0 {
+		s.Min = min.Clone()
+	}
+	if s.Max.IsNull() || columnType.Compare(max, s.Max) > 0 {
+		s.Max = max.Clone()
+	}
+}
+
+// newColumnStats returns the empty statistics of every leaf column of the schema.
+func newColumnStats(schema *parquet.Schema) []ColumnStats {
+	columns := schema.Columns()
+
+	out := make([]ColumnStats, len(columns))
+	for _, path := range columns {
+		leaf, _ := schema.Lookup(path...)
+		out[leaf.ColumnIndex] = ColumnStats{
+			Path:     path,
+			Node:     leaf.Node,
+			Repeated: leaf.MaxRepetitionLevel > 0,
+		}
+	}
+
+	return out
+}
+
+// rowGroupColumnStats returns the statistics of the leaf columns of the row group, which
+// must have the given schema.
+func rowGroupColumnStats(schema *parquet.Schema, rowGroup parquet.RowGroup) ([]ColumnStats, error) {
+	out := newColumnStats(schema)
+
+	for i, chunk := range rowGroup.ColumnChunks() {
+		if err := readChunkStats(&out[i], chunk); err != nil {
+			return nil, fmt.Errorf("column %q: %w", out[i].Path, err)
+		}
+	}
+
+	return out, nil
+}
+
+func readChunkStats(stats *ColumnStats, chunk parquet.ColumnChunk) error {
+	pages := chunk.Pages()
+	defer pages.Close()
+
+	for {
+		page, err := pages.ReadPage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read page: %w", err)
+		}
+
+		min, max, ok := page.Bounds()
+		stats.merge(page.NumValues(), page.NumNulls(), min, max, ok)
+		parquet.Release(page)
+	}
+}
+
+// mergeColumnStats returns the statistics of the concatenation of files of the given
+// schema, nil if the statistics of one of the non-empty files are unknown.
+func mergeColumnStats(schema *parquet.Schema, files []UploadedFile) []ColumnStats {
+	out := newColumnStats(schema)
+
+	for _, file := range files {
+		if len(file.Columns) != len(out) {
+			if file.Rows == 0 {
+				continue
+			}
+
+			return nil
+		}
+
+		for i, column := range file.Columns {
+			out[i].merge(column.Values, column.Nulls, column.Min, column.Max, column.HasBounds())
+		}
+	}
+
+	return out
+}
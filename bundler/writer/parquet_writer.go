@@ -1,10 +1,13 @@
 package writer
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
-	"path"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
@@ -34,6 +37,22 @@ type ParquetWriter struct {
 
 	activeRange           *bstream.Range
 	rowsBufferByTableName map[string]*parquet.RowBuffer[any]
+	rowsSize              int64
+	blockMarks            blockMarks[parquetPosition]
+}
+
+// parquetPosition is the position of the active boundary's row buffers at the end
+// of a block.
+type parquetPosition struct {
+	RowCounts []int64 `json:"row_counts"`
+	RowsSize  int64   `json:"rows_size"`
+}
+
+// parquetCheckpoint is what ParquetWriter saves on checkpoint along with one Parquet
+// file per table holding the rows of the active boundary.
+type parquetCheckpoint struct {
+	RowsSize   int64                       `json:"rows_size"`
+	BlockMarks blockMarks[parquetPosition] `json:"block_marks"`
 }
 
 func NewParquetWriter(descriptor protoreflect.MessageDescriptor, logger *zap.Logger, tracer logging.Tracer, opts ...ParquetWriterOption) (*ParquetWriter, error) {
@@ -65,11 +84,19 @@ func NewParquetWriter(descriptor protoreflect.MessageDescriptor, logger *zap.Log
 	}, nil
 }
 
+// Tables returns the tables found in the output message descriptor, one Parquet file
+// being written per table for each boundary.
+func (p *ParquetWriter) Tables() []parquetx.TableResult {
+	return p.tables
+}
+
 // CloseBoundary implements Writer.
-func (p *ParquetWriter) CloseBoundary(ctx context.Context) (Uploadeable, error) {
+func (p *ParquetWriter) CloseBoundary(ctx context.Context, namer FileNamer) (Uploadeable, error) {
 	defer func() {
 		p.activeRange = nil
 		p.rowsBufferByTableName = nil
+		p.rowsSize = 0
+		p.blockMarks = nil
 	}()
 
 	if p.activeRange == nil {
@@ -83,27 +110,32 @@ func (p *ParquetWriter) CloseBoundary(ctx context.Context) (Uploadeable, error)
 			panic(fmt.Errorf("no rows found for table %q, should have been created", table.Schema.Name()))
 		}
 
-		uploadables[i] = uploadTableFile(table.Schema, rows, p.activeRange)
+		uploadables[i] = uploadTableFile(table.Schema, rows, namer.Filename(table.Schema.Name(), FileTypeParquet))
 	}
 
-	return UploadeableFunc(func(ctx context.Context, store dstore.Store) (out string, err error) {
+	return uploadConcurrently(uploadables, p.options.UploadConcurrency), nil
+}
+
+// uploadConcurrently returns the Uploadeable uploading all the received ones, at most
+// concurrency at a time.
+func uploadConcurrently(uploadables []Uploadeable, concurrency int) Uploadeable {
+	return UploadeableFunc(func(ctx context.Context, store dstore.Store) (out []UploadedFile, err error) {
 		type uploadResult struct {
-			filename  string
+			files     []UploadedFile
 			uploadErr error
 		}
 
 		work := make(chan Uploadeable)
 		results := make(chan uploadResult)
 
-		// create worker 5 goroutines
 		wg := sync.WaitGroup{}
-		for i := 0; i < 5; i++ {
+		for i := 0; i < concurrency; i++ {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
 				for s := range work {
-					filename, uploadErr := s.Upload(ctx, store)
-					results <- uploadResult{filename, uploadErr}
+					files, uploadErr := s.Upload(ctx, store)
+					results <- uploadResult{files, uploadErr}
 				}
 			}()
 		}
@@ -119,20 +151,105 @@ func (p *ParquetWriter) CloseBoundary(ctx context.Context) (Uploadeable, error)
 			close(results)
 		}()
 
-		filenames := make([]string, 0, len(uploadables))
+		out = make([]UploadedFile, 0, len(uploadables))
 		for result := range results {
-			filenames = append(filenames, result.filename)
+			out = append(out, result.files...)
 			err = multierr.Append(err, result.uploadErr)
 		}
 
-		return strings.Join(filenames, ","), err
-	}), nil
+		sort.Slice(out, func(i, j int) bool { return out[i].Filename < out[j].Filename })
+		return out, err
+	})
+}
+
+// Compact implements Writer, the rows of the files of each table are merged in a single
+// file written with the table's schema.
+func (p *ParquetWriter) Compact(source dstore.Store, files []UploadedFile, namer FileNamer) Uploadeable {
+	uploadables := make([]Uploadeable, len(p.tables))
+	for i, table := range p.tables {
+		var tableFiles []UploadedFile
+		for _, file := range files {
+			if file.Table == table.Schema.Name() {
+				tableFiles = append(tableFiles, file)
+			}
+		}
+
+		uploadables[i] = compactTableFiles(source, table.Schema, tableFiles, namer.Filename(table.Schema.Name(), FileTypeParquet))
+	}
+
+	return uploadConcurrently(uploadables, p.options.UploadConcurrency)
+}
+
+// compactTableFiles writes the rows of the files in a single one, the statistics of its
+// columns are the merged statistics of the files.
+func compactTableFiles(source dstore.Store, schema *parquet.Schema, files []UploadedFile, filename string) Uploadeable {
+	return UploadeableFunc(func(ctx context.Context, store dstore.Store) ([]UploadedFile, error) {
+		reader, writer := io.Pipe()
+		rowCount := int64(0)
+
+		go func() {
+			defer writer.Close()
+
+			parquetWriter := parquet.NewWriter(writer, &parquet.WriterConfig{
+				CreatedBy: "substreams-sink-files",
+				Schema:    schema,
+			})
+
+			for _, file := range files {
+				n, err := copyTableFileRows(ctx, source, file.Filename, schema, parquetWriter)
+				if err != nil {
+					writer.CloseWithError(fmt.Errorf("copy rows of %q: %w", file.Filename, err))
+					return
+				}
+
+				rowCount += n
+			}
+
+			if err := parquetWriter.Close(); err != nil {
+				writer.CloseWithError(fmt.Errorf("close parquet writer: %w", err))
+				return
+			}
+		}()
+
+		stats := newUploadStats()
+		if err := store.WriteObject(ctx, filename, io.TeeReader(reader, stats)); err != nil {
+			reader.CloseWithError(err)
+			return nil, fmt.Errorf("write compacted parquet file: %w", err)
+		}
+
+		uploaded := stats.uploadedFile(filename, schema.Name(), rowCount)
+		uploaded.Columns = mergeColumnStats(schema, files)
+
+		return []UploadedFile{uploaded}, nil
+	})
+}
+
+// copyTableFileRows writes the rows of the given Parquet file of the source store to the
+// writer, the file is fully loaded in memory as Parquet files are read from their end.
+func copyTableFileRows(ctx context.Context, source dstore.Store, filename string, schema *parquet.Schema, writer *parquet.Writer) (int64, error) {
+	content := &bytes.Buffer{}
+	if err := copyObject(ctx, source, filename, content); err != nil {
+		return 0, err
+	}
+
+	reader := parquet.NewReader(bytes.NewReader(content.Bytes()), schema)
+	defer reader.Close()
+
+	n, err := parquet.CopyRows(writer, reader)
+	if err != nil {
+		return 0, fmt.Errorf("copy rows: %w", err)
+	}
+
+	return n, nil
 }
 
-func uploadTableFile(schema *parquet.Schema, rows *parquet.RowBuffer[any], activeRange *bstream.Range) Uploadeable {
-	filename := fmt.Sprintf(path.Join(schema.Name(), "%010d-%010d.parquet"), activeRange.StartBlock(), *activeRange.EndBlock())
+func uploadTableFile(schema *parquet.Schema, rows *parquet.RowBuffer[any], filename string) Uploadeable {
+	return UploadeableFunc(func(ctx context.Context, store dstore.Store) ([]UploadedFile, error) {
+		columns, err := rowGroupColumnStats(schema, rows)
+		if err != nil {
+			return nil, fmt.Errorf("column statistics: %w", err)
+		}
 
-	return UploadeableFunc(func(ctx context.Context, store dstore.Store) (string, error) {
 		reader, writer := io.Pipe()
 
 		go func() {
@@ -156,11 +273,15 @@ func uploadTableFile(schema *parquet.Schema, rows *parquet.RowBuffer[any], activ
 			}
 		}()
 
-		if err := store.WriteObject(ctx, filename, reader); err != nil {
-			return "", fmt.Errorf("write parquet file: %w", err)
+		stats := newUploadStats()
+		if err := store.WriteObject(ctx, filename, io.TeeReader(reader, stats)); err != nil {
+			return nil, fmt.Errorf("write parquet file: %w", err)
 		}
 
-		return filename, nil
+		uploaded := stats.uploadedFile(filename, schema.Name(), rows.NumRows())
+		uploaded.Columns = columns
+
+		return []UploadedFile{uploaded}, nil
 	})
 }
 
@@ -170,8 +291,8 @@ func (p *ParquetWriter) StartBoundary(blockRange *bstream.Range) error {
 		return fmt.Errorf("a range is already in progress")
 	}
 
-	if blockRange == nil || blockRange.EndBlock() == nil {
-		return fmt.Errorf("invalid block range, must be set and closed")
+	if blockRange == nil {
+		return fmt.Errorf("invalid block range, must be set")
 	}
 
 	p.activeRange = blockRange
@@ -220,11 +341,237 @@ func (p *ParquetWriter) EncodeMapModule(output *pbsubstreamsrpc.MapModuleOutput)
 		if n != len(rows) {
 			return fmt.Errorf("expected to write %d rows, but wrote %d", len(rows), n)
 		}
+
+		p.rowsSize += estimatedRowsSize(rows)
 	}
 
 	return nil
 }
 
+// EndBlock implements Writer.
+func (p *ParquetWriter) EndBlock(blockNum uint64) {
+	if p.activeRange == nil {
+		return
+	}
+
+	rowCounts := make([]int64, len(p.tables))
+	for i, table := range p.tables {
+		rowCounts[i] = p.rowsBufferByTableName[table.Schema.Name()].NumRows()
+	}
+
+	p.blockMarks = p.blockMarks.add(blockNum, parquetPosition{RowCounts: rowCounts, RowsSize: p.rowsSize})
+}
+
+// Stats implements Writer.
+func (p *ParquetWriter) Stats() WriterStats {
+	stats := WriterStats{Size: p.rowsSize}
+	for _, rows := range p.rowsBufferByTableName {
+		stats.Rows += rows.NumRows()
+	}
+
+	return stats
+}
+
+// Checkpoint implements Writer, the rows of each table are written to a Parquet file
+// named after the table in the checkpoint directory.
+func (p *ParquetWriter) Checkpoint(dir string) error {
+	if p.activeRange == nil {
+		return fmt.Errorf("no active range, unable to checkpoint")
+	}
+
+	for _, table := range p.tables {
+		if err := writeTableCheckpoint(filepath.Join(dir, table.Schema.Name()+".parquet"), table.Schema, p.rowsBufferByTableName[table.Schema.Name()]); err != nil {
+			return fmt.Errorf("checkpoint table %q: %w", table.Schema.Name(), err)
+		}
+	}
+
+	return writeCheckpointFile(dir, &parquetCheckpoint{
+		RowsSize:   p.rowsSize,
+		BlockMarks: p.blockMarks,
+	})
+}
+
+func writeTableCheckpoint(path string, schema *parquet.Schema, rows *parquet.RowBuffer[any]) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	defer file.Close()
+
+	parquetWriter := parquet.NewWriter(file, &parquet.WriterConfig{
+		CreatedBy: "substreams-sink-files",
+		Schema:    schema,
+	})
+
+	if _, err := parquetWriter.WriteRowGroup(rows); err != nil {
+		return fmt.Errorf("write row group parquet writer: %w", err)
+	}
+
+	if err := parquetWriter.Close(); err != nil {
+		return fmt.Errorf("close parquet writer: %w", err)
+	}
+
+	return file.Sync()
+}
+
+// RestoreCheckpoint implements Writer, rows written after the last block marked at
+// checkpoint time are discarded.
+func (p *ParquetWriter) RestoreCheckpoint(dir string, blockRange *bstream.Range) error {
+	checkpoint := &parquetCheckpoint{}
+	if err := readCheckpointFile(dir, checkpoint); err != nil {
+		return err
+	}
+
+	if err := p.StartBoundary(blockRange); err != nil {
+		return err
+	}
+
+	position, found := checkpoint.BlockMarks.last()
+	for i, table := range p.tables {
+		rows, err := readTableCheckpoint(filepath.Join(dir, table.Schema.Name()+".parquet"), table.Schema)
+		if err != nil {
+			p.activeRange = nil
+			return fmt.Errorf("restore table %q: %w", table.Schema.Name(), err)
+		}
+
+		rowCount := int64(0)
+		if found {
+			rowCount = position.RowCounts[i]
+		}
+
+		if rows.NumRows() != rowCount {
+			if rows, err = truncateRowBuffer(table.Schema, rows, rowCount); err != nil {
+				p.activeRange = nil
+				return fmt.Errorf("truncating table %q rows: %w", table.Schema.Name(), err)
+			}
+		}
+
+		p.rowsBufferByTableName[table.Schema.Name()] = rows
+	}
+
+	p.rowsSize = position.RowsSize
+	p.blockMarks = checkpoint.BlockMarks
+
+	return nil
+}
+
+func readTableCheckpoint(path string, schema *parquet.Schema) (*parquet.RowBuffer[any], error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	reader := parquet.NewReader(file, schema)
+	defer reader.Close()
+
+	rows := parquet.NewRowBuffer[any](&parquet.RowGroupConfig{
+		Schema: schema,
+	})
+
+	if _, err := parquet.CopyRows(rows, reader); err != nil {
+		return nil, fmt.Errorf("read rows: %w", err)
+	}
+
+	return rows, nil
+}
+
+// estimatedRowsSize returns the size of the values of the rows, which is an
+// approximation of the uncompressed size the rows will take once encoded.
+func estimatedRowsSize(rows []parquet.Row) (size int64) {
+	for _, row := range rows {
+		for _, value := range row {
+			if value.IsNull() {
+				continue
+			}
+
+			switch value.Kind() {
+			case parquet.Boolean:
+				size += 1
+			case parquet.Int32, parquet.Float:
+				size += 4
+			case parquet.Int64, parquet.Double:
+				size += 8
+			case parquet.Int96:
+				size += 12
+			case parquet.ByteArray, parquet.FixedLenByteArray:
+				size += int64(len(value.ByteArray()))
+			}
+		}
+	}
+
+	return size
+}
+
+// Revert implements Writer.
+func (p *ParquetWriter) Revert(lastValidBlockNum uint64) error {
+	if p.activeRange == nil {
+		return fmt.Errorf("no active range, unable to revert")
+	}
+
+	position, kept, found := p.blockMarks.revertTo(lastValidBlockNum)
+	p.blockMarks = kept
+	p.rowsSize = position.RowsSize
+
+	for i, table := range p.tables {
+		rowCount := int64(0)
+		if found {
+			rowCount = position.RowCounts[i]
+		}
+
+		rows := p.rowsBufferByTableName[table.Schema.Name()]
+		if rows.NumRows() == rowCount {
+			continue
+		}
+
+		truncated, err := truncateRowBuffer(table.Schema, rows, rowCount)
+		if err != nil {
+			return fmt.Errorf("truncating table %q rows: %w", table.Schema.Name(), err)
+		}
+
+		p.rowsBufferByTableName[table.Schema.Name()] = truncated
+	}
+
+	return nil
+}
+
+// truncateRowBuffer returns a new row buffer containing only the first `count` rows
+// of `rows`. The parquet library offers no way to drop rows from a buffer so we
+// rebuild one, this is fine as it only happens on chain reorganizations.
+func truncateRowBuffer(schema *parquet.Schema, rows *parquet.RowBuffer[any], count int64) (*parquet.RowBuffer[any], error) {
+	truncated := parquet.NewRowBuffer[any](&parquet.RowGroupConfig{
+		Schema: schema,
+	})
+
+	if count == 0 {
+		return truncated, nil
+	}
+
+	reader := rows.Rows()
+	defer reader.Close()
+
+	kept := make([]parquet.Row, count)
+	read := 0
+	for read < len(kept) {
+		n, err := reader.ReadRows(kept[read:])
+		read += n
+
+		if err != nil {
+			if err == io.EOF && read == len(kept) {
+				break
+			}
+
+			return nil, fmt.Errorf("read rows: %w", err)
+		}
+	}
+
+	if _, err := truncated.WriteRows(kept); err != nil {
+		return nil, fmt.Errorf("write rows: %w", err)
+	}
+
+	return truncated, nil
+}
+
 // Type implements Writer.
 func (p *ParquetWriter) Type() FileType {
 	return FileTypeParquet
@@ -14,11 +14,14 @@ import (
 // is the user facing configuration.
 type ParquetWriterOptions struct {
 	DefaultColumnCompression *pbparquet.Compression
+	// UploadConcurrency is the number of table files of a boundary uploaded in parallel
+	UploadConcurrency int
 }
 
 // ParquetWriterUserOptions holds the configuration options for the Parquet writer.
 type ParquetWriterUserOptions struct {
 	DefaultColumnCompression string
+	UploadConcurrency        int
 }
 
 func NewParquetWriterOptions(opts []ParquetWriterOption) (*ParquetWriterOptions, error) {
@@ -27,7 +30,11 @@ func NewParquetWriterOptions(opts []ParquetWriterOption) (*ParquetWriterOptions,
 		opt.apply(userOptions)
 	}
 
-	options := &ParquetWriterOptions{}
+	options := &ParquetWriterOptions{UploadConcurrency: 5}
+	if userOptions.UploadConcurrency > 0 {
+		options.UploadConcurrency = userOptions.UploadConcurrency
+	}
+
 	if userOptions.DefaultColumnCompression != "" {
 		compression, found := pbparquet.Compression_value[strings.ToUpper(userOptions.DefaultColumnCompression)]
 		if !found {
@@ -58,6 +65,14 @@ func ParquetDefaultColumnCompression(compression string) ParquetWriterOption {
 	})
 }
 
+// ParquetUploadConcurrency sets the number of table files of a boundary uploaded in parallel,
+// defaults to 5.
+func ParquetUploadConcurrency(concurrency int) ParquetWriterOption {
+	return optionFunc(func(o *ParquetWriterUserOptions) {
+		o.UploadConcurrency = concurrency
+	})
+}
+
 func ptr[T any](v T) *T {
 	return &v
 }
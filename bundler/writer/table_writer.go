@@ -0,0 +1,376 @@
+package writer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/logging"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// tableWriter implements Writer for the formats written as one file per table, the tables
+// being found in the output message descriptor with the same rules as the ParquetWriter.
+// Rows of the active boundary are kept in memory in a buffer per table until the boundary
+// is closed. The tableWriter handles boundaries, block marks and checkpoints, the encoding
+// of rows and files being left to the tableEncoding of the format.
+type tableWriter[B tableBuffer] struct {
+	baseWriter
+	options          *TableWriterOptions
+	descriptor       protoreflect.MessageDescriptor
+	tables           []encodedTable[B]
+	messageExtractor parquetx.ProtoMessageExtractor
+
+	activeRange *bstream.Range
+	// buffers holds the rows of each table, in the order of tables
+	buffers    []B
+	blockMarks blockMarks[tablePosition]
+}
+
+type encodedTable[B tableBuffer] struct {
+	name     string
+	encoding tableEncoding[B]
+}
+
+// tableBuffer holds the rows of a table in the active boundary.
+type tableBuffer interface {
+	// append adds the row of the message to the buffer
+	append(message protoreflect.Message) error
+	// endBlock is called once the rows of a block are appended, it returns the position of
+	// the buffer after them as received by truncate
+	endBlock() int64
+	// truncate discards the rows after the position
+	truncate(position int64)
+	// stats returns the rows and size of the buffer
+	stats() WriterStats
+}
+
+// tableEncoding is how the rows of a table are encoded by a format.
+type tableEncoding[B tableBuffer] interface {
+	newBuffer() (B, error)
+	// writeFile writes the rows of the buffer, up to its last position, as a file of the
+	// table, checkpoint files being uncompressed
+	writeFile(w io.Writer, buffer B, checkpoint bool) error
+	// readCheckpoint returns the buffer of the rows of a checkpoint file up to the position
+	readCheckpoint(file *os.File, position int64) (B, error)
+	// compactFiles writes the rows of the files of the source store as a single file, it
+	// returns the number of rows written
+	compactFiles(ctx context.Context, w io.Writer, source dstore.Store, files []string) (int64, error)
+}
+
+// tablePosition is the position of the buffer of each table at the end of a block.
+type tablePosition struct {
+	Positions []int64 `json:"positions"`
+}
+
+// tableCheckpoint is what tableWriter saves on checkpoint along with one checkpoint file
+// per table holding the rows of the active boundary.
+type tableCheckpoint struct {
+	BlockMarks blockMarks[tablePosition] `json:"block_marks"`
+}
+
+func newTableWriter[B tableBuffer](
+	fileType FileType,
+	descriptor protoreflect.MessageDescriptor,
+	options *TableWriterOptions,
+	newEncoding func(table parquetx.TableResult) (tableEncoding[B], error),
+	logger *zap.Logger,
+	tracer logging.Tracer,
+) (*tableWriter[B], error) {
+	tables, messageExtractor, err := parquetx.FindTableMessagesInMessageDescriptor(descriptor, logger, tracer)
+	if err != nil {
+		return nil, fmt.Errorf("find tables: %w", err)
+	}
+
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables found in message descriptor")
+	}
+
+	encodedTables := make([]encodedTable[B], len(tables))
+	for i, table := range tables {
+		encoding, err := newEncoding(table)
+		if err != nil {
+			return nil, fmt.Errorf("table %q: %w", table.Schema.Name(), err)
+		}
+
+		encodedTables[i] = encodedTable[B]{name: table.Schema.Name(), encoding: encoding}
+	}
+
+	return &tableWriter[B]{
+		baseWriter:       newBaseWriter(fileType, logger),
+		options:          options,
+		descriptor:       descriptor,
+		tables:           encodedTables,
+		messageExtractor: messageExtractor,
+	}, nil
+}
+
+// CloseBoundary implements Writer.
+func (w *tableWriter[B]) CloseBoundary(ctx context.Context, namer FileNamer) (Uploadeable, error) {
+	defer func() {
+		w.activeRange = nil
+		w.buffers = nil
+		w.blockMarks = nil
+	}()
+
+	if w.activeRange == nil {
+		return nil, fmt.Errorf("no active range, unable to close boundary")
+	}
+
+	uploadables := make([]Uploadeable, len(w.tables))
+	for i, table := range w.tables {
+		buffer := w.buffers[i]
+		buffer.endBlock()
+
+		uploadables[i] = w.writeTableFile(table.name, namer.Filename(table.name, w.fileType), func(_ context.Context, out io.Writer) (int64, error) {
+			return buffer.stats().Rows, table.encoding.writeFile(out, buffer, false)
+		})
+	}
+
+	return uploadConcurrently(uploadables, w.options.UploadConcurrency), nil
+}
+
+// Compact implements Writer, the rows of the files of each table are merged in a single
+// file.
+func (w *tableWriter[B]) Compact(source dstore.Store, files []UploadedFile, namer FileNamer) Uploadeable {
+	uploadables := make([]Uploadeable, len(w.tables))
+	for i, table := range w.tables {
+		var tableFiles []string
+		for _, file := range files {
+			if file.Table == table.name {
+				tableFiles = append(tableFiles, file.Filename)
+			}
+		}
+
+		uploadables[i] = w.writeTableFile(table.name, namer.Filename(table.name, w.fileType), func(ctx context.Context, out io.Writer) (int64, error) {
+			return table.encoding.compactFiles(ctx, out, source, tableFiles)
+		})
+	}
+
+	return uploadConcurrently(uploadables, w.options.UploadConcurrency)
+}
+
+// writeTableFile returns the Uploadeable writing the file produced by write, which returns
+// the number of rows of the file.
+func (w *tableWriter[B]) writeTableFile(table string, filename string, write func(ctx context.Context, out io.Writer) (int64, error)) Uploadeable {
+	return UploadeableFunc(func(ctx context.Context, store dstore.Store) ([]UploadedFile, error) {
+		reader, writer := io.Pipe()
+		rowCount := int64(0)
+
+		go func() {
+			defer writer.Close()
+
+			var err error
+			if rowCount, err = write(ctx, writer); err != nil {
+				writer.CloseWithError(err)
+			}
+		}()
+
+		stats := newUploadStats()
+		if err := store.WriteObject(ctx, filename, io.TeeReader(reader, stats)); err != nil {
+			reader.CloseWithError(err)
+			return nil, fmt.Errorf("write %s file: %w", w.fileType, err)
+		}
+
+		return []UploadedFile{stats.uploadedFile(filename, table, rowCount)}, nil
+	})
+}
+
+// StartBoundary implements Writer.
+func (w *tableWriter[B]) StartBoundary(blockRange *bstream.Range) error {
+	if w.activeRange != nil {
+		return fmt.Errorf("a range is already in progress")
+	}
+
+	if blockRange == nil {
+		return fmt.Errorf("invalid block range, must be set")
+	}
+
+	w.activeRange = blockRange
+	w.buffers = make([]B, len(w.tables))
+	for i, table := range w.tables {
+		buffer, err := table.encoding.newBuffer()
+		if err != nil {
+			w.activeRange = nil
+			return fmt.Errorf("new buffer of table %q: %w", table.name, err)
+		}
+
+		w.buffers[i] = buffer
+	}
+
+	return nil
+}
+
+func (w *tableWriter[B]) EncodeMapModule(output *pbsubstreamsrpc.MapModuleOutput) error {
+	if w.activeRange == nil {
+		return fmt.Errorf("active range must be set via StartBoundary before calling EncodeMapModule")
+	}
+
+	messageFullName := strings.TrimPrefix(output.MapOutput.TypeUrl, "type.googleapis.com/")
+	if messageFullName != string(w.descriptor.FullName()) {
+		return fmt.Errorf("received message type URL %q doesn't match expected output type %q", messageFullName, w.descriptor.FullName())
+	}
+
+	dynamicMsg := dynamicpb.NewMessage(w.descriptor)
+	err := proto.Unmarshal(output.MapOutput.Value, dynamicMsg)
+	if err != nil {
+		return fmt.Errorf("unmarshal message as proto: %w", err)
+	}
+
+	messagesByTable, err := w.messageExtractor.ExtractMessages(dynamicMsg)
+	if err != nil {
+		return fmt.Errorf("extracting rows from message %q: %w", messageFullName, err)
+	}
+
+	for i, table := range w.tables {
+		for j, message := range messagesByTable[table.name] {
+			if err := w.buffers[i].append(message); err != nil {
+				return fmt.Errorf("encoding row %d of table %q: %w", j, table.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// EndBlock implements Writer.
+func (w *tableWriter[B]) EndBlock(blockNum uint64) {
+	if w.activeRange == nil {
+		return
+	}
+
+	positions := make([]int64, len(w.buffers))
+	for i, buffer := range w.buffers {
+		positions[i] = buffer.endBlock()
+	}
+
+	w.blockMarks = w.blockMarks.add(blockNum, tablePosition{Positions: positions})
+}
+
+// Stats implements Writer, the size is the one of the buffered rows, before files are
+// compressed.
+func (w *tableWriter[B]) Stats() WriterStats {
+	stats := WriterStats{}
+	for _, buffer := range w.buffers {
+		bufferStats := buffer.stats()
+		stats.Size += bufferStats.Size
+		stats.Rows += bufferStats.Rows
+	}
+
+	return stats
+}
+
+// Checkpoint implements Writer, the rows of each table are written to an uncompressed file
+// named after the table in the checkpoint directory.
+func (w *tableWriter[B]) Checkpoint(dir string) error {
+	if w.activeRange == nil {
+		return fmt.Errorf("no active range, unable to checkpoint")
+	}
+
+	for i, table := range w.tables {
+		if err := w.writeCheckpoint(dir, table, w.buffers[i]); err != nil {
+			return fmt.Errorf("checkpoint table %q: %w", table.name, err)
+		}
+	}
+
+	return writeCheckpointFile(dir, &tableCheckpoint{
+		BlockMarks: w.blockMarks,
+	})
+}
+
+func (w *tableWriter[B]) writeCheckpoint(dir string, table encodedTable[B], buffer B) error {
+	file, err := os.Create(w.checkpointPath(dir, table))
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	defer file.Close()
+
+	if err := table.encoding.writeFile(file, buffer, true); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// RestoreCheckpoint implements Writer, rows written after the last block marked at
+// checkpoint time are discarded.
+func (w *tableWriter[B]) RestoreCheckpoint(dir string, blockRange *bstream.Range) error {
+	checkpoint := &tableCheckpoint{}
+	if err := readCheckpointFile(dir, checkpoint); err != nil {
+		return err
+	}
+
+	if err := w.StartBoundary(blockRange); err != nil {
+		return err
+	}
+
+	position, found := checkpoint.BlockMarks.last()
+	for i, table := range w.tables {
+		tablePosition := int64(0)
+		if found {
+			tablePosition = position.Positions[i]
+		}
+
+		buffer, err := w.readCheckpoint(dir, table, tablePosition)
+		if err != nil {
+			w.activeRange = nil
+			return fmt.Errorf("restore table %q: %w", table.name, err)
+		}
+
+		w.buffers[i] = buffer
+	}
+
+	w.blockMarks = checkpoint.BlockMarks
+
+	return nil
+}
+
+func (w *tableWriter[B]) readCheckpoint(dir string, table encodedTable[B], position int64) (out B, err error) {
+	file, err := os.Open(w.checkpointPath(dir, table))
+	if err != nil {
+		return out, fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	return table.encoding.readCheckpoint(file, position)
+}
+
+func (w *tableWriter[B]) checkpointPath(dir string, table encodedTable[B]) string {
+	return filepath.Join(dir, table.name+"."+string(w.fileType))
+}
+
+// Revert implements Writer.
+func (w *tableWriter[B]) Revert(lastValidBlockNum uint64) error {
+	if w.activeRange == nil {
+		return fmt.Errorf("no active range, unable to revert")
+	}
+
+	position, kept, found := w.blockMarks.revertTo(lastValidBlockNum)
+	w.blockMarks = kept
+
+	for i, buffer := range w.buffers {
+		tablePosition := int64(0)
+		if found {
+			tablePosition = position.Positions[i]
+		}
+
+		buffer.truncate(tablePosition)
+	}
+
+	return nil
+}
+
+// Write implements Writer.
+func (w *tableWriter[B]) Write(p []byte) (n int, err error) {
+	panic(fmt.Sprintf("shouldn't be called in the %s writer", w.fileType))
+}
@@ -0,0 +1,150 @@
+package writer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/hamba/avro/v2/ocf"
+)
+
+// AvroCodec is the codec compressing the blocks of the Avro container files.
+type AvroCodec string
+
+const (
+	AvroCodecNull    AvroCodec = "null"
+	AvroCodecDeflate AvroCodec = "deflate"
+	AvroCodecSnappy  AvroCodec = "snappy"
+	AvroCodecZstd    AvroCodec = "zstd"
+)
+
+// ParseAvroCodec parses the Avro block codec, accepted values are 'null' (no compression),
+// 'deflate', 'snappy' and 'zstd'. An empty value is 'deflate'.
+func ParseAvroCodec(in string) (AvroCodec, error) {
+	if in == "" {
+		return AvroCodecDeflate, nil
+	}
+
+	switch codec := AvroCodec(strings.ToLower(in)); codec {
+	case AvroCodecNull, AvroCodecDeflate, AvroCodecSnappy, AvroCodecZstd:
+		return codec, nil
+	}
+
+	return "", fmt.Errorf("invalid avro codec %q, accepted values are 'null', 'deflate', 'snappy' and 'zstd'", in)
+}
+
+// ocfCodec returns the name of the codec as written in the header of container files.
+func (c AvroCodec) ocfCodec() ocf.CodecName {
+	switch c {
+	case AvroCodecDeflate:
+		return ocf.Deflate
+	case AvroCodecSnappy:
+		return ocf.Snappy
+	case AvroCodecZstd:
+		return ocf.ZStandard
+	}
+
+	return ocf.Null
+}
+
+// ArrowCompression is the compression of the record batches' buffers in the Arrow IPC files.
+type ArrowCompression string
+
+const (
+	ArrowCompressionNone ArrowCompression = "none"
+	ArrowCompressionLZ4  ArrowCompression = "lz4"
+	ArrowCompressionZstd ArrowCompression = "zstd"
+)
+
+// ParseArrowCompression parses the Arrow buffer compression, accepted values are 'none',
+// 'lz4' and 'zstd'. An empty value is 'lz4'.
+func ParseArrowCompression(in string) (ArrowCompression, error) {
+	if in == "" {
+		return ArrowCompressionLZ4, nil
+	}
+
+	switch compression := ArrowCompression(strings.ToLower(in)); compression {
+	case ArrowCompressionNone, ArrowCompressionLZ4, ArrowCompressionZstd:
+		return compression, nil
+	}
+
+	return "", fmt.Errorf("invalid arrow compression %q, accepted values are 'none', 'lz4' and 'zstd'", in)
+}
+
+// ipcOptions returns the IPC writer options compressing buffers with this compression.
+func (c ArrowCompression) ipcOptions() []ipc.Option {
+	switch c {
+	case ArrowCompressionLZ4:
+		return []ipc.Option{ipc.WithLZ4()}
+	case ArrowCompressionZstd:
+		return []ipc.Option{ipc.WithZstd()}
+	}
+
+	return nil
+}
+
+// TableWriterOptions holds the configuration options for the writers producing one file
+// per table from their own encoding of the rows, the Avro and Arrow writers.
+type TableWriterOptions struct {
+	// AvroCodec compresses the blocks of Avro container files, defaults to AvroCodecDeflate
+	AvroCodec AvroCodec
+	// ArrowCompression compresses the buffers of Arrow record batches, defaults to
+	// ArrowCompressionLZ4
+	ArrowCompression ArrowCompression
+	// UploadConcurrency is the number of table files of a boundary uploaded in parallel
+	UploadConcurrency int
+}
+
+func NewTableWriterOptions(opts []TableWriterOption) *TableWriterOptions {
+	options := &TableWriterOptions{}
+	for _, opt := range opts {
+		opt.apply(options)
+	}
+
+	if options.AvroCodec == "" {
+		options.AvroCodec = AvroCodecDeflate
+	}
+
+	if options.ArrowCompression == "" {
+		options.ArrowCompression = ArrowCompressionLZ4
+	}
+
+	if options.UploadConcurrency <= 0 {
+		options.UploadConcurrency = 5
+	}
+
+	return options
+}
+
+// TableWriterOption is a function that configures the TableWriterOptions.
+type TableWriterOption interface {
+	apply(*TableWriterOptions)
+}
+
+type tableOptionFunc func(*TableWriterOptions)
+
+func (f tableOptionFunc) apply(o *TableWriterOptions) {
+	f(o)
+}
+
+// AvroBlockCodec sets the codec compressing the blocks of the Avro container files.
+func AvroBlockCodec(codec AvroCodec) TableWriterOption {
+	return tableOptionFunc(func(o *TableWriterOptions) {
+		o.AvroCodec = codec
+	})
+}
+
+// ArrowBufferCompression sets the compression of the Arrow record batches' buffers.
+func ArrowBufferCompression(compression ArrowCompression) TableWriterOption {
+	return tableOptionFunc(func(o *TableWriterOptions) {
+		o.ArrowCompression = compression
+	})
+}
+
+// TableUploadConcurrency sets the number of table files of a boundary uploaded in parallel,
+// defaults to 5.
+func TableUploadConcurrency(concurrency int) TableWriterOption {
+	return tableOptionFunc(func(o *TableWriterOptions) {
+		o.UploadConcurrency = concurrency
+	})
+}
@@ -0,0 +1,274 @@
+package writer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestTableWriter(t *testing.T) {
+	ctx := context.Background()
+	boundary := bstream.NewRangeExcludingEnd(0, 1000)
+
+	tableWriter := newTestTableWriter(t, &pbtesting.MultipleRepeated{})
+	require.NoError(t, tableWriter.StartBoundary(boundary))
+
+	writeTestTableBlock(t, tableWriter, 1, &pbtesting.MultipleRepeated{
+		TableA: []*pbtesting.Row{{TypeString: "a-1"}, {TypeString: "a-2"}},
+		TableB: []*pbtesting.Row{{TypeString: "b-1"}},
+	})
+	writeTestTableBlock(t, tableWriter, 2, &pbtesting.MultipleRepeated{
+		TableA: []*pbtesting.Row{{TypeString: "a-3"}},
+	})
+	assert.Equal(t, WriterStats{Size: 12, Rows: 4}, tableWriter.Stats())
+
+	uploadable, err := tableWriter.CloseBoundary(ctx, BlockRangeFileNamer(boundary))
+	require.NoError(t, err)
+	assert.Equal(t, WriterStats{}, tableWriter.Stats())
+
+	store := dstore.NewMockStore(nil)
+	files, err := uploadable.Upload(ctx, store)
+	require.NoError(t, err)
+
+	rowsByFile := map[string]int64{}
+	for _, file := range files {
+		rowsByFile[file.Filename] = file.Rows
+	}
+	assert.Equal(t, map[string]int64{
+		"table_a/0000000000-0000001000.txt": 3,
+		"table_b/0000000000-0000001000.txt": 1,
+		"table_c/0000000000-0000001000.txt": 0,
+	}, rowsByFile)
+
+	assert.Equal(t, "a-1\na-2\na-3\n", string(store.Files["table_a/0000000000-0000001000.txt"]))
+	assert.Equal(t, "", string(store.Files["table_c/0000000000-0000001000.txt"]))
+}
+
+func TestTableWriter_CheckpointAndRevert(t *testing.T) {
+	ctx := context.Background()
+	boundary := bstream.NewRangeExcludingEnd(0, 1000)
+	checkpointDir := t.TempDir()
+
+	crashed := newTestTableWriter(t, &pbtesting.SingleRepeated{})
+	require.NoError(t, crashed.StartBoundary(boundary))
+
+	writeTestTableBlock(t, crashed, 1, testTableRows("1"))
+	writeTestTableBlock(t, crashed, 2, testTableRows("2", "3"))
+	require.NoError(t, crashed.Checkpoint(checkpointDir))
+	writeTestTableBlock(t, crashed, 3, testTableRows("4"))
+	require.NoError(t, crashed.Checkpoint(checkpointDir))
+	require.NoError(t, crashed.Revert(2))
+
+	tableWriter := newTestTableWriter(t, &pbtesting.SingleRepeated{})
+	require.NoError(t, tableWriter.RestoreCheckpoint(checkpointDir, boundary))
+	assert.Equal(t, int64(4), tableWriter.Stats().Rows)
+
+	// Blocks restored from the checkpoint can be reverted
+	require.NoError(t, tableWriter.Revert(1))
+	assert.Equal(t, int64(1), tableWriter.Stats().Rows)
+	writeTestTableBlock(t, tableWriter, 2, testTableRows("20"))
+
+	uploadable, err := tableWriter.CloseBoundary(ctx, BlockRangeFileNamer(boundary))
+	require.NoError(t, err)
+
+	store := dstore.NewMockStore(nil)
+	_, err = uploadable.Upload(ctx, store)
+	require.NoError(t, err)
+
+	assert.Equal(t, "1\n20\n", string(store.Files["elements/0000000000-0000001000.txt"]))
+}
+
+func TestTableWriter_RestoreCheckpoint_DiscardsUnmarkedRows(t *testing.T) {
+	checkpointDir := t.TempDir()
+	boundary := bstream.NewRangeExcludingEnd(0, 1000)
+
+	crashed := newTestTableWriter(t, &pbtesting.SingleRepeated{})
+	require.NoError(t, crashed.StartBoundary(boundary))
+	writeTestTableBlock(t, crashed, 1, testTableRows("1"))
+
+	// Rows of a block not ended yet are not part of the checkpoint
+	message, err := anypb.New(testTableRows("2"))
+	require.NoError(t, err)
+	require.NoError(t, crashed.EncodeMapModule(&pbsubstreamsrpc.MapModuleOutput{Name: "test", MapOutput: message}))
+	require.NoError(t, crashed.Checkpoint(checkpointDir))
+
+	tableWriter := newTestTableWriter(t, &pbtesting.SingleRepeated{})
+	require.NoError(t, tableWriter.RestoreCheckpoint(checkpointDir, boundary))
+	assert.Equal(t, int64(1), tableWriter.Stats().Rows)
+}
+
+func TestTableWriter_Compact(t *testing.T) {
+	ctx := context.Background()
+
+	tableWriter := newTestTableWriter(t, &pbtesting.MultipleRepeated{})
+	headStore := dstore.NewMockStore(nil)
+
+	var heads []UploadedFile
+	writeHead := func(boundary *bstream.Range, output *pbtesting.MultipleRepeated) {
+		require.NoError(t, tableWriter.StartBoundary(boundary))
+		writeTestTableBlock(t, tableWriter, boundary.StartBlock(), output)
+
+		uploadable, err := tableWriter.CloseBoundary(ctx, BlockRangeFileNamer(boundary))
+		require.NoError(t, err)
+
+		files, err := uploadable.Upload(ctx, headStore)
+		require.NoError(t, err)
+		heads = append(heads, files...)
+	}
+
+	writeHead(bstream.NewRangeExcludingEnd(0, 10), &pbtesting.MultipleRepeated{TableA: []*pbtesting.Row{{TypeString: "a-1"}}, TableB: []*pbtesting.Row{{TypeString: "b-1"}}})
+	writeHead(bstream.NewRangeExcludingEnd(10, 20), &pbtesting.MultipleRepeated{TableA: []*pbtesting.Row{{TypeString: "a-2"}, {TypeString: "a-3"}}})
+
+	store := dstore.NewMockStore(nil)
+	files, err := tableWriter.Compact(headStore, heads, BlockRangeFileNamer(bstream.NewRangeExcludingEnd(0, 20))).Upload(ctx, store)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	rowsByFile := map[string]int64{}
+	for _, file := range files {
+		rowsByFile[file.Filename] = file.Rows
+	}
+	assert.Equal(t, map[string]int64{
+		"table_a/0000000000-0000000020.txt": 3,
+		"table_b/0000000000-0000000020.txt": 1,
+		"table_c/0000000000-0000000020.txt": 0,
+	}, rowsByFile)
+
+	assert.Equal(t, "a-1\na-2\na-3\n", string(store.Files["table_a/0000000000-0000000020.txt"]))
+}
+
+func newTestTableWriter(t *testing.T, output proto.Message) *tableWriter[*textRows] {
+	t.Helper()
+
+	tableWriter, err := newTableWriter("txt", output.ProtoReflect().Descriptor(), NewTableWriterOptions(nil), func(parquetx.TableResult) (tableEncoding[*textRows], error) {
+		return textEncoding{}, nil
+	}, zlog, ztracer)
+	require.NoError(t, err)
+
+	return tableWriter
+}
+
+func writeTestTableBlock(t *testing.T, tableWriter *tableWriter[*textRows], blockNum uint64, output proto.Message) {
+	t.Helper()
+
+	message, err := anypb.New(output)
+	require.NoError(t, err)
+
+	require.NoError(t, tableWriter.EncodeMapModule(&pbsubstreamsrpc.MapModuleOutput{Name: "test", MapOutput: message}))
+	tableWriter.EndBlock(blockNum)
+}
+
+func testTableRows(values ...string) *pbtesting.SingleRepeated {
+	output := &pbtesting.SingleRepeated{}
+	for _, value := range values {
+		output.Elements = append(output.Elements, &pbtesting.Row{TypeString: value})
+	}
+
+	return output
+}
+
+// textEncoding writes the 'typeString' field of the rows, one per line. The rows of the
+// block in progress are pending until the block ends but written to files like the
+// others.
+type textEncoding struct{}
+
+type textRows struct {
+	rows    []string
+	pending []string
+}
+
+func (textEncoding) newBuffer() (*textRows, error) {
+	return &textRows{}, nil
+}
+
+func (textEncoding) writeFile(w io.Writer, buffer *textRows, _ bool) error {
+	for _, rows := range [][]string{buffer.rows, buffer.pending} {
+		for _, row := range rows {
+			if _, err := fmt.Fprintln(w, row); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (textEncoding) readCheckpoint(file *os.File, position int64) (*textRows, error) {
+	buffer := &textRows{}
+	scanner := bufio.NewScanner(file)
+	for int64(len(buffer.rows)) < position && scanner.Scan() {
+		buffer.rows = append(buffer.rows, scanner.Text())
+	}
+
+	if int64(len(buffer.rows)) != position {
+		return nil, fmt.Errorf("expected %d rows, found %d", position, len(buffer.rows))
+	}
+
+	return buffer, scanner.Err()
+}
+
+func (textEncoding) compactFiles(ctx context.Context, w io.Writer, source dstore.Store, files []string) (int64, error) {
+	rows := int64(0)
+	for _, file := range files {
+		reader, err := source.OpenObject(ctx, file)
+		if err != nil {
+			return rows, err
+		}
+
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return rows, err
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return rows, err
+		}
+		rows += int64(strings.Count(string(data), "\n"))
+	}
+
+	return rows, nil
+}
+
+func (r *textRows) append(message protoreflect.Message) error {
+	r.pending = append(r.pending, message.Get(message.Descriptor().Fields().ByName("typeString")).String())
+	return nil
+}
+
+func (r *textRows) endBlock() int64 {
+	r.rows = append(r.rows, r.pending...)
+	r.pending = nil
+
+	return int64(len(r.rows))
+}
+
+func (r *textRows) truncate(position int64) {
+	r.rows = r.rows[:position]
+	r.pending = nil
+}
+
+func (r *textRows) stats() WriterStats {
+	stats := WriterStats{Rows: int64(len(r.rows) + len(r.pending))}
+	for _, rows := range [][]string{r.rows, r.pending} {
+		for _, row := range rows {
+			stats.Size += int64(len(row))
+		}
+	}
+
+	return stats
+}
@@ -1,32 +1,124 @@
 package writer
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"github.com/streamingfast/dstore"
+	"hash"
 	"io"
+	"os"
+
+	"github.com/streamingfast/dstore"
 )
 
+// dataFile is a file held in memory, it can be uploaded multiple times so that
+// failed uploads can be retried.
 type dataFile struct {
-	reader         io.Reader
+	data           []byte
 	outputFilename string
+	rows           int64
 }
 
-func (d *dataFile) Upload(ctx context.Context, store dstore.Store) (string, error) {
-	if err := store.WriteObject(ctx, d.outputFilename, d.reader); err != nil {
-		return "", fmt.Errorf("write object: %w", err)
+func (d *dataFile) Upload(ctx context.Context, store dstore.Store) ([]UploadedFile, error) {
+	stats := newUploadStats()
+	if err := store.WriteObject(ctx, d.outputFilename, io.TeeReader(bytes.NewReader(d.data), stats)); err != nil {
+		return nil, fmt.Errorf("write object: %w", err)
 	}
-	return store.ObjectPath(d.outputFilename), nil
+	return []UploadedFile{stats.uploadedFile(d.outputFilename, "", d.rows)}, nil
 }
 
+// localFile is a file of the working directory, it's kept once uploaded so that failed
+// uploads can be retried, Discard removing it once it's not needed anymore.
 type localFile struct {
 	localFilePath  string
 	outputFilename string
+	rows           int64
+}
+
+func (l *localFile) Upload(ctx context.Context, store dstore.Store) ([]UploadedFile, error) {
+	// This is the same as `store.PushLocalFile` but we need to see the data
+	// going through to compute the file's statistics.
+	f, err := os.Open(l.localFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	stats := newUploadStats()
+	if err := store.WriteObject(ctx, l.outputFilename, io.TeeReader(f, stats)); err != nil {
+		return nil, fmt.Errorf("pushing  object: %w", err)
+	}
+
+	return []UploadedFile{stats.uploadedFile(l.outputFilename, "", l.rows)}, nil
+}
+
+// Discard removes the local file, once uploaded or when it's not uploaded at all.
+func (l *localFile) Discard() error {
+	if err := os.Remove(l.localFilePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove local file: %w", err)
+	}
+
+	return nil
+}
+
+// copyObject writes the content of the given object of the store to w.
+func copyObject(ctx context.Context, store dstore.Store, filename string, w io.Writer) error {
+	return copyObjectAfter(ctx, store, filename, nil, w)
+}
+
+// copyObjectAfter writes the content of the given object of the store to w, except for
+// the prefix it must start with.
+func copyObjectAfter(ctx context.Context, store dstore.Store, filename string, prefix []byte, w io.Writer) error {
+	reader, err := store.OpenObject(ctx, filename)
+	if err != nil {
+		return fmt.Errorf("open object: %w", err)
+	}
+	defer reader.Close()
+
+	if len(prefix) > 0 {
+		start := make([]byte, len(prefix))
+		if _, err := io.ReadFull(reader, start); err != nil {
+			return fmt.Errorf("read object start: %w", err)
+		}
+
+		if !bytes.Equal(start, prefix) {
+			return fmt.Errorf("object does not start with the expected %d bytes", len(prefix))
+		}
+	}
+
+	if _, err := io.Copy(w, reader); err != nil {
+		return fmt.Errorf("read object: %w", err)
+	}
+
+	return nil
+}
+
+// uploadStats is an io.Writer that computes the size and SHA-256 checksum of the
+// data written to it, meant to be used with an io.TeeReader.
+type uploadStats struct {
+	hash hash.Hash
+	size int64
+}
+
+func newUploadStats() *uploadStats {
+	return &uploadStats{hash: sha256.New()}
+}
+
+func (s *uploadStats) Write(p []byte) (n int, err error) {
+	s.hash.Write(p)
+	s.size += int64(len(p))
+
+	return len(p), nil
 }
 
-func (l *localFile) Upload(ctx context.Context, store dstore.Store) (string, error) {
-	if err := store.PushLocalFile(ctx, l.localFilePath, l.outputFilename); err != nil {
-		return "", fmt.Errorf("pushing  object: %w", err)
+func (s *uploadStats) uploadedFile(filename string, table string, rows int64) UploadedFile {
+	return UploadedFile{
+		Filename: filename,
+		Table:    table,
+		Size:     s.size,
+		Rows:     rows,
+		SHA256:   hex.EncodeToString(s.hash.Sum(nil)),
 	}
-	return store.ObjectPath(l.outputFilename), nil
 }
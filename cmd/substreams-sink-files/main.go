@@ -10,6 +10,7 @@ import (
 	"github.com/streamingfast/cli/sflags"
 	"github.com/streamingfast/dmetrics"
 	"github.com/streamingfast/logging"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler"
 	"go.uber.org/zap"
 )
 
@@ -54,6 +55,7 @@ func preStart(cmd *cobra.Command, _ []string) {
 
 	if v := sflags.MustGetString(cmd, "metrics-listen-addr"); v != "" {
 		zlog.Info("starting prometheus metrics server", zap.String("listen_addr", v))
+		bundler.RegisterMetrics()
 		go dmetrics.Serve(v)
 	}
 
@@ -2,13 +2,18 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/cenkalti/backoff/v4"
+	"github.com/parquet-go/parquet-go"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"github.com/streamingfast/bstream"
 	"github.com/streamingfast/cli"
 	. "github.com/streamingfast/cli"
 	"github.com/streamingfast/cli/sflags"
@@ -16,9 +21,13 @@ import (
 	substreamsfile "github.com/streamingfast/substreams-sink-files/v2"
 	"github.com/streamingfast/substreams-sink-files/v2/bundler"
 	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/streamingfast/substreams-sink-files/v2/delta"
 	"github.com/streamingfast/substreams-sink-files/v2/encoder"
+	"github.com/streamingfast/substreams-sink-files/v2/iceberg"
+	"github.com/streamingfast/substreams-sink-files/v2/lease"
 	"github.com/streamingfast/substreams-sink-files/v2/protox"
 	"github.com/streamingfast/substreams-sink-files/v2/state"
+	"github.com/streamingfast/substreams-sink-files/v2/status"
 	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
 	sink "github.com/streamingfast/substreams/sink"
 	"go.uber.org/zap"
@@ -32,15 +41,137 @@ var SyncRunCmd = Command(syncRunE,
 	Flags(func(flags *pflag.FlagSet) {
 		sink.AddFlagsToSet(flags)
 
-		flags.StringP("output-dir", "o", "./output", FlagMultiLineDescription(`
+		flags.StringSliceP("output-dir", "o", []string{"./output"}, FlagMultiLineDescription(`
 			Output store where to write files, supports gs://, s3://, file:// and local paths,
 			see https://github.com/streamingfast/dstore?tab=readme-ov-file#features for supported syntax.
+
+			Multiple destinations can be given, comma separated or by repeating the flag, for example
+			'--output-dir=gs://lake/output,file:///mnt/nas/output'. Files are written to the first destination and then
+			copied to the other ones, a boundary being committed only once copied to all of them. Destinations prefixed
+			with 'optional:' (e.g. 'optional:file:///mnt/nas/output') are copied to in the background and can lag behind
+			without blocking the sink. The first destination holds the lease, the staging area of '--atomic-publish' and
+			head files, it cannot be optional.
+		`))
+		flags.String("state-store", "./state.yaml", FlagMultiLineDescription(`
+			Output path where to store latest received cursor, supports local paths as well as gs://, s3://, az:// and file:// URLs
+			pointing to the state file, for example 's3://bucket/output/state.yaml' to keep the cursor right next to the output files.
 		`))
-		flags.String("state-store", "./state.yaml", "Output path where to store latest received cursor, if empty, cursor will not be persisted")
 		flags.String("file-working-dir", "./localdata/working", "Working store where we accumulate data")
+		flags.Duration("checkpoint-interval", 0, FlagMultiLineDescription(`
+			If set, the active boundary is checkpointed to '<file-working-dir>/checkpoint' at most once per interval so that,
+			after a crash, the sink resumes from the last checkpoint instead of re-processing the boundary from its start block.
+			Checkpoints are local, so the working directory must be kept across restarts for them to be used. Disabled when 0.
+		`))
+		flags.String("startup-reconcile", "off", FlagMultiLineDescription(`
+			What to do when, at startup, the boundaries found in the output store are not consistent with the cursor of the
+			state: gaps before the cursor, orphan files overlapping other boundaries or boundaries past the cursor. Accepted
+			values are 'off' (no check), 'warn' (log and start anyway), 'fail' (refuse to start) and 'repair' which rewinds
+			the state before the first gap or orphan file and deletes the files after it so they are written again. Rewinding
+			the state uses the cursor of boundary manifests, see '--boundary-manifest'. Cannot be used with
+			'--empty-boundary=skip', use '--empty-boundary=marker' so that empty boundaries are not reported as gaps.
+		`))
+		flags.Duration("lease-ttl", 0, FlagMultiLineDescription(`
+			If set, the sink takes a lease, a '_lease.json' object in the output store, before writing anything and renews it
+			every third of this duration so that a second process pointing to the same output fails fast instead of overwriting
+			files and state. A lease not renewed for this duration, because its owner crashed, expires and can be taken over.
+			With '--parallel-segments', each segment takes its own '_lease.<start>-<end>.json' lease. Disabled when 0.
+		`))
+		flags.Bool("lease-wait", false, "If set, waits for the lease to be released or to expire instead of failing when it's held by another process, see '--lease-ttl'")
+		flags.String("status-listen-addr", "", FlagMultiLineDescription(`
+			If set, serves the progress of the sink as JSON on '/status' at this address, along with '/healthz' (liveness) and
+			'/readyz' (readiness) endpoints suitable for Kubernetes probes. Readiness fails when no block was received for
+			'--status-stall-timeout' or when the last upload attempt failed, liveness fails once the sink terminated with an error.
+		`))
+		flags.Duration("status-stall-timeout", 5*time.Minute, "Duration without receiving any block after which the stream is considered stalled and '/readyz' fails, see '--status-listen-addr'")
+		flags.Int("upload-concurrency", bundler.DefaultUploadConcurrency, FlagMultiLineDescription(`
+			Number of boundaries uploaded in parallel to the output store, for the 'parquet', 'avro' and 'arrow' encoders this is
+			also the number of table files of a boundary uploaded in parallel.
+		`))
+		flags.Int("upload-queue-size", bundler.DefaultUploadQueueSize, FlagMultiLineDescription(`
+			Number of closed boundaries that can wait for an upload slot, once reached block processing is paused until uploads
+			catch up which bounds the memory held by boundaries kept in memory (see '--buffer-max-size').
+		`))
+		flags.Uint64("upload-retries", bundler.DefaultUploadRetries, FlagMultiLineDescription(`
+			Number of times a failed upload is retried before the sink stops, retries are delayed by an exponential backoff
+			with jitter starting at '--upload-retry-backoff' and capped at 30s.
+		`))
+		flags.Duration("upload-retry-backoff", bundler.DefaultUploadBackoff, "Initial delay before retrying a failed upload, see '--upload-retries'")
+		flags.Int("parallel-segments", 1, FlagMultiLineDescription(`
+			Number of segments the block range is split into to be processed concurrently, each segment running its own
+			Substreams stream. Segments are aligned on '--file-block-count' boundaries and each keeps its progress in its
+			own state file, named after '--state-store' with the segment's range inserted before the extension (for example
+			'state.0000000000-0000100000.yaml'). Segments already completed are not processed again on restart. Requires
+			a '--stop-block' aligned on '--file-block-count' and cannot be used with '--file-boundary'.
+		`))
 		flags.Uint64P("file-block-count", "c", 10000, "Number of blocks per file")
+		flags.String("file-boundary", "", FlagMultiLineDescription(`
+			If set, files are cut on time windows computed from the block's timestamp instead of every '--file-block-count' blocks.
+			Accepted values are 'hourly', 'daily' or any duration like '15m' or '6h', windows are aligned on UTC. Files are named
+			'<window_start>-<window_end>_<start>-<end>' where the window is formatted as '20060102T150405Z' and '<start>-<end>'
+			is the actual block range contained in the file. Time windows without any block produce no file.
+		`))
+		flags.Uint64("file-max-size", 0, FlagMultiLineDescription(`
+			If set, a boundary is closed early once the data accumulated for it reaches this amount of bytes, the remaining
+			blocks of the boundary are written to the next file so a boundary can span multiple files each covering a sub-range
+			of its blocks. For Parquet, the size is the estimated uncompressed size of the rows, actual files are smaller once
+			compressed. A boundary is only closed between blocks, so a file can exceed this size by the data of one block.
+		`))
+		flags.Uint64("file-max-rows", 0, FlagMultiLineDescription(`
+			If set, a boundary is closed early once the rows accumulated for it reach this count (rows of all tables for Parquet,
+			lines for line based outputs), the remaining blocks of the boundary are written to the next file.
+		`))
+		flags.String("empty-boundary", "write", FlagMultiLineDescription(`
+			What to do with boundaries holding no data at all, which are common with sparse modules. Accepted values are 'write'
+			(write empty files like any other boundary), 'skip' (write nothing, only the state is saved) and 'marker' (write a
+			'<start>-<end>.empty' object instead of the boundary's files). With 'skip' and 'marker', consecutive boundaries
+			without any block are collapsed into a single one so that jumping over a large block range does not queue one
+			upload per boundary, a single marker covering the whole range is written with 'marker'. 'skip' cannot be used
+			with '--startup-reconcile'.
+		`))
+		flags.Duration("max-boundary-age", 0, FlagMultiLineDescription(`
+			If set, once the active boundary is older than this duration, the data accumulated so far is written as a head
+			file under the '_head/' folder of the output store, covering only the blocks seen so far, so that consumers see
+			fresh data when following the chain head. Once the boundary completes, its head files are compacted into the
+			boundary's files and deleted. The data of head files is kept under '<file-working-dir>/head' until the boundary
+			completes so that head files holding blocks undone by a reorganization are written again. Cannot be used with
+			'--checkpoint-interval' or '--parallel-segments'. Disabled when 0.
+		`))
+		flags.String("output-path-template", "", FlagMultiLineDescription(`
+			If set, the path of each output file relative to '--output-dir' is rendered from this template instead of the default
+			'[<table>/]<start>-<end>.<ext>' layout, for example '{table}/chain={network}/date={block_date}/{start}-{end}.parquet'
+			to produce Hive-style partitions. Accepted variables are {table}, {network}, {module}, {name}, {start}, {end},
+			{block_date}, {block_hour} and {ext}, refer to the README for their definition. The template must contain {name} or
+			both {start} and {end} and, for the 'parquet' encoder, {table}.
+		`))
+		flags.Bool("boundary-manifest", false, FlagMultiLineDescription(`
+			If set, a '<start>-<end>.manifest.json' file is written to the output store once all files of a boundary have been
+			uploaded. It describes the boundary's block range, first and last block, cursor, module and every file written along
+			with its size, row count and SHA-256 checksum.
+		`))
+		flags.Bool("atomic-publish", false, FlagMultiLineDescription(`
+			If set, all files of a boundary are first uploaded under the '_staging/<start>-<end>/' folder of the output store,
+			then promoted to their final name and committed by writing a '_commits/<start>-<end>.json' marker. Readers relying
+			on commit markers never see a partially written boundary. On restart, staging data left over by a previous run is
+			either promoted, if it was fully staged, or deleted.
+		`))
+		flags.StringArray("post-upload-exec", nil, FlagMultiLineDescription(`
+			Command run through 'sh -c' once all files of a boundary are uploaded, it receives on its standard input a JSON
+			description of the boundary (its manifest along with the URL of its files). Can be repeated, hooks run in order.
+		`))
+		flags.StringArray("post-upload-webhook", nil, FlagMultiLineDescription(`
+			URL to which the JSON description of the boundary is POSTed once all its files are uploaded, any status other than
+			2xx is a failure. Can be repeated, hooks run in order after the '--post-upload-exec' ones.
+		`))
+		flags.String("post-upload-hook-policy", "retry", FlagMultiLineDescription(`
+			What to do when a post-upload hook fails. Accepted values are 'block' (retry until it succeeds, blocking the commit
+			of following boundaries), 'retry' (retry '--post-upload-hook-retries' times then stop the sink, the boundary being
+			processed again on restart) and 'log' (retry '--post-upload-hook-retries' times then log the failure and continue).
+		`))
+		flags.Uint64("post-upload-hook-retries", 3, "Number of times a failed post-upload hook is retried, with an exponential backoff, see '--post-upload-hook-policy'")
+		flags.Duration("post-upload-hook-timeout", time.Minute, "Maximum duration of each post-upload hook attempt")
 		flags.String("encoder", "parquet", FlagMultiLineDescription(`
-			Sets which encoder to use to parse the Substreams Output Module data. Options are: 'parquet', 'lines', 'protojson:<jq like expression>'
+			Sets which encoder to use to parse the Substreams Output Module data. Options are: 'parquet', 'avro', 'arrow', 'lines', 'protojson:<jq like expression>',
+			'protocsv:<jq like expression>'
 
 			## Parquet
 
@@ -48,6 +179,17 @@ var SyncRunCmd = Command(syncRunE,
 			Refer to project readme at https://github.com/streamingfast/substreams-sink-files/blob/master/README.md for details
 			about how Parquet encoder works to transform Protobuf messages into Parquet "rows/columns".
 
+			## Avro
+
+			When using 'avro', tables are found in the output module's message the same way as for 'parquet' and the rows of each
+			table are written to an Avro object container file, '<table>/<start>-<end>.avro', embedding the Avro schema derived
+			from the table's Protobuf message. See '--avro-codec'.
+
+			## Arrow
+
+			When using 'arrow', tables are found in the output module's message the same way as for 'parquet' and the rows of each
+			table are written as Arrow record batches to an Arrow IPC file, '<table>/<start>-<end>.arrow'. See '--arrow-compression'.
+
 			## Lines
 
 			When using 'lines', the output module must be a 'sf.substreams.sink.files.v1.Lines', which is essentially a list of strings,
@@ -93,6 +235,36 @@ var SyncRunCmd = Command(syncRunE,
 			  {"id": 2, "name": "two"}
 
 			This mode is a little bit less performant that the 'lines' encoder, as the JSON encoding is done on the fly.
+
+			## 'protocsv:<jq like expression>'
+
+			When using 'protocsv:<jq like expression>', rows are extracted the same way as 'protojson' but written as CSV lines, with
+			a header line at the start of each file. Columns are derived from the row message, fields of nested messages are flattened
+			with dotted names (e.g. 'token.symbol') while repeated and map fields are written as JSON. See '--csv-delimiter'.
+		`))
+		flags.String("csv-delimiter", ",", FlagMultiLineDescription(`
+			Delimiter of the columns written by the 'protocsv' encoder, a single character. Use 'tab' (or '\t') to produce TSV
+			files, named with the '.tsv' extension instead of '.csv'.
+		`))
+		flags.String("avro-codec", "deflate", FlagMultiLineDescription(`
+			Codec compressing the blocks of the container files written by the 'avro' encoder. Accepted values are 'null' (no
+			compression), 'deflate', 'snappy' and 'zstd'.
+		`))
+		flags.String("arrow-compression", "lz4", FlagMultiLineDescription(`
+			Compression of the record batches' buffers in the IPC files written by the 'arrow' encoder. Accepted values are 'none',
+			'lz4' and 'zstd'.
+		`))
+		flags.String("table-format", "none", FlagMultiLineDescription(`
+			Table format the files of the 'parquet' encoder are committed to once a boundary is uploaded, accepted values are 'none',
+			'delta' and 'iceberg'. Each table folder, the path up to the '{table}' folder, is a table whose files are the ones under
+			it, 'key=value' folders following the table folder being the files' partition values. With 'delta', the table's
+			'_delta_log/' transaction log receives a commit adding the boundary's files, see '--delta-checkpoint-interval'. With
+			'iceberg', a new snapshot adding the boundary's files is written to the table's 'metadata/' folder, tables being found
+			through their 'metadata/version-hint.text' file like with Iceberg's Hadoop catalog.
+		`))
+		flags.Uint64("delta-checkpoint-interval", 10, FlagMultiLineDescription(`
+			Number of commits of a Delta table between checkpoints of its transaction log, a checkpoint holding the state of the
+			table so that readers don't have to replay every commit. Use 0 to disable checkpoints.
 		`))
 		flags.Uint64("buffer-max-size", 64*1024*1024, FlagMultiLineDescription(`
 			Amount of memory bytes to allocate to the buffered writer. If your data set is small enough that every is hold in memory, we are going to avoid
@@ -105,6 +277,17 @@ var SyncRunCmd = Command(syncRunE,
 
 			Default value for the buffer is 64 MiB.
 		`))
+		flags.String("compression", "none", FlagMultiLineDescription(`
+			Compression applied while writing files of the 'lines', 'proto', 'protojson' and 'protocsv' encoders. Accepted values are 'none',
+			'gzip', 'zstd' and 'lz4'. The data is compressed as it's written, so '--buffer-max-size' holds compressed data and the
+			files are named with the compression extension appended, for example '0000000000-0000001000.jsonl.zst'.
+
+			With 'gzip' and 'zstd', the data of each block is compressed in its own frame so that blocks undone by a chain reorganization
+			can be reverted, files being compressed as a single stream when no block can be undone, with an '--undo-buffer-size'
+			greater than 0 or '--final-blocks-only'. 'lz4' frames cannot be concatenated, it requires an '--undo-buffer-size' greater than 0 or '--final-blocks-only'.
+			For the 'parquet' encoder, see '--parquet-default-column-compression', for the 'avro' encoder, see '--avro-codec' and for the
+			'arrow' encoder, see '--arrow-compression'.
+		`))
 
 		addCommonParquetFlags(flags)
 	}),
@@ -136,20 +319,80 @@ func syncRunE(cmd *cobra.Command, args []string) error {
 		outputModuleName = args[1]
 	}
 
-	fileOutputPath := sflags.MustGetString(cmd, "output-dir")
+	fileOutputPaths := sflags.MustGetStringSlice(cmd, "output-dir")
 	fileWorkingDir := sflags.MustGetString(cmd, "file-working-dir")
 	stateStorePath := sflags.MustGetString(cmd, "state-store")
 	blocksPerFile := sflags.MustGetUint64(cmd, "file-block-count")
+	fileBoundary := sflags.MustGetString(cmd, "file-boundary")
+	fileMaxSize := sflags.MustGetUint64(cmd, "file-max-size")
+	fileMaxRows := sflags.MustGetUint64(cmd, "file-max-rows")
+	emptyBoundary := sflags.MustGetString(cmd, "empty-boundary")
+	maxBoundaryAge := sflags.MustGetDuration(cmd, "max-boundary-age")
+	outputPathTemplate := sflags.MustGetString(cmd, "output-path-template")
 	bufferMaxSize := sflags.MustGetUint64(cmd, "buffer-max-size")
+	compressionName := sflags.MustGetString(cmd, "compression")
 	encoderType := sflags.MustGetString(cmd, "encoder")
+	csvDelimiter := sflags.MustGetString(cmd, "csv-delimiter")
+	avroCodecName := sflags.MustGetString(cmd, "avro-codec")
+	arrowCompressionName := sflags.MustGetString(cmd, "arrow-compression")
+	tableFormat := sflags.MustGetString(cmd, "table-format")
+	deltaCheckpointInterval := sflags.MustGetUint64(cmd, "delta-checkpoint-interval")
+	boundaryManifest := sflags.MustGetBool(cmd, "boundary-manifest")
+	atomicPublish := sflags.MustGetBool(cmd, "atomic-publish")
+	parallelSegments := sflags.MustGetInt(cmd, "parallel-segments")
+	checkpointInterval := sflags.MustGetDuration(cmd, "checkpoint-interval")
+	startupReconcile := sflags.MustGetString(cmd, "startup-reconcile")
+	leaseTTL := sflags.MustGetDuration(cmd, "lease-ttl")
+	leaseWait := sflags.MustGetBool(cmd, "lease-wait")
+	postUploadExec := sflags.MustGetStringArray(cmd, "post-upload-exec")
+	postUploadWebhook := sflags.MustGetStringArray(cmd, "post-upload-webhook")
+	postUploadHookPolicy := sflags.MustGetString(cmd, "post-upload-hook-policy")
+	postUploadHookRetries := sflags.MustGetUint64(cmd, "post-upload-hook-retries")
+	postUploadHookTimeout := sflags.MustGetDuration(cmd, "post-upload-hook-timeout")
+	statusListenAddr := sflags.MustGetString(cmd, "status-listen-addr")
+	statusStallTimeout := sflags.MustGetDuration(cmd, "status-stall-timeout")
+	uploadConcurrency := sflags.MustGetInt(cmd, "upload-concurrency")
+	uploadQueueSize := sflags.MustGetInt(cmd, "upload-queue-size")
+	uploadRetries := sflags.MustGetUint64(cmd, "upload-retries")
+	uploadRetryBackoff := sflags.MustGetDuration(cmd, "upload-retry-backoff")
 
 	zlog.Info("sink to files",
-		zap.String("file_output_path", fileOutputPath),
+		zap.Strings("file_output_paths", fileOutputPaths),
 		zap.String("file_working_dir", fileWorkingDir),
 		zap.String("encoder_type", encoderType),
+		zap.String("csv_delimiter", csvDelimiter),
+		zap.String("avro_codec", avroCodecName),
+		zap.String("arrow_compression", arrowCompressionName),
+		zap.String("table_format", tableFormat),
+		zap.Uint64("delta_checkpoint_interval", deltaCheckpointInterval),
 		zap.String("state_store", stateStorePath),
 		zap.Uint64("blocks_per_file", blocksPerFile),
+		zap.String("file_boundary", fileBoundary),
+		zap.Uint64("file_max_size", fileMaxSize),
+		zap.Uint64("file_max_rows", fileMaxRows),
+		zap.String("empty_boundary", emptyBoundary),
+		zap.Duration("max_boundary_age", maxBoundaryAge),
+		zap.String("output_path_template", outputPathTemplate),
 		zap.Uint64("buffer_max_size", bufferMaxSize),
+		zap.String("compression", compressionName),
+		zap.Bool("boundary_manifest", boundaryManifest),
+		zap.Bool("atomic_publish", atomicPublish),
+		zap.Int("parallel_segments", parallelSegments),
+		zap.Duration("checkpoint_interval", checkpointInterval),
+		zap.String("startup_reconcile", startupReconcile),
+		zap.Duration("lease_ttl", leaseTTL),
+		zap.Bool("lease_wait", leaseWait),
+		zap.Strings("post_upload_exec", postUploadExec),
+		zap.Strings("post_upload_webhook", postUploadWebhook),
+		zap.String("post_upload_hook_policy", postUploadHookPolicy),
+		zap.Uint64("post_upload_hook_retries", postUploadHookRetries),
+		zap.Duration("post_upload_hook_timeout", postUploadHookTimeout),
+		zap.String("status_listen_addr", statusListenAddr),
+		zap.Duration("status_stall_timeout", statusStallTimeout),
+		zap.Int("upload_concurrency", uploadConcurrency),
+		zap.Int("upload_queue_size", uploadQueueSize),
+		zap.Uint64("upload_retries", uploadRetries),
+		zap.Duration("upload_retry_backoff", uploadRetryBackoff),
 	)
 
 	sinker, err := sink.NewFromViper(cmd,
@@ -163,75 +406,350 @@ func syncRunE(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("new sinker: %w", err)
 	}
 
-	if blockRange := sinker.BlockRange(); blockRange.EndBlock() != nil {
-		size, err := sinker.BlockRange().Size()
+	reconcilePolicy, err := bundler.ParseReconcilePolicy(startupReconcile)
+	if err != nil {
+		return fmt.Errorf("invalid --startup-reconcile: %w", err)
+	}
+
+	emptyBoundaryPolicy, err := bundler.ParseEmptyBoundaryPolicy(emptyBoundary)
+	if err != nil {
+		return fmt.Errorf("invalid --empty-boundary: %w", err)
+	}
+
+	hookPolicy, err := bundler.ParseHookFailurePolicy(postUploadHookPolicy)
+	if err != nil {
+		return fmt.Errorf("invalid --post-upload-hook-policy: %w", err)
+	}
+
+	delimiter, err := parseCSVDelimiter(csvDelimiter)
+	if err != nil {
+		return fmt.Errorf("invalid --csv-delimiter: %w", err)
+	}
+
+	compression, err := writer.ParseCompression(compressionName)
+	if err != nil {
+		return fmt.Errorf("invalid --compression: %w", err)
+	}
+
+	avroCodec, err := writer.ParseAvroCodec(avroCodecName)
+	if err != nil {
+		return fmt.Errorf("invalid --avro-codec: %w", err)
+	}
+
+	arrowCompression, err := writer.ParseArrowCompression(arrowCompressionName)
+	if err != nil {
+		return fmt.Errorf("invalid --arrow-compression: %w", err)
+	}
+
+	var timeWindowSize time.Duration
+	if fileBoundary != "" {
+		timeWindowSize, err = bundler.ParseFileBoundary(fileBoundary)
 		if err != nil {
-			panic(fmt.Errorf("size should error only on open ended range, which we should have caught earlier: %w", err))
+			return fmt.Errorf("invalid --file-boundary: %w", err)
 		}
-
-		cli.Ensure(size >= blocksPerFile, "You requested %d blocks per file but your block range spans only %d blocks, this would produce 0 file, refusing to start", blocksPerFile, size)
 	}
 
+	cli.Ensure(len(fileOutputPaths) > 0, "--output-dir must contain at least one destination")
+
+	fileOutputPath, required := bundler.ParseDestination(fileOutputPaths[0])
+	cli.Ensure(required, "--output-dir first destination %q cannot be optional, it's the one files are written to first", fileOutputPaths[0])
+
 	fileOutputStore, err := dstore.NewStore(fileOutputPath, "", "", false)
 	if err != nil {
 		return fmt.Errorf("new store %q: %w", fileOutputPath, err)
 	}
 
-	stateFileDirectory := filepath.Dir(stateStorePath)
-	if err := os.MkdirAll(stateFileDirectory, os.ModePerm); err != nil {
-		return fmt.Errorf("create state file directories: %w", err)
+	// Objects updated in place, the lease on each renewal and the journals of the copies
+	// pending for optional replicas, are written through a store overwriting objects
+	overwriteStore, err := dstore.NewStore(fileOutputPath, "", "", true)
+	if err != nil {
+		return fmt.Errorf("new overwrite store %q: %w", fileOutputPath, err)
 	}
 
-	stateStore, err := state.NewFileStateStore(stateStorePath)
-	if err != nil {
-		return fmt.Errorf("new file state store: %w", err)
+	var replicas []bundler.Replica
+	for _, destination := range fileOutputPaths[1:] {
+		replicaPath, required := bundler.ParseDestination(destination)
+		// Objects updated in place in the output store, like table metadata, are copied over
+		replicaStore, err := dstore.NewStore(replicaPath, "", "", true)
+		if err != nil {
+			return fmt.Errorf("new replica store %q: %w", replicaPath, err)
+		}
+
+		replicas = append(replicas, bundler.Replica{Store: replicaStore, Required: required})
 	}
 
-	var boundaryWriter writer.Writer
-	var sinkEncoder encoder.Encoder
+	cli.Ensure(uploadConcurrency > 0, "--upload-concurrency must be greater than 0")
+	cli.Ensure(uploadQueueSize > 0, "--upload-queue-size must be greater than 0")
+	cli.Ensure(maxBoundaryAge == 0 || checkpointInterval == 0, "--max-boundary-age cannot be used with --checkpoint-interval")
+	cli.Ensure(maxBoundaryAge == 0 || parallelSegments <= 1, "--max-boundary-age cannot be used with --parallel-segments")
+	cli.Ensure(maxBoundaryAge == 0 || !strings.HasPrefix(encoderType, "protocsv:") || compression != writer.CompressionLZ4, "--max-boundary-age cannot be used with the 'protocsv' encoder and --compression=lz4, compacted head files would repeat the header line")
+	cli.Ensure(compression.Revertable() || sinker.UndoBufferSize > 0 || sinker.FinalBlocksOnly, "--compression=%s cannot revert data already compressed, it requires an --undo-buffer-size greater than 0 or --final-blocks-only, use 'gzip' or 'zstd' otherwise", compression)
+	cli.Ensure(compression == writer.CompressionNone || encoderType != "parquet", "--compression cannot be used with the 'parquet' encoder, use --parquet-default-column-compression instead")
+	cli.Ensure(compression == writer.CompressionNone || encoderType != "avro", "--compression cannot be used with the 'avro' encoder, use --avro-codec instead")
+	cli.Ensure(compression == writer.CompressionNone || encoderType != "arrow", "--compression cannot be used with the 'arrow' encoder, use --arrow-compression instead")
+	cli.Ensure(tableFormat == "none" || tableFormat == "delta" || tableFormat == "iceberg", "--table-format must be one of 'none', 'delta' or 'iceberg', got %q", tableFormat)
+	cli.Ensure(tableFormat == "none" || encoderType == "parquet", "--table-format requires the 'parquet' encoder")
+
+	bundlerOptions := []bundler.Option{
+		bundler.WithUploadConcurrency(uploadConcurrency),
+		bundler.WithUploadQueueSize(uploadQueueSize),
+		bundler.WithUploadRetry(uploadRetries, uploadRetryBackoff),
+		bundler.WithEmptyBoundaryPolicy(emptyBoundaryPolicy),
+	}
+	if boundaryManifest {
+		bundlerOptions = append(bundlerOptions, bundler.WithManifest(sinker.OutputModuleName(), sinker.OutputModuleHash()))
+	}
+	if atomicPublish {
+		bundlerOptions = append(bundlerOptions, bundler.WithAtomicPublish())
+	}
+	if timeWindowSize > 0 {
+		bundlerOptions = append(bundlerOptions, bundler.WithTimeWindow(timeWindowSize))
+	}
+	if fileMaxSize > 0 {
+		bundlerOptions = append(bundlerOptions, bundler.WithMaxFileSize(fileMaxSize))
+	}
+	if fileMaxRows > 0 {
+		bundlerOptions = append(bundlerOptions, bundler.WithMaxFileRows(fileMaxRows))
+	}
+	if maxBoundaryAge > 0 {
+		bundlerOptions = append(bundlerOptions, bundler.WithMaxBoundaryAge(maxBoundaryAge, filepath.Join(fileWorkingDir, "head")))
+	}
+	if len(replicas) > 0 {
+		bundlerOptions = append(bundlerOptions, bundler.WithReplicas(overwriteStore, replicas...))
+	}
+	if len(postUploadExec) > 0 || len(postUploadWebhook) > 0 {
+		var hooks []bundler.Hook
+		for _, command := range postUploadExec {
+			hooks = append(hooks, bundler.NewExecHook(command, zlog))
+		}
+		for _, url := range postUploadWebhook {
+			hooks = append(hooks, bundler.NewWebhookHook(url))
+		}
 
-	switch {
-	case encoderType == "lines" || strings.HasPrefix(encoderType, "proto:") || strings.HasPrefix(encoderType, "protojson:"):
-		boundaryWriter = writer.NewBufferedIO(bufferMaxSize, fileWorkingDir, writer.FileTypeJSONL, zlog)
-		sinkEncoder, err = getEncoder(encoderType, sinker)
+		bundlerOptions = append(bundlerOptions, bundler.WithPostUploadHooks(sinker.OutputModuleName(), sinker.OutputModuleHash(), hookPolicy, postUploadHookRetries, postUploadHookTimeout, hooks...))
+	}
+	if outputPathTemplate != "" {
+		pathTemplate, err := bundler.NewPathTemplate(outputPathTemplate, sinker.Package().GetNetwork(), sinker.OutputModuleName())
 		if err != nil {
-			return fmt.Errorf("failed to create encoder: %w", err)
+			return fmt.Errorf("invalid --output-path-template: %w", err)
 		}
 
-	case encoderType == "parquet":
-		flagValues := readCommonParquetFlags(cmd)
+		if reconcilePolicy != bundler.ReconcileOff && !pathTemplate.HasVariable("name") && !strings.Contains(outputPathTemplate, "{start}-{end}") {
+			return fmt.Errorf("invalid --output-path-template: template %q must contain {name} or '{start}-{end}' for --startup-reconcile to find the block range of files", outputPathTemplate)
+		}
 
-		msgDesc, err := outputMessageDescriptor(sinker)
-		if err != nil {
-			return fmt.Errorf("output module message descriptor: %w", err)
+		if (encoderType == "parquet" || encoderType == "avro" || encoderType == "arrow") && !pathTemplate.HasVariable("table") {
+			return fmt.Errorf("invalid --output-path-template: template %q must contain {table} when using %q encoder as one file is produced per table", outputPathTemplate, encoderType)
+		}
+
+		if tableFormat != "none" && !slices.Contains(strings.Split(path.Dir(outputPathTemplate), "/"), "{table}") {
+			return fmt.Errorf("invalid --output-path-template: template %q must have a {table} folder when using --table-format, the table's files being under it", outputPathTemplate)
+		}
+
+		bundlerOptions = append(bundlerOptions, bundler.WithPathTemplate(pathTemplate))
+	}
+
+	checkpointDir := filepath.Join(fileWorkingDir, "checkpoint")
+
+	// Shared by the bundlers of all segments so that commits to a table are serialized
+	var tableCommitter bundler.TableCommitter
+
+	bufferedOptions := []writer.BufferedIOOption{writer.BufferedCompression(compression)}
+	if sinker.UndoBufferSize > 0 || sinker.FinalBlocksOnly {
+		bufferedOptions = append(bufferedOptions, writer.BufferedIrreversible())
+	}
+
+	newFileSinker := func(sinker *sink.Sinker, stateStore state.Store, checkpointDir string, leaseFilename string, logger *zap.Logger) (*substreamsfile.FileSinker, error) {
+		var boundaryWriter writer.Writer
+		var sinkEncoder encoder.Encoder
+		var err error
+
+		switch {
+		case encoderType == "lines" || strings.HasPrefix(encoderType, "proto:") || strings.HasPrefix(encoderType, "protojson:"):
+			boundaryWriter = writer.NewBufferedIO(bufferMaxSize, fileWorkingDir, writer.FileTypeJSONL, logger, bufferedOptions...)
+			sinkEncoder, err = getEncoder(encoderType, sinker)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create encoder: %w", err)
+			}
+
+		case strings.HasPrefix(encoderType, "protocsv:"):
+			msgDesc, err := outputMessageDescriptor(sinker)
+			if err != nil {
+				return nil, fmt.Errorf("output message descriptor: %w", err)
+			}
+
+			csvEncoder, err := encoder.NewProtoToCSV(strings.TrimPrefix(encoderType, "protocsv:"), msgDesc, delimiter)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create encoder: %w", err)
+			}
+			sinkEncoder = csvEncoder
+
+			fileType := writer.FileTypeCSV
+			if delimiter == '\t' {
+				fileType = writer.FileTypeTSV
+			}
+			boundaryWriter = writer.NewBufferedIO(bufferMaxSize, fileWorkingDir, fileType, logger, append(bufferedOptions, writer.BufferedHeader(csvEncoder.HeaderLine()))...)
+
+		case encoderType == "parquet":
+			flagValues := readCommonParquetFlags(cmd)
+
+			msgDesc, err := outputMessageDescriptor(sinker)
+			if err != nil {
+				return nil, fmt.Errorf("output module message descriptor: %w", err)
+			}
+
+			parquetOptions := append(flagValues.AsParquetWriterOptions(), writer.ParquetUploadConcurrency(uploadConcurrency))
+			parquetWriter, err := writer.NewParquetWriter(msgDesc, logger, tracer, parquetOptions...)
+			if err != nil {
+				return nil, fmt.Errorf("new parquet writer: %w", err)
+			}
+
+			if tableFormat == "delta" && tableCommitter == nil {
+				schemas := make([]*parquet.Schema, 0, len(parquetWriter.Tables()))
+				for _, table := range parquetWriter.Tables() {
+					schemas = append(schemas, table.Schema)
+				}
+
+				tableCommitter = delta.NewCommitter(schemas, deltaCheckpointInterval, overwriteStore, zlog)
+			}
+
+			if tableFormat == "iceberg" && tableCommitter == nil {
+				tableCommitter = iceberg.NewCommitter(parquetWriter.Tables(), overwriteStore)
+			}
+
+			boundaryWriter = parquetWriter
+			sinkEncoder = encoder.EncoderFunc(func(output *pbsubstreamsrpc.MapModuleOutput, _ writer.Writer) error {
+				return parquetWriter.EncodeMapModule(output)
+			})
+
+		case encoderType == "avro":
+			msgDesc, err := outputMessageDescriptor(sinker)
+			if err != nil {
+				return nil, fmt.Errorf("output module message descriptor: %w", err)
+			}
+
+			avroWriter, err := writer.NewAvroWriter(msgDesc, logger, tracer, writer.AvroBlockCodec(avroCodec), writer.TableUploadConcurrency(uploadConcurrency))
+			if err != nil {
+				return nil, fmt.Errorf("new avro writer: %w", err)
+			}
+
+			boundaryWriter = avroWriter
+			sinkEncoder = encoder.EncoderFunc(func(output *pbsubstreamsrpc.MapModuleOutput, _ writer.Writer) error {
+				return avroWriter.EncodeMapModule(output)
+			})
+
+		case encoderType == "arrow":
+			msgDesc, err := outputMessageDescriptor(sinker)
+			if err != nil {
+				return nil, fmt.Errorf("output module message descriptor: %w", err)
+			}
+
+			arrowWriter, err := writer.NewArrowWriter(msgDesc, logger, tracer, writer.ArrowBufferCompression(arrowCompression), writer.TableUploadConcurrency(uploadConcurrency))
+			if err != nil {
+				return nil, fmt.Errorf("new arrow writer: %w", err)
+			}
+
+			boundaryWriter = arrowWriter
+			sinkEncoder = encoder.EncoderFunc(func(output *pbsubstreamsrpc.MapModuleOutput, _ writer.Writer) error {
+				return arrowWriter.EncodeMapModule(output)
+			})
+
+		default:
+			return nil, fmt.Errorf("unknown encoder type %q", encoderType)
+		}
+
+		options := slices.Clone(bundlerOptions)
+		if tableCommitter != nil {
+			options = append(options, bundler.WithTableCommitters(tableCommitter))
+		}
+		if checkpointInterval > 0 {
+			options = append(options, bundler.WithCheckpoint(checkpointInterval, checkpointDir))
+		}
+		if reconcilePolicy != bundler.ReconcileOff {
+			options = append(options, bundler.WithReconcile(reconcilePolicy, sinker.BlockRange()))
 		}
 
-		parquetWriter, err := writer.NewParquetWriter(msgDesc, zlog, tracer, flagValues.AsParquetWriterOptions()...)
+		fileBundler, err := bundler.New(
+			blocksPerFile,
+			boundaryWriter,
+			stateStore,
+			fileOutputStore,
+			logger,
+			options...,
+		)
 		if err != nil {
-			return fmt.Errorf("new parquet writer: %w", err)
+			return nil, fmt.Errorf("new bundler: %w", err)
 		}
 
-		boundaryWriter = parquetWriter
-		sinkEncoder = encoder.EncoderFunc(func(output *pbsubstreamsrpc.MapModuleOutput, _ writer.Writer) error {
-			return parquetWriter.EncodeMapModule(output)
-		})
+		var fileSinkerOptions []substreamsfile.FileSinkerOption
+		if leaseTTL > 0 {
+			fileSinkerOptions = append(fileSinkerOptions, substreamsfile.WithLease(lease.New(overwriteStore, leaseFilename, leaseTTL, leaseWait, logger)))
+		}
 
-	default:
-		return fmt.Errorf("unknown encoder type %q", encoderType)
+		return substreamsfile.NewFileSinker(sinker, fileBundler, sinkEncoder, logger, tracer, fileSinkerOptions...), nil
 	}
 
-	bundler, err := bundler.New(
-		blocksPerFile,
-		boundaryWriter,
-		stateStore,
-		fileOutputStore,
-		zlog,
-	)
-	if err != nil {
-		return fmt.Errorf("new bundler: %w", err)
+	var statusSegments []status.Segment
+	if parallelSegments > 1 {
+		blockRange := sinker.BlockRange()
+		cli.Ensure(blockRange.EndBlock() != nil, "--parallel-segments requires a --stop-block to be set")
+		cli.Ensure(timeWindowSize == 0, "--parallel-segments cannot be used with --file-boundary")
+		cli.Ensure(*blockRange.EndBlock()%blocksPerFile == 0, "--parallel-segments requires --stop-block to be a multiple of --file-block-count (%d), got %d", blocksPerFile, *blockRange.EndBlock())
+
+		segments, err := substreamsfile.SplitSegments(blockRange, blocksPerFile, parallelSegments)
+		if err != nil {
+			return fmt.Errorf("split block range in segments: %w", err)
+		}
+
+		var segmentSinkers []*substreamsfile.FileSinker
+		for i, segment := range segments {
+			segmentLogger := zlog.With(zap.Stringer("segment", segment))
+
+			stateStore, err := state.NewStoreFromURL(cmd.Context(), state.SegmentLocation(stateStorePath, segment))
+			if err != nil {
+				return fmt.Errorf("new segment %s state store: %w", segment, err)
+			}
+
+			if stateStore.IsCompleted() {
+				segmentLogger.Info("segment already completed, skipping it")
+				continue
+			}
+
+			segmentSinker, err := newSegmentSinker(sinker, segment, i, segmentLogger)
+			if err != nil {
+				return fmt.Errorf("new segment %s sinker: %w", segment, err)
+			}
+
+			segmentCheckpointDir := filepath.Join(checkpointDir, fmt.Sprintf("%010d-%010d", segment.StartBlock(), *segment.EndBlock()))
+			fileSinker, err := newFileSinker(segmentSinker, stateStore, segmentCheckpointDir, state.SegmentLocation(lease.DefaultFilename, segment), segmentLogger)
+			if err != nil {
+				return err
+			}
+
+			segmentSinkers = append(segmentSinkers, fileSinker)
+			statusSegments = append(statusSegments, status.Segment{Name: fmt.Sprintf("%010d-%010d", segment.StartBlock(), *segment.EndBlock()), Source: fileSinker})
+		}
+
+		zlog.Info("running segments in parallel", zap.Int("segment_count", len(segments)), zap.Int("remaining_segment_count", len(segmentSinkers)))
+		app.SuperviseAndStart(substreamsfile.NewSegmentedFileSinker(segmentSinkers, zlog))
+	} else {
+		stateStore, err := state.NewStoreFromURL(cmd.Context(), stateStorePath)
+		if err != nil {
+			return fmt.Errorf("new state store: %w", err)
+		}
+
+		fileSinker, err := newFileSinker(sinker, stateStore, checkpointDir, lease.DefaultFilename, zlog)
+		if err != nil {
+			return err
+		}
+
+		app.SuperviseAndStart(fileSinker)
+		statusSegments = append(statusSegments, status.Segment{Source: fileSinker})
 	}
 
-	app.SuperviseAndStart(substreamsfile.NewFileSinker(sinker, bundler, sinkEncoder, zlog, tracer))
+	if statusListenAddr != "" {
+		app.SuperviseAndStart(status.NewServer(statusListenAddr, encoderType, fileWorkingDir, statusStallTimeout, statusSegments, zlog))
+	}
 
 	if err := app.WaitForTermination(zlog, 0*time.Second, 30*time.Second); err != nil {
 		zlog.Info("app termination error", zap.Error(err))
@@ -242,6 +760,29 @@ func syncRunE(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// newSegmentSinker returns a copy of the sinker streaming only the blocks of the given segment.
+// Stateful parts of the configuration are re-created for each segment and only the first
+// segment serves Prometheus metrics.
+func newSegmentSinker(sinker *sink.Sinker, segment *bstream.Range, index int, logger *zap.Logger) (*sink.Sinker, error) {
+	config := *sinker.SinkerConfig
+	config.StartBlock = int64(segment.StartBlock())
+	config.StopBlock = *segment.EndBlock()
+	config.Logger = logger
+	config.LivenessChecker = sink.NewCursorBasedLivenessChecker()
+
+	if exponentialBackOff, ok := config.BackOff.(*backoff.ExponentialBackOff); ok {
+		segmentBackOff := *exponentialBackOff
+		segmentBackOff.Reset()
+		config.BackOff = &segmentBackOff
+	}
+
+	if index > 0 {
+		config.PrometheusAddr = ""
+	}
+
+	return sink.NewFromConfig(&config)
+}
+
 func getEncoder(encoderType string, sinker *sink.Sinker) (encoder.Encoder, error) {
 	if encoderType == "lines" {
 		return encoder.NewLineEncoder(), nil
@@ -262,6 +803,21 @@ func getEncoder(encoderType string, sinker *sink.Sinker) (encoder.Encoder, error
 	return nil, fmt.Errorf("unknown encoder type %q", encoderType)
 }
 
+// parseCSVDelimiter parses the value of --csv-delimiter, a single character or 'tab'.
+func parseCSVDelimiter(in string) (rune, error) {
+	switch in {
+	case "tab", `\t`:
+		return '\t', nil
+	}
+
+	delimiter, size := utf8.DecodeRuneInString(in)
+	if size == 0 || size != len(in) {
+		return 0, fmt.Errorf("delimiter %q must be a single character", in)
+	}
+
+	return delimiter, nil
+}
+
 func outputMessageDescriptor(sinker *sink.Sinker) (protoreflect.MessageDescriptor, error) {
 	outputTypeName := protoreflect.FullName(sinker.OutputModuleTypeUnprefixed())
 	value, err := protox.FindMessageByNameInFiles(sinker.Package().ProtoFiles, outputTypeName)
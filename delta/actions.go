@@ -0,0 +1,67 @@
+package delta
+
+// Action is a line of a Delta commit file, a single one of its fields is set. The same
+// structure is used for the rows of checkpoints, hence the Parquet tags, `remove` actions
+// are only read from commits written by other tools.
+type Action struct {
+	CommitInfo *CommitInfo `json:"commitInfo,omitempty" parquet:"-"`
+	Protocol   *Protocol   `json:"protocol,omitempty" parquet:"protocol,optional"`
+	MetaData   *Metadata   `json:"metaData,omitempty" parquet:"metaData,optional"`
+	Add        *Add        `json:"add,omitempty" parquet:"add,optional"`
+	Remove     *Remove     `json:"remove,omitempty" parquet:"-"`
+}
+
+// Protocol is the version of the Delta protocol readers and writers of the table must
+// support, we only use features of the initial protocol versions.
+type Protocol struct {
+	MinReaderVersion int32 `json:"minReaderVersion" parquet:"minReaderVersion"`
+	MinWriterVersion int32 `json:"minWriterVersion" parquet:"minWriterVersion"`
+}
+
+// Metadata describes the table, its schema being the JSON serialization of a Spark
+// struct type.
+type Metadata struct {
+	ID               string            `json:"id" parquet:"id"`
+	Format           Format            `json:"format" parquet:"format"`
+	SchemaString     string            `json:"schemaString" parquet:"schemaString"`
+	PartitionColumns []string          `json:"partitionColumns" parquet:"partitionColumns,list"`
+	Configuration    map[string]string `json:"configuration" parquet:"configuration"`
+	CreatedTime      int64             `json:"createdTime,omitempty" parquet:"createdTime,optional"`
+}
+
+type Format struct {
+	Provider string            `json:"provider" parquet:"provider"`
+	Options  map[string]string `json:"options" parquet:"options"`
+}
+
+// Add adds a data file to the table, its path being relative to the table's directory.
+// Stats is the JSON serialization of the file's statistics, see newFileStats.
+type Add struct {
+	Path             string            `json:"path" parquet:"path"`
+	PartitionValues  map[string]string `json:"partitionValues" parquet:"partitionValues"`
+	Size             int64             `json:"size" parquet:"size"`
+	ModificationTime int64             `json:"modificationTime" parquet:"modificationTime"`
+	DataChange       bool              `json:"dataChange" parquet:"dataChange"`
+	Stats            string            `json:"stats,omitempty" parquet:"stats,optional"`
+}
+
+// Remove removes a data file from the table.
+type Remove struct {
+	Path string `json:"path"`
+}
+
+// CommitInfo describes the operation of a commit, it's informational only.
+type CommitInfo struct {
+	Timestamp           int64             `json:"timestamp"`
+	Operation           string            `json:"operation"`
+	OperationParameters map[string]string `json:"operationParameters"`
+	IsBlindAppend       bool              `json:"isBlindAppend"`
+	EngineInfo          string            `json:"engineInfo"`
+}
+
+// lastCheckpoint is the content of the `_delta_log/_last_checkpoint` file pointing to the
+// most recent checkpoint, size being its number of actions.
+type lastCheckpoint struct {
+	Version int64 `json:"version"`
+	Size    int64 `json:"size"`
+}
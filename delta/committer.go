@@ -0,0 +1,190 @@
+package delta
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"go.uber.org/zap"
+)
+
+// Committer records the Parquet files of every boundary in the Delta transaction log of
+// their table, it implements bundler.TableCommitter.
+//
+// The directory of a table is the part of the file's path up to the folder named after
+// the table, the following `key=value` folders being the partition values of the file.
+// A boundary produces one commit per table holding files, commits are serialized and
+// checkpoints are written every checkpointInterval commits.
+//
+// The store received by Commit must not overwrite objects, see tableLog.
+type Committer struct {
+	schemas            map[string]*parquet.Schema
+	checkpointInterval int64
+	overwriteStore     dstore.Store
+	zlogger            *zap.Logger
+
+	mu   sync.Mutex
+	logs map[string]*tableLog
+}
+
+// NewCommitter returns a committer for the tables of the given schemas, the schemas' name
+// being the table's name. A checkpointInterval of 0 disables checkpoints. The
+// overwriteStore is the output store opened so that it overwrites objects, through which
+// `_last_checkpoint` is updated.
+func NewCommitter(schemas []*parquet.Schema, checkpointInterval uint64, overwriteStore dstore.Store, zlogger *zap.Logger) *Committer {
+	bySchema := make(map[string]*parquet.Schema, len(schemas))
+	for _, schema := range schemas {
+		bySchema[schema.Name()] = schema
+	}
+
+	return &Committer{
+		schemas:            bySchema,
+		checkpointInterval: int64(checkpointInterval),
+		overwriteStore:     overwriteStore,
+		zlogger:            zlogger,
+		logs:               map[string]*tableLog{},
+	}
+}
+
+// Name implements bundler.TableCommitter.
+func (c *Committer) Name() string {
+	return "delta"
+}
+
+// Commit implements bundler.TableCommitter. Files already part of their table are skipped,
+// so committing a boundary again after a failure or a restart adds no file twice.
+func (c *Committer) Commit(ctx context.Context, store dstore.Store, boundary string, files []writer.UploadedFile) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byTable := map[string][]writer.UploadedFile{}
+	for _, file := range files {
+		if file.Rows == 0 {
+			continue
+		}
+
+		dir, _, err := bundler.SplitTablePath(file)
+		if err != nil {
+			return nil, err
+		}
+
+		byTable[dir] = append(byTable[dir], file)
+	}
+
+	dirs := make([]string, 0, len(byTable))
+	for dir := range byTable {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+
+	var written []string
+	for _, dir := range dirs {
+		filenames, err := c.commitTable(ctx, store, dir, byTable[dir])
+		if err != nil {
+			return nil, fmt.Errorf("table %q: %w", dir, err)
+		}
+
+		written = append(written, filenames...)
+	}
+
+	return written, nil
+}
+
+func (c *Committer) commitTable(ctx context.Context, store dstore.Store, dir string, files []writer.UploadedFile) ([]string, error) {
+	table := files[0].Table
+	schema, found := c.schemas[table]
+	if !found {
+		return nil, fmt.Errorf("unknown table %q", table)
+	}
+
+	var partitionColumns []string
+	adds := make([]*Add, 0, len(files))
+	for i, file := range files {
+		add, columns, err := newAdd(file)
+		if err != nil {
+			return nil, fmt.Errorf("file %q: %w", file.Filename, err)
+		}
+
+		if i == 0 {
+			partitionColumns = columns
+		} else if !slices.Equal(columns, partitionColumns) {
+			return nil, fmt.Errorf("file %q is partitioned by %q while other files are partitioned by %q", file.Filename, columns, partitionColumns)
+		}
+
+		adds = append(adds, add)
+	}
+
+	schemaString, err := schemaString(schema, partitionColumns)
+	if err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+
+	log, found := c.logs[dir]
+	if !found {
+		log = newTableLog(store, c.overwriteStore, dir)
+		c.logs[dir] = log
+	}
+
+	filename, err := log.commit(ctx, adds, schemaString, partitionColumns)
+	if err != nil {
+		return nil, err
+	}
+
+	if filename == "" {
+		return nil, nil
+	}
+
+	written := []string{filename}
+	if c.checkpointInterval > 0 && log.version > 0 && log.version%c.checkpointInterval == 0 {
+		filenames, err := log.checkpoint(ctx)
+		if err != nil {
+			// The commit is written, readers replay the commits following the previous checkpoint
+			c.zlogger.Warn("unable to write delta checkpoint", zap.String("table", dir), zap.Int64("version", log.version), zap.Error(err))
+		} else {
+			written = append(written, filenames...)
+		}
+	}
+
+	return written, nil
+}
+
+// newAdd returns the add action of the file and the name of its partition columns, taken
+// from the `key=value` folders of its path relative to the table's directory.
+func newAdd(file writer.UploadedFile) (*Add, []string, error) {
+	_, relative, err := bundler.SplitTablePath(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columns, values, err := bundler.PartitionValues(relative)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	segments := strings.Split(relative, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	stats, err := newFileStats(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &Add{
+		Path:             strings.Join(segments, "/"),
+		PartitionValues:  values,
+		Size:             file.Size,
+		ModificationTime: time.Now().UnixMilli(),
+		DataChange:       true,
+		Stats:            stats,
+	}, columns, nil
+}
@@ -0,0 +1,217 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var transfersSchema = parquet.NewSchema("transfers", parquet.Group{
+	"from":   parquet.String(),
+	"amount": parquet.Uint(64),
+})
+
+func TestCommitter_Commit(t *testing.T) {
+	ctx := context.Background()
+	store, overwriteStore := newStores(t)
+
+	committer := NewCommitter([]*parquet.Schema{transfersSchema}, 2, overwriteStore, zap.NewNop())
+
+	filenames, err := committer.Commit(ctx, store, "0000000000-0000000100", []writer.UploadedFile{
+		{Filename: "transfers/date=2024-01-01/0000000000-0000000100.parquet", Table: "transfers", Size: 100, Rows: 2},
+		{Filename: "approvals/date=2024-01-01/0000000000-0000000100.parquet", Table: "approvals", Size: 10, Rows: 0},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"transfers/_delta_log/00000000000000000000.json"}, filenames)
+
+	actions := readCommit(t, store, filenames[0])
+	require.Len(t, actions, 4)
+	assert.Equal(t, "WRITE", actions[0].CommitInfo.Operation)
+	assert.Equal(t, &Protocol{MinReaderVersion: 1, MinWriterVersion: 2}, actions[1].Protocol)
+	assert.Equal(t, []string{"date"}, actions[2].MetaData.PartitionColumns)
+	assert.Equal(t, "date=2024-01-01/0000000000-0000000100.parquet", actions[3].Add.Path)
+	assert.Equal(t, map[string]string{"date": "2024-01-01"}, actions[3].Add.PartitionValues)
+	assert.Equal(t, int64(100), actions[3].Add.Size)
+	assert.JSONEq(t, `{"numRecords":2}`, actions[3].Add.Stats)
+
+	// Committing the boundary again, as done when its upload is retried, adds nothing
+	filenames, err = committer.Commit(ctx, store, "0000000000-0000000100", []writer.UploadedFile{
+		{Filename: "transfers/date=2024-01-01/0000000000-0000000100.parquet", Table: "transfers", Size: 100, Rows: 2},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, filenames)
+
+	filenames, err = committer.Commit(ctx, store, "0000000100-0000000200", []writer.UploadedFile{
+		{Filename: "transfers/date=2024-01-01/0000000100-0000000200.parquet", Table: "transfers", Size: 200, Rows: 4},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"transfers/_delta_log/00000000000000000001.json"}, filenames)
+
+	filenames, err = committer.Commit(ctx, store, "0000000200-0000000300", []writer.UploadedFile{
+		{Filename: "transfers/date=2024-01-02/0000000200-0000000300.parquet", Table: "transfers", Size: 300, Rows: 6},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"transfers/_delta_log/00000000000000000002.json",
+		"transfers/_delta_log/00000000000000000002.checkpoint.parquet",
+		"transfers/_delta_log/_last_checkpoint",
+	}, filenames)
+
+	// A new committer, like after a restart, loads the table from its checkpoint
+	committer = NewCommitter([]*parquet.Schema{transfersSchema}, 2, overwriteStore, zap.NewNop())
+	filenames, err = committer.Commit(ctx, store, "0000000200-0000000300", []writer.UploadedFile{
+		{Filename: "transfers/date=2024-01-02/0000000200-0000000300.parquet", Table: "transfers", Size: 300, Rows: 6},
+		{Filename: "transfers/date=2024-01-02/0000000300-0000000400.parquet", Table: "transfers", Size: 400, Rows: 8},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"transfers/_delta_log/00000000000000000003.json"}, filenames)
+
+	actions = readCommit(t, store, filenames[0])
+	require.Len(t, actions, 2)
+	assert.Equal(t, "date=2024-01-02/0000000300-0000000400.parquet", actions[1].Add.Path)
+
+	log := committer.logs["transfers"]
+	assert.Equal(t, int64(3), log.version)
+	assert.Equal(t, actions[1].Add.Path, log.files["date=2024-01-02/0000000300-0000000400.parquet"].Path)
+	assert.Len(t, log.files, 4)
+}
+
+func TestCommitter_Commit_SchemaChange(t *testing.T) {
+	ctx := context.Background()
+	store, overwriteStore := newStores(t)
+
+	committer := NewCommitter([]*parquet.Schema{transfersSchema}, 0, overwriteStore, zap.NewNop())
+	_, err := committer.Commit(ctx, store, "0000000000-0000000100", []writer.UploadedFile{
+		{Filename: "output/transfers/0000000000-0000000100.parquet", Table: "transfers", Size: 100, Rows: 2},
+	})
+	require.NoError(t, err)
+
+	changed := parquet.NewSchema("transfers", parquet.Group{
+		"from":   parquet.String(),
+		"to":     parquet.String(),
+		"amount": parquet.Uint(64),
+	})
+
+	committer = NewCommitter([]*parquet.Schema{changed}, 0, overwriteStore, zap.NewNop())
+	filenames, err := committer.Commit(ctx, store, "0000000100-0000000200", []writer.UploadedFile{
+		{Filename: "output/transfers/0000000100-0000000200.parquet", Table: "transfers", Size: 100, Rows: 2},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"output/transfers/_delta_log/00000000000000000001.json"}, filenames)
+
+	actions := readCommit(t, store, filenames[0])
+	require.Len(t, actions, 3)
+	require.NotNil(t, actions[1].MetaData)
+	assert.Equal(t, committer.logs["output/transfers"].metadata.ID, actions[1].MetaData.ID)
+	assert.Contains(t, actions[1].MetaData.SchemaString, `"name":"to"`)
+
+	_, err = committer.Commit(ctx, store, "0000000200-0000000300", []writer.UploadedFile{
+		{Filename: "output/transfers/date=2024-01-01/0000000200-0000000300.parquet", Table: "transfers", Size: 100, Rows: 2},
+	})
+	require.ErrorContains(t, err, `files are partitioned by ["date"] while the table is partitioned by []`)
+}
+
+func TestCommitter_Commit_NonOverwritingStore(t *testing.T) {
+	ctx := context.Background()
+
+	// Both stores share the same objects, only the second one overwrites them
+	store := dstore.NewMockStore(nil)
+	store.OpenObjectFunc = func(ctx context.Context, name string) (io.ReadCloser, error) {
+		content, found := store.Files[name]
+		if !found {
+			return nil, dstore.ErrNotFound
+		}
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	overwriteStore := dstore.NewMockStore(nil)
+	overwriteStore.Files = store.Files
+	overwriteStore.SetOverwrite(true)
+
+	committer := NewCommitter([]*parquet.Schema{transfersSchema}, 1, overwriteStore, zap.NewNop())
+	for i := 0; i < 3; i++ {
+		_, err := committer.Commit(ctx, store, "", []writer.UploadedFile{
+			{Filename: fmt.Sprintf("transfers/%010d.parquet", i), Table: "transfers", Size: 100, Rows: 2},
+		})
+		require.NoError(t, err)
+	}
+
+	// `_last_checkpoint` points to the latest checkpoint
+	last := &lastCheckpoint{}
+	require.NoError(t, json.Unmarshal(store.Files["transfers/_delta_log/_last_checkpoint"], last))
+	assert.Equal(t, int64(2), last.Version)
+
+	// A commit written by another process is kept, the commit failing
+	concurrent := []byte(`{"add":{"path":"other.parquet","size":10,"dataChange":true}}` + "\n")
+	store.SetFile("transfers/_delta_log/00000000000000000003.json", concurrent)
+
+	_, err := committer.Commit(ctx, store, "", []writer.UploadedFile{
+		{Filename: "transfers/0000000003.parquet", Table: "transfers", Size: 100, Rows: 2},
+	})
+	require.ErrorContains(t, err, "commit 3 already exists, the table is written by another process")
+	assert.Equal(t, concurrent, store.Files["transfers/_delta_log/00000000000000000003.json"])
+
+	// The table is loaded again on retry, committing after the other process' commit
+	filenames, err := committer.Commit(ctx, store, "", []writer.UploadedFile{
+		{Filename: "transfers/0000000003.parquet", Table: "transfers", Size: 100, Rows: 2},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "transfers/_delta_log/00000000000000000004.json", filenames[0])
+	assert.Len(t, committer.logs["transfers"].files, 5)
+}
+
+func TestNewAdd(t *testing.T) {
+	add, columns, err := newAdd(writer.UploadedFile{
+		Filename: "events/transfers/chain=mainnet/date=2024-01-01/block range/0000000000-0000000100.parquet",
+		Table:    "transfers",
+		Size:     10,
+		Rows:     1,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"chain", "date"}, columns)
+	assert.Equal(t, map[string]string{"chain": "mainnet", "date": "2024-01-01"}, add.PartitionValues)
+	assert.Equal(t, "chain=mainnet/date=2024-01-01/block%20range/0000000000-0000000100.parquet", add.Path)
+	assert.True(t, add.DataChange)
+}
+
+func newStores(t *testing.T) (store dstore.Store, overwriteStore dstore.Store) {
+	t.Helper()
+
+	dir := t.TempDir()
+	store, err := dstore.NewStore("file://"+dir, "", "", false)
+	require.NoError(t, err)
+	overwriteStore, err = dstore.NewStore("file://"+dir, "", "", true)
+	require.NoError(t, err)
+
+	return store, overwriteStore
+}
+
+func readCommit(t *testing.T, store dstore.Store, filename string) (out []Action) {
+	t.Helper()
+
+	reader, err := store.OpenObject(context.Background(), filename)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var action Action
+		require.NoError(t, json.Unmarshal([]byte(line), &action))
+		out = append(out, action)
+	}
+
+	return out
+}
@@ -0,0 +1,353 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/dstore"
+)
+
+// LogDir is the name of the transaction log folder of Delta tables.
+const LogDir = "_delta_log"
+
+const lastCheckpointFilename = "_last_checkpoint"
+
+var commitFilenameRegex = regexp.MustCompile(`^(\d{20})\.json$`)
+
+// tableLog is the transaction log of a Delta table along with the snapshot of the table
+// at its latest version, which is loaded from the store on first use.
+//
+// Commits are written through store, which must not overwrite objects so that a commit
+// written concurrently by another process is never replaced. `_last_checkpoint`, updated
+// in place, is written through overwriteStore, the same location opened so that it
+// overwrites objects.
+type tableLog struct {
+	store          dstore.Store
+	overwriteStore dstore.Store
+	// dir is the table's directory relative to the store
+	dir string
+
+	loaded   bool
+	version  int64
+	protocol *Protocol
+	metadata *Metadata
+	files    map[string]*Add
+}
+
+func newTableLog(store dstore.Store, overwriteStore dstore.Store, dir string) *tableLog {
+	return &tableLog{store: store, overwriteStore: overwriteStore, dir: dir}
+}
+
+func (l *tableLog) logFilename(name string) string {
+	return path.Join(l.dir, LogDir, name)
+}
+
+func commitFilename(version int64) string {
+	return fmt.Sprintf("%020d.json", version)
+}
+
+func checkpointFilename(version int64) string {
+	return fmt.Sprintf("%020d.checkpoint.parquet", version)
+}
+
+// load reads the latest snapshot of the table, starting from the last checkpoint if any
+// and replaying the commits that follow it. The version is -1 if the table has no log yet.
+func (l *tableLog) load(ctx context.Context) error {
+	l.version = -1
+	l.protocol = nil
+	l.metadata = nil
+	l.files = map[string]*Add{}
+
+	checkpoint, err := l.readLastCheckpoint(ctx)
+	if err != nil {
+		return fmt.Errorf("read last checkpoint: %w", err)
+	}
+
+	if checkpoint != nil {
+		if err := l.readCheckpoint(ctx, checkpoint.Version); err != nil {
+			return fmt.Errorf("read checkpoint %d: %w", checkpoint.Version, err)
+		}
+		l.version = checkpoint.Version
+	}
+
+	var versions []int64
+	err = l.store.Walk(ctx, l.logFilename("")+"/", func(filename string) error {
+		match := commitFilenameRegex.FindStringSubmatch(path.Base(filename))
+		if match == nil {
+			return nil
+		}
+
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		if version > l.version {
+			versions = append(versions, version)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk log: %w", err)
+	}
+	slices.Sort(versions)
+
+	for _, version := range versions {
+		if version != l.version+1 {
+			return fmt.Errorf("commit %d is missing from the log, found commit %d after commit %d", l.version+1, version, l.version)
+		}
+
+		if err := l.replay(ctx, version); err != nil {
+			return fmt.Errorf("replay commit %d: %w", version, err)
+		}
+		l.version = version
+	}
+
+	l.loaded = true
+	return nil
+}
+
+func (l *tableLog) readLastCheckpoint(ctx context.Context) (*lastCheckpoint, error) {
+	content, err := l.readObject(ctx, l.logFilename(lastCheckpointFilename))
+	if err != nil {
+		if errors.Is(err, dstore.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	checkpoint := &lastCheckpoint{}
+	if err := json.Unmarshal(content, checkpoint); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return checkpoint, nil
+}
+
+func (l *tableLog) readCheckpoint(ctx context.Context, version int64) error {
+	content, err := l.readObject(ctx, l.logFilename(checkpointFilename(version)))
+	if err != nil {
+		return err
+	}
+
+	reader := parquet.NewGenericReader[Action](bytes.NewReader(content))
+	defer reader.Close()
+
+	actions := make([]Action, 64)
+	for {
+		n, err := reader.Read(actions)
+		for _, action := range actions[:n] {
+			l.apply(action)
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read actions: %w", err)
+		}
+	}
+}
+
+func (l *tableLog) replay(ctx context.Context, version int64) error {
+	content, err := l.readObject(ctx, l.logFilename(commitFilename(version)))
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var action Action
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			return fmt.Errorf("unmarshal action: %w", err)
+		}
+
+		l.apply(action)
+	}
+
+	return scanner.Err()
+}
+
+func (l *tableLog) apply(action Action) {
+	switch {
+	case action.Protocol != nil:
+		l.protocol = action.Protocol
+	case action.MetaData != nil:
+		l.metadata = action.MetaData
+	case action.Add != nil:
+		l.files[action.Add.Path] = action.Add
+	case action.Remove != nil:
+		delete(l.files, action.Remove.Path)
+	}
+}
+
+func (l *tableLog) readObject(ctx context.Context, filename string) ([]byte, error) {
+	reader, err := l.store.OpenObject(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// commit writes the next commit of the log adding the files, files already part of the
+// table with the same size being skipped. The table is created along with its first
+// commit and its metadata is updated when the schema changed. It returns the name of the
+// commit file, empty if all files were already part of the table.
+func (l *tableLog) commit(ctx context.Context, adds []*Add, schema string, partitionColumns []string) (string, error) {
+	if !l.loaded {
+		if err := l.load(ctx); err != nil {
+			return "", fmt.Errorf("load log: %w", err)
+		}
+	}
+
+	var actions []Action
+	for _, add := range adds {
+		if existing, found := l.files[add.Path]; found && existing.Size == add.Size {
+			continue
+		}
+
+		actions = append(actions, Action{Add: add})
+	}
+
+	if len(actions) == 0 {
+		return "", nil
+	}
+
+	if partitionColumns == nil {
+		partitionColumns = []string{}
+	}
+
+	partitionBy, _ := json.Marshal(partitionColumns)
+	header := []Action{{CommitInfo: &CommitInfo{
+		Timestamp:           time.Now().UnixMilli(),
+		Operation:           "WRITE",
+		OperationParameters: map[string]string{"mode": "Append", "partitionBy": string(partitionBy)},
+		IsBlindAppend:       true,
+		EngineInfo:          "substreams-sink-files",
+	}}}
+
+	switch {
+	case l.metadata == nil:
+		header = append(header,
+			Action{Protocol: &Protocol{MinReaderVersion: 1, MinWriterVersion: 2}},
+			Action{MetaData: &Metadata{
+				ID:               uuid.NewString(),
+				Format:           Format{Provider: "parquet", Options: map[string]string{}},
+				SchemaString:     schema,
+				PartitionColumns: partitionColumns,
+				Configuration:    map[string]string{},
+				CreatedTime:      time.Now().UnixMilli(),
+			}},
+		)
+
+	case !slices.Equal(l.metadata.PartitionColumns, partitionColumns):
+		return "", fmt.Errorf("files are partitioned by %q while the table is partitioned by %q", partitionColumns, l.metadata.PartitionColumns)
+
+	case l.metadata.SchemaString != schema:
+		metadata := *l.metadata
+		metadata.SchemaString = schema
+		header = append(header, Action{MetaData: &metadata})
+	}
+	actions = append(header, actions...)
+
+	if l.store.Overwrite() {
+		return "", fmt.Errorf("commits must be written through a store that does not overwrite objects")
+	}
+
+	version := l.version + 1
+	filename := l.logFilename(commitFilename(version))
+
+	content := &bytes.Buffer{}
+	for _, action := range actions {
+		line, err := json.Marshal(action)
+		if err != nil {
+			return "", fmt.Errorf("marshal action: %w", err)
+		}
+
+		content.Write(line)
+		content.WriteByte('\n')
+	}
+
+	// The store does not overwrite objects, a commit already written by another process is
+	// kept as is and found when reading the commit back. Stores supporting preconditions,
+	// like GCS, skip the write atomically, others check that the object exists first.
+	if err := l.store.WriteObject(ctx, filename, bytes.NewReader(content.Bytes())); err != nil {
+		l.loaded = false
+		return "", fmt.Errorf("write commit %d: %w", version, err)
+	}
+
+	written, err := l.readObject(ctx, filename)
+	if err != nil {
+		l.loaded = false
+		return "", fmt.Errorf("read back commit %d: %w", version, err)
+	}
+
+	if !bytes.Equal(written, content.Bytes()) {
+		l.loaded = false
+		return "", fmt.Errorf("commit %d already exists, the table is written by another process", version)
+	}
+
+	for _, action := range actions {
+		l.apply(action)
+	}
+	l.version = version
+
+	return filename, nil
+}
+
+// checkpoint writes the snapshot of the table at its current version as a checkpoint and
+// points `_last_checkpoint` to it, it returns the name of the files written.
+func (l *tableLog) checkpoint(ctx context.Context) ([]string, error) {
+	actions := []Action{{Protocol: l.protocol}, {MetaData: l.metadata}}
+
+	paths := make([]string, 0, len(l.files))
+	for path := range l.files {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	for _, path := range paths {
+		actions = append(actions, Action{Add: l.files[path]})
+	}
+
+	content := &bytes.Buffer{}
+	writer := parquet.NewGenericWriter[Action](content, parquet.Compression(&parquet.Snappy))
+	if _, err := writer.Write(actions); err != nil {
+		return nil, fmt.Errorf("write actions: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("close parquet writer: %w", err)
+	}
+
+	filename := l.logFilename(checkpointFilename(l.version))
+	if err := l.store.WriteObject(ctx, filename, content); err != nil {
+		return nil, fmt.Errorf("write checkpoint: %w", err)
+	}
+
+	last, err := json.Marshal(&lastCheckpoint{Version: l.version, Size: int64(len(actions))})
+	if err != nil {
+		return nil, fmt.Errorf("marshal last checkpoint: %w", err)
+	}
+
+	lastFilename := l.logFilename(lastCheckpointFilename)
+	if err := l.overwriteStore.WriteObject(ctx, lastFilename, bytes.NewReader(last)); err != nil {
+		return nil, fmt.Errorf("write last checkpoint: %w", err)
+	}
+
+	return []string{filename, lastFilename}, nil
+}
@@ -0,0 +1,145 @@
+package delta
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// structType, structField and arrayType are the JSON serialization of Spark types used
+// by Delta for the table's schema, primitive types being plain strings.
+type structType struct {
+	Type   string        `json:"type"`
+	Fields []structField `json:"fields"`
+}
+
+type structField struct {
+	Name     string         `json:"name"`
+	Type     any            `json:"type"`
+	Nullable bool           `json:"nullable"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+type arrayType struct {
+	Type         string `json:"type"`
+	ElementType  any    `json:"elementType"`
+	ContainsNull bool   `json:"containsNull"`
+}
+
+// schemaString returns the Delta schema of the Parquet schema, the partition columns being
+// appended as nullable string columns.
+func schemaString(schema *parquet.Schema, partitionColumns []string) (string, error) {
+	root, err := groupType(schema)
+	if err != nil {
+		return "", err
+	}
+
+	for _, column := range partitionColumns {
+		for _, field := range root.Fields {
+			if field.Name == column {
+				return "", fmt.Errorf("partition column %q is also a column of the table", column)
+			}
+		}
+
+		root.Fields = append(root.Fields, structField{Name: column, Type: "string", Nullable: true, Metadata: map[string]any{}})
+	}
+
+	content, err := json.Marshal(root)
+	if err != nil {
+		return "", fmt.Errorf("marshal schema: %w", err)
+	}
+
+	return string(content), nil
+}
+
+func groupType(node parquet.Node) (*structType, error) {
+	out := &structType{Type: "struct", Fields: []structField{}}
+	for _, field := range node.Fields() {
+		fieldType, err := nodeType(field)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", field.Name(), err)
+		}
+
+		out.Fields = append(out.Fields, structField{
+			Name:     field.Name(),
+			Type:     fieldType,
+			Nullable: field.Optional(),
+			Metadata: map[string]any{},
+		})
+	}
+
+	return out, nil
+}
+
+func nodeType(node parquet.Node) (out any, err error) {
+	if node.Leaf() {
+		out = primitiveType(node)
+	} else if out, err = groupType(node); err != nil {
+		return nil, err
+	}
+
+	if node.Repeated() {
+		return &arrayType{Type: "array", ElementType: out, ContainsNull: false}, nil
+	}
+
+	return out, nil
+}
+
+// primitiveType returns the Delta type of the leaf node. Unsigned integers are widened like
+// Spark does when reading them, 256 bits decimals exceed the maximum precision of Delta
+// decimals (38) and are left as binary.
+func primitiveType(node parquet.Node) string {
+	columnType := node.Type()
+	logicalType := columnType.LogicalType()
+
+	switch columnType.Kind() {
+	case parquet.Boolean:
+		return "boolean"
+
+	case parquet.Int32:
+		if logicalType != nil && logicalType.Integer != nil {
+			switch {
+			case !logicalType.Integer.IsSigned:
+				return "long"
+			case logicalType.Integer.BitWidth == 8:
+				return "byte"
+			case logicalType.Integer.BitWidth == 16:
+				return "short"
+			}
+		}
+		if logicalType != nil && logicalType.Date != nil {
+			return "date"
+		}
+		return "integer"
+
+	case parquet.Int64:
+		if logicalType != nil && logicalType.Timestamp != nil {
+			return "timestamp"
+		}
+		if logicalType != nil && logicalType.Integer != nil && !logicalType.Integer.IsSigned {
+			return "decimal(20,0)"
+		}
+		return "long"
+
+	case parquet.Float:
+		return "float"
+
+	case parquet.Double:
+		return "double"
+
+	case parquet.ByteArray:
+		if logicalType != nil && (logicalType.UTF8 != nil || logicalType.Enum != nil || logicalType.Json != nil) {
+			return "string"
+		}
+		return "binary"
+
+	case parquet.FixedLenByteArray:
+		if logicalType != nil && logicalType.Decimal != nil && logicalType.Decimal.Precision <= 38 {
+			return fmt.Sprintf("decimal(%d,%d)", logicalType.Decimal.Precision, logicalType.Decimal.Scale)
+		}
+		return "binary"
+	}
+
+	return "binary"
+}
@@ -0,0 +1,48 @@
+package delta
+
+import (
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaString(t *testing.T) {
+	schema := parquet.NewSchema("transfers", parquet.Group{
+		"hash":      parquet.String(),
+		"index":     parquet.Uint(32),
+		"amount":    parquet.Uint(64),
+		"value":     parquet.Decimal(0, 76, parquet.FixedLenByteArrayType(32)),
+		"fee":       parquet.Optional(parquet.Leaf(parquet.DoubleType)),
+		"timestamp": parquet.Timestamp(parquet.Nanosecond),
+		"topics":    parquet.Repeated(parquet.String()),
+		"raw":       parquet.Leaf(parquet.ByteArrayType),
+		"log": parquet.Group{
+			"address": parquet.String(),
+			"ordinal": parquet.Int(64),
+		},
+	})
+
+	out, err := schemaString(schema, []string{"date"})
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{"type":"struct","fields":[
+		{"name":"amount","type":"decimal(20,0)","nullable":false,"metadata":{}},
+		{"name":"fee","type":"double","nullable":true,"metadata":{}},
+		{"name":"hash","type":"string","nullable":false,"metadata":{}},
+		{"name":"index","type":"long","nullable":false,"metadata":{}},
+		{"name":"log","type":{"type":"struct","fields":[
+			{"name":"address","type":"string","nullable":false,"metadata":{}},
+			{"name":"ordinal","type":"long","nullable":false,"metadata":{}}
+		]},"nullable":false,"metadata":{}},
+		{"name":"raw","type":"binary","nullable":false,"metadata":{}},
+		{"name":"timestamp","type":"timestamp","nullable":false,"metadata":{}},
+		{"name":"topics","type":{"type":"array","elementType":"string","containsNull":false},"nullable":false,"metadata":{}},
+		{"name":"value","type":"binary","nullable":false,"metadata":{}},
+		{"name":"date","type":"string","nullable":true,"metadata":{}}
+	]}`, out)
+
+	_, err = schemaString(schema, []string{"hash"})
+	require.ErrorContains(t, err, `partition column "hash" is also a column of the table`)
+}
@@ -0,0 +1,145 @@
+package delta
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+)
+
+// stringStatsLength is the length, in characters, past which string bounds are truncated
+// like Delta writers do. The truncated minimum is still a lower bound while the maximum
+// is omitted as its truncation would not be an upper bound anymore.
+const stringStatsLength = 32
+
+// fileStats are the statistics of a data file recorded in its add action, the bounds and
+// null counts of nested columns being nested objects. Repeated columns have no statistics.
+type fileStats struct {
+	NumRecords int64          `json:"numRecords"`
+	MinValues  map[string]any `json:"minValues,omitempty"`
+	MaxValues  map[string]any `json:"maxValues,omitempty"`
+	NullCount  map[string]any `json:"nullCount,omitempty"`
+}
+
+// newFileStats returns the JSON statistics of the file, only the number of records when
+// the statistics of its columns are unknown.
+func newFileStats(file writer.UploadedFile) (string, error) {
+	stats := &fileStats{NumRecords: file.Rows}
+
+	if len(file.Columns) > 0 {
+		stats.MinValues = map[string]any{}
+		stats.MaxValues = map[string]any{}
+		stats.NullCount = map[string]any{}
+	}
+
+	for _, column := range file.Columns {
+		if column.Repeated {
+			continue
+		}
+
+		setNested(stats.NullCount, column.Path, column.Nulls)
+
+		if !column.HasBounds() {
+			continue
+		}
+
+		if min, ok := statsValue(column.Node, column.Min, false); ok {
+			setNested(stats.MinValues, column.Path, min)
+		}
+		if max, ok := statsValue(column.Node, column.Max, true); ok {
+			setNested(stats.MaxValues, column.Path, max)
+		}
+	}
+
+	content, err := json.Marshal(stats)
+	if err != nil {
+		return "", fmt.Errorf("marshal stats: %w", err)
+	}
+
+	return string(content), nil
+}
+
+func setNested(values map[string]any, path []string, value any) {
+	for _, name := range path[:len(path)-1] {
+		nested, ok := values[name].(map[string]any)
+		if !ok {
+			nested = map[string]any{}
+			values[name] = nested
+		}
+		values = nested
+	}
+
+	values[path[len(path)-1]] = value
+}
+
+// statsValue returns the JSON value of a bound of the column, false if the column's type
+// has no bounds in Delta statistics (booleans and binaries) or the value can't be
+// represented.
+func statsValue(node parquet.Node, value parquet.Value, upper bool) (any, bool) {
+	switch primitiveType(node) {
+	case "byte", "short", "integer":
+		return value.Int32(), true
+	case "long":
+		if value.Kind() == parquet.Int32 {
+			return value.Uint32(), true
+		}
+		return value.Int64(), true
+	case "decimal(20,0)":
+		return value.Uint64(), true
+
+	case "float", "double":
+		number := value.Double()
+		if value.Kind() == parquet.Float {
+			number = float64(value.Float())
+		}
+		if math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, false
+		}
+		return number, true
+
+	case "string":
+		text := string(value.ByteArray())
+		if utf8.RuneCountInString(text) <= stringStatsLength {
+			return text, true
+		}
+		if upper {
+			return nil, false
+		}
+		return string([]rune(text)[:stringStatsLength]), true
+
+	case "timestamp":
+		return timestampValue(node, value.Int64(), upper), true
+
+	case "date":
+		return time.Unix(int64(value.Int32())*86400, 0).UTC().Format("2006-01-02"), true
+	}
+
+	return nil, false
+}
+
+// timestampValue formats the timestamp with the millisecond precision of Delta statistics,
+// upper bounds being rounded up so that they remain upper bounds.
+func timestampValue(node parquet.Node, value int64, upper bool) string {
+	unit := node.Type().LogicalType().Timestamp.Unit
+
+	var at time.Time
+	switch {
+	case unit.Millis != nil:
+		at = time.UnixMilli(value)
+	case unit.Micros != nil:
+		at = time.UnixMicro(value)
+	default:
+		at = time.Unix(0, value)
+	}
+
+	truncated := at.Truncate(time.Millisecond)
+	if upper && !truncated.Equal(at) {
+		truncated = truncated.Add(time.Millisecond)
+	}
+
+	return truncated.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
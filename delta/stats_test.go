@@ -0,0 +1,72 @@
+package delta
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFileStats(t *testing.T) {
+	at := time.Date(2024, 1, 1, 12, 30, 0, 1_500_000, time.UTC)
+
+	out, err := newFileStats(writer.UploadedFile{
+		Rows: 3,
+		Columns: []writer.ColumnStats{
+			{
+				Path: []string{"amount"}, Node: parquet.Uint(64), Values: 3,
+				Min: parquet.ValueOf(uint64(1)), Max: parquet.ValueOf(uint64(18446744073709551615)),
+			},
+			{
+				Path: []string{"log", "address"}, Node: parquet.String(), Values: 3,
+				Min: parquet.ValueOf("0xaa"), Max: parquet.ValueOf("0x" + strings.Repeat("f", 40)),
+			},
+			{
+				Path: []string{"log", "fee"}, Node: parquet.Optional(parquet.Leaf(parquet.DoubleType)), Values: 3, Nulls: 3,
+			},
+			{
+				Path: []string{"timestamp"}, Node: parquet.Timestamp(parquet.Nanosecond), Values: 3,
+				Min: parquet.ValueOf(at.UnixNano()), Max: parquet.ValueOf(at.UnixNano()),
+			},
+			{
+				Path: []string{"topics"}, Node: parquet.String(), Repeated: true, Values: 6,
+				Min: parquet.ValueOf("a"), Max: parquet.ValueOf("b"),
+			},
+			{
+				Path: []string{"removed"}, Node: parquet.Leaf(parquet.BooleanType), Values: 3,
+				Min: parquet.ValueOf(false), Max: parquet.ValueOf(true),
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+		"numRecords": 3,
+		"minValues": {
+			"amount": 1,
+			"log": {"address": "0xaa"},
+			"timestamp": "2024-01-01T12:30:00.001Z"
+		},
+		"maxValues": {
+			"amount": 18446744073709551615,
+			"timestamp": "2024-01-01T12:30:00.002Z"
+		},
+		"nullCount": {
+			"amount": 0,
+			"log": {"address": 0, "fee": 3},
+			"timestamp": 0,
+			"removed": 0
+		}
+	}`, out)
+}
+
+func TestNewFileStats_UnknownColumns(t *testing.T) {
+	out, err := newFileStats(writer.UploadedFile{Rows: 10})
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{"numRecords":10}`, out)
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
 	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
 	pbsinkfiles "github.com/streamingfast/substreams-sink-files/v2/pb/sf/substreams/sink/files/v1"
 	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
@@ -67,7 +68,7 @@ type testWriter struct {
 	written []byte
 }
 
-func (*testWriter) CloseBoundary(ctx context.Context) (writer.Uploadeable, error) {
+func (*testWriter) CloseBoundary(ctx context.Context, namer writer.FileNamer) (writer.Uploadeable, error) {
 	panic("unimplemented")
 }
 
@@ -76,6 +77,35 @@ func (*testWriter) StartBoundary(*bstream.Range) error {
 	panic("unimplemented")
 }
 
+// EndBlock implements writer.Writer
+func (*testWriter) EndBlock(blockNum uint64) {
+}
+
+// Revert implements writer.Writer
+func (*testWriter) Revert(lastValidBlockNum uint64) error {
+	panic("unimplemented")
+}
+
+// Stats implements writer.Writer
+func (w *testWriter) Stats() writer.WriterStats {
+	return writer.WriterStats{Size: int64(len(w.written))}
+}
+
+// Checkpoint implements writer.Writer
+func (*testWriter) Checkpoint(dir string) error {
+	panic("unimplemented")
+}
+
+// RestoreCheckpoint implements writer.Writer
+func (*testWriter) RestoreCheckpoint(dir string, blockRange *bstream.Range) error {
+	panic("unimplemented")
+}
+
+// Compact implements writer.Writer
+func (*testWriter) Compact(source dstore.Store, files []writer.UploadedFile, namer writer.FileNamer) writer.Uploadeable {
+	panic("unimplemented")
+}
+
 // Type implements writer.Writer
 func (*testWriter) Type() writer.FileType {
 	return writer.FileTypeJSONL
@@ -0,0 +1,330 @@
+package encoder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/streamingfast/substreams-sink-files/v2/pq"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const timestampFullName protoreflect.FullName = "google.protobuf.Timestamp"
+
+// ProtoToCSV writes the rows extracted from the output module's message by the query as
+// CSV lines, the columns being derived from the row message's descriptor. Fields of nested
+// messages are flattened as columns named after their path, e.g. 'token.symbol', while
+// repeated and map fields are written as a single column holding their JSON value.
+//
+// The header line with the name of each column, see HeaderLine, is not written by the
+// encoder, it's written by the writer at the start of every file so that it's not counted
+// as a row.
+type ProtoToCSV struct {
+	querier          *pq.Query
+	outputModuleDesc protoreflect.MessageDescriptor
+	columns          []csvColumn
+	header           []string
+	headerLine       []byte
+
+	buffer *bytes.Buffer
+	csv    *csv.Writer
+	record []string
+}
+
+// csvColumn is a column of the CSV file, the value found at the path of fields from the
+// row message.
+type csvColumn struct {
+	name string
+	path []protoreflect.FieldDescriptor
+}
+
+func NewProtoToCSV(fieldPath string, outputModuleDesc protoreflect.MessageDescriptor, delimiter rune) (*ProtoToCSV, error) {
+	entitiesQuery, err := pq.Parse(fieldPath)
+	if err != nil {
+		return nil, fmt.Errorf("parse entities path %q: %w", fieldPath, err)
+	}
+
+	rowDesc, err := entitiesQuery.ResolveDescriptor(outputModuleDesc)
+	if err != nil {
+		return nil, fmt.Errorf("resolve row descriptor: %w", err)
+	}
+
+	columns, err := csvColumns(rowDesc, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("columns of %q: %w", rowDesc.FullName(), err)
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("row message %q has no fields", rowDesc.FullName())
+	}
+
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.name
+	}
+
+	if delimiter == 0 || delimiter == '"' || delimiter == '\r' || delimiter == '\n' || !utf8.ValidRune(delimiter) || delimiter == utf8.RuneError {
+		return nil, fmt.Errorf("invalid delimiter %q", delimiter)
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	csvWriter := csv.NewWriter(buffer)
+	csvWriter.Comma = delimiter
+
+	csvWriter.Write(header)
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		return nil, fmt.Errorf("encode header: %w", err)
+	}
+	headerLine := append([]byte(nil), buffer.Bytes()...)
+
+	return &ProtoToCSV{
+		querier:          entitiesQuery,
+		outputModuleDesc: outputModuleDesc,
+		columns:          columns,
+		header:           header,
+		headerLine:       headerLine,
+		buffer:           buffer,
+		csv:              csvWriter,
+		record:           make([]string, len(columns)),
+	}, nil
+}
+
+// Header returns the name of the columns, in order.
+func (p *ProtoToCSV) Header() []string {
+	return p.header
+}
+
+// HeaderLine returns the header line to write at the start of every file, see
+// writer.BufferedHeader.
+func (p *ProtoToCSV) HeaderLine() []byte {
+	return p.headerLine
+}
+
+func (p *ProtoToCSV) EncodeTo(output *pbsubstreamsrpc.MapModuleOutput, w writer.Writer) error {
+	entities, err := p.querier.Resolve(output.GetMapOutput().GetValue(), p.outputModuleDesc)
+	if err != nil {
+		return fmt.Errorf("failed to resolve entities query: %w", err)
+	}
+
+	if len(entities) == 0 {
+		return nil
+	}
+
+	p.buffer.Reset()
+	for idx, entity := range entities {
+		for i, column := range p.columns {
+			value, err := column.value(entity)
+			if err != nil {
+				// Discards the rows buffered so far, the buffer being reset on next call
+				p.csv.Flush()
+				return fmt.Errorf("encode entity at index %d column %q: %w", idx, column.name, err)
+			}
+			p.record[i] = value
+		}
+
+		p.csv.Write(p.record)
+	}
+
+	p.csv.Flush()
+	if err := p.csv.Error(); err != nil {
+		return fmt.Errorf("encode csv: %w", err)
+	}
+
+	// Quoted fields can hold newlines, the rows are the records written
+	if rowWriter, ok := w.(writer.RowWriter); ok {
+		_, err = rowWriter.WriteRows(p.buffer.Bytes(), int64(len(entities)))
+	} else {
+		_, err = w.Write(p.buffer.Bytes())
+	}
+	if err != nil {
+		return fmt.Errorf("write csv: %w", err)
+	}
+
+	return nil
+}
+
+// csvColumns returns the columns of the message, fields of nested messages being
+// flattened. Timestamps, repeated and map fields are kept as a single column.
+func csvColumns(desc protoreflect.MessageDescriptor, path []protoreflect.FieldDescriptor, seen []protoreflect.FullName) ([]csvColumn, error) {
+	for _, name := range seen {
+		if name == desc.FullName() {
+			return nil, fmt.Errorf("recursive message %q cannot be flattened", desc.FullName())
+		}
+	}
+	seen = append(seen, desc.FullName())
+
+	var out []csvColumn
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		fieldPath := append(append([]protoreflect.FieldDescriptor{}, path...), field)
+
+		if field.Message() != nil && !field.IsList() && !field.IsMap() && field.Message().FullName() != timestampFullName {
+			nested, err := csvColumns(field.Message(), fieldPath, seen)
+			if err != nil {
+				return nil, err
+			}
+
+			out = append(out, nested...)
+			continue
+		}
+
+		names := make([]string, len(fieldPath))
+		for j, pathField := range fieldPath {
+			names[j] = string(pathField.Name())
+		}
+
+		out = append(out, csvColumn{name: strings.Join(names, "."), path: fieldPath})
+	}
+
+	return out, nil
+}
+
+// value returns the column's value in the row, empty when a message along the path or
+// the field itself is not set, fields without presence being written with their default.
+func (c csvColumn) value(row protoreflect.Message) (string, error) {
+	message := row
+	for _, field := range c.path[:len(c.path)-1] {
+		if !message.Has(field) {
+			return "", nil
+		}
+		message = message.Get(field).Message()
+	}
+
+	field := c.path[len(c.path)-1]
+	if field.HasPresence() && !message.Has(field) {
+		return "", nil
+	}
+
+	value := message.Get(field)
+	switch {
+	case field.IsMap():
+		return mapToJSON(field, value.Map())
+	case field.IsList():
+		return listToJSON(field, value.List())
+	}
+
+	return formatCSVValue(field, value)
+}
+
+func formatCSVValue(field protoreflect.FieldDescriptor, value protoreflect.Value) (string, error) {
+	switch field.Kind() {
+	case protoreflect.StringKind:
+		return value.String(), nil
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(value.Bytes()), nil
+	case protoreflect.BoolKind:
+		return strconv.FormatBool(value.Bool()), nil
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return strconv.FormatInt(value.Int(), 10), nil
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return strconv.FormatUint(value.Uint(), 10), nil
+	case protoreflect.FloatKind:
+		return strconv.FormatFloat(value.Float(), 'g', -1, 32), nil
+	case protoreflect.DoubleKind:
+		return strconv.FormatFloat(value.Float(), 'g', -1, 64), nil
+	case protoreflect.EnumKind:
+		if enumValue := field.Enum().Values().ByNumber(value.Enum()); enumValue != nil {
+			return string(enumValue.Name()), nil
+		}
+		return strconv.FormatInt(int64(value.Enum()), 10), nil
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if field.Message().FullName() == timestampFullName {
+			return formatTimestamp(value.Message()), nil
+		}
+
+		out, err := protojson.Marshal(value.Message().Interface())
+		if err != nil {
+			return "", fmt.Errorf("protojson marshal: %w", err)
+		}
+		return string(out), nil
+	}
+
+	return "", fmt.Errorf("unsupported field kind %s", field.Kind())
+}
+
+// formatTimestamp formats a google.protobuf.Timestamp message as a RFC 3339 UTC time.
+func formatTimestamp(message protoreflect.Message) string {
+	fields := message.Descriptor().Fields()
+	seconds := message.Get(fields.ByName("seconds")).Int()
+	nanos := message.Get(fields.ByName("nanos")).Int()
+
+	return time.Unix(seconds, nanos).UTC().Format(time.RFC3339Nano)
+}
+
+func listToJSON(field protoreflect.FieldDescriptor, list protoreflect.List) (string, error) {
+	elements := make([]json.RawMessage, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		element, err := jsonValue(field, list.Get(i))
+		if err != nil {
+			return "", err
+		}
+		elements[i] = element
+	}
+
+	out, err := json.Marshal(elements)
+	if err != nil {
+		return "", fmt.Errorf("json marshal: %w", err)
+	}
+	return string(out), nil
+}
+
+func mapToJSON(field protoreflect.FieldDescriptor, entries protoreflect.Map) (string, error) {
+	elements := make(map[string]json.RawMessage, entries.Len())
+
+	var err error
+	entries.Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+		var element json.RawMessage
+		if element, err = jsonValue(field.MapValue(), value); err != nil {
+			return false
+		}
+
+		elements[key.String()] = element
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	out, err := json.Marshal(elements)
+	if err != nil {
+		return "", fmt.Errorf("json marshal: %w", err)
+	}
+	return string(out), nil
+}
+
+// jsonValue encodes a single value of the field as JSON, strings, bytes, enums and
+// timestamps being quoted.
+func jsonValue(field protoreflect.FieldDescriptor, value protoreflect.Value) (json.RawMessage, error) {
+	formatted, err := formatCSVValue(field, value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch field.Kind() {
+	case protoreflect.StringKind, protoreflect.BytesKind, protoreflect.EnumKind:
+		return json.Marshal(formatted)
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		if field.Message().FullName() == timestampFullName {
+			return json.Marshal(formatted)
+		}
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		// NaN and infinities are not valid JSON numbers
+		if _, err := json.Marshal(value.Float()); err != nil {
+			return json.Marshal(formatted)
+		}
+	}
+
+	return json.RawMessage(formatted), nil
+}
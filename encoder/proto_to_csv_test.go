@@ -0,0 +1,123 @@
+package encoder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestProtoToCSV_EncodeTo(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		delimiter rune
+		message   proto.Message
+		written   string
+		expected  string
+	}{
+		{
+			"nested fields flattened",
+			".",
+			',',
+			&pbtesting.FromTablesNestedFlat{Nested: &pbtesting.NestedFlat{Row: &pbtesting.RowT{
+				TypeString:    "a, \"quoted\"\nvalue",
+				TypeInt64:     -5,
+				TypeUint64:    18446744073709551615,
+				TypeFloat:     0.1,
+				TypeDouble:    1.5,
+				TypeBool:      true,
+				TypeBytes:     []byte{0x01, 0x02},
+				TypeTimestamp: timestamppb.New(time.Date(2024, 3, 5, 13, 0, 0, 500, time.UTC)),
+			}}},
+			"",
+			"\"a, \"\"quoted\"\"\nvalue\",0,-5,0,18446744073709551615,0,0,0,0,0,0,0.1,1.5,true,AQI=,2024-03-05T13:00:00.0000005Z,false\n",
+		},
+		{
+			"optional and repeated fields",
+			".",
+			'\t',
+			&pbtesting.FlattenedMessage{
+				Id:         "1",
+				Memo:       proto.String("memo"),
+				Operations: []*pbtesting.FlattenedOperation{{Id: "op1", Token: "t1"}, {Id: "op2"}},
+			},
+			"",
+			"\t1\tfalse\tmemo\t\"[{\"\"id\"\":\"\"op1\"\",\"\"token\"\":\"\"t1\"\"},{\"\"id\"\":\"\"op2\"\"}]\"\t[]\t\n",
+		},
+		{
+			"rows of repeated field appended to data written",
+			".elements[]",
+			',',
+			&pbtesting.FromTablesRepeated{Elements: []*pbtesting.RowT{{TypeString: "first"}, {TypeString: "second", TypeInt32: 2}}},
+			"previous\n",
+			"previous\n" +
+				"first,0,0,0,0,0,0,0,0,0,0,0,0,false,,,false\n" +
+				"second,2,0,0,0,0,0,0,0,0,0,0,0,false,,,false\n",
+		},
+		{
+			"no rows",
+			".elements[]",
+			',',
+			&pbtesting.FromTablesRepeated{},
+			"",
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoder, err := NewProtoToCSV(tt.query, tt.message.ProtoReflect().Descriptor(), tt.delimiter)
+			require.NoError(t, err)
+
+			value, err := anypb.New(tt.message)
+			require.NoError(t, err)
+
+			writer := &testWriter{written: []byte(tt.written)}
+			require.NoError(t, encoder.EncodeTo(&pbsubstreamsrpc.MapModuleOutput{MapOutput: value}, writer))
+			assert.Equal(t, tt.expected, string(writer.written))
+		})
+	}
+}
+
+func TestProtoToCSV_EncodeTo_Rows(t *testing.T) {
+	message := &pbtesting.FromTablesRepeated{Elements: []*pbtesting.RowT{{TypeString: "multi\nline"}}}
+	encoder, err := NewProtoToCSV(".elements[]", message.ProtoReflect().Descriptor(), ',')
+	require.NoError(t, err)
+
+	value, err := anypb.New(message)
+	require.NoError(t, err)
+
+	// A record with a quoted newline is a single row
+	buffered := writer.NewBufferedIO(0, t.TempDir(), writer.FileTypeCSV, zap.NewNop(), writer.BufferedHeader(encoder.HeaderLine()))
+	require.NoError(t, buffered.StartBoundary(bstream.NewRangeExcludingEnd(0, 100)))
+	require.NoError(t, encoder.EncodeTo(&pbsubstreamsrpc.MapModuleOutput{MapOutput: value}, buffered))
+	assert.Equal(t, int64(1), buffered.Stats().Rows)
+}
+
+func TestNewProtoToCSV(t *testing.T) {
+	descriptor := (&pbtesting.FromTablesRepeated{}).ProtoReflect().Descriptor()
+
+	_, err := NewProtoToCSV(".elements[]", descriptor, '"')
+	assert.EqualError(t, err, `invalid delimiter '"'`)
+
+	_, err = NewProtoToCSV(".unknown[]", descriptor, ',')
+	assert.EqualError(t, err, `resolve row descriptor: field "unknown" does not exist on proto of type "sf.substreams.sink.files.testing.FromTablesRepeated"`)
+
+	encoder, err := NewProtoToCSV(".elements[]", descriptor, ';')
+	require.NoError(t, err)
+	assert.Equal(t, "typeString", encoder.Header()[0])
+
+	encoder, err = NewProtoToCSV(".", (&pbtesting.FlattenedMessage{}).ProtoReflect().Descriptor(), '\t')
+	require.NoError(t, err)
+	assert.Equal(t, "number\tid\tsuccess\tmemo\toperations\tmetadata\tprovider\n", string(encoder.HeaderLine()))
+}
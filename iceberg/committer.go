@@ -0,0 +1,125 @@
+package iceberg
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+)
+
+// Committer records the Parquet files of every boundary in a new snapshot of their Iceberg
+// table, it implements bundler.TableCommitter.
+//
+// The directory of a table is the part of the file's path up to the folder named after
+// the table, the following `key=value` folders being the partition values of the file.
+// Tables are found through their metadata files only, like with Iceberg's Hadoop catalog,
+// and commits are serialized.
+type Committer struct {
+	tableResults   map[string]parquetx.TableResult
+	overwriteStore dstore.Store
+
+	mu     sync.Mutex
+	tables map[string]*table
+
+	replicaMu sync.Mutex
+	// replicaManifestLengths are the length of the manifests rewritten for replicas, by
+	// their location in the replica
+	replicaManifestLengths map[string]int64
+}
+
+// NewCommitter returns a committer for the given tables, the schemas' name being the
+// table's name. The overwriteStore is the output store opened so that it overwrites
+// objects, through which the version hint of tables is updated.
+func NewCommitter(tables []parquetx.TableResult, overwriteStore dstore.Store) *Committer {
+	byName := make(map[string]parquetx.TableResult, len(tables))
+	for _, table := range tables {
+		byName[table.Schema.Name()] = table
+	}
+
+	return &Committer{
+		tableResults:   byName,
+		overwriteStore: overwriteStore,
+		tables:         map[string]*table{},
+
+		replicaManifestLengths: map[string]int64{},
+	}
+}
+
+// Name implements bundler.TableCommitter.
+func (c *Committer) Name() string {
+	return "iceberg"
+}
+
+// Commit implements bundler.TableCommitter. Files already part of their table are skipped,
+// so committing a boundary again after a failure or a restart adds no file twice.
+func (c *Committer) Commit(ctx context.Context, store dstore.Store, boundary string, files []writer.UploadedFile) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byTable := map[string][]writer.UploadedFile{}
+	for _, file := range files {
+		if file.Rows == 0 {
+			continue
+		}
+
+		dir, _, err := bundler.SplitTablePath(file)
+		if err != nil {
+			return nil, err
+		}
+
+		byTable[dir] = append(byTable[dir], file)
+	}
+
+	dirs := make([]string, 0, len(byTable))
+	for dir := range byTable {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+
+	var written []string
+	for _, dir := range dirs {
+		filenames, err := c.commitTable(ctx, store, dir, byTable[dir])
+		if err != nil {
+			return nil, fmt.Errorf("table %q: %w", dir, err)
+		}
+
+		written = append(written, filenames...)
+	}
+
+	return written, nil
+}
+
+func (c *Committer) commitTable(ctx context.Context, store dstore.Store, dir string, files []writer.UploadedFile) ([]string, error) {
+	tableResult, found := c.tableResults[files[0].Table]
+	if !found {
+		return nil, fmt.Errorf("unknown table %q", files[0].Table)
+	}
+
+	var partitionColumns []string
+	for i, file := range files {
+		_, relative, _ := bundler.SplitTablePath(file)
+		columns, _, err := bundler.PartitionValues(relative)
+		if err != nil {
+			return nil, fmt.Errorf("file %q: %w", file.Filename, err)
+		}
+
+		if i == 0 {
+			partitionColumns = columns
+		} else if !slices.Equal(columns, partitionColumns) {
+			return nil, fmt.Errorf("file %q is partitioned by %q while other files are partitioned by %q", file.Filename, columns, partitionColumns)
+		}
+	}
+
+	table, found := c.tables[dir]
+	if !found {
+		table = newTable(store, c.overwriteStore, dir)
+		c.tables[dir] = table
+	}
+
+	return table.commit(ctx, tableResult, files, partitionColumns)
+}
@@ -0,0 +1,322 @@
+package iceberg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitter_Commit(t *testing.T) {
+	ctx := context.Background()
+	store, overwriteStore := newStores(t)
+
+	tables := []parquetx.TableResult{findTable(t, &pbtesting.FlattenedMessage{})}
+	committer := NewCommitter(tables, overwriteStore)
+
+	filenames, err := committer.Commit(ctx, store, "0000000000-0000000100", []writer.UploadedFile{
+		{
+			Filename: "flattened/date=2024-01-01/0000000000-0000000100.parquet", Table: "flattened", Size: 100, Rows: 2,
+			Columns: []writer.ColumnStats{
+				{Path: []string{"id"}, Node: parquet.String(), Values: 2, Min: parquet.ValueOf("a"), Max: parquet.ValueOf("b")},
+				{Path: []string{"memo"}, Node: parquet.Optional(parquet.String()), Values: 2, Nulls: 2},
+				{Path: []string{"operations", "id"}, Node: parquet.String(), Repeated: true, Values: 3},
+			},
+		},
+		{Filename: "flattened/date=2024-01-02/0000000000-0000000100.parquet", Table: "flattened", Size: 50, Rows: 1},
+		{Filename: "other/date=2024-01-01/0000000000-0000000100.parquet", Table: "other", Size: 10, Rows: 0},
+	})
+	require.NoError(t, err)
+	require.Len(t, filenames, 4)
+	assert.Regexp(t, `^flattened/metadata/[0-9a-f-]+-m0\.avro$`, filenames[0])
+	assert.Regexp(t, `^flattened/metadata/snap-\d+-1-[0-9a-f-]+\.avro$`, filenames[1])
+	assert.Equal(t, []string{"flattened/metadata/v1.metadata.json", "flattened/metadata/version-hint.text"}, filenames[2:])
+	assert.Equal(t, "1", readString(t, store, "flattened/metadata/version-hint.text"))
+
+	metadata := readMetadata(t, store, "flattened/metadata/v1.metadata.json")
+	assert.Equal(t, formatVersion, metadata.FormatVersion)
+	assert.Equal(t, store.ObjectURL("flattened"), metadata.Location)
+	assert.Equal(t, int64(1), metadata.LastSequenceNumber)
+	assert.Equal(t, []PartitionField{{SourceID: 536870919, FieldID: 1000, Name: "date", Transform: "identity"}}, metadata.defaultSpec().Fields)
+	assert.Equal(t, 1000, metadata.LastPartitionID)
+	assert.Contains(t, metadata.Properties, "schema.name-mapping.default")
+
+	first := metadata.currentSnapshot()
+	require.NotNil(t, first)
+	assert.Nil(t, first.ParentSnapshotID)
+	assert.Equal(t, store.ObjectURL(filenames[1]), first.ManifestList)
+	assert.Equal(t, "append", first.Summary["operation"])
+	assert.Equal(t, "2", first.Summary["added-data-files"])
+	assert.Equal(t, "3", first.Summary["total-records"])
+	assert.Equal(t, "2", first.Summary["changed-partition-count"])
+	assert.Equal(t, first.SnapshotID, metadata.Refs["main"].SnapshotID)
+
+	manifests, err := readAvroFile[manifestFile](ctx, store, filenames[1])
+	require.NoError(t, err)
+	require.Len(t, manifests, 1)
+	assert.Equal(t, store.ObjectURL(filenames[0]), manifests[0].ManifestPath)
+	assert.Equal(t, int32(2), manifests[0].AddedFilesCount)
+	assert.Equal(t, int64(3), manifests[0].AddedRowsCount)
+	require.NotNil(t, manifests[0].Partitions)
+	require.Len(t, *manifests[0].Partitions, 1)
+	assert.Equal(t, "2024-01-01", string(*(*manifests[0].Partitions)[0].LowerBound))
+	assert.Equal(t, "2024-01-02", string(*(*manifests[0].Partitions)[0].UpperBound))
+
+	entries, err := readAvroFile[manifestEntry](ctx, store, filenames[0])
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, int32(manifestEntryStatusAdded), entries[0].Status)
+	assert.Equal(t, store.ObjectURL("flattened/date=2024-01-01/0000000000-0000000100.parquet"), entries[0].DataFile.FilePath)
+	assert.Equal(t, "PARQUET", entries[0].DataFile.FileFormat)
+	assert.Equal(t, map[string]any{"date": "2024-01-01"}, entries[0].DataFile.Partition)
+	assert.Equal(t, int64(2), entries[0].DataFile.RecordCount)
+	assert.Equal(t, int64(100), entries[0].DataFile.FileSizeInBytes)
+	assert.Equal(t, &[]longEntry{{Key: 2, Value: 2}, {Key: 4, Value: 2}}, entries[0].DataFile.ValueCounts)
+	assert.Equal(t, &[]longEntry{{Key: 2, Value: 0}, {Key: 4, Value: 2}}, entries[0].DataFile.NullValueCounts)
+	assert.Equal(t, &[]bytesEntry{{Key: 2, Value: []byte("a")}}, entries[0].DataFile.LowerBounds)
+	assert.Equal(t, &[]bytesEntry{{Key: 2, Value: []byte("b")}}, entries[0].DataFile.UpperBounds)
+	assert.Nil(t, entries[1].DataFile.ValueCounts)
+
+	// Committing the boundary again, as done when its upload is retried, adds nothing
+	filenames, err = committer.Commit(ctx, store, "0000000000-0000000100", []writer.UploadedFile{
+		{Filename: "flattened/date=2024-01-02/0000000000-0000000100.parquet", Table: "flattened", Size: 50, Rows: 1},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, filenames)
+
+	filenames, err = committer.Commit(ctx, store, "0000000100-0000000200", []writer.UploadedFile{
+		{Filename: "flattened/date=2024-01-02/0000000100-0000000200.parquet", Table: "flattened", Size: 200, Rows: 4},
+	})
+	require.NoError(t, err)
+	require.Len(t, filenames, 4)
+	assert.Equal(t, "flattened/metadata/v2.metadata.json", filenames[2])
+	assert.Equal(t, "2", readString(t, store, "flattened/metadata/version-hint.text"))
+
+	metadata = readMetadata(t, store, "flattened/metadata/v2.metadata.json")
+	second := metadata.currentSnapshot()
+	require.NotNil(t, second)
+	assert.Equal(t, &first.SnapshotID, second.ParentSnapshotID)
+	assert.Equal(t, int64(2), second.SequenceNumber)
+	assert.Equal(t, "3", second.Summary["total-data-files"])
+	assert.Equal(t, "7", second.Summary["total-records"])
+	assert.Len(t, metadata.Snapshots, 2)
+	assert.Len(t, metadata.Schemas, 1)
+	assert.Equal(t, []MetadataLogEntry{{
+		MetadataFile: store.ObjectURL("flattened/metadata/v1.metadata.json"),
+		TimestampMs:  first.TimestampMs,
+	}}, metadata.MetadataLog)
+
+	manifests, err = readAvroFile[manifestFile](ctx, store, filenames[1])
+	require.NoError(t, err)
+	require.Len(t, manifests, 2)
+	assert.Equal(t, store.ObjectURL(filenames[0]), manifests[0].ManifestPath)
+	assert.Equal(t, first.SnapshotID, manifests[1].AddedSnapshotID)
+
+	// A new committer, like after a restart, loads the table from its latest metadata
+	committer = NewCommitter(tables, overwriteStore)
+	filenames, err = committer.Commit(ctx, store, "0000000100-0000000200", []writer.UploadedFile{
+		{Filename: "flattened/date=2024-01-02/0000000100-0000000200.parquet", Table: "flattened", Size: 200, Rows: 4},
+		{Filename: "flattened/date=2024-01-02/0000000200-0000000300.parquet", Table: "flattened", Size: 300, Rows: 6},
+	})
+	require.NoError(t, err)
+	require.Len(t, filenames, 4)
+	assert.Equal(t, "flattened/metadata/v3.metadata.json", filenames[2])
+
+	entries, err = readAvroFile[manifestEntry](ctx, store, filenames[0])
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, store.ObjectURL("flattened/date=2024-01-02/0000000200-0000000300.parquet"), entries[0].DataFile.FilePath)
+
+	_, err = committer.Commit(ctx, store, "0000000300-0000000400", []writer.UploadedFile{
+		{Filename: "flattened/0000000300-0000000400.parquet", Table: "flattened", Size: 400, Rows: 8},
+	})
+	assert.ErrorContains(t, err, "partitioned by")
+}
+
+func TestCommitter_Commit_SchemaChange(t *testing.T) {
+	ctx := context.Background()
+	store, overwriteStore := newStores(t)
+
+	flattened := findTable(t, &pbtesting.FlattenedMessage{})
+
+	_, err := NewCommitter([]parquetx.TableResult{flattened}, overwriteStore).Commit(ctx, store, "0000000000-0000000100", []writer.UploadedFile{
+		{Filename: "events/0000000000-0000000100.parquet", Table: "flattened", Size: 100, Rows: 2},
+	})
+	require.ErrorContains(t, err, "not in a folder named after its table")
+
+	_, err = NewCommitter([]parquetx.TableResult{flattened}, overwriteStore).Commit(ctx, store, "0000000000-0000000100", []writer.UploadedFile{
+		{Filename: "flattened/0000000000-0000000100.parquet", Table: "flattened", Size: 100, Rows: 2},
+	})
+	require.NoError(t, err)
+
+	// The table is written with the schema of another message, like after a module upgrade
+	rows := findTable(t, &pbtesting.RowColumnNestedMessage{})
+	renamed := parquetx.TableResult{Descriptor: rows.Descriptor, Schema: parquet.NewSchema("flattened", rows.Schema)}
+
+	filenames, err := NewCommitter([]parquetx.TableResult{renamed}, overwriteStore).Commit(ctx, store, "0000000100-0000000200", []writer.UploadedFile{
+		{Filename: "flattened/0000000100-0000000200.parquet", Table: "flattened", Size: 200, Rows: 4},
+	})
+	require.NoError(t, err)
+	require.Len(t, filenames, 4)
+
+	metadata := readMetadata(t, store, "flattened/metadata/v2.metadata.json")
+	require.Len(t, metadata.Schemas, 2)
+	assert.Equal(t, 1, metadata.CurrentSchemaID)
+	assert.Equal(t, 1, *metadata.currentSnapshot().SchemaID)
+	assert.Equal(t, 0, *metadata.Snapshots[0].SchemaID)
+	// Nested fields are given ids after the ones of the previous schema
+	assert.Equal(t, 536870919, metadata.currentSchema().Fields[0].Type.(*StructType).Fields[0].ID)
+	assert.Equal(t, 536870919, metadata.LastColumnID)
+}
+
+func TestCommitter_Commit_NonOverwritingStore(t *testing.T) {
+	ctx := context.Background()
+
+	// Both stores share the same objects, only the second one overwrites them
+	store := dstore.NewMockStore(nil)
+	store.OpenObjectFunc = func(ctx context.Context, name string) (io.ReadCloser, error) {
+		content, found := store.Files[name]
+		if !found {
+			return nil, dstore.ErrNotFound
+		}
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+	overwriteStore := dstore.NewMockStore(nil)
+	overwriteStore.Files = store.Files
+	overwriteStore.SetOverwrite(true)
+
+	committer := NewCommitter([]parquetx.TableResult{findTable(t, &pbtesting.FlattenedMessage{})}, overwriteStore)
+	for i := 0; i < 2; i++ {
+		_, err := committer.Commit(ctx, store, "", []writer.UploadedFile{
+			{Filename: fmt.Sprintf("flattened/%010d.parquet", i), Table: "flattened", Size: 100, Rows: 2},
+		})
+		require.NoError(t, err)
+	}
+
+	// The version hint points to the latest version
+	assert.Equal(t, "2", string(store.Files["flattened/metadata/version-hint.text"]))
+
+	// Metadata written by another process is kept, the commit failing
+	concurrent := []byte(`{"format-version":2}`)
+	store.SetFile("flattened/metadata/v3.metadata.json", concurrent)
+
+	_, err := committer.Commit(ctx, store, "", []writer.UploadedFile{
+		{Filename: "flattened/0000000002.parquet", Table: "flattened", Size: 100, Rows: 2},
+	})
+	require.ErrorContains(t, err, "metadata version 3 already exists, the table is written by another process")
+	assert.Equal(t, concurrent, store.Files["flattened/metadata/v3.metadata.json"])
+	assert.Equal(t, "2", string(store.Files["flattened/metadata/version-hint.text"]))
+}
+
+func TestCommitter_RewriteForReplica(t *testing.T) {
+	ctx := context.Background()
+	store, overwriteStore := newStores(t)
+	replica, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+	require.NoError(t, err)
+
+	tables := []parquetx.TableResult{findTable(t, &pbtesting.FlattenedMessage{})}
+	committer := NewCommitter(tables, overwriteStore)
+
+	replicate := func(committer *Committer, filenames []string) {
+		for _, filename := range filenames {
+			reader, err := store.OpenObject(ctx, filename)
+			require.NoError(t, err)
+
+			content, err := committer.RewriteForReplica(ctx, store, replica, filename, reader)
+			require.NoError(t, err)
+			require.NoError(t, replica.WriteObject(ctx, filename, content))
+			reader.Close()
+		}
+	}
+
+	require.NoError(t, store.WriteObject(ctx, "flattened/date=2024-01-01/0000000000-0000000100.parquet", strings.NewReader("data")))
+	first, err := committer.Commit(ctx, store, "0000000000-0000000100", []writer.UploadedFile{
+		{Filename: "flattened/date=2024-01-01/0000000000-0000000100.parquet", Table: "flattened", Size: 100, Rows: 2},
+	})
+	require.NoError(t, err)
+	replicate(committer, append([]string{"flattened/date=2024-01-01/0000000000-0000000100.parquet"}, first...))
+
+	second, err := committer.Commit(ctx, store, "0000000100-0000000200", []writer.UploadedFile{
+		{Filename: "flattened/date=2024-01-01/0000000100-0000000200.parquet", Table: "flattened", Size: 100, Rows: 2},
+	})
+	require.NoError(t, err)
+	// A new committer, like after a restart, does not know the length of the rewritten
+	// manifests copied before
+	replicate(NewCommitter(tables, overwriteStore), second)
+
+	// Data files and version hints are copied as is
+	assert.Equal(t, readString(t, store, "flattened/date=2024-01-01/0000000000-0000000100.parquet"), readString(t, replica, "flattened/date=2024-01-01/0000000000-0000000100.parquet"))
+	assert.Equal(t, "2", readString(t, replica, "flattened/metadata/version-hint.text"))
+
+	metadata := readMetadata(t, replica, "flattened/metadata/v2.metadata.json")
+	assert.Equal(t, replica.ObjectURL("flattened"), metadata.Location)
+	assert.Equal(t, replica.ObjectURL(second[1]), metadata.currentSnapshot().ManifestList)
+	assert.Equal(t, replica.ObjectURL(first[1]), metadata.Snapshots[0].ManifestList)
+	assert.Equal(t, replica.ObjectURL("flattened/metadata/v1.metadata.json"), metadata.MetadataLog[0].MetadataFile)
+	assert.Equal(t, readMetadata(t, store, "flattened/metadata/v2.metadata.json").Properties, metadata.Properties)
+
+	manifests, err := readAvroFile[manifestFile](ctx, replica, second[1])
+	require.NoError(t, err)
+	require.Len(t, manifests, 2)
+	for i, filename := range []string{second[0], first[0]} {
+		assert.Equal(t, replica.ObjectURL(filename), manifests[i].ManifestPath)
+		assert.Equal(t, int64(len(readBytes(t, replica, filename))), manifests[i].ManifestLength)
+	}
+
+	entries, err := readAvroFile[manifestEntry](ctx, replica, first[0])
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, replica.ObjectURL("flattened/date=2024-01-01/0000000000-0000000100.parquet"), entries[0].DataFile.FilePath)
+	assert.Equal(t, map[string]any{"date": "2024-01-01"}, entries[0].DataFile.Partition)
+}
+
+func newStores(t *testing.T) (store dstore.Store, overwriteStore dstore.Store) {
+	t.Helper()
+
+	dir := t.TempDir()
+	store, err := dstore.NewStore("file://"+dir, "", "", false)
+	require.NoError(t, err)
+	overwriteStore, err = dstore.NewStore("file://"+dir, "", "", true)
+	require.NoError(t, err)
+
+	return store, overwriteStore
+}
+
+func readMetadata(t *testing.T, store dstore.Store, filename string) *TableMetadata {
+	t.Helper()
+
+	metadata := &TableMetadata{}
+	require.NoError(t, json.Unmarshal([]byte(readString(t, store, filename)), metadata))
+
+	return metadata
+}
+
+func readString(t *testing.T, store dstore.Store, filename string) string {
+	t.Helper()
+
+	return strings.TrimSpace(string(readBytes(t, store, filename)))
+}
+
+func readBytes(t *testing.T, store dstore.Store, filename string) []byte {
+	t.Helper()
+
+	reader, err := store.OpenObject(context.Background(), filename)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	return content
+}
@@ -0,0 +1,5 @@
+package iceberg
+
+import "github.com/streamingfast/logging"
+
+var zlog, tracer = logging.PackageLogger("iceberg", "github.com/streamingfast/substreams-sink-files/v2/iceberg_test")
@@ -0,0 +1,326 @@
+package iceberg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/ocf"
+	"github.com/streamingfast/dstore"
+)
+
+const (
+	manifestEntryStatusAdded   = 1
+	manifestEntryStatusDeleted = 2
+)
+
+// manifestEntrySchema is the Avro schema of manifest entries, without the data_file fields
+// of delete files and encryption, the partition record being given by the partition spec.
+const manifestEntrySchema = `{
+	"type": "record",
+	"name": "manifest_entry",
+	"fields": [
+		{"name": "status", "type": "int", "field-id": 0},
+		{"name": "snapshot_id", "type": ["null", "long"], "default": null, "field-id": 1},
+		{"name": "sequence_number", "type": ["null", "long"], "default": null, "field-id": 3},
+		{"name": "file_sequence_number", "type": ["null", "long"], "default": null, "field-id": 4},
+		{"name": "data_file", "field-id": 2, "type": {
+			"type": "record",
+			"name": "r2",
+			"fields": [
+				{"name": "content", "type": "int", "field-id": 134},
+				{"name": "file_path", "type": "string", "field-id": 100},
+				{"name": "file_format", "type": "string", "field-id": 101},
+				{"name": "partition", "type": %s, "field-id": 102},
+				{"name": "record_count", "type": "long", "field-id": 103},
+				{"name": "file_size_in_bytes", "type": "long", "field-id": 104},
+				{"name": "value_counts", "type": ["null", %s], "default": null, "field-id": 109},
+				{"name": "null_value_counts", "type": ["null", %s], "default": null, "field-id": 110},
+				{"name": "lower_bounds", "type": ["null", %s], "default": null, "field-id": 125},
+				{"name": "upper_bounds", "type": ["null", %s], "default": null, "field-id": 128}
+			]
+		}}
+	]
+}`
+
+// manifestFileSchema is the Avro schema of the entries of manifest lists.
+const manifestFileSchema = `{
+	"type": "record",
+	"name": "manifest_file",
+	"fields": [
+		{"name": "manifest_path", "type": "string", "field-id": 500},
+		{"name": "manifest_length", "type": "long", "field-id": 501},
+		{"name": "partition_spec_id", "type": "int", "field-id": 502},
+		{"name": "content", "type": "int", "field-id": 517},
+		{"name": "sequence_number", "type": "long", "field-id": 515},
+		{"name": "min_sequence_number", "type": "long", "field-id": 516},
+		{"name": "added_snapshot_id", "type": "long", "field-id": 503},
+		{"name": "added_files_count", "type": "int", "field-id": 504},
+		{"name": "existing_files_count", "type": "int", "field-id": 505},
+		{"name": "deleted_files_count", "type": "int", "field-id": 506},
+		{"name": "added_rows_count", "type": "long", "field-id": 512},
+		{"name": "existing_rows_count", "type": "long", "field-id": 513},
+		{"name": "deleted_rows_count", "type": "long", "field-id": 514},
+		{"name": "partitions", "type": ["null", {
+			"type": "array",
+			"element-id": 508,
+			"items": {
+				"type": "record",
+				"name": "r508",
+				"fields": [
+					{"name": "contains_null", "type": "boolean", "field-id": 509},
+					{"name": "contains_nan", "type": ["null", "boolean"], "default": null, "field-id": 518},
+					{"name": "lower_bound", "type": ["null", "bytes"], "default": null, "field-id": 510},
+					{"name": "upper_bound", "type": ["null", "bytes"], "default": null, "field-id": 511}
+				]
+			}
+		}], "default": null, "field-id": 507}
+	]
+}`
+
+type manifestEntry struct {
+	Status             int32    `avro:"status"`
+	SnapshotID         *int64   `avro:"snapshot_id"`
+	SequenceNumber     *int64   `avro:"sequence_number"`
+	FileSequenceNumber *int64   `avro:"file_sequence_number"`
+	DataFile           dataFile `avro:"data_file"`
+}
+
+type dataFile struct {
+	Content         int32          `avro:"content"`
+	FilePath        string         `avro:"file_path"`
+	FileFormat      string         `avro:"file_format"`
+	Partition       map[string]any `avro:"partition"`
+	RecordCount     int64          `avro:"record_count"`
+	FileSizeInBytes int64          `avro:"file_size_in_bytes"`
+	ValueCounts     *[]longEntry   `avro:"value_counts"`
+	NullValueCounts *[]longEntry   `avro:"null_value_counts"`
+	LowerBounds     *[]bytesEntry  `avro:"lower_bounds"`
+	UpperBounds     *[]bytesEntry  `avro:"upper_bounds"`
+}
+
+// longEntry and bytesEntry are the entries of the maps keyed by field id of data files,
+// Avro maps only having string keys.
+type longEntry struct {
+	Key   int32 `avro:"key"`
+	Value int64 `avro:"value"`
+}
+
+type bytesEntry struct {
+	Key   int32  `avro:"key"`
+	Value []byte `avro:"value"`
+}
+
+type manifestFile struct {
+	ManifestPath       string          `avro:"manifest_path"`
+	ManifestLength     int64           `avro:"manifest_length"`
+	PartitionSpecID    int32           `avro:"partition_spec_id"`
+	Content            int32           `avro:"content"`
+	SequenceNumber     int64           `avro:"sequence_number"`
+	MinSequenceNumber  int64           `avro:"min_sequence_number"`
+	AddedSnapshotID    int64           `avro:"added_snapshot_id"`
+	AddedFilesCount    int32           `avro:"added_files_count"`
+	ExistingFilesCount int32           `avro:"existing_files_count"`
+	DeletedFilesCount  int32           `avro:"deleted_files_count"`
+	AddedRowsCount     int64           `avro:"added_rows_count"`
+	ExistingRowsCount  int64           `avro:"existing_rows_count"`
+	DeletedRowsCount   int64           `avro:"deleted_rows_count"`
+	Partitions         *[]fieldSummary `avro:"partitions"`
+}
+
+type fieldSummary struct {
+	ContainsNull bool    `avro:"contains_null"`
+	ContainsNaN  *bool   `avro:"contains_nan"`
+	LowerBound   *[]byte `avro:"lower_bound"`
+	UpperBound   *[]byte `avro:"upper_bound"`
+}
+
+// mapSchema returns the Avro schema of an Iceberg map with int keys, which is an array of
+// key/value records.
+func mapSchema(keyID, valueID int, valueType string) string {
+	return fmt.Sprintf(`{"type": "array", "logicalType": "map", "items": {
+		"type": "record",
+		"name": "k%d_v%d",
+		"fields": [
+			{"name": "key", "type": "int", "field-id": %d},
+			{"name": "value", "type": %q, "field-id": %d}
+		]
+	}}`, keyID, valueID, keyID, valueType, valueID)
+}
+
+// partitionSchema returns the Avro schema of the partition record of the spec's data files,
+// all partition columns being strings.
+func partitionSchema(spec *PartitionSpec) string {
+	fields := make([]string, len(spec.Fields))
+	for i, field := range spec.Fields {
+		fields[i] = fmt.Sprintf(`{"name": %q, "type": ["null", "string"], "default": null, "field-id": %d}`, avroName(field.Name), field.FieldID)
+	}
+
+	return fmt.Sprintf(`{"type": "record", "name": "r102", "fields": [%s]}`, strings.Join(fields, ","))
+}
+
+func manifestEntryAvroSchema(spec *PartitionSpec) (avro.Schema, error) {
+	return avro.ParseWithCache(fmt.Sprintf(manifestEntrySchema,
+		partitionSchema(spec),
+		mapSchema(119, 120, "long"),
+		mapSchema(121, 122, "long"),
+		mapSchema(126, 127, "bytes"),
+		mapSchema(129, 130, "bytes"),
+	), "", &avro.SchemaCache{})
+}
+
+// avroName returns the name as a valid Avro name, invalid characters being replaced like
+// Iceberg does.
+func avroName(name string) string {
+	out := &strings.Builder{}
+	for i, r := range name {
+		valid := r == '_' || (r < unicode.MaxASCII && unicode.IsLetter(r)) || (i > 0 && r < unicode.MaxASCII && unicode.IsDigit(r))
+		switch {
+		case valid:
+			out.WriteRune(r)
+		case i == 0 && r < unicode.MaxASCII && unicode.IsDigit(r):
+			out.WriteString("_" + string(r))
+		default:
+			out.WriteString("_x" + strings.ToUpper(strconv.FormatInt(int64(r), 16)))
+		}
+	}
+
+	return out.String()
+}
+
+// writeManifest writes the manifest of the data files added by a snapshot, it returns the
+// length of the manifest.
+func writeManifest(ctx context.Context, store dstore.Store, filename string, schema *Schema, spec *PartitionSpec, entries []manifestEntry) (int64, error) {
+	avroSchema, err := manifestEntryAvroSchema(spec)
+	if err != nil {
+		return 0, fmt.Errorf("parse manifest entry schema: %w", err)
+	}
+
+	schemaJSON, err := json.Marshal(schema)
+	if err != nil {
+		return 0, fmt.Errorf("marshal schema: %w", err)
+	}
+
+	specJSON, err := json.Marshal(spec.Fields)
+	if err != nil {
+		return 0, fmt.Errorf("marshal partition spec: %w", err)
+	}
+
+	return writeAvroFile(ctx, store, filename, avroSchema, map[string][]byte{
+		"schema":            schemaJSON,
+		"schema-id":         []byte(strconv.Itoa(schema.SchemaID)),
+		"partition-spec":    specJSON,
+		"partition-spec-id": []byte(strconv.Itoa(spec.SpecID)),
+		"format-version":    []byte(strconv.Itoa(formatVersion)),
+		"content":           []byte("data"),
+	}, entries)
+}
+
+// writeManifestList writes the list of manifests of a snapshot, it returns the length of
+// the manifest list.
+func writeManifestList(ctx context.Context, store dstore.Store, filename string, snapshot *Snapshot, manifests []manifestFile) (int64, error) {
+	avroSchema, err := avro.Parse(manifestFileSchema)
+	if err != nil {
+		return 0, fmt.Errorf("parse manifest file schema: %w", err)
+	}
+
+	parentSnapshotID := "null"
+	if snapshot.ParentSnapshotID != nil {
+		parentSnapshotID = strconv.FormatInt(*snapshot.ParentSnapshotID, 10)
+	}
+
+	return writeAvroFile(ctx, store, filename, avroSchema, map[string][]byte{
+		"snapshot-id":        []byte(strconv.FormatInt(snapshot.SnapshotID, 10)),
+		"parent-snapshot-id": []byte(parentSnapshotID),
+		"sequence-number":    []byte(strconv.FormatInt(snapshot.SequenceNumber, 10)),
+		"format-version":     []byte(strconv.Itoa(formatVersion)),
+	}, manifests)
+}
+
+func writeAvroFile[T any](ctx context.Context, store dstore.Store, filename string, schema avro.Schema, metadata map[string][]byte, records []T) (int64, error) {
+	content, err := encodeAvroFile(schema, metadata, records)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := store.WriteObject(ctx, filename, bytes.NewReader(content)); err != nil {
+		return 0, fmt.Errorf("write %q: %w", filename, err)
+	}
+
+	return int64(len(content)), nil
+}
+
+// encodeAvroFile returns the content of an Avro file holding the records, the metadata
+// being the file's user metadata.
+func encodeAvroFile[T any](schema avro.Schema, metadata map[string][]byte, records []T) ([]byte, error) {
+	content := &bytes.Buffer{}
+	encoder, err := ocf.NewEncoderWithSchema(schema, content,
+		ocf.WithCodec(ocf.Deflate),
+		ocf.WithMetadata(metadata),
+		ocf.WithSchemaMarshaler(ocf.FullSchemaMarshaler),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("new avro encoder: %w", err)
+	}
+
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, fmt.Errorf("encode record: %w", err)
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("close avro encoder: %w", err)
+	}
+
+	return content.Bytes(), nil
+}
+
+// readAvroFile reads the records of the Avro file, the fields of the file that T doesn't
+// have are skipped.
+func readAvroFile[T any](ctx context.Context, store dstore.Store, filename string) ([]T, error) {
+	reader, err := store.OpenObject(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read %q: %w", filename, err)
+	}
+
+	out, _, err := decodeAvroFile[T](content)
+	return out, err
+}
+
+// decodeAvroFile returns the records of the Avro file and the file's metadata, which
+// includes its schema under `avro.schema`.
+func decodeAvroFile[T any](content []byte) ([]T, map[string][]byte, error) {
+	decoder, err := ocf.NewDecoder(bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, fmt.Errorf("new avro decoder: %w", err)
+	}
+
+	var out []T
+	for decoder.HasNext() {
+		var record T
+		if err := decoder.Decode(&record); err != nil {
+			return nil, nil, fmt.Errorf("decode record: %w", err)
+		}
+
+		out = append(out, record)
+	}
+
+	if err := decoder.Error(); err != nil {
+		return nil, nil, fmt.Errorf("read records: %w", err)
+	}
+
+	return out, decoder.Metadata(), nil
+}
@@ -0,0 +1,139 @@
+package iceberg
+
+import (
+	"encoding/json"
+)
+
+// formatVersion is the version of the Iceberg table format written.
+const formatVersion = 2
+
+// TableMetadata is the content of a table's metadata file. Fields written by other tools
+// that are not modeled here are kept as-is when the metadata is written again.
+type TableMetadata struct {
+	FormatVersion      int                    `json:"format-version"`
+	TableUUID          string                 `json:"table-uuid"`
+	Location           string                 `json:"location"`
+	LastSequenceNumber int64                  `json:"last-sequence-number"`
+	LastUpdatedMs      int64                  `json:"last-updated-ms"`
+	LastColumnID       int                    `json:"last-column-id"`
+	CurrentSchemaID    int                    `json:"current-schema-id"`
+	Schemas            []*Schema              `json:"schemas"`
+	DefaultSpecID      int                    `json:"default-spec-id"`
+	PartitionSpecs     []*PartitionSpec       `json:"partition-specs"`
+	LastPartitionID    int                    `json:"last-partition-id"`
+	DefaultSortOrderID int                    `json:"default-sort-order-id"`
+	SortOrders         []json.RawMessage      `json:"sort-orders"`
+	Properties         map[string]string      `json:"properties"`
+	CurrentSnapshotID  *int64                 `json:"current-snapshot-id,omitempty"`
+	Refs               map[string]SnapshotRef `json:"refs"`
+	Snapshots          []*Snapshot            `json:"snapshots"`
+	SnapshotLog        []SnapshotLogEntry     `json:"snapshot-log"`
+	MetadataLog        []MetadataLogEntry     `json:"metadata-log"`
+
+	unknown map[string]json.RawMessage
+}
+
+type PartitionSpec struct {
+	SpecID int              `json:"spec-id"`
+	Fields []PartitionField `json:"fields"`
+}
+
+type PartitionField struct {
+	SourceID  int    `json:"source-id"`
+	FieldID   int    `json:"field-id"`
+	Name      string `json:"name"`
+	Transform string `json:"transform"`
+}
+
+type SnapshotRef struct {
+	SnapshotID int64  `json:"snapshot-id"`
+	Type       string `json:"type"`
+}
+
+type Snapshot struct {
+	SnapshotID       int64             `json:"snapshot-id"`
+	ParentSnapshotID *int64            `json:"parent-snapshot-id,omitempty"`
+	SequenceNumber   int64             `json:"sequence-number"`
+	TimestampMs      int64             `json:"timestamp-ms"`
+	ManifestList     string            `json:"manifest-list"`
+	Summary          map[string]string `json:"summary"`
+	SchemaID         *int              `json:"schema-id,omitempty"`
+}
+
+type SnapshotLogEntry struct {
+	SnapshotID  int64 `json:"snapshot-id"`
+	TimestampMs int64 `json:"timestamp-ms"`
+}
+
+type MetadataLogEntry struct {
+	MetadataFile string `json:"metadata-file"`
+	TimestampMs  int64  `json:"timestamp-ms"`
+}
+
+func (m *TableMetadata) UnmarshalJSON(data []byte) error {
+	type metadata TableMetadata
+	if err := json.Unmarshal(data, (*metadata)(m)); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, &m.unknown)
+}
+
+func (m TableMetadata) MarshalJSON() ([]byte, error) {
+	type metadata TableMetadata
+	known, err := json.Marshal(metadata(m))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.unknown) == 0 {
+		return known, nil
+	}
+
+	out := map[string]json.RawMessage{}
+	if err := json.Unmarshal(known, &out); err != nil {
+		return nil, err
+	}
+
+	for key, value := range m.unknown {
+		if _, found := out[key]; !found {
+			out[key] = value
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+func (m *TableMetadata) currentSchema() *Schema {
+	for _, schema := range m.Schemas {
+		if schema.SchemaID == m.CurrentSchemaID {
+			return schema
+		}
+	}
+
+	return nil
+}
+
+func (m *TableMetadata) defaultSpec() *PartitionSpec {
+	for _, spec := range m.PartitionSpecs {
+		if spec.SpecID == m.DefaultSpecID {
+			return spec
+		}
+	}
+
+	return nil
+}
+
+func (m *TableMetadata) currentSnapshot() *Snapshot {
+	if m.CurrentSnapshotID == nil {
+		return nil
+	}
+
+	for _, snapshot := range m.Snapshots {
+		if snapshot.SnapshotID == *m.CurrentSnapshotID {
+			return snapshot
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package iceberg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"strings"
+
+	"github.com/hamba/avro/v2"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler"
+)
+
+var _ bundler.ReplicaRewriter = (*Committer)(nil)
+
+// RewriteForReplica implements bundler.ReplicaRewriter. The metadata of tables refers to
+// manifest lists, manifests and data files by their URL in the output store, so the
+// metadata files copied to a replica are rewritten to refer to the replica's files, like
+// if the table had been written to the replica. Locations outside of the output store are
+// kept as is, and so are other files.
+func (c *Committer) RewriteForReplica(ctx context.Context, source dstore.Store, replica dstore.Store, filename string, content io.Reader) (io.Reader, error) {
+	if path.Base(path.Dir(filename)) != MetadataDir {
+		return content, nil
+	}
+
+	relocation := newRelocation(source, replica)
+	name := path.Base(filename)
+
+	var rewrite func(data []byte) ([]byte, error)
+	switch {
+	case metadataFilenameRegex.MatchString(name):
+		rewrite = relocation.rewriteMetadata
+	case strings.HasPrefix(name, "snap-") && strings.HasSuffix(name, ".avro"):
+		rewrite = func(data []byte) ([]byte, error) {
+			return c.rewriteManifestList(ctx, source, relocation, data)
+		}
+	case strings.HasSuffix(name, ".avro"):
+		rewrite = func(data []byte) ([]byte, error) {
+			return c.rewriteManifest(relocation, relocation.location(source.ObjectURL(filename)), data)
+		}
+	default:
+		return content, nil
+	}
+
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	rewritten, err := rewrite(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(rewritten), nil
+}
+
+// rewriteManifestList rewrites the location of the manifests of a manifest list, their
+// length being the one of the rewritten manifests.
+func (c *Committer) rewriteManifestList(ctx context.Context, source dstore.Store, relocation relocation, data []byte) ([]byte, error) {
+	records, schema, metadata, err := decodeRewrittenFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("manifest list: %w", err)
+	}
+
+	for _, record := range records {
+		manifestPath, _ := record["manifest_path"].(string)
+		location := relocation.location(manifestPath)
+		if location == manifestPath {
+			continue
+		}
+
+		length, err := c.replicaManifestLength(ctx, source, relocation, manifestPath)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %q: %w", manifestPath, err)
+		}
+
+		record["manifest_path"] = location
+		record["manifest_length"] = length
+	}
+
+	return encodeAvroFile(schema, metadata, records)
+}
+
+// rewriteManifest rewrites the location of the data files of a manifest, the length of the
+// rewritten manifest being kept for the manifest lists referring to it.
+func (c *Committer) rewriteManifest(relocation relocation, location string, data []byte) ([]byte, error) {
+	records, schema, metadata, err := decodeRewrittenFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+
+	for _, record := range records {
+		dataFile, ok := record["data_file"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("manifest entry without data file")
+		}
+
+		filePath, _ := dataFile["file_path"].(string)
+		dataFile["file_path"] = relocation.location(filePath)
+	}
+
+	rewritten, err := encodeAvroFile(schema, metadata, records)
+	if err != nil {
+		return nil, err
+	}
+
+	c.replicaMu.Lock()
+	c.replicaManifestLengths[location] = int64(len(rewritten))
+	c.replicaMu.Unlock()
+
+	return rewritten, nil
+}
+
+// replicaManifestLength returns the length of the manifest once rewritten for the replica.
+// Manifests are copied before the manifest lists referring to them, their length is known
+// unless they were copied by a previous run, the manifest of the output store is then
+// rewritten again, which gives the same length.
+func (c *Committer) replicaManifestLength(ctx context.Context, source dstore.Store, relocation relocation, manifestPath string) (int64, error) {
+	location := relocation.location(manifestPath)
+
+	c.replicaMu.Lock()
+	length, found := c.replicaManifestLengths[location]
+	c.replicaMu.Unlock()
+	if found {
+		return length, nil
+	}
+
+	reader, err := source.OpenObject(ctx, strings.TrimPrefix(manifestPath, relocation.from))
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return 0, fmt.Errorf("read: %w", err)
+	}
+
+	rewritten, err := c.rewriteManifest(relocation, location, data)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(rewritten)), nil
+}
+
+// decodeRewrittenFile returns the records of the Avro file as generic values, so that the
+// fields written by other tools are kept, along with its schema and user metadata.
+func decodeRewrittenFile(data []byte) ([]map[string]any, avro.Schema, map[string][]byte, error) {
+	records, metadata, err := decodeAvroFile[map[string]any](data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Manifests of different partition specs have records of the same name, the schema must
+	// not be cached
+	schema, err := avro.ParseWithCache(string(metadata["avro.schema"]), "", &avro.SchemaCache{})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parse schema: %w", err)
+	}
+
+	maps.DeleteFunc(metadata, func(key string, _ []byte) bool { return strings.HasPrefix(key, "avro.") })
+	return records, schema, metadata, nil
+}
+
+// relocation changes the locations of files of the output store to the ones of the same
+// files in a replica.
+type relocation struct {
+	from string
+	to   string
+}
+
+func newRelocation(source dstore.Store, replica dstore.Store) relocation {
+	return relocation{from: storePrefix(source), to: storePrefix(replica)}
+}
+
+// storePrefix returns the prefix of the location of the store's files.
+func storePrefix(store dstore.Store) string {
+	return strings.TrimSuffix(store.ObjectURL(""), "/") + "/"
+}
+
+func (r relocation) location(location string) string {
+	if relative, found := strings.CutPrefix(location, r.from); found {
+		return r.to + relative
+	}
+
+	return location
+}
+
+// rewriteMetadata rewrites the location of the table, of the manifest lists of its
+// snapshots and of its previous metadata files.
+func (r relocation) rewriteMetadata(data []byte) ([]byte, error) {
+	metadata := &TableMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("unmarshal metadata: %w", err)
+	}
+
+	metadata.Location = r.location(metadata.Location)
+	for _, snapshot := range metadata.Snapshots {
+		snapshot.ManifestList = r.location(snapshot.ManifestList)
+	}
+	for i := range metadata.MetadataLog {
+		metadata.MetadataLog[i].MetadataFile = r.location(metadata.MetadataLog[i].MetadataFile)
+	}
+
+	return json.Marshal(metadata)
+}
@@ -0,0 +1,395 @@
+package iceberg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// nestedFieldIDStart is the first id given to nested fields, list elements and partition
+// columns. It's above the largest Protobuf field number (2^29 - 1) so that those ids never
+// collide with the ids of top-level fields, which are their Protobuf field number.
+const nestedFieldIDStart = 1 << 29
+
+// Schema is the JSON serialization of an Iceberg schema, the type of fields being either
+// the name of a primitive type, a *StructType or a *ListType.
+type Schema struct {
+	Type     string  `json:"type"`
+	SchemaID int     `json:"schema-id"`
+	Fields   []Field `json:"fields"`
+}
+
+type Field struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Required bool   `json:"required"`
+	Type     any    `json:"type"`
+	Doc      string `json:"doc,omitempty"`
+}
+
+type StructType struct {
+	Type   string  `json:"type"`
+	Fields []Field `json:"fields"`
+}
+
+type ListType struct {
+	Type            string `json:"type"`
+	ElementID       int    `json:"element-id"`
+	Element         any    `json:"element"`
+	ElementRequired bool   `json:"element-required"`
+}
+
+func (f *Field) UnmarshalJSON(data []byte) error {
+	type field Field
+	raw := struct {
+		*field
+		Type json.RawMessage `json:"type"`
+	}{field: (*field)(f)}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	f.Type, err = unmarshalType(raw.Type)
+	return err
+}
+
+func (t *ListType) UnmarshalJSON(data []byte) error {
+	type list ListType
+	raw := struct {
+		*list
+		Element json.RawMessage `json:"element"`
+	}{list: (*list)(t)}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var err error
+	t.Element, err = unmarshalType(raw.Element)
+	return err
+}
+
+func unmarshalType(data json.RawMessage) (any, error) {
+	var primitive string
+	if err := json.Unmarshal(data, &primitive); err == nil {
+		return primitive, nil
+	}
+
+	var nested struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &nested); err != nil {
+		return nil, err
+	}
+
+	switch nested.Type {
+	case "struct":
+		out := &StructType{}
+		return out, json.Unmarshal(data, out)
+	case "list":
+		out := &ListType{}
+		return out, json.Unmarshal(data, out)
+	}
+
+	return nil, fmt.Errorf("unsupported type %q", nested.Type)
+}
+
+// sameFields returns true if both schemas have the same fields, whatever their id.
+func (s *Schema) sameFields(other *Schema) bool {
+	left, _ := json.Marshal(s.Fields)
+	right, _ := json.Marshal(other.Fields)
+
+	return string(left) == string(right)
+}
+
+// field returns the top-level field with the given name, nil if there is none.
+func (s *Schema) field(name string) *Field {
+	for i := range s.Fields {
+		if s.Fields[i].Name == name {
+			return &s.Fields[i]
+		}
+	}
+
+	return nil
+}
+
+// fieldIDs gives their id to the fields of a schema. Top-level fields use their Protobuf
+// field number while nested fields, list elements and partition columns reuse the id
+// they have in the table's current schema, found by path, or get a new one.
+type fieldIDs struct {
+	byPath map[string]int
+	last   int
+}
+
+func newFieldIDs(current *Schema, lastColumnID int) *fieldIDs {
+	ids := &fieldIDs{byPath: map[string]int{}, last: max(lastColumnID, nestedFieldIDStart-1)}
+	if current != nil {
+		ids.collect("", current.Fields, true)
+	}
+
+	return ids
+}
+
+func (ids *fieldIDs) collect(parent string, fields []Field, topLevel bool) {
+	for _, field := range fields {
+		path := joinPath(parent, field.Name)
+		if !topLevel || field.ID >= nestedFieldIDStart {
+			ids.byPath[path] = field.ID
+		}
+
+		ids.collectType(path, field.Type)
+	}
+}
+
+func (ids *fieldIDs) collectType(path string, fieldType any) {
+	switch fieldType := fieldType.(type) {
+	case *StructType:
+		ids.collect(path, fieldType.Fields, false)
+	case *ListType:
+		element := joinPath(path, "element")
+		ids.byPath[element] = fieldType.ElementID
+		ids.collectType(element, fieldType.Element)
+	}
+}
+
+func (ids *fieldIDs) nested(path string) int {
+	if id, found := ids.byPath[path]; found {
+		return id
+	}
+
+	ids.last++
+	ids.byPath[path] = ids.last
+	return ids.last
+}
+
+func joinPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+
+	return parent + "." + name
+}
+
+// newSchema returns the Iceberg schema of the table, the partition columns being appended
+// as optional string columns. The ids of fields that are not top-level are taken from the
+// table's current schema, nil for a new table, new fields getting ids above lastColumnID.
+// It returns the largest field id given.
+func newSchema(table parquetx.TableResult, partitionColumns []string, current *Schema, lastColumnID int) (*Schema, int, error) {
+	ids := newFieldIDs(current, lastColumnID)
+
+	fields, err := schemaFields(table.Schema, table.Descriptor, "", ids)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	out := &Schema{Type: "struct", Fields: fields}
+	for _, column := range partitionColumns {
+		if out.field(column) != nil {
+			return nil, 0, fmt.Errorf("partition column %q is also a column of the table", column)
+		}
+
+		out.Fields = append(out.Fields, Field{ID: ids.nested(column), Name: column, Type: "string"})
+	}
+
+	lastColumnID = ids.last
+	for _, field := range out.Fields {
+		lastColumnID = max(lastColumnID, field.ID)
+	}
+
+	return out, lastColumnID, nil
+}
+
+func schemaFields(node parquet.Node, descriptor protoreflect.MessageDescriptor, parent string, ids *fieldIDs) ([]Field, error) {
+	var out []Field
+	for _, field := range node.Fields() {
+		protoField := descriptor.Fields().ByName(protoreflect.Name(field.Name()))
+		if protoField == nil {
+			return nil, fmt.Errorf("column %q has no field in message %s", field.Name(), descriptor.FullName())
+		}
+
+		path := joinPath(parent, field.Name())
+		id := int(protoField.Number())
+		if parent != "" {
+			id = ids.nested(path)
+		}
+
+		fieldType, err := nodeType(field, protoField, path, ids)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", field.Name(), err)
+		}
+
+		var doc string
+		if isNanosecondTimestamp(field) {
+			doc = "Nanoseconds since Unix epoch"
+		}
+
+		out = append(out, Field{
+			ID:       id,
+			Name:     field.Name(),
+			Required: !field.Optional(),
+			Type:     fieldType,
+			Doc:      doc,
+		})
+	}
+
+	return out, nil
+}
+
+func nodeType(node parquet.Node, field protoreflect.FieldDescriptor, path string, ids *fieldIDs) (out any, err error) {
+	elementPath := path
+	if node.Repeated() {
+		elementPath = joinPath(path, "element")
+	}
+
+	if node.Leaf() {
+		out = primitiveType(node)
+	} else {
+		fields, err := schemaFields(node, field.Message(), elementPath, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		out = &StructType{Type: "struct", Fields: fields}
+	}
+
+	if node.Repeated() {
+		return &ListType{Type: "list", ElementID: ids.nested(elementPath), Element: out, ElementRequired: true}, nil
+	}
+
+	return out, nil
+}
+
+// primitiveType returns the Iceberg type of the leaf node. Iceberg has no unsigned integers
+// nor nanosecond timestamps in format version 2, so unsigned integers are read as longs,
+// values above 2^63 - 1 being negative, and timestamps as longs of nanoseconds.
+func primitiveType(node parquet.Node) string {
+	columnType := node.Type()
+	logicalType := columnType.LogicalType()
+
+	switch columnType.Kind() {
+	case parquet.Boolean:
+		return "boolean"
+
+	case parquet.Int32:
+		if logicalType != nil && logicalType.Date != nil {
+			return "date"
+		}
+		if logicalType != nil && logicalType.Integer != nil && !logicalType.Integer.IsSigned {
+			return "long"
+		}
+		return "int"
+
+	case parquet.Int64:
+		return "long"
+
+	case parquet.Float:
+		return "float"
+
+	case parquet.Double:
+		return "double"
+
+	case parquet.ByteArray:
+		if logicalType != nil && (logicalType.UTF8 != nil || logicalType.Enum != nil || logicalType.Json != nil) {
+			return "string"
+		}
+		return "binary"
+
+	case parquet.FixedLenByteArray:
+		return fmt.Sprintf("fixed[%d]", columnType.Length())
+	}
+
+	return "binary"
+}
+
+func isNanosecondTimestamp(node parquet.Node) bool {
+	if !node.Leaf() {
+		return false
+	}
+
+	logicalType := node.Type().LogicalType()
+	return logicalType != nil && logicalType.Timestamp != nil && logicalType.Timestamp.Unit.Nanos != nil
+}
+
+// leafField is a column of the schema that is not part of a list.
+type leafField struct {
+	id        int
+	fieldType string
+}
+
+// leafFields returns the columns of the schema that are not part of a list, by their
+// dotted path.
+func leafFields(schema *Schema) map[string]leafField {
+	out := map[string]leafField{}
+	collectLeafFields(out, "", schema.Fields)
+
+	return out
+}
+
+func collectLeafFields(out map[string]leafField, parent string, fields []Field) {
+	for _, field := range fields {
+		path := joinPath(parent, field.Name)
+
+		switch fieldType := field.Type.(type) {
+		case string:
+			out[path] = leafField{id: field.ID, fieldType: fieldType}
+		case *StructType:
+			collectLeafFields(out, path, fieldType.Fields)
+		}
+	}
+}
+
+// nameMapping returns the name mapping of the schema, stored in the table's properties, it
+// lets readers find the columns of the Parquet files, which have no field ids, by name.
+func nameMapping(schema *Schema) (string, error) {
+	content, err := json.Marshal(mappedFields(schema.Fields))
+	if err != nil {
+		return "", fmt.Errorf("marshal name mapping: %w", err)
+	}
+
+	return string(content), nil
+}
+
+type mappedField struct {
+	FieldID int           `json:"field-id"`
+	Names   []string      `json:"names"`
+	Fields  []mappedField `json:"fields,omitempty"`
+}
+
+func mappedFields(fields []Field) []mappedField {
+	out := make([]mappedField, 0, len(fields))
+	for _, field := range fields {
+		out = append(out, mappedField{
+			FieldID: field.ID,
+			Names:   []string{field.Name},
+			Fields:  mappedTypeFields(field.Type),
+		})
+	}
+
+	return out
+}
+
+func mappedTypeFields(fieldType any) []mappedField {
+	switch fieldType := fieldType.(type) {
+	case *StructType:
+		return mappedFields(fieldType.Fields)
+	case *ListType:
+		return []mappedField{{
+			FieldID: fieldType.ElementID,
+			Names:   []string{"element"},
+			Fields:  mappedTypeFields(fieldType.Element),
+		}}
+	}
+
+	return nil
+}
+
+// pathOf returns the dotted path of a column of a Parquet file.
+func pathOf(columnPath []string) string {
+	return strings.Join(columnPath, ".")
+}
@@ -0,0 +1,108 @@
+package iceberg
+
+import (
+	"encoding/json"
+	"testing"
+
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestNewSchema(t *testing.T) {
+	table := findTable(t, &pbtesting.FlattenedMessage{})
+
+	schema, lastColumnID, err := newSchema(table, []string{"date"}, nil, 0)
+	require.NoError(t, err)
+
+	out, err := json.Marshal(schema)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "struct",
+		"schema-id": 0,
+		"fields": [
+			{"id": 1, "name": "number", "required": false, "type": "string"},
+			{"id": 2, "name": "id", "required": true, "type": "string"},
+			{"id": 3, "name": "success", "required": true, "type": "boolean"},
+			{"id": 4, "name": "memo", "required": false, "type": "string"},
+			{"id": 5, "name": "operations", "required": true, "type": {
+				"type": "list", "element-id": 536870914, "element-required": true, "element": {
+					"type": "struct", "fields": [
+						{"id": 536870912, "name": "id", "required": true, "type": "string"},
+						{"id": 536870913, "name": "token", "required": true, "type": "string"}
+					]
+				}
+			}},
+			{"id": 6, "name": "metadata", "required": true, "type": {
+				"type": "list", "element-id": 536870918, "element-required": true, "element": {
+					"type": "struct", "fields": [
+						{"id": 536870915, "name": "address", "required": true, "type": "string"},
+						{"id": 536870916, "name": "symbol", "required": false, "type": "string"},
+						{"id": 536870917, "name": "decimals", "required": true, "type": "string"}
+					]
+				}
+			}},
+			{"id": 7, "name": "provider", "required": false, "type": "string"},
+			{"id": 536870919, "name": "date", "required": false, "type": "string"}
+		]
+	}`, string(out))
+	assert.Equal(t, 536870919, lastColumnID)
+
+	// The ids of nested fields are the ones of the current schema
+	again, againLastColumnID, err := newSchema(table, []string{"date"}, schema, lastColumnID)
+	require.NoError(t, err)
+	assert.True(t, again.sameFields(schema))
+	assert.Equal(t, lastColumnID, againLastColumnID)
+
+	// New fields are given ids after the last column id
+	withoutPartition, _, err := newSchema(table, nil, nil, 0)
+	require.NoError(t, err)
+	withPartition, withPartitionLastColumnID, err := newSchema(table, []string{"date"}, withoutPartition, 536870918)
+	require.NoError(t, err)
+	assert.Equal(t, 536870914, withPartition.field("operations").Type.(*ListType).ElementID)
+	assert.Equal(t, 536870919, withPartition.field("date").ID)
+	assert.Equal(t, 536870919, withPartitionLastColumnID)
+
+	_, _, err = newSchema(table, []string{"memo"}, nil, 0)
+	assert.ErrorContains(t, err, `partition column "memo"`)
+}
+
+func TestNameMapping(t *testing.T) {
+	schema, _, err := newSchema(findTable(t, &pbtesting.FlattenedMessage{}), nil, nil, 0)
+	require.NoError(t, err)
+
+	mapping, err := nameMapping(schema)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[
+		{"field-id": 1, "names": ["number"]},
+		{"field-id": 2, "names": ["id"]},
+		{"field-id": 3, "names": ["success"]},
+		{"field-id": 4, "names": ["memo"]},
+		{"field-id": 5, "names": ["operations"], "fields": [
+			{"field-id": 536870914, "names": ["element"], "fields": [
+				{"field-id": 536870912, "names": ["id"]},
+				{"field-id": 536870913, "names": ["token"]}
+			]}
+		]},
+		{"field-id": 6, "names": ["metadata"], "fields": [
+			{"field-id": 536870918, "names": ["element"], "fields": [
+				{"field-id": 536870915, "names": ["address"]},
+				{"field-id": 536870916, "names": ["symbol"]},
+				{"field-id": 536870917, "names": ["decimals"]}
+			]}
+		]},
+		{"field-id": 7, "names": ["provider"]}
+	]`, mapping)
+}
+
+func findTable(t *testing.T, message proto.Message) parquetx.TableResult {
+	t.Helper()
+
+	tables, _, err := parquetx.FindTablesInMessageDescriptor(message.ProtoReflect().Descriptor(), nil, zlog, tracer)
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+
+	return tables[0]
+}
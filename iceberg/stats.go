@@ -0,0 +1,105 @@
+package iceberg
+
+import (
+	"encoding/binary"
+	"math"
+	"unicode/utf8"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+)
+
+// stringBoundLength is the length, in characters, past which string bounds are truncated
+// like Iceberg writers do by default. The truncated lower bound is still a lower bound
+// while the upper bound is omitted as its truncation would not be an upper bound anymore.
+const stringBoundLength = 16
+
+// fileMetrics returns the value counts, null counts and bounds of the file's columns keyed
+// by field id, columns part of a list being skipped.
+func fileMetrics(schema *Schema, file writer.UploadedFile) (values, nulls []longEntry, lower, upper []bytesEntry) {
+	fields := leafFields(schema)
+
+	for _, column := range file.Columns {
+		field, found := fields[pathOf(column.Path)]
+		if column.Repeated || !found {
+			continue
+		}
+
+		id := int32(field.id)
+		values = append(values, longEntry{Key: id, Value: column.Values})
+		nulls = append(nulls, longEntry{Key: id, Value: column.Nulls})
+
+		if !column.HasBounds() {
+			continue
+		}
+
+		if bound, ok := boundValue(field.fieldType, column.Node, column.Min, column.Max, false); ok {
+			lower = append(lower, bytesEntry{Key: id, Value: bound})
+		}
+		if bound, ok := boundValue(field.fieldType, column.Node, column.Min, column.Max, true); ok {
+			upper = append(upper, bytesEntry{Key: id, Value: bound})
+		}
+	}
+
+	return
+}
+
+// boundValue returns the single-value serialization of the lower or upper bound of the
+// column, false if the column's type has no bounds (binaries and fixed) or the bounds can't
+// be represented.
+func boundValue(fieldType string, node parquet.Node, min, max parquet.Value, upper bool) ([]byte, bool) {
+	value := min
+	if upper {
+		value = max
+	}
+
+	switch fieldType {
+	case "boolean":
+		if value.Boolean() {
+			return []byte{1}, true
+		}
+		return []byte{0}, true
+
+	case "int", "date":
+		return binary.LittleEndian.AppendUint32(nil, uint32(value.Int32())), true
+
+	case "long":
+		switch {
+		case node.Type().Kind() == parquet.Int32:
+			return binary.LittleEndian.AppendUint64(nil, uint64(value.Uint32())), true
+		case isUnsigned(node):
+			// Values above 2^63 - 1 are negative once read as longs, bounds would be wrong
+			if max.Uint64() > math.MaxInt64 {
+				return nil, false
+			}
+			return binary.LittleEndian.AppendUint64(nil, value.Uint64()), true
+		}
+		return binary.LittleEndian.AppendUint64(nil, uint64(value.Int64())), true
+
+	case "float":
+		if number := value.Float(); !math.IsNaN(float64(number)) {
+			return binary.LittleEndian.AppendUint32(nil, math.Float32bits(number)), true
+		}
+
+	case "double":
+		if number := value.Double(); !math.IsNaN(number) {
+			return binary.LittleEndian.AppendUint64(nil, math.Float64bits(number)), true
+		}
+
+	case "string":
+		text := value.ByteArray()
+		if utf8.RuneCount(text) <= stringBoundLength {
+			return append([]byte(nil), text...), true
+		}
+		if !upper {
+			return []byte(string([]rune(string(text))[:stringBoundLength])), true
+		}
+	}
+
+	return nil, false
+}
+
+func isUnsigned(node parquet.Node) bool {
+	logicalType := node.Type().LogicalType()
+	return logicalType != nil && logicalType.Integer != nil && !logicalType.Integer.IsSigned
+}
@@ -0,0 +1,42 @@
+package iceberg
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoundValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		fieldType string
+		node      parquet.Node
+		min, max  parquet.Value
+		wantLower []byte
+		wantUpper []byte
+	}{
+		{"boolean", "boolean", parquet.Leaf(parquet.BooleanType), parquet.ValueOf(false), parquet.ValueOf(true), []byte{0}, []byte{1}},
+		{"int", "int", parquet.Int(32), parquet.ValueOf(int32(-1)), parquet.ValueOf(int32(2)), []byte{0xff, 0xff, 0xff, 0xff}, []byte{2, 0, 0, 0}},
+		{"uint32 as long", "long", parquet.Uint(32), parquet.ValueOf(uint32(1)), parquet.ValueOf(uint32(math.MaxUint32)), []byte{1, 0, 0, 0, 0, 0, 0, 0}, []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}},
+		{"uint64 as long", "long", parquet.Uint(64), parquet.ValueOf(uint64(1)), parquet.ValueOf(uint64(256)), []byte{1, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 1, 0, 0, 0, 0, 0, 0}},
+		{"uint64 above long", "long", parquet.Uint(64), parquet.ValueOf(uint64(1)), parquet.ValueOf(uint64(math.MaxUint64)), nil, nil},
+		{"double", "double", parquet.Leaf(parquet.DoubleType), parquet.ValueOf(1.0), parquet.ValueOf(2.0), []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}, []byte{0, 0, 0, 0, 0, 0, 0, 0x40}},
+		{"double nan", "double", parquet.Leaf(parquet.DoubleType), parquet.ValueOf(math.NaN()), parquet.ValueOf(math.NaN()), nil, nil},
+		{"string", "string", parquet.String(), parquet.ValueOf("a"), parquet.ValueOf("b"), []byte("a"), []byte("b")},
+		{"long string", "string", parquet.String(), parquet.ValueOf(strings.Repeat("é", 20)), parquet.ValueOf(strings.Repeat("ü", 20)), []byte(strings.Repeat("é", 16)), nil},
+		{"binary", "binary", parquet.Leaf(parquet.ByteArrayType), parquet.ValueOf([]byte{1}), parquet.ValueOf([]byte{2}), nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lower, _ := boundValue(test.fieldType, test.node, test.min, test.max, false)
+			upper, _ := boundValue(test.fieldType, test.node, test.min, test.max, true)
+
+			assert.Equal(t, test.wantLower, lower)
+			assert.Equal(t, test.wantUpper, upper)
+		})
+	}
+}
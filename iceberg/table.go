@@ -0,0 +1,578 @@
+package iceberg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/streamingfast/substreams-sink-files/v2/parquetx"
+)
+
+// MetadataDir is the name of the folder of Iceberg tables holding their metadata.
+const MetadataDir = "metadata"
+
+const versionHintFilename = "version-hint.text"
+
+// maxPreviousMetadata is the number of previous metadata files kept in the metadata log,
+// like the default of Iceberg's `write.metadata.previous-versions-max` property.
+const maxPreviousMetadata = 100
+
+// firstPartitionFieldID is the id of the first partition field of partition specs.
+const firstPartitionFieldID = 1000
+
+var metadataFilenameRegex = regexp.MustCompile(`^v(\d+)\.metadata\.json$`)
+
+// table is an Iceberg table of a filesystem catalog, like Iceberg's Hadoop catalog: its
+// metadata files are `metadata/v<version>.metadata.json` and `metadata/version-hint.text`
+// holds the latest version. The table's state is loaded from the store on first use.
+//
+// Metadata files are written through store, which must not overwrite objects so that a
+// version written concurrently by another process is never replaced. The version hint,
+// updated in place, is written through overwriteStore, the same location opened so that
+// it overwrites objects.
+type table struct {
+	store          dstore.Store
+	overwriteStore dstore.Store
+	// dir is the table's directory relative to the store
+	dir string
+
+	loaded   bool
+	version  int
+	metadata *TableMetadata
+	// manifests are the manifests of the current snapshot
+	manifests []manifestFile
+	// files are the size of the data files of the current snapshot, by path
+	files map[string]int64
+}
+
+func newTable(store dstore.Store, overwriteStore dstore.Store, dir string) *table {
+	return &table{store: store, overwriteStore: overwriteStore, dir: dir}
+}
+
+func (t *table) metadataFilename(name string) string {
+	return path.Join(t.dir, MetadataDir, name)
+}
+
+func metadataFilename(version int) string {
+	return fmt.Sprintf("v%d.metadata.json", version)
+}
+
+// relativeName returns the name, relative to the store, of a file referenced by its
+// location in the table's metadata.
+func (t *table) relativeName(location string) (string, error) {
+	prefix := storePrefix(t.store)
+	if !strings.HasPrefix(location, prefix) {
+		return "", fmt.Errorf("file %q is not in the output store %q", location, prefix)
+	}
+
+	return strings.TrimPrefix(location, prefix), nil
+}
+
+// load reads the latest metadata of the table and the data files of its current snapshot.
+// The version is 0 if the table has no metadata yet.
+func (t *table) load(ctx context.Context) error {
+	t.version = 0
+	t.metadata = nil
+	t.manifests = nil
+	t.files = map[string]int64{}
+
+	version, err := t.latestVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("find latest version: %w", err)
+	}
+
+	if version == 0 {
+		t.loaded = true
+		return nil
+	}
+
+	content, err := t.readObject(ctx, t.metadataFilename(metadataFilename(version)))
+	if err != nil {
+		return fmt.Errorf("read metadata version %d: %w", version, err)
+	}
+
+	metadata := &TableMetadata{}
+	if err := json.Unmarshal(content, metadata); err != nil {
+		return fmt.Errorf("unmarshal metadata version %d: %w", version, err)
+	}
+
+	if snapshot := metadata.currentSnapshot(); snapshot != nil {
+		if err := t.loadSnapshot(ctx, snapshot); err != nil {
+			return fmt.Errorf("load snapshot %d: %w", snapshot.SnapshotID, err)
+		}
+	}
+
+	t.version = version
+	t.metadata = metadata
+	t.loaded = true
+	return nil
+}
+
+// latestVersion returns the version of the version hint, checking that no newer metadata
+// exists, or the largest version of the metadata folder if there is no version hint.
+func (t *table) latestVersion(ctx context.Context) (int, error) {
+	content, err := t.readObject(ctx, t.metadataFilename(versionHintFilename))
+	if err != nil && !errors.Is(err, dstore.ErrNotFound) {
+		return 0, fmt.Errorf("read version hint: %w", err)
+	}
+
+	if err == nil {
+		version, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return 0, fmt.Errorf("invalid version hint %q: %w", content, err)
+		}
+
+		// The version hint is written after the metadata, it can lag behind
+		for {
+			exists, err := t.store.FileExists(ctx, t.metadataFilename(metadataFilename(version+1)))
+			if err != nil {
+				return 0, fmt.Errorf("check metadata version %d exists: %w", version+1, err)
+			}
+			if !exists {
+				return version, nil
+			}
+			version++
+		}
+	}
+
+	version := 0
+	err = t.store.Walk(ctx, t.metadataFilename("")+"/", func(filename string) error {
+		if match := metadataFilenameRegex.FindStringSubmatch(path.Base(filename)); match != nil {
+			found, _ := strconv.Atoi(match[1])
+			version = max(version, found)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("walk metadata: %w", err)
+	}
+
+	return version, nil
+}
+
+func (t *table) loadSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	listFilename, err := t.relativeName(snapshot.ManifestList)
+	if err != nil {
+		return err
+	}
+
+	manifests, err := readAvroFile[manifestFile](ctx, t.store, listFilename)
+	if err != nil {
+		return fmt.Errorf("read manifest list: %w", err)
+	}
+
+	for _, manifest := range manifests {
+		manifestFilename, err := t.relativeName(manifest.ManifestPath)
+		if err != nil {
+			return err
+		}
+
+		entries, err := readAvroFile[manifestEntryFile](ctx, t.store, manifestFilename)
+		if err != nil {
+			return fmt.Errorf("read manifest: %w", err)
+		}
+
+		for _, entry := range entries {
+			if entry.Status != manifestEntryStatusDeleted {
+				t.files[entry.DataFile.FilePath] = entry.DataFile.FileSizeInBytes
+			}
+		}
+	}
+
+	t.manifests = manifests
+	return nil
+}
+
+// manifestEntryFile are the fields of manifest entries needed to know the data files of a
+// snapshot.
+type manifestEntryFile struct {
+	Status   int32 `avro:"status"`
+	DataFile struct {
+		FilePath        string `avro:"file_path"`
+		FileSizeInBytes int64  `avro:"file_size_in_bytes"`
+	} `avro:"data_file"`
+}
+
+func (t *table) readObject(ctx context.Context, filename string) ([]byte, error) {
+	reader, err := t.store.OpenObject(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// commit appends the files to the table in a new snapshot, files already part of the table
+// with the same size being skipped. The table is created along with its first snapshot and
+// its schema is updated when it changed. It returns the name of the files written, none if
+// all files were already part of the table.
+func (t *table) commit(ctx context.Context, tableResult parquetx.TableResult, files []writer.UploadedFile, partitionColumns []string) ([]string, error) {
+	if !t.loaded {
+		if err := t.load(ctx); err != nil {
+			return nil, fmt.Errorf("load table: %w", err)
+		}
+	}
+
+	var added []writer.UploadedFile
+	for _, file := range files {
+		if size, found := t.files[t.store.ObjectURL(file.Filename)]; found && size == file.Size {
+			continue
+		}
+
+		added = append(added, file)
+	}
+
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now().UnixMilli()
+	metadata, err := t.nextMetadata(tableResult, partitionColumns, now)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := metadata.currentSchema()
+	spec := metadata.defaultSpec()
+	snapshot := &Snapshot{
+		SnapshotID:     t.newSnapshotID(),
+		SequenceNumber: metadata.LastSequenceNumber + 1,
+		TimestampMs:    now,
+		SchemaID:       &schema.SchemaID,
+	}
+
+	previous := metadata.currentSnapshot()
+	if previous != nil {
+		snapshot.ParentSnapshotID = &previous.SnapshotID
+	}
+
+	entries := make([]manifestEntry, len(added))
+	manifest := manifestFile{
+		PartitionSpecID:   int32(spec.SpecID),
+		SequenceNumber:    snapshot.SequenceNumber,
+		MinSequenceNumber: snapshot.SequenceNumber,
+		AddedSnapshotID:   snapshot.SnapshotID,
+		AddedFilesCount:   int32(len(added)),
+	}
+
+	var addedSize int64
+	partitionValues := make([]map[string]string, len(added))
+	for i, file := range added {
+		entries[i], partitionValues[i], err = newManifestEntry(t.store, schema, spec, snapshot.SnapshotID, file)
+		if err != nil {
+			return nil, fmt.Errorf("file %q: %w", file.Filename, err)
+		}
+
+		manifest.AddedRowsCount += file.Rows
+		addedSize += file.Size
+	}
+	manifest.Partitions = partitionSummaries(spec, partitionValues)
+
+	manifestFilename := t.metadataFilename(fmt.Sprintf("%s-m0.avro", uuid.NewString()))
+	manifest.ManifestPath = t.store.ObjectURL(manifestFilename)
+	if manifest.ManifestLength, err = writeManifest(ctx, t.store, manifestFilename, schema, spec, entries); err != nil {
+		return nil, fmt.Errorf("write manifest: %w", err)
+	}
+
+	manifests := append([]manifestFile{manifest}, t.manifests...)
+	listFilename := t.metadataFilename(fmt.Sprintf("snap-%d-1-%s.avro", snapshot.SnapshotID, uuid.NewString()))
+	snapshot.ManifestList = t.store.ObjectURL(listFilename)
+	if _, err := writeManifestList(ctx, t.store, listFilename, snapshot, manifests); err != nil {
+		return nil, fmt.Errorf("write manifest list: %w", err)
+	}
+
+	snapshot.Summary = snapshotSummary(previous, len(added), manifest.AddedRowsCount, addedSize, partitionValues)
+	metadata.Snapshots = append(metadata.Snapshots, snapshot)
+	metadata.CurrentSnapshotID = &snapshot.SnapshotID
+	metadata.Refs = map[string]SnapshotRef{"main": {SnapshotID: snapshot.SnapshotID, Type: "branch"}}
+	metadata.SnapshotLog = append(metadata.SnapshotLog, SnapshotLogEntry{SnapshotID: snapshot.SnapshotID, TimestampMs: now})
+	metadata.LastSequenceNumber = snapshot.SequenceNumber
+
+	filenames, err := t.writeMetadata(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range added {
+		t.files[t.store.ObjectURL(file.Filename)] = file.Size
+	}
+	t.manifests = manifests
+
+	return append([]string{manifestFilename, listFilename}, filenames...), nil
+}
+
+// nextMetadata returns a copy of the table's metadata, a new one if the table doesn't exist
+// yet, with its schema updated to the one of the table.
+func (t *table) nextMetadata(tableResult parquetx.TableResult, partitionColumns []string, now int64) (*TableMetadata, error) {
+	if t.metadata == nil {
+		schema, lastColumnID, err := newSchema(tableResult, partitionColumns, nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("schema: %w", err)
+		}
+
+		spec := &PartitionSpec{SpecID: 0, Fields: []PartitionField{}}
+		for i, column := range partitionColumns {
+			spec.Fields = append(spec.Fields, PartitionField{
+				SourceID:  schema.field(column).ID,
+				FieldID:   firstPartitionFieldID + i,
+				Name:      column,
+				Transform: "identity",
+			})
+		}
+
+		metadata := &TableMetadata{
+			FormatVersion:   formatVersion,
+			TableUUID:       uuid.NewString(),
+			Location:        strings.TrimSuffix(t.store.ObjectURL(t.dir), "/"),
+			LastUpdatedMs:   now,
+			LastColumnID:    lastColumnID,
+			Schemas:         []*Schema{schema},
+			PartitionSpecs:  []*PartitionSpec{spec},
+			LastPartitionID: firstPartitionFieldID + len(partitionColumns) - 1,
+			SortOrders:      []json.RawMessage{json.RawMessage(`{"order-id":0,"fields":[]}`)},
+			Properties:      map[string]string{"write.format.default": "parquet"},
+			SnapshotLog:     []SnapshotLogEntry{},
+			MetadataLog:     []MetadataLogEntry{},
+		}
+
+		return metadata, setNameMapping(metadata, schema)
+	}
+
+	// The copy shares the slices of the current metadata, they are only appended to
+	metadata := *t.metadata
+	metadata.LastUpdatedMs = now
+	metadata.Properties = maps.Clone(t.metadata.Properties)
+	if metadata.Properties == nil {
+		metadata.Properties = map[string]string{}
+	}
+	metadata.MetadataLog = append(slices.Clone(t.metadata.MetadataLog), MetadataLogEntry{
+		MetadataFile: t.store.ObjectURL(t.metadataFilename(metadataFilename(t.version))),
+		TimestampMs:  t.metadata.LastUpdatedMs,
+	})
+	if len(metadata.MetadataLog) > maxPreviousMetadata {
+		metadata.MetadataLog = metadata.MetadataLog[len(metadata.MetadataLog)-maxPreviousMetadata:]
+	}
+
+	var specColumns []string
+	if spec := metadata.defaultSpec(); spec != nil {
+		for _, field := range spec.Fields {
+			specColumns = append(specColumns, field.Name)
+		}
+	}
+	if !slices.Equal(specColumns, partitionColumns) {
+		return nil, fmt.Errorf("files are partitioned by %q while the table is partitioned by %q", partitionColumns, specColumns)
+	}
+
+	current := metadata.currentSchema()
+	schema, lastColumnID, err := newSchema(tableResult, partitionColumns, current, metadata.LastColumnID)
+	if err != nil {
+		return nil, fmt.Errorf("schema: %w", err)
+	}
+
+	if current == nil || !schema.sameFields(current) {
+		for _, existing := range metadata.Schemas {
+			schema.SchemaID = max(schema.SchemaID, existing.SchemaID+1)
+		}
+
+		metadata.Schemas = append(slices.Clone(metadata.Schemas), schema)
+		metadata.CurrentSchemaID = schema.SchemaID
+		metadata.LastColumnID = max(metadata.LastColumnID, lastColumnID)
+
+		if err := setNameMapping(&metadata, schema); err != nil {
+			return nil, err
+		}
+	}
+
+	metadata.Snapshots = slices.Clone(metadata.Snapshots)
+	metadata.SnapshotLog = slices.Clone(metadata.SnapshotLog)
+	return &metadata, nil
+}
+
+func setNameMapping(metadata *TableMetadata, schema *Schema) error {
+	mapping, err := nameMapping(schema)
+	if err != nil {
+		return err
+	}
+
+	metadata.Properties["schema.name-mapping.default"] = mapping
+	return nil
+}
+
+func (t *table) newSnapshotID() int64 {
+	for {
+		id := rand.Int64N(math.MaxInt64) + 1
+		if t.metadata == nil || !slices.ContainsFunc(t.metadata.Snapshots, func(snapshot *Snapshot) bool { return snapshot.SnapshotID == id }) {
+			return id
+		}
+	}
+}
+
+// writeMetadata writes the metadata as the next version of the table and points the
+// version hint to it, it returns the name of the files written.
+func (t *table) writeMetadata(ctx context.Context, metadata *TableMetadata) ([]string, error) {
+	version := t.version + 1
+	filename := t.metadataFilename(metadataFilename(version))
+
+	if t.store.Overwrite() {
+		return nil, fmt.Errorf("metadata must be written through a store that does not overwrite objects")
+	}
+
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("marshal metadata: %w", err)
+	}
+
+	// The store does not overwrite objects, a version already written by another process is
+	// kept as is and found when reading the metadata back. Stores supporting preconditions,
+	// like GCS, skip the write atomically, others check that the object exists first.
+	if err := t.store.WriteObject(ctx, filename, bytes.NewReader(content)); err != nil {
+		t.loaded = false
+		return nil, fmt.Errorf("write metadata version %d: %w", version, err)
+	}
+
+	written, err := t.readObject(ctx, filename)
+	if err != nil {
+		t.loaded = false
+		return nil, fmt.Errorf("read back metadata version %d: %w", version, err)
+	}
+
+	if !bytes.Equal(written, content) {
+		t.loaded = false
+		return nil, fmt.Errorf("metadata version %d already exists, the table is written by another process", version)
+	}
+
+	t.version = version
+	t.metadata = metadata
+
+	// The version is committed, readers checking for newer metadata than the version hint, a
+	// retry reloads the table and finds its files already part of it
+	hintFilename := t.metadataFilename(versionHintFilename)
+	if err := t.overwriteStore.WriteObject(ctx, hintFilename, strings.NewReader(strconv.Itoa(version))); err != nil {
+		t.loaded = false
+		return nil, fmt.Errorf("write version hint: %w", err)
+	}
+
+	return []string{filename, hintFilename}, nil
+}
+
+func newManifestEntry(store dstore.Store, schema *Schema, spec *PartitionSpec, snapshotID int64, file writer.UploadedFile) (manifestEntry, map[string]string, error) {
+	_, relative, err := bundler.SplitTablePath(file)
+	if err != nil {
+		return manifestEntry{}, nil, err
+	}
+
+	_, values, err := bundler.PartitionValues(relative)
+	if err != nil {
+		return manifestEntry{}, nil, err
+	}
+
+	partition := make(map[string]any, len(spec.Fields))
+	for _, field := range spec.Fields {
+		partition[avroName(field.Name)] = values[field.Name]
+	}
+
+	entry := manifestEntry{
+		Status:     manifestEntryStatusAdded,
+		SnapshotID: &snapshotID,
+		DataFile: dataFile{
+			FilePath:        store.ObjectURL(file.Filename),
+			FileFormat:      "PARQUET",
+			Partition:       partition,
+			RecordCount:     file.Rows,
+			FileSizeInBytes: file.Size,
+		},
+	}
+
+	if len(file.Columns) > 0 {
+		valueCounts, nullCounts, lowerBounds, upperBounds := fileMetrics(schema, file)
+		entry.DataFile.ValueCounts = &valueCounts
+		entry.DataFile.NullValueCounts = &nullCounts
+		entry.DataFile.LowerBounds = &lowerBounds
+		entry.DataFile.UpperBounds = &upperBounds
+	}
+
+	return entry, values, nil
+}
+
+// partitionSummaries returns the summary of each partition field of the manifest's files,
+// the bounds of the values being compared like strings are.
+func partitionSummaries(spec *PartitionSpec, values []map[string]string) *[]fieldSummary {
+	out := make([]fieldSummary, len(spec.Fields))
+	for i, field := range spec.Fields {
+		var lower, upper []byte
+		for j, fileValues := range values {
+			value := []byte(fileValues[field.Name])
+			if j == 0 || bytes.Compare(value, lower) < 0 {
+				lower = value
+			}
+			if j == 0 || bytes.Compare(value, upper) > 0 {
+				upper = value
+			}
+		}
+
+		out[i] = fieldSummary{ContainsNull: false, LowerBound: &lower, UpperBound: &upper}
+	}
+
+	return &out
+}
+
+// snapshotSummary returns the summary of an append snapshot, the totals being the ones of
+// the previous snapshot plus the added files.
+func snapshotSummary(previous *Snapshot, addedFiles int, addedRecords int64, addedSize int64, partitionValues []map[string]string) map[string]string {
+	partitions := map[string]bool{}
+	for _, values := range partitionValues {
+		key, _ := json.Marshal(values)
+		partitions[string(key)] = true
+	}
+
+	summary := map[string]string{
+		"operation":               "append",
+		"added-data-files":        strconv.Itoa(addedFiles),
+		"added-records":           strconv.FormatInt(addedRecords, 10),
+		"added-files-size":        strconv.FormatInt(addedSize, 10),
+		"changed-partition-count": strconv.Itoa(len(partitions)),
+		"engine-name":             "substreams-sink-files",
+	}
+
+	totals := map[string]int64{
+		"total-data-files":       int64(addedFiles),
+		"total-records":          addedRecords,
+		"total-files-size":       addedSize,
+		"total-delete-files":     0,
+		"total-position-deletes": 0,
+		"total-equality-deletes": 0,
+	}
+
+	for key, added := range totals {
+		total := added
+		if previous != nil {
+			previousTotal, err := strconv.ParseInt(previous.Summary[key], 10, 64)
+			if err != nil {
+				// Totals are unknown when the previous snapshot doesn't have them
+				continue
+			}
+			total += previousTotal
+		}
+
+		summary[key] = strconv.FormatInt(total, 10)
+	}
+
+	return summary
+}
@@ -0,0 +1,280 @@
+package lease
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/shutter"
+	"go.uber.org/zap"
+)
+
+// DefaultFilename is the name of the lease object in the output store.
+const DefaultFilename = "_lease.json"
+
+// Lease guarantees, on a best effort basis, that a single process writes to an output
+// store at a time. The lease is an object of the store recording its owner and when it
+// expires, it's renewed every third of its TTL while held and deleted once released.
+//
+// Object stores offer no atomic compare-and-swap through dstore, so two processes
+// acquiring an expired lease at the exact same time could both write it. To reduce this
+// window, the lease is read back after a short delay to confirm it was not overwritten.
+// A renewal finding another owner terminates the lease with an error.
+//
+// A lease not renewed for its TTL, because its owner crashed, is considered stale and
+// can be taken over by another process.
+type Lease struct {
+	*shutter.Shutter
+
+	store    dstore.Store
+	filename string
+	owner    string
+	ttl      time.Duration
+	wait     bool
+	logger   *zap.Logger
+
+	expiresAt time.Time
+}
+
+// Record is the content of the lease object.
+type Record struct {
+	Owner     string    `json:"owner"`
+	RenewedAt time.Time `json:"renewed_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// New creates a lease on the object `filename` of the store, the store must allow
+// overwrites. When wait is true, Acquire waits for the lease to be released or to
+// expire instead of failing if it's held by another process.
+func New(store dstore.Store, filename string, ttl time.Duration, wait bool, logger *zap.Logger) *Lease {
+	return &Lease{
+		Shutter:  shutter.New(),
+		store:    store,
+		filename: filename,
+		owner:    newOwner(),
+		ttl:      ttl,
+		wait:     wait,
+		logger:   logger.With(zap.String("lease", store.ObjectURL(filename))),
+	}
+}
+
+// Owner returns the identifier this process records in the lease object.
+func (l *Lease) Owner() string {
+	return l.owner
+}
+
+// Acquire takes the lease, it fails if the lease is held by another process unless
+// the lease was created to wait for it.
+func (l *Lease) Acquire(ctx context.Context) error {
+	for {
+		holder, err := l.tryAcquire(ctx)
+		if err != nil {
+			return err
+		}
+
+		if holder == nil {
+			l.logger.Info("lease acquired", zap.String("owner", l.owner), zap.Duration("ttl", l.ttl))
+			return nil
+		}
+
+		if !l.wait {
+			return fmt.Errorf("lease %q is held by %q until %s, another process is writing to the same output", l.store.ObjectURL(l.filename), holder.Owner, holder.ExpiresAt.Format(time.RFC3339))
+		}
+
+		l.logger.Info("lease held by another process, waiting", zap.String("holder", holder.Owner), zap.Time("expires_at", holder.ExpiresAt))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.ttl / 3):
+		}
+	}
+}
+
+// tryAcquire writes the lease if it's free, stale or already ours, it returns the
+// record of the holder if the lease is held by another process.
+func (l *Lease) tryAcquire(ctx context.Context) (*Record, error) {
+	record, err := l.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if record != nil && record.Owner != l.owner && time.Now().Before(record.ExpiresAt) {
+		return record, nil
+	}
+
+	if record != nil && record.Owner != l.owner {
+		l.logger.Info("taking over stale lease", zap.String("previous_owner", record.Owner), zap.Time("expired_at", record.ExpiresAt))
+	}
+
+	if err := l.write(ctx, time.Now()); err != nil {
+		return nil, err
+	}
+
+	// Give a concurrent process writing the lease at the same time the chance to
+	// overwrite it, in which case the last writer wins
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(min(l.ttl/10, 2*time.Second)):
+	}
+
+	record, err = l.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if record == nil || record.Owner != l.owner {
+		if record == nil {
+			return nil, fmt.Errorf("lease %q disappeared while being acquired", l.store.ObjectURL(l.filename))
+		}
+
+		return record, nil
+	}
+
+	return nil, nil
+}
+
+// Launch renews the lease until it's shut down, the lease is released when shut down
+// without error. If the lease is taken over by another process or cannot be renewed
+// before it expires, it terminates with an error.
+func (l *Lease) Launch(ctx context.Context) {
+	l.OnTerminating(func(err error) {
+		if err != nil {
+			return
+		}
+
+		if err := l.release(context.Background()); err != nil {
+			l.logger.Warn("unable to release lease, it will expire on its own", zap.Error(err))
+		}
+	})
+
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.Terminating():
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := l.renew(ctx); err != nil {
+				l.Shutdown(err)
+				return
+			}
+		}
+	}()
+}
+
+func (l *Lease) renew(ctx context.Context) error {
+	record, err := l.read(ctx)
+	if err == nil && record != nil && record.Owner != l.owner {
+		return fmt.Errorf("lease %q was taken over by %q", l.store.ObjectURL(l.filename), record.Owner)
+	}
+
+	if err == nil {
+		err = l.write(ctx, time.Now())
+	}
+
+	if err != nil {
+		if time.Now().After(l.expiresAt) {
+			return fmt.Errorf("unable to renew lease before it expired: %w", err)
+		}
+
+		l.logger.Warn("unable to renew lease, retrying", zap.Error(err), zap.Time("expires_at", l.expiresAt))
+		return nil
+	}
+
+	l.logger.Debug("lease renewed", zap.Time("expires_at", l.expiresAt))
+	return nil
+}
+
+func (l *Lease) release(ctx context.Context) error {
+	record, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	if record == nil || record.Owner != l.owner {
+		return nil
+	}
+
+	if err := l.store.DeleteObject(ctx, l.filename); err != nil {
+		return fmt.Errorf("delete lease: %w", err)
+	}
+
+	l.logger.Info("lease released")
+	return nil
+}
+
+func (l *Lease) write(ctx context.Context, now time.Time) error {
+	record := &Record{
+		Owner:     l.owner,
+		RenewedAt: now.UTC(),
+		ExpiresAt: now.Add(l.ttl).UTC(),
+	}
+
+	content, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal lease: %w", err)
+	}
+
+	if err := l.store.WriteObject(ctx, l.filename, bytes.NewReader(content)); err != nil {
+		return fmt.Errorf("write lease: %w", err)
+	}
+
+	l.expiresAt = record.ExpiresAt
+	return nil
+}
+
+// read returns the lease record or nil if the lease object does not exist
+func (l *Lease) read(ctx context.Context) (*Record, error) {
+	exists, err := l.store.FileExists(ctx, l.filename)
+	if err != nil {
+		return nil, fmt.Errorf("check lease exists: %w", err)
+	}
+
+	if !exists {
+		return nil, nil
+	}
+
+	reader, err := l.store.OpenObject(ctx, l.filename)
+	if err != nil {
+		return nil, fmt.Errorf("open lease: %w", err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read lease: %w", err)
+	}
+
+	record := &Record{}
+	if err := json.Unmarshal(content, record); err != nil {
+		return nil, fmt.Errorf("unmarshal lease: %w", err)
+	}
+
+	return record, nil
+}
+
+func newOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
@@ -0,0 +1,81 @@
+package lease
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/dstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestLease_Acquire(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	first := New(store, DefaultFilename, 300*time.Millisecond, false, zap.NewNop())
+	require.NoError(t, first.Acquire(ctx))
+	first.Launch(ctx)
+
+	second := New(store, DefaultFilename, 300*time.Millisecond, false, zap.NewNop())
+	require.Error(t, second.Acquire(ctx), "lease is held and renewed by first")
+
+	first.Shutdown(nil)
+	<-first.Terminated()
+
+	require.NoError(t, second.Acquire(ctx), "lease was released by first")
+
+	record, err := second.read(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, second.Owner(), record.Owner)
+}
+
+func TestLease_AcquireWait(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	first := New(store, DefaultFilename, 300*time.Millisecond, false, zap.NewNop())
+	require.NoError(t, first.Acquire(ctx))
+	first.Launch(ctx)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		first.Shutdown(nil)
+	}()
+
+	second := New(store, DefaultFilename, 300*time.Millisecond, true, zap.NewNop())
+	require.NoError(t, second.Acquire(ctx))
+}
+
+func TestLease_StaleTakeover(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+
+	// Crashed owner, acquired but never renewed
+	crashed := New(store, DefaultFilename, 100*time.Millisecond, false, zap.NewNop())
+	require.NoError(t, crashed.Acquire(ctx))
+	time.Sleep(150 * time.Millisecond)
+
+	second := New(store, DefaultFilename, 100*time.Millisecond, false, zap.NewNop())
+	require.NoError(t, second.Acquire(ctx))
+
+	// The crashed owner coming back finds the lease taken over on renewal
+	crashed.Launch(ctx)
+	select {
+	case <-crashed.Terminated():
+		require.ErrorContains(t, crashed.Err(), "taken over")
+	case <-time.After(time.Second):
+		t.Fatal("lease should have terminated after being taken over")
+	}
+}
+
+func newTestStore(t *testing.T) dstore.Store {
+	t.Helper()
+
+	store, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+	require.NoError(t, err)
+
+	return store
+}
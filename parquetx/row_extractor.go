@@ -21,7 +21,35 @@ func (f protoRowExtractorFunc) ExtractRows(root protoreflect.Message) (map[strin
 	return f(root)
 }
 
+// ProtoMessageExtractor extracts the messages of each table from the root message, it
+// follows the same rules as ProtoRowExtractor but leaves the encoding of the messages to
+// the caller.
+type ProtoMessageExtractor interface {
+	ExtractMessages(root protoreflect.Message) (map[string][]protoreflect.Message, error)
+}
+
+type protoMessageExtractorFunc func(root protoreflect.Message) (map[string][]protoreflect.Message, error)
+
+func (f protoMessageExtractorFunc) ExtractMessages(root protoreflect.Message) (map[string][]protoreflect.Message, error) {
+	return f(root)
+}
+
+// asMessage is the conversion used by message extractors, messages are kept as-is.
+func asMessage(message protoreflect.Message) (protoreflect.Message, error) {
+	return message, nil
+}
+
 func ProtoRowExtractorFromTables(tables []TableResult) ProtoRowExtractor {
+	return protoRowExtractorFunc(extractFromTables(tables, ProtoMessageToRow))
+}
+
+func ProtoMessageExtractorFromTables(tables []TableResult) ProtoMessageExtractor {
+	return protoMessageExtractorFunc(extractFromTables(tables, asMessage))
+}
+
+// extractFromTables walks the root message collecting, converted, every message that is
+// one of the tables.
+func extractFromTables[T any](tables []TableResult, convert func(protoreflect.Message) (T, error)) func(root protoreflect.Message) (map[string][]T, error) {
 	// FIXME: This is relatively inefficient as we are traversing some message fields that
 	// are dead end and will not yield any rows. We need to change that by first walking
 	// the message and building a list of every "paths" to field (deeply nested too + list
@@ -35,8 +63,8 @@ func ProtoRowExtractorFromTables(tables []TableResult) ProtoRowExtractor {
 		tablesByMessage[table.Descriptor.FullName()] = table.Schema
 	}
 
-	return protoRowExtractorFunc(func(root protoreflect.Message) (out map[string][]parquet.Row, err error) {
-		out = make(map[string][]parquet.Row)
+	return func(root protoreflect.Message) (out map[string][]T, err error) {
+		out = make(map[string][]T)
 
 		var processNode func(node protoreflect.Message) error
 		processNode = func(node protoreflect.Message) error {
@@ -80,9 +108,9 @@ func ProtoRowExtractorFromTables(tables []TableResult) ProtoRowExtractor {
 					// If it's a repeated field, we need to iterate over the list
 					if field.IsList() {
 						list := node.Get(field).List()
-						rows := make([]parquet.Row, list.Len())
+						rows := make([]T, list.Len())
 						for i := range list.Len() {
-							row, err := ProtoMessageToRow(list.Get(i).Message())
+							row, err := convert(list.Get(i).Message())
 							if err != nil {
 								return fmt.Errorf("converting repeated field %q index %d to row: %w", field.FullName(), i, err)
 							}
@@ -94,7 +122,7 @@ func ProtoRowExtractorFromTables(tables []TableResult) ProtoRowExtractor {
 						continue
 					}
 
-					row, err := ProtoMessageToRow(node.Get(field).Message())
+					row, err := convert(node.Get(field).Message())
 					if err != nil {
 						return fmt.Errorf("converting field %q to row: %w", field.FullName(), err)
 					}
@@ -127,7 +155,7 @@ func ProtoRowExtractorFromTables(tables []TableResult) ProtoRowExtractor {
 		// Maybe the root message is a table itself, so we need to process it
 		rootDescriptor := root.Descriptor()
 		if schema, found := tablesByMessage[rootDescriptor.FullName()]; found {
-			row, err := ProtoMessageToRow(root)
+			row, err := convert(root)
 			if err != nil {
 				return nil, fmt.Errorf("converting message row: %w", err)
 			}
@@ -140,7 +168,7 @@ func ProtoRowExtractorFromTables(tables []TableResult) ProtoRowExtractor {
 		}
 
 		return
-	})
+	}
 }
 
 func ProtoRowExtractorFromRoot(tableName string) ProtoRowExtractor {
@@ -156,22 +184,40 @@ func ProtoRowExtractorFromRoot(tableName string) ProtoRowExtractor {
 	})
 }
 
+func ProtoMessageExtractorFromRoot(tableName string) ProtoMessageExtractor {
+	return protoMessageExtractorFunc(func(root protoreflect.Message) (map[string][]protoreflect.Message, error) {
+		return map[string][]protoreflect.Message{
+			tableName: {root},
+		}, nil
+	})
+}
+
 func ProtoRowExtractorFromRepeatedFields(fieldByTableName map[string]protoreflect.FieldDescriptor) ProtoRowExtractor {
+	return protoRowExtractorFunc(extractFromRepeatedFields(fieldByTableName, ProtoMessageToRow))
+}
+
+func ProtoMessageExtractorFromRepeatedFields(fieldByTableName map[string]protoreflect.FieldDescriptor) ProtoMessageExtractor {
+	return protoMessageExtractorFunc(extractFromRepeatedFields(fieldByTableName, asMessage))
+}
+
+// extractFromRepeatedFields collects, converted, the elements of each repeated field of
+// the root message, each field being a table.
+func extractFromRepeatedFields[T any](fieldByTableName map[string]protoreflect.FieldDescriptor, convert func(protoreflect.Message) (T, error)) func(root protoreflect.Message) (map[string][]T, error) {
 	for _, field := range fieldByTableName {
 		if !field.IsList() {
 			panic(fmt.Errorf("field %s is not a list", field.FullName()))
 		}
 	}
 
-	return protoRowExtractorFunc(func(root protoreflect.Message) (out map[string][]parquet.Row, err error) {
-		out = make(map[string][]parquet.Row)
+	return func(root protoreflect.Message) (out map[string][]T, err error) {
+		out = make(map[string][]T)
 
 		for tableName, field := range fieldByTableName {
 			list := root.Get(field).List()
 
-			rows := make([]parquet.Row, list.Len())
+			rows := make([]T, list.Len())
 			for i := range list.Len() {
-				row, err := ProtoMessageToRow(list.Get(i).Message())
+				row, err := convert(list.Get(i).Message())
 				if err != nil {
 					return nil, fmt.Errorf("converting repeated field %q index %d to row: %w", field.FullName(), i, err)
 				}
@@ -183,5 +229,5 @@ func ProtoRowExtractorFromRepeatedFields(fieldByTableName map[string]protoreflec
 		}
 
 		return
-	})
+	}
 }
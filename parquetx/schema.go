@@ -52,15 +52,69 @@ func tableResult(descriptor protoreflect.MessageDescriptor, schema *parquet.Sche
 }
 
 func FindTablesInMessageDescriptor(descriptor protoreflect.MessageDescriptor, defaultColumnCompression *pbparquet.Compression, logger *zap.Logger, tracer logging.Tracer) (out []TableResult, rowExtractor ProtoRowExtractor, err error) {
+	layout, err := findTables(descriptor, defaultColumnCompression, logger, tracer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return layout.tables, layout.rowExtractor(), nil
+}
+
+// FindTableMessagesInMessageDescriptor finds the tables of the message descriptor like
+// FindTablesInMessageDescriptor does but returns an extractor of the tables' messages, for
+// outputs encoding messages in another format than Parquet.
+func FindTableMessagesInMessageDescriptor(descriptor protoreflect.MessageDescriptor, logger *zap.Logger, tracer logging.Tracer) (out []TableResult, messageExtractor ProtoMessageExtractor, err error) {
+	layout, err := findTables(descriptor, nil, logger, tracer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return layout.tables, layout.messageExtractor(), nil
+}
+
+// tablesLayout is the tables found in a message descriptor along with where their
+// messages are located in the root message.
+type tablesLayout struct {
+	tables []TableResult
+	// rootTableName is set when the root message is itself the single table
+	rootTableName string
+	// repeatedFields is set when the tables are the repeated fields of the root message
+	repeatedFields map[string]protoreflect.FieldDescriptor
+}
+
+func (l *tablesLayout) rowExtractor() ProtoRowExtractor {
+	switch {
+	case l.rootTableName != "":
+		return ProtoRowExtractorFromRoot(l.rootTableName)
+	case l.repeatedFields != nil:
+		return ProtoRowExtractorFromRepeatedFields(l.repeatedFields)
+	}
+
+	return ProtoRowExtractorFromTables(l.tables)
+}
+
+func (l *tablesLayout) messageExtractor() ProtoMessageExtractor {
+	switch {
+	case l.rootTableName != "":
+		return ProtoMessageExtractorFromRoot(l.rootTableName)
+	case l.repeatedFields != nil:
+		return ProtoMessageExtractorFromRepeatedFields(l.repeatedFields)
+	}
+
+	return ProtoMessageExtractorFromTables(l.tables)
+}
+
+func findTables(descriptor protoreflect.MessageDescriptor, defaultColumnCompression *pbparquet.Compression, logger *zap.Logger, tracer logging.Tracer) (layout *tablesLayout, err error) {
 	// We catch any errors that might happen during the walk, so we can return a proper error an not a panic
 	defer func() {
 		if recoveredErr := recover(); recoveredErr != nil {
-			out = nil
-			rowExtractor = nil
+			layout = nil
 			err = fmt.Errorf("error while walking message descriptor %s: %w", descriptor.FullName(), recoveredAnyToError(recoveredErr))
 		}
 	}()
 
+	var out []TableResult
+
 	protox.WalkMessageDescriptors(descriptor, logger, tracer, func(child protoreflect.MessageDescriptor) {
 		if tableName, hasTableName := GetMessageTableName(child); hasTableName {
 			logger.Debug("found protobuf message with parquet table extension", zap.String("table_name", tableName), zap.String("message_name", string(child.Name())))
@@ -81,7 +135,7 @@ func FindTablesInMessageDescriptor(descriptor protoreflect.MessageDescriptor, de
 			})))
 		}
 
-		return out, ProtoRowExtractorFromTables(out), nil
+		return &tablesLayout{tables: out}, nil
 	}
 
 	// Otherwise, let's support the case to pickup each repeated fields as a table
@@ -91,12 +145,15 @@ func FindTablesInMessageDescriptor(descriptor protoreflect.MessageDescriptor, de
 	if len(messageRepeatedFields) == 0 {
 		tableName := strcase.ToSnake(string(descriptor.Name()))
 
-		return []TableResult{
-			tableResult(
-				descriptor,
-				parquet.NewSchema(tableName, newMessageNode(descriptor, defaultColumnCompression)),
-			),
-		}, ProtoRowExtractorFromRoot(tableName), nil
+		return &tablesLayout{
+			tables: []TableResult{
+				tableResult(
+					descriptor,
+					parquet.NewSchema(tableName, newMessageNode(descriptor, defaultColumnCompression)),
+				),
+			},
+			rootTableName: tableName,
+		}, nil
 	}
 
 	// We skip fields that are repeated of primitive types for now
@@ -120,7 +177,7 @@ func FindTablesInMessageDescriptor(descriptor protoreflect.MessageDescriptor, de
 		repeatedFields[tableName] = field
 	}
 
-	return out, ProtoRowExtractorFromRepeatedFields(repeatedFields), nil
+	return &tablesLayout{tables: out, repeatedFields: repeatedFields}, nil
 }
 
 func GetMessageTableName(descriptor protoreflect.MessageDescriptor) (string, bool) {
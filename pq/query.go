@@ -80,3 +80,27 @@ func (q *Query) Resolve(root []byte, descriptor protoreflect.MessageDescriptor)
 
 	return out, nil
 }
+
+// ResolveDescriptor returns the descriptor of the messages the query resolves to when
+// applied to messages of the given descriptor, without any data.
+func (q *Query) ResolveDescriptor(descriptor protoreflect.MessageDescriptor) (protoreflect.MessageDescriptor, error) {
+	if len(q.Elements) == 1 && q.Elements[0].Kind() == ExpressionKindCurrent {
+		return descriptor, nil
+	}
+
+	if len(q.Elements) != 3 || q.Elements[0].Kind() != ExpressionKindCurrent || q.Elements[1].Kind() != ExpressionKindField || q.Elements[2].Kind() != ExpressionKindArray {
+		return nil, fmt.Errorf("only accepting query in the form '.' or '.<fieldName>[]'")
+	}
+
+	fieldName := q.Elements[1].(*FieldAccess).Name
+	fieldDesc := descriptor.Fields().ByName(protoreflect.Name(fieldName))
+	if fieldDesc == nil {
+		return nil, fmt.Errorf("field %q does not exist on proto of type %q", fieldName, descriptor.FullName())
+	}
+
+	if !fieldDesc.IsList() || fieldDesc.Message() == nil {
+		return nil, fmt.Errorf("field %q of type %q is not a repeated message field while accessing array field", fieldName, fieldDesc.FullName())
+	}
+
+	return fieldDesc.Message(), nil
+}
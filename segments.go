@@ -0,0 +1,120 @@
+package substreams_file_sink
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/shutter"
+	"go.uber.org/zap"
+)
+
+// SplitSegments splits the block range in at most `count` segments of contiguous blocks
+// that can be processed concurrently. Segments are aligned on boundaries of `blockCount`
+// blocks so that no boundary spans two segments, the first and last segments start and
+// end exactly at the block range's start and end.
+func SplitSegments(blockRange *bstream.Range, blockCount uint64, count int) ([]*bstream.Range, error) {
+	if blockRange.EndBlock() == nil {
+		return nil, fmt.Errorf("block range %s must have an end block to be split in segments", blockRange)
+	}
+
+	if blockCount == 0 || count <= 0 {
+		return nil, fmt.Errorf("block count and segment count must be greater than 0")
+	}
+
+	startBlock, endBlock := blockRange.StartBlock(), *blockRange.EndBlock()
+	if endBlock <= startBlock {
+		return nil, fmt.Errorf("block range %s is empty", blockRange)
+	}
+
+	alignedStart := startBlock - startBlock%blockCount
+	boundaryCount := (endBlock - alignedStart + blockCount - 1) / blockCount
+	if uint64(count) > boundaryCount {
+		count = int(boundaryCount)
+	}
+
+	segments := make([]*bstream.Range, 0, count)
+	boundaryIndex := uint64(0)
+	for i := 0; i < count; i++ {
+		segmentBoundaries := boundaryCount / uint64(count)
+		if uint64(i) < boundaryCount%uint64(count) {
+			segmentBoundaries++
+		}
+
+		segmentStart := max(startBlock, alignedStart+boundaryIndex*blockCount)
+		boundaryIndex += segmentBoundaries
+		segmentEnd := min(endBlock, alignedStart+boundaryIndex*blockCount)
+
+		segments = append(segments, bstream.NewRangeExcludingEnd(segmentStart, segmentEnd))
+	}
+
+	return segments, nil
+}
+
+// SegmentedFileSinker runs one FileSinker per segment of the block range concurrently.
+// It terminates once every segment completed or as soon as one of them failed, in which
+// case all other segments are stopped.
+type SegmentedFileSinker struct {
+	*shutter.Shutter
+
+	sinkers []*FileSinker
+	logger  *zap.Logger
+}
+
+func NewSegmentedFileSinker(sinkers []*FileSinker, logger *zap.Logger) *SegmentedFileSinker {
+	return &SegmentedFileSinker{
+		Shutter: shutter.New(),
+		sinkers: sinkers,
+		logger:  logger,
+	}
+}
+
+func (s *SegmentedFileSinker) Run(ctx context.Context) error {
+	s.OnTerminating(func(err error) {
+		s.logger.Info("segmented file sinker terminating, stopping all segments", zap.Error(err))
+		for _, sinker := range s.sinkers {
+			sinker.Shutdown(err)
+		}
+	})
+
+	// Segments share the output store, so left overs of a previous run are recovered prior
+	// starting any segment to not interfere with the uploads of running ones
+	for _, sinker := range s.sinkers {
+		if err := sinker.Recover(ctx); err != nil {
+			return fmt.Errorf("segment %s: %w", sinker.BlockRange(), err)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for _, sinker := range s.sinkers {
+		wg.Add(1)
+
+		go func(sinker *FileSinker) {
+			defer wg.Done()
+
+			segment := sinker.BlockRange()
+			s.logger.Info("starting segment", zap.Stringer("segment", segment))
+
+			if err := sinker.Run(ctx); err != nil {
+				s.Shutdown(fmt.Errorf("segment %s: %w", segment, err))
+				return
+			}
+
+			// The sinker terminates on its own when the stream ends, this waits until its
+			// bundler has uploaded all boundaries
+			sinker.Shutdown(nil)
+			<-sinker.Terminated()
+
+			if err := sinker.Err(); err != nil {
+				s.Shutdown(fmt.Errorf("segment %s: %w", segment, err))
+				return
+			}
+
+			s.logger.Info("segment completed", zap.Stringer("segment", segment))
+		}(sinker)
+	}
+
+	wg.Wait()
+	return nil
+}
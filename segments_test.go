@@ -0,0 +1,59 @@
+package substreams_file_sink
+
+import (
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitSegments(t *testing.T) {
+	tests := []struct {
+		name        string
+		blockRange  *bstream.Range
+		blockCount  uint64
+		count       int
+		expect      []*bstream.Range
+		expectError bool
+	}{
+		{
+			"even split",
+			bstream.NewRangeExcludingEnd(0, 1000), 100, 2,
+			[]*bstream.Range{bstream.NewRangeExcludingEnd(0, 500), bstream.NewRangeExcludingEnd(500, 1000)},
+			false,
+		},
+		{
+			"uneven split gives extra boundaries to first segments",
+			bstream.NewRangeExcludingEnd(0, 1000), 100, 3,
+			[]*bstream.Range{bstream.NewRangeExcludingEnd(0, 400), bstream.NewRangeExcludingEnd(400, 700), bstream.NewRangeExcludingEnd(700, 1000)},
+			false,
+		},
+		{
+			"unaligned start",
+			bstream.NewRangeExcludingEnd(150, 600), 100, 2,
+			[]*bstream.Range{bstream.NewRangeExcludingEnd(150, 400), bstream.NewRangeExcludingEnd(400, 600)},
+			false,
+		},
+		{
+			"more segments than boundaries",
+			bstream.NewRangeExcludingEnd(0, 200), 100, 8,
+			[]*bstream.Range{bstream.NewRangeExcludingEnd(0, 100), bstream.NewRangeExcludingEnd(100, 200)},
+			false,
+		},
+		{"open range", bstream.NewOpenRange(0), 100, 2, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := SplitSegments(test.blockRange, test.blockCount, test.count)
+			if test.expectError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expect, actual)
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/streamingfast/shutter"
 	"github.com/streamingfast/substreams-sink-files/v2/bundler"
 	"github.com/streamingfast/substreams-sink-files/v2/encoder"
+	"github.com/streamingfast/substreams-sink-files/v2/lease"
 	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
 	sink "github.com/streamingfast/substreams/sink"
 	"go.uber.org/zap"
@@ -18,14 +19,27 @@ type FileSinker struct {
 	*shutter.Shutter
 	*sink.Sinker
 
-	bundler *bundler.Bundler
-	encoder encoder.Encoder
-	logger  *zap.Logger
-	tracer  logging.Tracer
+	bundler   *bundler.Bundler
+	encoder   encoder.Encoder
+	logger    *zap.Logger
+	tracer    logging.Tracer
+	lease     *lease.Lease
+	recovered bool
 }
 
-func NewFileSinker(sinker *sink.Sinker, bundler *bundler.Bundler, encoder encoder.Encoder, logger *zap.Logger, tracer logging.Tracer) *FileSinker {
-	return &FileSinker{
+// FileSinkerOption configures optional behaviors of the FileSinker.
+type FileSinkerOption func(fs *FileSinker)
+
+// WithLease makes the sinker acquire the lease before touching the output store and
+// hold it until it terminates, it stops if the lease is lost.
+func WithLease(lease *lease.Lease) FileSinkerOption {
+	return func(fs *FileSinker) {
+		fs.lease = lease
+	}
+}
+
+func NewFileSinker(sinker *sink.Sinker, bundler *bundler.Bundler, encoder encoder.Encoder, logger *zap.Logger, tracer logging.Tracer, opts ...FileSinkerOption) *FileSinker {
+	fs := &FileSinker{
 		Shutter: shutter.New(),
 		Sinker:  sinker,
 
@@ -34,14 +48,15 @@ func NewFileSinker(sinker *sink.Sinker, bundler *bundler.Bundler, encoder encode
 		logger:  logger,
 		tracer:  tracer,
 	}
-}
 
-func (fs *FileSinker) Run(ctx context.Context) error {
-	cursor, err := fs.bundler.GetCursor()
-	if err != nil {
-		return fmt.Errorf("failed to read cursor: %w", err)
+	for _, opt := range opts {
+		opt(fs)
 	}
 
+	return fs
+}
+
+func (fs *FileSinker) Run(ctx context.Context) error {
 	fs.Sinker.OnTerminating(fs.Shutdown)
 	fs.OnTerminating(func(err error) {
 		fs.logger.Info("file sinker terminating")
@@ -54,6 +69,24 @@ func (fs *FileSinker) Run(ctx context.Context) error {
 		fs.bundler.Shutdown(nil)
 	})
 
+	if err := fs.Recover(ctx); err != nil {
+		return err
+	}
+
+	// Registered after the bundler so that the lease is released once all boundaries are uploaded
+	if fs.lease != nil {
+		fs.OnTerminating(func(_ error) {
+			fs.logger.Info("file sinker terminating, releasing lease")
+			fs.lease.Shutdown(nil)
+		})
+	}
+
+	// Recovering may resume from a checkpoint, so the cursor is read after
+	cursor, err := fs.bundler.GetCursor()
+	if err != nil {
+		return fmt.Errorf("failed to read cursor: %w", err)
+	}
+
 	fs.bundler.Launch(ctx)
 
 	expectedStartBlock := uint64(0)
@@ -73,8 +106,44 @@ func (fs *FileSinker) Run(ctx context.Context) error {
 	return nil
 }
 
+// Recover finishes or cleans up the work left over in the output store by a previous run,
+// it's called by Run unless it was already called before. When the sinker has a lease,
+// it's acquired first.
+func (fs *FileSinker) Recover(ctx context.Context) error {
+	if fs.recovered {
+		return nil
+	}
+
+	if fs.lease != nil {
+		if err := fs.lease.Acquire(ctx); err != nil {
+			return fmt.Errorf("unable to acquire lease: %w", err)
+		}
+
+		fs.lease.OnTerminating(fs.Shutdown)
+		fs.lease.Launch(ctx)
+	}
+
+	if err := fs.bundler.Recover(ctx); err != nil {
+		// The lease is released so that other processes do not wait for it to expire, it's
+		// only deleted when shut down without error
+		if fs.lease != nil {
+			fs.lease.Shutdown(nil)
+		}
+
+		return fmt.Errorf("unable to recover bundler: %w", err)
+	}
+
+	fs.recovered = true
+	return nil
+}
+
+// Status returns a snapshot of the progress of the sinker, see bundler.Bundler.Status.
+func (fs *FileSinker) Status() bundler.Status {
+	return fs.bundler.Status()
+}
+
 func (fs *FileSinker) HandleBlockScopedData(ctx context.Context, data *pbsubstreamsrpc.BlockScopedData, isLive *bool, cursor *sink.Cursor) error {
-	if err := fs.bundler.Roll(ctx, cursor.Block().Num()); err != nil {
+	if err := fs.bundler.Roll(ctx, data.Clock); err != nil {
 		return fmt.Errorf("failed to roll: %w", err)
 	}
 
@@ -89,6 +158,26 @@ func (fs *FileSinker) HandleBlockScopedData(ctx context.Context, data *pbsubstre
 	return nil
 }
 
+// HandleBlockRangeCompletion implements sink.SinkerCompletionHandler, it's called once
+// the stream reached its stop block.
+func (fs *FileSinker) HandleBlockRangeCompletion(ctx context.Context, cursor *sink.Cursor) error {
+	fs.logger.Info("stop block reached, finishing bundler", zap.Stringer("last_block_seen", cursor.Block()))
+
+	if err := fs.bundler.Finish(ctx, fs.StopBlock()); err != nil {
+		return fmt.Errorf("failed to finish bundler: %w", err)
+	}
+
+	return nil
+}
+
 func (fs *FileSinker) HandleBlockUndoSignal(ctx context.Context, undoSignal *pbsubstreamsrpc.BlockUndoSignal, cursor *sink.Cursor) error {
-	return fmt.Errorf("received undo signal but there is no handling of undo, this is because you used `--undo-buffer-size=0` which is invalid right now")
+	fs.logger.Info("received undo signal, reverting active boundary",
+		zap.Stringer("last_valid_block", cursor.Block()),
+	)
+
+	if err := fs.bundler.Revert(ctx, cursor); err != nil {
+		return fmt.Errorf("failed to revert to block %s: %w", cursor.Block(), err)
+	}
+
+	return nil
 }
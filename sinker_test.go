@@ -0,0 +1,96 @@
+package substreams_file_sink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	"github.com/streamingfast/substreams-sink-files/v2/lease"
+	"github.com/streamingfast/substreams-sink-files/v2/state"
+	sink "github.com/streamingfast/substreams/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestFileSinker_RecoverLeaseTakeover(t *testing.T) {
+	ctx := context.Background()
+	statePath := filepath.Join(t.TempDir(), "state.yaml")
+
+	outputStore, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+	require.NoError(t, err)
+
+	saveCursor := func(blockNum uint64) {
+		stateStore, err := state.NewFileStateStore(statePath)
+		require.NoError(t, err)
+
+		stateStore.SetCursor(testCursor(blockNum))
+		saveable, err := stateStore.GetState()
+		require.NoError(t, err)
+		require.NoError(t, saveable.Save())
+	}
+
+	saveCursor(99)
+
+	holder := lease.New(outputStore, lease.DefaultFilename, time.Second, false, zap.NewNop())
+	require.NoError(t, holder.Acquire(ctx))
+	holder.Launch(ctx)
+
+	// The standby reads the state while the holder is still writing boundaries
+	stateStore, err := state.NewFileStateStore(statePath)
+	require.NoError(t, err)
+
+	fileBundler, err := bundler.New(100, writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop())
+	require.NoError(t, err)
+
+	standby := NewFileSinker(nil, fileBundler, nil, zap.NewNop(), nil, WithLease(lease.New(outputStore, lease.DefaultFilename, time.Second, true, zap.NewNop())))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		saveCursor(199)
+		holder.Shutdown(nil)
+	}()
+
+	require.NoError(t, standby.Recover(ctx))
+	defer standby.lease.Shutdown(nil)
+
+	cursor, err := fileBundler.GetCursor()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(199), cursor.Block().Num(), "state saved by the previous holder is used")
+}
+
+func TestFileSinker_RecoverFailureReleasesLease(t *testing.T) {
+	ctx := context.Background()
+	statePath := filepath.Join(t.TempDir(), "state.yaml")
+
+	outputStore, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+	require.NoError(t, err)
+
+	stateStore, err := state.NewFileStateStore(statePath)
+	require.NoError(t, err)
+
+	fileBundler, err := bundler.New(100, writer.NewBufferedIO(1024, t.TempDir(), writer.FileTypeJSONL, zap.NewNop()), stateStore, outputStore, zap.NewNop())
+	require.NoError(t, err)
+
+	fileSinker := NewFileSinker(nil, fileBundler, nil, zap.NewNop(), nil, WithLease(lease.New(outputStore, lease.DefaultFilename, time.Minute, false, zap.NewNop())))
+
+	// The state is reloaded once the lease is acquired, recovering fails on a corrupted state
+	require.NoError(t, os.WriteFile(statePath, []byte("cursor: ["), 0644))
+	require.ErrorContains(t, fileSinker.Recover(ctx), "unable to recover bundler")
+
+	exists, err := outputStore.FileExists(ctx, lease.DefaultFilename)
+	require.NoError(t, err)
+	assert.False(t, exists, "lease is released")
+}
+
+func testCursor(blockNum uint64) *sink.Cursor {
+	block := bstream.NewBlockRef(fmt.Sprintf("%08x", blockNum), blockNum)
+	return &sink.Cursor{Cursor: &bstream.Cursor{Step: bstream.StepNewIrreversible, Block: block, LIB: block, HeadBlock: block}}
+}
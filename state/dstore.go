@@ -0,0 +1,103 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/streamingfast/dstore"
+	"gopkg.in/yaml.v3"
+)
+
+var _ Store = (*DStoreStateStore)(nil)
+
+// DStoreStateStore keeps the state in a single object of a `dstore.Store`, which means
+// the state can live on any supported storage (gs://, s3://, az://, file://), usually
+// right next to the output files so that a sinker restarted on a fresh machine can
+// resume from where it left off.
+type DStoreStateStore struct {
+	*stateTracker
+
+	store    dstore.Store
+	filename string
+}
+
+func NewDStoreStateStore(ctx context.Context, store dstore.Store, filename string) (*DStoreStateStore, error) {
+	s, err := readDStoreState(ctx, store, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DStoreStateStore{
+		stateTracker: newStateTracker(s),
+		store:        store,
+		filename:     filename,
+	}, nil
+}
+
+func readDStoreState(ctx context.Context, store dstore.Store, filename string) (*FileState, error) {
+	s := newFileState()
+
+	exists, err := store.FileExists(ctx, filename)
+	if err != nil {
+		return nil, fmt.Errorf("check state file %q exists: %w", store.ObjectURL(filename), err)
+	}
+
+	if !exists {
+		return s, nil
+	}
+
+	reader, err := store.OpenObject(ctx, filename)
+	if err != nil {
+		return nil, fmt.Errorf("open state file %q: %w", store.ObjectURL(filename), err)
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read state file %q: %w", store.ObjectURL(filename), err)
+	}
+
+	if err := yaml.Unmarshal(content, s); err != nil {
+		return nil, fmt.Errorf("unmarshal state file %q: %w", store.ObjectURL(filename), err)
+	}
+
+	return s, nil
+}
+
+func (s *DStoreStateStore) Reload(ctx context.Context) error {
+	state, err := readDStoreState(ctx, s.store, s.filename)
+	if err != nil {
+		return err
+	}
+
+	s.state = state
+	return nil
+}
+
+func (s *DStoreStateStore) GetState() (Saveable, error) {
+	cnt, err := yaml.Marshal(s.state)
+	if err != nil {
+		return nil, fmt.Errorf("marshall: %w", err)
+	}
+
+	return &dstoreStateInstance{
+		data:     cnt,
+		store:    s.store,
+		filename: s.filename,
+	}, nil
+}
+
+type dstoreStateInstance struct {
+	data     []byte
+	store    dstore.Store
+	filename string
+}
+
+func (s *dstoreStateInstance) Save() error {
+	if err := s.store.WriteObject(context.Background(), s.filename, bytes.NewReader(s.data)); err != nil {
+		return fmt.Errorf("unable to write state file %q: %w", s.store.ObjectURL(s.filename), err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	sink "github.com/streamingfast/substreams/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDStoreStateStore(t *testing.T) {
+	ctx := context.Background()
+	store := dstore.NewMockStore(nil)
+
+	stateStore, err := NewDStoreStateStore(ctx, store, "state.yaml")
+	require.NoError(t, err)
+
+	cursor, err := stateStore.ReadCursor()
+	require.NoError(t, err)
+	assert.True(t, cursor.IsBlank())
+
+	block := bstream.NewBlockRef("0a", 10)
+	expected := &sink.Cursor{Cursor: &bstream.Cursor{Step: bstream.StepNewIrreversible, Block: block, LIB: block, HeadBlock: block}}
+
+	stateStore.NewBoundary(NewActiveBoundary(bstream.NewRangeExcludingEnd(0, 100)))
+	stateStore.SetCursor(expected)
+
+	saveable, err := stateStore.GetState()
+	require.NoError(t, err)
+	require.NoError(t, saveable.Save())
+	require.Contains(t, store.Files, "state.yaml")
+
+	reloaded, err := NewDStoreStateStore(ctx, store, "state.yaml")
+	require.NoError(t, err)
+
+	cursor, err = reloaded.ReadCursor()
+	require.NoError(t, err)
+	assert.Equal(t, expected.String(), cursor.String())
+	assert.Equal(t, BlockState{ID: "0a", Number: 10}, reloaded.state.Block)
+	assert.Equal(t, ActiveBoundary{StartBlockNumber: 0, EndBlockNumber: 100}, reloaded.state.ActiveBoundary)
+	assert.False(t, reloaded.state.StartedAt.IsZero())
+	assert.False(t, reloaded.IsCompleted())
+}
+
+func TestDStoreStateStore_Reload(t *testing.T) {
+	ctx := context.Background()
+	store := dstore.NewMockStore(nil)
+
+	stateStore, err := NewDStoreStateStore(ctx, store, "state.yaml")
+	require.NoError(t, err)
+
+	// Another process saves the state after it was read
+	other, err := NewDStoreStateStore(ctx, store, "state.yaml")
+	require.NoError(t, err)
+
+	block := bstream.NewBlockRef("0a", 10)
+	other.SetCursor(&sink.Cursor{Cursor: &bstream.Cursor{Step: bstream.StepNewIrreversible, Block: block, LIB: block, HeadBlock: block}})
+	saveable, err := other.GetState()
+	require.NoError(t, err)
+	require.NoError(t, saveable.Save())
+
+	cursor, err := stateStore.ReadCursor()
+	require.NoError(t, err)
+	assert.True(t, cursor.IsBlank())
+
+	require.NoError(t, stateStore.Reload(ctx))
+
+	cursor, err = stateStore.ReadCursor()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), cursor.Block().Num())
+}
+
+func TestSegmentLocation(t *testing.T) {
+	segment := bstream.NewRangeExcludingEnd(0, 100000)
+
+	assert.Equal(t, "./state.0000000000-0000100000.yaml", SegmentLocation("./state.yaml", segment))
+	assert.Equal(t, "s3://bucket/output/state.0000000000-0000100000.yaml", SegmentLocation("s3://bucket/output/state.yaml", segment))
+	assert.Equal(t, "./data.d/state.0000000000-0000100000", SegmentLocation("./data.d/state", segment))
+}
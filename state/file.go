@@ -1,6 +1,7 @@
 package state
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sync"
@@ -14,42 +15,83 @@ import (
 var _ Store = (*FileStateStore)(nil)
 
 type FileStateStore struct {
-	startOnce sync.Once
+	*stateTracker
 
 	outputPath string
-
-	state *FileState
 }
 
 func NewFileStateStore(outputPath string) (*FileStateStore, error) {
-	s := &FileState{}
+	s, err := readFileState(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStateStore{
+		stateTracker: newStateTracker(s),
+		outputPath:   outputPath,
+	}, nil
+}
+
+func readFileState(outputPath string) (*FileState, error) {
+	s := newFileState()
 	content, err := os.ReadFile(outputPath)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("read file: %w", err)
 	}
-	if err != nil && os.IsNotExist(err) {
-		s = newFileState()
-	}
 
 	if err := yaml.Unmarshal(content, s); err != nil {
 		return nil, fmt.Errorf("unmarshal state file %q: %w", outputPath, err)
 	}
-	return &FileStateStore{
-		outputPath: outputPath,
-		state:      s,
+
+	return s, nil
+}
+
+func (s *FileStateStore) Reload(_ context.Context) error {
+	state, err := readFileState(s.outputPath)
+	if err != nil {
+		return err
+	}
+
+	s.state = state
+	return nil
+}
+
+func (s *FileStateStore) GetState() (Saveable, error) {
+	cnt, err := yaml.Marshal(s.state)
+	if err != nil {
+		return nil, fmt.Errorf("marshall: %w", err)
+	}
+	return &stateInstance{
+		data: cnt,
+		path: s.outputPath,
 	}, nil
 }
 
-func (s *FileStateStore) ReadCursor() (cursor *sink.Cursor, err error) {
+// stateTracker holds the in-memory state shared by all Store implementations, each
+// implementation only differs in how the state is read at startup and saved.
+type stateTracker struct {
+	startOnce sync.Once
+
+	state *FileState
+}
+
+func newStateTracker(state *FileState) *stateTracker {
+	return &stateTracker{state: state}
+}
+
+func (s *stateTracker) ReadCursor() (cursor *sink.Cursor, err error) {
 	return sink.NewCursor(s.state.Cursor)
 }
 
-func (s *FileStateStore) NewBoundary(boundary *bstream.Range) {
-	s.state.ActiveBoundary.StartBlockNumber = boundary.StartBlock()
-	s.state.ActiveBoundary.EndBlockNumber = *boundary.EndBlock()
+func (s *stateTracker) NewBoundary(boundary ActiveBoundary) {
+	s.state.ActiveBoundary = boundary
 }
 
-func (s *FileStateStore) SetCursor(cursor *sink.Cursor) {
+func (s *stateTracker) ActiveBoundary() ActiveBoundary {
+	return s.state.ActiveBoundary
+}
+
+func (s *stateTracker) SetCursor(cursor *sink.Cursor) {
 	s.startOnce.Do(func() {
 		restartAt := time.Now()
 		if s.state.StartedAt.IsZero() {
@@ -58,6 +100,7 @@ func (s *FileStateStore) SetCursor(cursor *sink.Cursor) {
 		s.state.RestartedAt = restartAt
 	})
 
+	s.state.Completed = false
 	s.state.Cursor = cursor.String()
 	s.state.Block = BlockState{
 		ID:     cursor.Block().ID(),
@@ -65,21 +108,29 @@ func (s *FileStateStore) SetCursor(cursor *sink.Cursor) {
 	}
 }
 
-func (s *FileStateStore) GetState() (Saveable, error) {
-	cnt, err := yaml.Marshal(s.state)
-	if err != nil {
-		return nil, fmt.Errorf("marshall: %w", err)
-	}
-	return &stateInstance{
-		data: cnt,
-		path: s.outputPath,
-	}, nil
+func (s *stateTracker) MarkCompleted() {
+	s.state.Completed = true
+}
+
+func (s *stateTracker) IsCompleted() bool {
+	return s.state.Completed
+}
+
+func (s *stateTracker) StartedAt() time.Time {
+	return s.state.StartedAt
+}
+
+func (s *stateTracker) RestartedAt() time.Time {
+	return s.state.RestartedAt
 }
 
 type FileState struct {
 	Cursor         string         `yaml:"cursor" json:"cursor"`
 	Block          BlockState     `yaml:"block" json:"block"`
 	ActiveBoundary ActiveBoundary `yaml:"active_boundary" json:"active_boundary"`
+	// Completed is true once the stream reached its stop block and all boundaries up to
+	// it have been written.
+	Completed bool `yaml:"completed,omitempty" json:"completed,omitempty"`
 
 	// StartedAt is the time this process was launching initially without accounting to any restart, once set, this
 	// value, it's never re-written (unless the file does not exist anymore).
@@ -103,7 +154,23 @@ type BlockState struct {
 
 type ActiveBoundary struct {
 	StartBlockNumber uint64 `yaml:"start_block_number"  json:"start_block_number"`
-	EndBlockNumber   uint64 `yaml:"end_block_number"  json:"end_block_number"`
+	// EndBlockNumber is the exclusive end block of the boundary, it's 0 while the end
+	// block is not known yet, which is the case of time window boundaries.
+	EndBlockNumber uint64 `yaml:"end_block_number"  json:"end_block_number"`
+
+	// WindowStart and WindowEnd are the time window covered by the boundary, only set when
+	// boundaries are time windows. A restart resuming within this window continues it.
+	WindowStart time.Time `yaml:"window_start,omitempty" json:"window_start,omitempty"`
+	WindowEnd   time.Time `yaml:"window_end,omitempty" json:"window_end,omitempty"`
+}
+
+func NewActiveBoundary(boundary *bstream.Range) ActiveBoundary {
+	out := ActiveBoundary{StartBlockNumber: boundary.StartBlock()}
+	if boundary.EndBlock() != nil {
+		out.EndBlockNumber = *boundary.EndBlock()
+	}
+
+	return out
 }
 
 type stateInstance struct {
@@ -1,15 +1,36 @@
 package state
 
 import (
-	"github.com/streamingfast/bstream"
+	"context"
+	"time"
+
 	sink "github.com/streamingfast/substreams/sink"
 )
 
 type Store interface {
-	NewBoundary(*bstream.Range)
+	// Reload reads the saved state again, discarding the in-memory one. It's used once the
+	// lease is acquired, another process may have saved the state since it was first read.
+	Reload(ctx context.Context) error
+
+	NewBoundary(ActiveBoundary)
+	// ActiveBoundary returns the boundary recorded by the last call to NewBoundary, it's
+	// the one of the saved state until then.
+	ActiveBoundary() ActiveBoundary
 	ReadCursor() (*sink.Cursor, error)
 	SetCursor(*sink.Cursor)
 	GetState() (Saveable, error)
+
+	// MarkCompleted records that the stream reached its stop block, it's reset by the
+	// next call to SetCursor.
+	MarkCompleted()
+	// IsCompleted returns true if the stream reached its stop block when the state was
+	// last saved.
+	IsCompleted() bool
+
+	// StartedAt returns the time the sink first started processing, kept across restarts.
+	StartedAt() time.Time
+	// RestartedAt returns the time the sink last started processing.
+	RestartedAt() time.Time
 }
 
 type Saveable interface {
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+)
+
+// NewStoreFromURL creates the Store implementation matching the state store location
+// received. A location with a URL scheme (gs://, s3://, az://, file://) is handled through
+// DStoreStateStore while a plain local path is handled through FileStateStore.
+func NewStoreFromURL(ctx context.Context, location string) (Store, error) {
+	if !hasURLScheme(location) {
+		if err := os.MkdirAll(filepath.Dir(location), os.ModePerm); err != nil {
+			return nil, fmt.Errorf("create state file directories: %w", err)
+		}
+
+		return NewFileStateStore(location)
+	}
+
+	store, filename, err := dstore.NewStoreFromFileURL(location, dstore.AllowOverwrite())
+	if err != nil {
+		return nil, fmt.Errorf("new state store %q: %w", location, err)
+	}
+
+	if filename == "" || filename == "." || filename == "/" {
+		return nil, fmt.Errorf("state store %q must point to a file, not a directory", location)
+	}
+
+	return NewDStoreStateStore(ctx, store, filename)
+}
+
+func hasURLScheme(location string) bool {
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+
+	// A single letter scheme is a Windows drive letter, not a URL scheme
+	return len(parsed.Scheme) > 1
+}
+
+// SegmentLocation returns the location of the state of the given segment when the
+// block range is processed in parallel segments, the segment's block range is inserted
+// before the extension of the location, 'state.yaml' becoming for example
+// 'state.0000000000-0000100000.yaml'.
+func SegmentLocation(location string, segment *bstream.Range) string {
+	ext := path.Ext(location)
+	if strings.Contains(ext, "/") {
+		ext = ""
+	}
+
+	return fmt.Sprintf("%s.%010d-%010d%s", strings.TrimSuffix(location, ext), segment.StartBlock(), *segment.EndBlock(), ext)
+}
@@ -0,0 +1,256 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/streamingfast/shutter"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler"
+	"go.uber.org/zap"
+)
+
+// Source is something whose progress is reported by the Server, a FileSinker.
+type Source interface {
+	Status() bundler.Status
+}
+
+// Segment is a Source reported by the Server, Name identifies it when the block range
+// is processed in parallel segments and is empty otherwise.
+type Segment struct {
+	Name   string
+	Source Source
+}
+
+// Server serves the progress of the sink as JSON on `/status` along with health checks
+// suitable for Kubernetes probes:
+//
+//   - `/healthz` (liveness) fails once a segment terminated with an error;
+//   - `/readyz` (readiness) fails as well when the stream is stalled, no block being
+//     received for more than the stall timeout, or when the last upload attempt failed.
+type Server struct {
+	*shutter.Shutter
+
+	addr         string
+	encoder      string
+	workingDir   string
+	stallTimeout time.Duration
+	segments     []Segment
+	logger       *zap.Logger
+
+	server *http.Server
+}
+
+func NewServer(addr string, encoder string, workingDir string, stallTimeout time.Duration, segments []Segment, logger *zap.Logger) *Server {
+	s := &Server{
+		Shutter:      shutter.New(),
+		addr:         addr,
+		encoder:      encoder,
+		workingDir:   workingDir,
+		stallTimeout: stallTimeout,
+		segments:     segments,
+		logger:       logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	s.OnTerminating(func(_ error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		s.server.Shutdown(ctx)
+	})
+
+	return s
+}
+
+// Run serves requests until the server is shut down.
+func (s *Server) Run() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("listen on %q: %w", s.addr, err)
+	}
+
+	s.logger.Info("serving status", zap.String("listen_addr", listener.Addr().String()))
+	if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve status: %w", err)
+	}
+
+	return nil
+}
+
+// Report is the content served on `/status`.
+type Report struct {
+	// Healthy is the liveness verdict and Ready the readiness one, Reasons explaining
+	// why the sink is not ready.
+	Healthy bool     `json:"healthy"`
+	Ready   bool     `json:"ready"`
+	Reasons []string `json:"reasons,omitempty"`
+
+	Encoder              string `json:"encoder"`
+	WorkingDir           string `json:"working_dir"`
+	WorkingDirUsageBytes int64  `json:"working_dir_usage_bytes"`
+
+	Segments []SegmentReport `json:"segments"`
+}
+
+type SegmentReport struct {
+	Name string `json:"name,omitempty"`
+	bundler.Status
+}
+
+// Verdict is the content served on `/healthz` and `/readyz`.
+type Verdict struct {
+	Healthy bool     `json:"healthy"`
+	Ready   bool     `json:"ready"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, _ *http.Request) {
+	report := Report{
+		Encoder:    s.encoder,
+		WorkingDir: s.workingDir,
+	}
+
+	report.Segments = s.segmentReports()
+
+	verdict := evaluate(report.Segments, time.Now(), s.stallTimeout)
+	report.Healthy, report.Ready, report.Reasons = verdict.Healthy, verdict.Ready, verdict.Reasons
+
+	usage, err := directoryUsage(s.workingDir)
+	if err != nil {
+		s.logger.Debug("unable to compute working directory usage", zap.Error(err))
+	}
+	report.WorkingDirUsageBytes = usage
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, _ *http.Request) {
+	verdict := s.verdict()
+
+	code := http.StatusOK
+	if !verdict.Healthy {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, verdict)
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, _ *http.Request) {
+	verdict := s.verdict()
+
+	code := http.StatusOK
+	if !verdict.Ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, verdict)
+}
+
+func (s *Server) verdict() Verdict {
+	return evaluate(s.segmentReports(), time.Now(), s.stallTimeout)
+}
+
+func (s *Server) segmentReports() []SegmentReport {
+	out := make([]SegmentReport, len(s.segments))
+	for i, segment := range s.segments {
+		out[i] = SegmentReport{Name: segment.Name, Status: segment.Source.Status()}
+	}
+
+	return out
+}
+
+// evaluate computes the health and readiness of the sink from the status of its segments.
+// Segments terminated without error are done and do not affect the verdict.
+func evaluate(segments []SegmentReport, now time.Time, stallTimeout time.Duration) Verdict {
+	verdict := Verdict{Healthy: true, Ready: true}
+	notReady := func(segment SegmentReport, format string, args ...any) {
+		prefix := "sink"
+		if segment.Name != "" {
+			prefix = "segment " + segment.Name
+		}
+
+		verdict.Ready = false
+		verdict.Reasons = append(verdict.Reasons, prefix+" "+fmt.Sprintf(format, args...))
+	}
+
+	for _, segment := range segments {
+		if segment.Terminated {
+			if segment.Error != "" {
+				verdict.Healthy = false
+				notReady(segment, "terminated: %s", segment.Error)
+			}
+
+			continue
+		}
+
+		if segment.LaunchedAt.IsZero() {
+			notReady(segment, "not launched yet")
+			continue
+		}
+
+		if segment.UploadError != "" {
+			notReady(segment, "upload failing since %s: %s", segment.UploadErrorAt.Format(time.RFC3339), segment.UploadError)
+		}
+
+		lastActivity := segment.LastBlockAt
+		if lastActivity.IsZero() {
+			lastActivity = segment.LaunchedAt
+		}
+
+		if stallTimeout > 0 && now.Sub(lastActivity) > stallTimeout {
+			notReady(segment, "stalled, no block received for %s", now.Sub(lastActivity).Truncate(time.Second))
+		}
+	}
+
+	return verdict
+}
+
+// directoryUsage returns the total size of the files found in dir, 0 if it does not exist.
+func directoryUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		total += info.Size()
+		return nil
+	})
+
+	return total, err
+}
+
+func writeJSON(w http.ResponseWriter, code int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,108 @@
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streamingfast/substreams-sink-files/v2/bundler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type staticSource bundler.Status
+
+func (s staticSource) Status() bundler.Status {
+	return bundler.Status(s)
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2024, 3, 5, 13, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		segments      []SegmentReport
+		expectVerdict Verdict
+	}{
+		{
+			"processing",
+			[]SegmentReport{{Status: bundler.Status{LaunchedAt: now.Add(-time.Hour), LastBlockAt: now.Add(-time.Second)}}},
+			Verdict{Healthy: true, Ready: true},
+		},
+		{
+			"not launched",
+			[]SegmentReport{{Status: bundler.Status{}}},
+			Verdict{Healthy: true, Ready: false, Reasons: []string{"sink not launched yet"}},
+		},
+		{
+			"waiting for first block",
+			[]SegmentReport{{Status: bundler.Status{LaunchedAt: now.Add(-time.Second)}}},
+			Verdict{Healthy: true, Ready: true},
+		},
+		{
+			"stalled",
+			[]SegmentReport{{Status: bundler.Status{LaunchedAt: now.Add(-time.Hour), LastBlockAt: now.Add(-10 * time.Minute)}}},
+			Verdict{Healthy: true, Ready: false, Reasons: []string{"sink stalled, no block received for 10m0s"}},
+		},
+		{
+			"upload failing",
+			[]SegmentReport{{Status: bundler.Status{LaunchedAt: now.Add(-time.Hour), LastBlockAt: now, UploadError: "boom", UploadErrorAt: now}}},
+			Verdict{Healthy: true, Ready: false, Reasons: []string{"sink upload failing since 2024-03-05T13:00:00Z: boom"}},
+		},
+		{
+			"segment completed",
+			[]SegmentReport{
+				{Name: "0000000000-0000000100", Status: bundler.Status{LaunchedAt: now.Add(-time.Hour), LastBlockAt: now.Add(-time.Hour), Terminated: true}},
+				{Name: "0000000100-0000000200", Status: bundler.Status{LaunchedAt: now.Add(-time.Hour), LastBlockAt: now}},
+			},
+			Verdict{Healthy: true, Ready: true},
+		},
+		{
+			"segment failed",
+			[]SegmentReport{{Name: "0000000000-0000000100", Status: bundler.Status{LaunchedAt: now.Add(-time.Hour), Terminated: true, Error: "boom"}}},
+			Verdict{Healthy: false, Ready: false, Reasons: []string{"segment 0000000000-0000000100 terminated: boom"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expectVerdict, evaluate(test.segments, now, 5*time.Minute))
+		})
+	}
+}
+
+func TestServer(t *testing.T) {
+	workingDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(workingDir, "0000000000-0000000100.tmp.jsonl"), []byte("0123456789"), os.ModePerm))
+
+	source := staticSource{LaunchedAt: time.Now(), LastBlockAt: time.Now(), UploadError: "boom", UploadErrorAt: time.Now(), PendingUploads: 2}
+	server := NewServer("", "lines", workingDir, time.Minute, []Segment{{Source: source}}, zap.NewNop())
+
+	get := func(path string) (int, map[string]any) {
+		recorder := httptest.NewRecorder()
+		server.server.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+
+		out := map[string]any{}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &out))
+		return recorder.Code, out
+	}
+
+	code, report := get("/status")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "lines", report["encoder"])
+	assert.Equal(t, float64(10), report["working_dir_usage_bytes"])
+	assert.Equal(t, false, report["ready"])
+	assert.Equal(t, float64(2), report["segments"].([]any)[0].(map[string]any)["pending_uploads"])
+
+	code, _ = get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, verdict := get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Len(t, verdict["reasons"], 1)
+}
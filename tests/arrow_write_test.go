@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/arrowx"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestArrowWriter_Dictionary(t *testing.T) {
+	ctx := context.Background()
+	descriptor := (&pbtesting.RowColumEnumInside{}).ProtoReflect().Descriptor()
+
+	table, err := arrowx.TableFromMessageDescriptor(descriptor)
+	require.NoError(t, err)
+
+	for _, compression := range []writer.ArrowCompression{writer.ArrowCompressionNone, writer.ArrowCompressionLZ4, writer.ArrowCompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			arrowWriter, err := writer.NewArrowWriter(descriptor, testLogger, testTracer, writer.ArrowBufferCompression(compression))
+			require.NoError(t, err)
+
+			headStore, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+			require.NoError(t, err)
+
+			// Each block is a record batch, the batches of a boundary being concatenated and
+			// the ones of compacted files kept as is, they all share the enum's dictionary
+			var heads []writer.UploadedFile
+			for _, head := range []struct {
+				boundary *bstream.Range
+				values   []pbtesting.RowColumEnumInside_Value
+			}{
+				{bstream.NewRangeExcludingEnd(0, 10), []pbtesting.RowColumEnumInside_Value{pbtesting.RowColumEnumInside_SECOND, pbtesting.RowColumEnumInside_FIRST}},
+				{bstream.NewRangeExcludingEnd(10, 20), []pbtesting.RowColumEnumInside_Value{pbtesting.RowColumEnumInside_UNKNOWN}},
+			} {
+				require.NoError(t, arrowWriter.StartBoundary(head.boundary))
+				for i, value := range head.values {
+					writeArrowBlock(t, arrowWriter, head.boundary.StartBlock()+uint64(i), &pbtesting.RowColumEnumInside{Value: value})
+				}
+
+				uploadable, err := arrowWriter.CloseBoundary(ctx, writer.BlockRangeFileNamer(head.boundary))
+				require.NoError(t, err)
+
+				files, err := uploadable.Upload(ctx, headStore)
+				require.NoError(t, err)
+				heads = append(heads, files...)
+			}
+
+			store, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+			require.NoError(t, err)
+
+			_, err = arrowWriter.Compact(headStore, heads, writer.BlockRangeFileNamer(bstream.NewRangeExcludingEnd(0, 20))).Upload(ctx, store)
+			require.NoError(t, err)
+
+			var values []string
+			schema, batches := readArrowFile(t, store, "rows/0000000000-0000000020.arrow", func(record arrow.Record) {
+				column := record.Column(0).(*array.Dictionary)
+				assert.Equal(t, `["UNKNOWN" "FIRST" "SECOND"]`, column.Dictionary().String())
+
+				for i := range column.Len() {
+					values = append(values, column.ValueStr(i))
+				}
+			})
+
+			assert.True(t, table.Schema().Equal(schema), "schema %s", schema)
+			assert.Equal(t, 2, batches)
+			assert.Equal(t, []string{"SECOND", "FIRST", "UNKNOWN"}, values)
+		})
+	}
+}
+
+func TestArrowWriter_Decimal256(t *testing.T) {
+	ctx := context.Background()
+	descriptor := (&pbtesting.RowColumnTypeInt256{}).ProtoReflect().Descriptor()
+	boundary := bstream.NewRangeExcludingEnd(0, 10)
+
+	table, err := arrowx.TableFromMessageDescriptor(descriptor)
+	require.NoError(t, err)
+
+	arrowWriter, err := writer.NewArrowWriter(descriptor, testLogger, testTracer)
+	require.NoError(t, err)
+	require.NoError(t, arrowWriter.StartBoundary(boundary))
+
+	writeArrowBlock(t, arrowWriter, 1, &pbtesting.RowColumnTypeInt256{Positive: "0xff", Negative: "-12345678901234567890123456789"})
+	writeArrowBlock(t, arrowWriter, 2, &pbtesting.RowColumnTypeInt256{Positive: "9999999999999999999999999999999999999999999999999999999999999999999999999999", Negative: "-1"})
+
+	uploadable, err := arrowWriter.CloseBoundary(ctx, writer.BlockRangeFileNamer(boundary))
+	require.NoError(t, err)
+
+	store, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+	require.NoError(t, err)
+
+	_, err = uploadable.Upload(ctx, store)
+	require.NoError(t, err)
+
+	var positives, negatives []string
+	schema, _ := readArrowFile(t, store, "row_column_type_int_256/0000000000-0000000010.arrow", func(record arrow.Record) {
+		for i := range int(record.NumRows()) {
+			positives = append(positives, record.Column(0).(*array.Decimal256).ValueStr(i))
+			negatives = append(negatives, record.Column(1).(*array.Decimal256).ValueStr(i))
+		}
+	})
+
+	assert.True(t, table.Schema().Equal(schema), "schema %s", schema)
+	assert.Equal(t, []string{"255", "9999999999999999999999999999999999999999999999999999999999999999999999999999"}, positives)
+	assert.Equal(t, []string{"-12345678901234567890123456789", "-1"}, negatives)
+}
+
+func TestParseArrowCompression(t *testing.T) {
+	compression, err := writer.ParseArrowCompression("")
+	require.NoError(t, err)
+	assert.Equal(t, writer.ArrowCompressionLZ4, compression)
+
+	compression, err = writer.ParseArrowCompression("ZSTD")
+	require.NoError(t, err)
+	assert.Equal(t, writer.ArrowCompressionZstd, compression)
+
+	_, err = writer.ParseArrowCompression("gzip")
+	assert.EqualError(t, err, `invalid arrow compression "gzip", accepted values are 'none', 'lz4' and 'zstd'`)
+}
+
+func writeArrowBlock(t *testing.T, arrowWriter *writer.ArrowWriter, blockNum uint64, output proto.Message) {
+	t.Helper()
+
+	message, err := anypb.New(output)
+	require.NoError(t, err)
+
+	require.NoError(t, arrowWriter.EncodeMapModule(&pbsubstreamsrpc.MapModuleOutput{Name: "test", MapOutput: message}))
+	arrowWriter.EndBlock(blockNum)
+}
+
+// readArrowFile calls onRecord for each record batch of the IPC file, it returns the
+// schema of the file along with its number of record batches.
+func readArrowFile(t *testing.T, store dstore.Store, filename string, onRecord func(record arrow.Record)) (schema *arrow.Schema, batches int) {
+	t.Helper()
+
+	reader, err := store.OpenObject(context.Background(), filename)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	fileReader, err := ipc.NewFileReader(bytes.NewReader(content))
+	require.NoError(t, err)
+	defer fileReader.Close()
+
+	for i := range fileReader.NumRecords() {
+		record, err := fileReader.Record(i)
+		require.NoError(t, err)
+
+		onRecord(record)
+	}
+
+	return fileReader.Schema(), fileReader.NumRecords()
+}
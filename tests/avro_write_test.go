@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/hamba/avro/v2"
+	"github.com/hamba/avro/v2/ocf"
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/avrox"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestAvroWriter(t *testing.T) {
+	ctx := context.Background()
+
+	record, err := avrox.RecordFromMessageDescriptor((&pbtesting.Row{}).ProtoReflect().Descriptor())
+	require.NoError(t, err)
+
+	for _, codec := range []writer.AvroCodec{writer.AvroCodecNull, writer.AvroCodecDeflate, writer.AvroCodecSnappy, writer.AvroCodecZstd} {
+		t.Run(string(codec), func(t *testing.T) {
+			avroWriter, err := writer.NewAvroWriter((&pbtesting.SingleRepeated{}).ProtoReflect().Descriptor(), testLogger, testTracer, writer.AvroBlockCodec(codec))
+			require.NoError(t, err)
+
+			maxUint64 := testProtobufRow(2)
+			maxUint64.TypeUint64 = math.MaxUint64
+			maxUint64.TypeTimestamp = nil
+
+			headStore, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+			require.NoError(t, err)
+
+			var heads []writer.UploadedFile
+			for _, head := range []struct {
+				boundary *bstream.Range
+				rows     []*pbtesting.Row
+			}{
+				{bstream.NewRangeExcludingEnd(0, 10), []*pbtesting.Row{testProtobufRow(1), maxUint64}},
+				{bstream.NewRangeExcludingEnd(10, 20), []*pbtesting.Row{testProtobufRow(3)}},
+			} {
+				require.NoError(t, avroWriter.StartBoundary(head.boundary))
+				writeAvroBlock(t, avroWriter, head.boundary.StartBlock(), &pbtesting.SingleRepeated{Elements: head.rows})
+
+				uploadable, err := avroWriter.CloseBoundary(ctx, writer.BlockRangeFileNamer(head.boundary))
+				require.NoError(t, err)
+
+				files, err := uploadable.Upload(ctx, headStore)
+				require.NoError(t, err)
+				heads = append(heads, files...)
+			}
+
+			store, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+			require.NoError(t, err)
+
+			_, err = avroWriter.Compact(headStore, heads, writer.BlockRangeFileNamer(bstream.NewRangeExcludingEnd(0, 20))).Upload(ctx, store)
+			require.NoError(t, err)
+
+			for _, file := range []struct {
+				store    dstore.Store
+				filename string
+			}{
+				{headStore, "elements/0000000000-0000000010.avro"},
+				{store, "elements/0000000000-0000000020.avro"},
+			} {
+				rows, metadata := readAvroFile(t, file.store, file.filename)
+
+				schema, err := avro.ParseWithCache(string(metadata["avro.schema"]), "", &avro.SchemaCache{})
+				require.NoError(t, err)
+				assert.Equal(t, record.Schema().String(), schema.String())
+				assert.Equal(t, codecName(codec), string(metadata["avro.codec"]))
+
+				require.GreaterOrEqual(t, len(rows), 2)
+				assert.Equal(t, map[string]any{
+					"typeString":    "abc-1",
+					"typeInt32":     1,
+					"typeInt64":     int64(1),
+					"typeUint32":    int64(1),
+					"typeUint64":    big.NewRat(1, 1),
+					"typeSint32":    1,
+					"typeSint64":    int64(1),
+					"typeFixed32":   int64(1),
+					"typeFixed64":   big.NewRat(1, 1),
+					"typeSfixed32":  1,
+					"typeSfixed64":  int64(1),
+					"typeFloat":     float32(1.1),
+					"typeDouble":    1.1,
+					"typeBool":      false,
+					"typeBytes":     []byte("bytes-1"),
+					"typeTimestamp": testProtobufRow(1).TypeTimestamp.AsTime(),
+				}, rows[0])
+				assert.Equal(t, "18446744073709551615", rows[1]["typeUint64"].(*big.Rat).RatString())
+				assert.Nil(t, rows[1]["typeTimestamp"])
+			}
+		})
+	}
+}
+
+func TestParseAvroCodec(t *testing.T) {
+	codec, err := writer.ParseAvroCodec("")
+	require.NoError(t, err)
+	assert.Equal(t, writer.AvroCodecDeflate, codec)
+
+	codec, err = writer.ParseAvroCodec("ZSTD")
+	require.NoError(t, err)
+	assert.Equal(t, writer.AvroCodecZstd, codec)
+
+	_, err = writer.ParseAvroCodec("lz4")
+	assert.EqualError(t, err, `invalid avro codec "lz4", accepted values are 'null', 'deflate', 'snappy' and 'zstd'`)
+}
+
+func writeAvroBlock(t *testing.T, avroWriter *writer.AvroWriter, blockNum uint64, output proto.Message) {
+	t.Helper()
+
+	message, err := anypb.New(output)
+	require.NoError(t, err)
+
+	require.NoError(t, avroWriter.EncodeMapModule(&pbsubstreamsrpc.MapModuleOutput{Name: "test", MapOutput: message}))
+	avroWriter.EndBlock(blockNum)
+}
+
+// readAvroFile returns the rows of the container file along with the metadata of its
+// header.
+func readAvroFile(t *testing.T, store dstore.Store, filename string) (rows []map[string]any, metadata map[string][]byte) {
+	t.Helper()
+
+	reader, err := store.OpenObject(context.Background(), filename)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	decoder, err := ocf.NewDecoder(reader)
+	require.NoError(t, err)
+
+	for decoder.HasNext() {
+		var row map[string]any
+		require.NoError(t, decoder.Decode(&row))
+		rows = append(rows, row)
+	}
+	require.NoError(t, decoder.Error())
+
+	return rows, decoder.Metadata()
+}
+
+func codecName(codec writer.AvroCodec) string {
+	if codec == writer.AvroCodecZstd {
+		return string(ocf.ZStandard)
+	}
+
+	return string(codec)
+}
@@ -0,0 +1,68 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestParquetWriter_Checkpoint(t *testing.T) {
+	ctx := context.Background()
+	descriptor := (&pbtesting.SingleRepeated{}).ProtoReflect().Descriptor()
+	boundary := bstream.NewRangeExcludingEnd(0, 1000)
+	checkpointDir := t.TempDir()
+
+	writeBlock := func(parquetWriter *writer.ParquetWriter, blockNum uint64, rows ...int) {
+		output := &pbtesting.SingleRepeated{}
+		for _, row := range rows {
+			output.Elements = append(output.Elements, testProtobufRow(row))
+		}
+
+		message, err := anypb.New(output)
+		require.NoError(t, err)
+
+		require.NoError(t, parquetWriter.EncodeMapModule(&pbsubstreamsrpc.MapModuleOutput{Name: "test", MapOutput: message}))
+		parquetWriter.EndBlock(blockNum)
+	}
+
+	crashed, err := writer.NewParquetWriter(descriptor, testLogger, testTracer)
+	require.NoError(t, err)
+	require.NoError(t, crashed.StartBoundary(boundary))
+
+	writeBlock(crashed, 1, 1)
+	writeBlock(crashed, 2, 2, 3)
+	require.NoError(t, crashed.Checkpoint(checkpointDir))
+	writeBlock(crashed, 3, 4)
+
+	parquetWriter, err := writer.NewParquetWriter(descriptor, testLogger, testTracer)
+	require.NoError(t, err)
+	require.NoError(t, parquetWriter.RestoreCheckpoint(checkpointDir, boundary))
+	assert.Equal(t, int64(3), parquetWriter.Stats().Rows)
+
+	writeBlock(parquetWriter, 3, 30)
+	require.NoError(t, parquetWriter.Revert(1))
+	writeBlock(parquetWriter, 2, 20)
+
+	uploadable, err := parquetWriter.CloseBoundary(ctx, writer.BlockRangeFileNamer(boundary))
+	require.NoError(t, err)
+
+	store, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+	require.NoError(t, err)
+
+	_, err = uploadable.Upload(ctx, store)
+	require.NoError(t, err)
+
+	actualRows, err := parquet.ReadFile[GoRow](store.ObjectPath("elements/0000000000-0000001000.parquet"), parquet.NewSchema("elements", parquet.Group{}))
+	require.NoError(t, err)
+
+	assert.Equal(t, []GoRow{testGoRow(1), testGoRow(20)}, actualRows)
+}
@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestParquetWriter_Compact(t *testing.T) {
+	ctx := context.Background()
+	descriptor := (&pbtesting.SingleRepeated{}).ProtoReflect().Descriptor()
+
+	parquetWriter, err := writer.NewParquetWriter(descriptor, testLogger, testTracer)
+	require.NoError(t, err)
+
+	headStore, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+	require.NoError(t, err)
+
+	var heads []writer.UploadedFile
+	writeHead := func(boundary *bstream.Range, rows ...int) {
+		require.NoError(t, parquetWriter.StartBoundary(boundary))
+
+		output := &pbtesting.SingleRepeated{}
+		for _, row := range rows {
+			output.Elements = append(output.Elements, testProtobufRow(row))
+		}
+
+		message, err := anypb.New(output)
+		require.NoError(t, err)
+
+		require.NoError(t, parquetWriter.EncodeMapModule(&pbsubstreamsrpc.MapModuleOutput{Name: "test", MapOutput: message}))
+		parquetWriter.EndBlock(boundary.StartBlock())
+
+		uploadable, err := parquetWriter.CloseBoundary(ctx, writer.BlockRangeFileNamer(boundary))
+		require.NoError(t, err)
+
+		files, err := uploadable.Upload(ctx, headStore)
+		require.NoError(t, err)
+		heads = append(heads, files...)
+	}
+
+	writeHead(bstream.NewRangeExcludingEnd(0, 10), 1, 2)
+	writeHead(bstream.NewRangeExcludingEnd(10, 20), 3)
+
+	store, err := dstore.NewStore("file://"+t.TempDir(), "", "", true)
+	require.NoError(t, err)
+
+	files, err := parquetWriter.Compact(headStore, heads, writer.BlockRangeFileNamer(bstream.NewRangeExcludingEnd(0, 20))).Upload(ctx, store)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "elements/0000000000-0000000020.parquet", files[0].Filename)
+	assert.Equal(t, int64(3), files[0].Rows)
+
+	headStats := findColumnStats(t, heads[0], "typeInt64")
+	assert.Equal(t, int64(2), headStats.Values)
+	assert.Equal(t, int64(1), headStats.Min.Int64())
+	assert.Equal(t, int64(2), headStats.Max.Int64())
+
+	compactedStats := findColumnStats(t, files[0], "typeString")
+	assert.Equal(t, int64(3), compactedStats.Values)
+	assert.Equal(t, int64(0), compactedStats.Nulls)
+	assert.Equal(t, "abc-1", compactedStats.Min.String())
+	assert.Equal(t, "abc-3", compactedStats.Max.String())
+
+	actualRows, err := parquet.ReadFile[GoRow](store.ObjectPath("elements/0000000000-0000000020.parquet"), parquet.NewSchema("elements", parquet.Group{}))
+	require.NoError(t, err)
+
+	assert.Equal(t, []GoRow{testGoRow(1), testGoRow(2), testGoRow(3)}, actualRows)
+}
+
+func findColumnStats(t *testing.T, file writer.UploadedFile, path ...string) writer.ColumnStats {
+	t.Helper()
+
+	for _, column := range file.Columns {
+		if slices.Equal(column.Path, path) {
+			return column
+		}
+	}
+
+	require.FailNow(t, "column statistics not found", "column %q of file %q", path, file.Filename)
+	return writer.ColumnStats{}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/streamingfast/bstream"
+	"github.com/streamingfast/dstore"
+	"github.com/streamingfast/substreams-sink-files/v2/bundler/writer"
+	pbtesting "github.com/streamingfast/substreams-sink-files/v2/internal/pb/tests"
+	pbsubstreamsrpc "github.com/streamingfast/substreams/pb/sf/substreams/rpc/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+func TestParquetWriter_Revert(t *testing.T) {
+	tests := []struct {
+		name              string
+		blocks            map[uint64][]int
+		lastValidBlockNum uint64
+		afterRevert       map[uint64][]int
+		expectedRows      []GoRow
+	}{
+		{
+			"revert last block",
+			map[uint64][]int{1: {1}, 2: {2, 3}, 3: {4}},
+			2,
+			map[uint64][]int{3: {40}},
+			[]GoRow{testGoRow(1), testGoRow(2), testGoRow(3), testGoRow(40)},
+		},
+		{
+			"revert multiple blocks",
+			map[uint64][]int{1: {1}, 2: {2, 3}, 3: {4}},
+			1,
+			map[uint64][]int{2: {20}, 3: {30}},
+			[]GoRow{testGoRow(1), testGoRow(20), testGoRow(30)},
+		},
+		{
+			"revert whole boundary",
+			map[uint64][]int{1: {1}, 2: {2}},
+			0,
+			map[uint64][]int{1: {10}},
+			[]GoRow{testGoRow(10)},
+		},
+		{
+			"revert to block without data",
+			map[uint64][]int{1: {1}, 3: {3}},
+			2,
+			map[uint64][]int{3: {30}},
+			[]GoRow{testGoRow(1), testGoRow(30)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			descriptor := (&pbtesting.SingleRepeated{}).ProtoReflect().Descriptor()
+
+			parquetWriter, err := writer.NewParquetWriter(descriptor, testLogger, testTracer)
+			require.NoError(t, err)
+			require.NoError(t, parquetWriter.StartBoundary(bstream.NewRangeExcludingEnd(0, 1000)))
+
+			writeBlocks := func(blocks map[uint64][]int) {
+				for blockNum := uint64(0); blockNum < 1000; blockNum++ {
+					rows, found := blocks[blockNum]
+					if !found {
+						continue
+					}
+
+					output := &pbtesting.SingleRepeated{}
+					for _, row := range rows {
+						output.Elements = append(output.Elements, testProtobufRow(row))
+					}
+
+					message, err := anypb.New(output)
+					require.NoError(t, err)
+
+					require.NoError(t, parquetWriter.EncodeMapModule(&pbsubstreamsrpc.MapModuleOutput{Name: "test", MapOutput: message}))
+					parquetWriter.EndBlock(blockNum)
+				}
+			}
+
+			writeBlocks(tt.blocks)
+			require.NoError(t, parquetWriter.Revert(tt.lastValidBlockNum))
+			writeBlocks(tt.afterRevert)
+			assert.Equal(t, int64(len(tt.expectedRows)), parquetWriter.Stats().Rows)
+
+			uploadable, err := parquetWriter.CloseBoundary(ctx, writer.BlockRangeFileNamer(bstream.NewRangeExcludingEnd(0, 1000)))
+			require.NoError(t, err)
+
+			storeDest := t.TempDir()
+			store, err := dstore.NewStore("file://"+storeDest, "", "", true)
+			require.NoError(t, err)
+
+			_, err = uploadable.Upload(ctx, store)
+			require.NoError(t, err)
+
+			actualRows, err := parquet.ReadFile[GoRow](store.ObjectPath("elements/0000000000-0000001000.parquet"), parquet.NewSchema("elements", parquet.Group{}))
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expectedRows, actualRows)
+		})
+	}
+}
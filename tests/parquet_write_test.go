@@ -68,6 +68,7 @@ func runCases[T any](t *testing.T, cases []parquetWriterCase[T]) {
 			}
 
 			ctx := context.Background()
+			namer := writer.BlockRangeFileNamer(bstream.NewRangeExcludingEnd(0, 1000))
 			writer, err := writer.NewParquetWriter(descriptor, testLogger, testTracer, testCase.writerOptions...)
 			if testCase.expectedNewWriterError != nil {
 				testCase.expectedNewWriterError(t, err)
@@ -98,7 +99,7 @@ func runCases[T any](t *testing.T, cases []parquetWriterCase[T]) {
 				require.NoError(t, allErr)
 			}
 
-			uploadable, err := writer.CloseBoundary(ctx)
+			uploadable, err := writer.CloseBoundary(ctx, namer)
 			require.NoError(t, err, "testing")
 
 			store, err := dstore.NewStore("file://"+storeDest, "", "", true)